@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lyon-v/squash-docker-image/internal/image"
+	"github.com/spf13/cobra"
+)
+
+// newVersionCommand creates the version command printing the versions of the binary
+// and of the image store it connects to.
+func newVersionCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "version",
+		Short: "Show the version of squash-docker-image and of the image store",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintf(table, "Version:\t%s\n", Version)
+			fmt.Fprintf(table, "Squash version:\t%s\n", image.SquashVersion())
+			fmt.Fprintf(table, "Git commit:\t%s\n", gitCommit())
+			fmt.Fprintf(table, "Go version:\t%s\n", runtime.Version())
+			fmt.Fprintf(table, "OS/Arch:\t%s/%s\n", runtime.GOOS, runtime.GOARCH)
+
+			quietLogger()
+			ctx, stop := commandContext()
+			defer stop()
+			store, err := image.NewImageStore(storeCLI(), logger)
+			if err == nil {
+				var server image.StoreVersion
+				if server, err = store.Version(ctx); err == nil {
+					fmt.Fprintf(table, "Server:\t%s\n", server)
+				}
+				image.CloseStore(store)
+			}
+			if err != nil {
+				fmt.Fprintf(table, "Server:\tnot reachable (%s)\n", backend)
+			}
+			table.Flush()
+			if err != nil {
+				exitOnCommandError(err)
+			}
+		},
+	}
+}
+
+// gitCommit is the commit the binary is built from, marked as modified when the tree
+// had changes.
+func gitCommit() string {
+	if len(GitCommit) != 0 {
+		return GitCommit
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+	if len(revision) == 0 {
+		return "unknown"
+	}
+	if modified == "true" {
+		revision += " (modified)"
+	}
+	return revision
+}
+
+// newCacheCommand creates the cache command with its ls and prune subcommands.
+func newCacheCommand() *cobra.Command {
+	cacheCmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the layer cache used with --cache",
+	}
+	cacheCmd.PersistentFlags().StringVar(&cacheDir, "cache-dir", image.DefaultCacheDir(), "Directory of the layer cache")
+
+	lsCmd := &cobra.Command{
+		Use:   "ls",
+		Short: "List the entries of the layer cache, the most recently used first",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cache, err := image.OpenLayerCache(cacheDir)
+			if err != nil {
+				exitOnCommandError(err)
+			}
+			entries, err := cache.List()
+			if err != nil {
+				exitOnCommandError(err)
+			}
+			image.WriteCacheEntries(os.Stdout, entries)
+		},
+	}
+
+	pruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove entries from the layer cache",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			opts := image.PruneOptions{All: pruneAll, OlderThan: olderThan}
+			if len(maxSize) != 0 {
+				size, err := image.ParseSize(maxSize)
+				if err != nil {
+					exitOnCommandError(err)
+				}
+				opts.MaxSize = size
+			}
+			if !opts.All && opts.OlderThan == 0 && opts.MaxSize == 0 {
+				exitOnCommandError(fmt.Errorf("one of --all, --older-than or --max-size is required"))
+			}
+			cache, err := image.OpenLayerCache(cacheDir)
+			if err != nil {
+				exitOnCommandError(err)
+			}
+			removed, err := cache.Prune(opts)
+			var freed int64
+			for _, entry := range removed {
+				freed += entry.Size
+			}
+			fmt.Printf("Removed %d entries, %.2f MB freed\n", len(removed), float64(freed)/1024/1024)
+			if err != nil {
+				exitOnCommandError(err)
+			}
+		},
+	}
+	pruneCmd.Flags().BoolVar(&pruneAll, "all", false, "Remove all entries")
+	pruneCmd.Flags().DurationVar(&olderThan, "older-than", 0, "Remove the entries not used for this long, like 168h")
+	pruneCmd.Flags().StringVar(&maxSize, "max-size", "", "Remove the least recently used entries until the cache is not larger than this, like 10G")
+
+	cacheCmd.AddCommand(lsCmd, pruneCmd)
+	return cacheCmd
+}
+
+// newDoctorCommand creates the doctor command checking the connection to the daemon.
+func newDoctorCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "doctor",
+		Short: "Check the connection to the Docker daemon or containerd and report its version",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			quietLogger()
+			ctx, stop := commandContext()
+			defer stop()
+			report, err := image.DoctorStore(ctx, storeCLI(), logger)
+			if len(report.Host) != 0 {
+				image.WriteDoctorReport(os.Stdout, report)
+			}
+			if err != nil {
+				exitOnCommandError(err)
+			}
+		},
+	}
+}
+
+// newServeCommand creates the serve command running squash jobs submitted over HTTP.
+func newServeCommand() *cobra.Command {
+	serveCmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Run squash jobs submitted to an HTTP API",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx, stop := commandContext()
+			defer stop()
+
+			if len(serverOptions.Token) == 0 {
+				serverOptions.Token = os.Getenv("SQUASH_SERVER_TOKEN")
+			}
+			serverOptions.Defaults = storeCLI()
+			serverOptions.Defaults.Rootless = rootless
+			if useCache {
+				serverOptions.Defaults.CacheDir = cacheDir
+			}
+
+			server, err := image.NewServer(serverOptions, logger)
+			if err != nil {
+				exitOnCommandError(err)
+			}
+			if err := server.Serve(ctx); err != nil {
+				exitOnCommandError(err)
+			}
+		},
+	}
+	serveCmd.Flags().StringVar(&serverOptions.Listen, "listen", "127.0.0.1:8080", "Address to listen on, like 127.0.0.1:8080 or unix:///run/squash-docker-image.sock")
+	serveCmd.Flags().StringVar(&serverOptions.WorkDir, "work-dir", filepath.Join(os.TempDir(), "squash-docker-image-jobs"), "Directory holding the temporary files, archive, report and log of each job")
+	serveCmd.Flags().IntVar(&serverOptions.Workers, "workers", 2, "Number of jobs run at the same time")
+	serveCmd.Flags().IntVar(&serverOptions.QueueSize, "queue-size", 16, "Number of jobs waiting for a worker before new ones are rejected")
+	serveCmd.Flags().StringVar(&serverOptions.Token, "token", "", "Bearer token every request must carry, $SQUASH_SERVER_TOKEN by default; can only be empty when listening on a unix socket")
+	serveCmd.Flags().StringArrayVar(&serverOptions.Transports, "allow-transport", nil, "Transport jobs may read images from besides the image store: oci, oci-archive or docker, can be repeated")
+	serveCmd.Flags().StringArrayVar(&serverOptions.AllowedPaths, "allow-path", nil, "Directory the OCI layouts and archives of jobs must be in, allows the oci and oci-archive transports when --allow-transport is not given, can be repeated")
+	serveCmd.Flags().DurationVar(&serverOptions.Retention, "retention", 24*time.Hour, "How long finished jobs and their files are kept, until they are deleted when 0")
+	addWorkFlags(serveCmd.Flags())
+	return serveCmd
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/lyon-v/squash-docker-image/internal/image"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// addFormatFlag adds the --format flag of the commands printing a description.
+func addFormatFlag(flags *pflag.FlagSet) {
+	flags.StringVar(&outputFormat, "format", "text", "Output format: text or json")
+}
+
+// writeOutput prints v as JSON with --format json, with write otherwise.
+func writeOutput(v interface{}, write func(w io.Writer) error) error {
+	switch outputFormat {
+	case "text":
+		return write(os.Stdout)
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(v)
+	}
+	return fmt.Errorf("unsupported format '%s', expected one of: text, json", outputFormat)
+}
+
+// newPlanCommand creates the plan command showing the layers a squash would merge.
+func newPlanCommand() *cobra.Command {
+	planCmd := &cobra.Command{
+		Use:   "plan [IMAGE]",
+		Short: "Show the layers a squash would keep and merge, without squashing",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := imageArgument(args); err != nil {
+				exitOnCommandError(err)
+			}
+			if file := loadSquashFile(); file != nil {
+				applySquashFile(cmd.Flags(), file)
+			}
+			quietLogger()
+			ctx, stop := commandContext()
+			defer stop()
+
+			cli := storeCLI()
+			cli.Image = imageName
+			cli.FromLayer = fromLayer
+			squash, err := image.NewSquash(cli, logger)
+			if err != nil {
+				exitOnCommandError(err)
+			}
+			defer squash.Close()
+			plan, planErr := squash.Plan(ctx)
+			var unnecessary *image.SquashUnnecessaryError
+			if planErr != nil && !errors.As(planErr, &unnecessary) {
+				exitOnCommandError(planErr)
+			}
+			err = writeOutput(plan, func(w io.Writer) error {
+				return image.WritePlan(w, plan)
+			})
+			if err != nil {
+				exitOnCommandError(err)
+			}
+			if planErr != nil {
+				exitOnCommandError(planErr)
+			}
+		},
+	}
+	addImageFlags(planCmd.Flags())
+	addFormatFlag(planCmd.Flags())
+	return planCmd
+}
+
+// newInspectCommand creates the inspect command describing an image and its layers.
+func newInspectCommand() *cobra.Command {
+	inspectCmd := &cobra.Command{
+		Use:   "inspect IMAGE",
+		Short: "Show the config and layers of an image, from the image store or an archive",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			quietLogger()
+			ctx, stop := commandContext()
+			defer stop()
+
+			contents, err := image.ReadImageContents(ctx, storeCLI(), logger, args[0])
+			if err != nil {
+				exitOnCommandError(err)
+			}
+			err = writeOutput(contents, func(w io.Writer) error {
+				return image.WriteImageContents(w, contents)
+			})
+			if err != nil {
+				exitOnCommandError(err)
+			}
+		},
+	}
+	addFormatFlag(inspectCmd.Flags())
+	return inspectCmd
+}
+
+// imageChanges are the differences of two images as --format json prints them.
+type imageChanges struct {
+	Config []image.ConfigChange `json:"config"`
+	Files  []image.FileChange   `json:"files"`
+}
+
+// newDiffCommand creates the diff command comparing the files and config of two
+// images.
+func newDiffCommand() *cobra.Command {
+	diffCmd := &cobra.Command{
+		Use:   "diff IMAGE1 IMAGE2",
+		Short: "Show how the files and runtime config of IMAGE2 differ from the ones of IMAGE1",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			quietLogger()
+			ctx, stop := commandContext()
+			defer stop()
+
+			a, err := image.ReadImageContents(ctx, storeCLI(), logger, args[0])
+			if err != nil {
+				exitOnCommandError(err)
+			}
+			b, err := image.ReadImageContents(ctx, storeCLI(), logger, args[1])
+			if err != nil {
+				exitOnCommandError(err)
+			}
+			changes := imageChanges{
+				Config: image.DiffConfigs(a.Config, b.Config),
+				Files:  image.DiffFilesystems(a.Filesystem(), b.Filesystem()),
+			}
+			err = writeOutput(changes, func(w io.Writer) error {
+				return image.WriteChanges(w, changes.Files, changes.Config)
+			})
+			if err != nil {
+				exitOnCommandError(err)
+			}
+		},
+	}
+	addFormatFlag(diffCmd.Flags())
+	return diffCmd
+}
+
+// newVerifyCommand creates the verify command checking an image, or that a squashed
+// image runs like its source.
+func newVerifyCommand() *cobra.Command {
+	verifyCmd := &cobra.Command{
+		Use:   "verify IMAGE | verify SOURCE SQUASHED",
+		Short: "Check that the layers of an image match its config, and that a squashed image has the files and config of its source",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			quietLogger()
+			ctx, stop := commandContext()
+			defer stop()
+
+			var contents []*image.ImageContents
+			for _, name := range args {
+				c, err := image.ReadImageContents(ctx, storeCLI(), logger, name)
+				if err != nil {
+					exitOnCommandError(err)
+				}
+				contents = append(contents, c)
+			}
+
+			if len(contents) == 1 {
+				if err := image.VerifyImage(contents[0]); err != nil {
+					exitOnCommandError(err)
+				}
+				fmt.Printf("%s: %d layers match the config\n", args[0], len(contents[0].Layers))
+				return
+			}
+			// The excluded paths and config edits of a config file are expected
+			var excluded []string
+			var edits image.ConfigEdits
+			if file := loadSquashFile(); file != nil {
+				excluded, edits = file.Exclude, file.Config
+			}
+			files, configs, err := image.VerifySquashed(contents[0], contents[1], excluded, edits)
+			if err != nil {
+				image.WriteChanges(os.Stdout, files, configs)
+				exitOnCommandError(err)
+			}
+			fmt.Printf("%s has the files and config of %s\n", args[1], args[0])
+		},
+	}
+	addConfigFlag(verifyCmd.Flags())
+	return verifyCmd
+}
+
+// newExportCommand creates the export command writing an image of the image store to
+// an archive, like docker save.
+func newExportCommand() *cobra.Command {
+	exportCmd := &cobra.Command{
+		Use:   "export IMAGE",
+		Short: "Write an image of the image store to a tar archive, like docker save",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(outputPath) == 0 {
+				exitOnCommandError(errors.New("--output-path is required, - writes the archive to stdout"))
+			}
+			if source := image.ParseImageSource(args[0]); source.Transport != image.TransportDaemon {
+				exitOnCommandError(fmt.Errorf("only images of the image store can be exported, '%s' is read from %s", args[0], source.Transport))
+			}
+			quietLogger()
+			ctx, stop := commandContext()
+			defer stop()
+
+			store, err := image.NewImageStore(storeCLI(), logger)
+			if err != nil {
+				exitOnCommandError(err)
+			}
+			defer image.CloseStore(store)
+			imageID, err := store.ImageID(ctx, args[0])
+			if err != nil {
+				exitOnCommandError(err)
+			}
+			archive, err := store.Save(ctx, []string{imageID})
+			if err != nil {
+				exitOnCommandError(err)
+			}
+			defer archive.Close()
+
+			if outputPath == image.StdoutPath {
+				if _, err := io.Copy(os.Stdout, archive); err != nil {
+					exitOnCommandError(image.NewIOError("failed to write the archive to stdout", err))
+				}
+				return
+			}
+			if err := writeArchive(outputPath, archive); err != nil {
+				exitOnCommandError(err)
+			}
+			logger.Infof("Image %s exported to %s", args[0], outputPath)
+		},
+	}
+	exportCmd.Flags().StringVarP(&outputPath, "output-path", "o", "", "Path of the archive, - writes it to stdout")
+	return exportCmd
+}
+
+// writeArchive writes the archive to a temporary file next to path that replaces path
+// once it is complete.
+func writeArchive(path string, archive io.Reader) error {
+	file, err := os.CreateTemp(filepath.Dir(path), ".export-*.tar")
+	if err != nil {
+		return image.NewIOError("failed to create the archive", err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := io.Copy(file, archive); err != nil {
+		file.Close()
+		return image.NewIOError("failed to write the archive", err)
+	}
+	if err := file.Close(); err != nil {
+		return image.NewIOError("failed to write the archive", err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return image.NewIOError("failed to write the archive", err)
+	}
+	return nil
+}
@@ -9,25 +9,60 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
-
-	"github.com/docker/docker/client"
-	"github.com/sirupsen/logrus"
 )
 
 type V2Image struct {
-	ImageSpec                   // Embedding V1Image to reuse fields
-	DockerClient *client.Client // Placeholder for Docker client
-	Logger       *logrus.Logger
-	TmpLayerDir  string
-	MergeDir     string
+	ImageSpec   // Embedding V1Image to reuse fields
+	Store       ImageStore
+	Logger      Logger
+	Out         io.Writer // Human readable messages, stderr when the image goes to stdout
+	Output      io.Writer // Receives the image when it is exported to StdoutPath
+	Progress    ProgressFunc
+	TmpLayerDir string
+	MergeDir    string
+
+	batch  *batchState // Set when the image is squashed as part of a batch
+	format string      // Format of the saved image, see detectFormat
+
+	resume     bool        // Continue in the work directory of an earlier run
+	checkpoint *checkpoint // Completed phases, set when resuming
+
+	cache          *LayerCache // Layer cache, nil when not used
+	squashedDiffID string      // Taken from the cache, without the sha256: prefix
+
+	// Files of the saved image spooled to the new image directory, mapped to their
+	// digests. See spoolTar.
+	spooled map[string]string
+	// The new image directory is removed while it is exported, nothing loads it later
+	removeExported bool
+
+	layerSizes       []int64  // Sizes of OldImageLayers from the image history
+	outputPath       string   // Where the image is exported, checked for free space
+	tmpDirCandidates []string // Parents for the temporary directory when TmpDir is not set
+	tmpParent        string   // Chosen by checkSpace, the system temporary directory when empty
+
+	// Ownership and device nodes are kept in metadata indexes instead of on disk, see
+	// extractRootless
+	rootless   bool
+	layerIndex metadataIndex // Files of TmpLayerDir
+	mergeIndex metadataIndex // Files of MergeDir
+
+	// Set while squashing and exporting, read by Squash.Results
+	newImageID   string
+	newManifest  ImageManifest
+	newLayers    []SquashedLayer
+	platform     *OCIPlatform
+	exported     []exportedManifest
+	exportIndex  string
+	sourceLayers []SquashedLayer
+	mergeStats   MergeStats
+	phases       []PhaseDuration
 }
 
 // NewImage creates a new instance of Image with provided parameters.
@@ -35,29 +70,46 @@ func NewV2Image(s *Squash) *V2Image {
 	return &V2Image{
 		ImageSpec: ImageSpec{
 			Image:     s.image,
-			Tag:       s.tag,
+			Tags:      s.tags,
 			FromLayer: s.fromLayer,
 			TmpDir:    s.tmpDir,
 
+			Compression:      s.compression,
+			CompressionLevel: s.compressionLevel,
+
+			Excludes:    s.excludes,
+			ConfigEdits: s.configEdits,
+
 			Comment:       s.comment,
 			Date:          time.Now(),
 			LastCreatedBy: s.lastCreatedBy,
 		},
-		DockerClient: s.docker,
-		Logger:       s.logs,
+		Store:    s.store,
+		Logger:   s.logs,
+		Out:      s.out,
+		Output:   s.output,
+		Progress: s.progress,
+		resume:   s.resume,
+		cache:    s.cache,
+
+		removeExported:   !s.loadImage && !s.development,
+		outputPath:       s.outputPath,
+		tmpDirCandidates: s.tmpDirCandidates,
+		rootless:         s.rootless,
 	}
 }
 
+// Format is the format of the saved image, FormatV1, FormatDocker or FormatOCI.
 func (oim *V2Image) Format() string {
-	return "oci"
+	return oim.format
 }
 
-func (oim *V2Image) Squash() (string, error) {
+func (oim *V2Image) Squash(ctx context.Context) (string, error) {
 	// Implementation for oim
-	if err := oim.beforeSquashing(); err != nil {
+	if err := oim.beforeSquashing(ctx); err != nil {
 		return "", err
 	}
-	ret, err := oim.squash()
+	ret, err := oim.squash(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -70,68 +122,88 @@ func (oim *V2Image) Squash() (string, error) {
 func (im *V2Image) afterSquashing() error {
 
 	var err error
-	im.Logger.Info("Removing from disk already squashed layers...")
-	im.Logger.Infof("Cleaning up %s temporary directory...", im.OldImageDir)
-	if err = os.RemoveAll(im.OldImageDir); err != nil {
-		im.Logger.Errorf("Cleaning up  temporary directory failed:", err)
+	if im.batch != nil {
+		// The saved images are shared by the batch and removed once all are squashed
+		im.SizeAfter, err = im.manifestSize(im.NewImageDir, im.batch.lastManifest())
+	} else {
+		im.Logger.Infof("Removing from disk already squashed layers...")
+		im.Logger.Infof("Cleaning up %s temporary directory...", im.OldImageDir)
+		if err = os.RemoveAll(im.OldImageDir); err != nil {
+			im.Logger.Errorf("Cleaning up temporary directory failed: %v", err)
+		}
+		im.SizeAfter, err = im.dirSize(im.NewImageDir)
 	}
-	im.SizeAfter, err = im.dirSize(im.NewImageDir)
 	if err != nil {
 		return err
 	}
+	im.newLayers = im.readNewLayers()
 
 	sizeBeforeMb := float64(im.SizeBefore) / 1024 / 1024
 	sizeAfterMb := float64(im.SizeAfter) / 1024 / 1024
 	im.Logger.Infof("Original image size: %f MB , Squashed image size: %f MB", sizeBeforeMb, sizeAfterMb)
 	if sizeAfterMb > sizeBeforeMb {
-		im.Logger.Info("If the squashed image is larger than original it means that there were no meaningful files to squash and it just added metadata. Are you sure you specified correct parameters?")
+		im.Logger.Infof("If the squashed image is larger than original it means that there were no meaningful files to squash and it just added metadata. Are you sure you specified correct parameters?")
 	} else {
 
-		fmt.Printf("Image size decreased by [ %.2f%% ]\n", float64(((sizeBeforeMb-sizeAfterMb)/sizeBeforeMb)*100))
+		fmt.Fprintf(im.Out, "Image size decreased by [ %.2f%% ]\n", float64(((sizeBeforeMb-sizeAfterMb)/sizeBeforeMb)*100))
 	}
 
 	return nil
 }
 
-func (im *V2Image) squash() (string, error) {
+func (im *V2Image) squash(ctx context.Context) (string, error) {
+	if im.resumed(CheckpointMetadata) {
+		return im.newImageID, nil
+	}
+	// Read before the metadata of the new image replaces the diff_ids
+	im.sourceLayers = im.readSourceLayers()
 
 	if len(im.LayerPathsToSquash) != 0 {
 		os.Mkdir(im.SquashedDir, os.ModePerm)
-		im.squashLayers()
+		if im.resumed(CheckpointMerged) {
+			im.mergeStats = *im.checkpoint.phase(CheckpointMerged).Stats
+		} else {
+			if err := im.squashLayers(ctx); err != nil {
+				return "", err
+			}
+			stats := im.mergeStats
+			if err := im.recordCheckpoint(checkpointPhase{Phase: CheckpointMerged, Stats: &stats}, im.SquashedTar); err != nil {
+				return "", err
+			}
+		}
 	}
 
-	var layerPathID string
-	var oldLayerPath string
+	var squashedLayer string
 	var err error
 
-	im.DiffIDs = im.generateDiffIds()
+	if im.DiffIDs, err = im.generateDiffIds(ctx); err != nil {
+		return "", err
+	}
 	im.ChainIDs = im.generateChainIds(im.DiffIDs)
 	metaData, err := im.generateImageMetadata()
 	if err != nil {
 		return "", err
 	}
 
-	imageID := im.writeImageMetadata(metaData)
-	if len(im.LayerPathsToSquash) != 0 {
-		layerPathID, err = im.generateSquashedLayerPathId()
+	imageID, err := im.writeImageMetadata(metaData)
+	if err != nil {
+		return "", err
+	}
+	if len(im.LayerPathsToSquash) != 0 && im.OCIFormat {
+		if squashedLayer, err = im.moveSquashedBlob(); err != nil {
+			return "", err
+		}
+	} else if len(im.LayerPathsToSquash) != 0 {
+		layerPathID, err := im.generateSquashedLayerPathId()
 		if err != nil {
 			return "", err
 		}
 
-		if im.OCIFormat {
-
-			oldLayerPath = im.OldManifest.Config
-		} else {
-
-			if len(im.LayerPathsToSquash[0]) != 0 {
-				oldLayerPath = im.LayerPathsToSquash[0]
-			} else {
-				oldLayerPath = layerPathID
-			}
-			oldLayerPath = filepath.Join(oldLayerPath, "json")
-
+		oldLayerPath := layerPathID
+		if len(im.LayerPathsToSquash[0]) != 0 {
+			oldLayerPath = im.LayerPathsToSquash[0]
 		}
-		metaData, err = im.generateLastLayerMetadata(layerPathID, oldLayerPath)
+		metaData, err = im.generateLastLayerMetadata(layerPathID, filepath.Join(oldLayerPath, "json"))
 		im.writeSquashedLayerMetadata(metaData)
 
 		if err := im.writeVersionFile(im.SquashedDir); err != nil {
@@ -141,72 +213,159 @@ func (im *V2Image) squash() (string, error) {
 		destPath := filepath.Join(im.NewImageDir, layerPathID)
 
 		// Move directory
-		err := os.Rename(im.SquashedDir, destPath)
+		err = os.Rename(im.SquashedDir, destPath)
 		if err != nil {
 			im.Logger.Errorf("Failed to move directory from %s to %s: %v", im.SquashedDir, destPath, err)
 			return "", err
 		}
-
+		squashedLayer = filepath.Join(layerPathID, "layer.tar")
 	}
-	manifest := im.generateManifestMetadata(imageID, layerPathID)
+	manifest := im.generateManifestMetadata(imageID, squashedLayer)
+	im.newImageID = imageID
+	im.newManifest = manifest
 
 	if err := im.writeManifestMetadata(manifest); err != nil {
 		return "", err
 	}
 
-	layers := manifest.Layers
-
-	repositoryImageId := strings.Split(layers[len(layers)-1], "/")[0]
-
-	if err := im.moveLayers(); err != nil {
+	if err := im.moveLayers(ctx); err != nil {
 		return "", err
 	}
 
-	repositoriesFile := filepath.Join(im.NewImageDir, "repositories")
-	im.generateRepositoriesJson(repositoriesFile, repositoryImageId)
+	// OCI layouts are written back as OCI layouts, the repositories file only describes
+	// the layer directories of Docker archives
+	if im.OCIFormat {
+		if err := im.writeImageIndex(); err != nil {
+			return "", err
+		}
+	} else {
+		layers := manifest.Layers
+		repositoryImageId := strings.Split(layers[len(layers)-1], "/")[0]
+		repositoriesFile := filepath.Join(im.NewImageDir, "repositories")
+		im.generateRepositoriesJson(repositoriesFile, repositoryImageId)
+	}
+
+	if im.checkpoint != nil {
+		im.saveState()
+		artifacts, err := im.newImageArtifacts()
+		if err != nil {
+			return "", err
+		}
+		if err := im.recordCheckpoint(checkpointPhase{Phase: CheckpointMetadata}, artifacts...); err != nil {
+			return "", err
+		}
+	}
 
 	return imageID, nil
 
 }
 
-func (im *V2Image) squashLayers() {
-	im.Logger.Info("Starting squashing...")
+func (im *V2Image) squashLayers(ctx context.Context) error {
+	im.Logger.Infof("Starting squashing...")
 	im.TmpLayerDir = filepath.Join(filepath.Dir(im.SquashedTar), "tmpdir")
 	im.MergeDir = filepath.Join(filepath.Dir(im.SquashedTar), "mergedir")
 
+	// Layers merged by an earlier run are kept
+	merged := 0
+	if extracted := im.checkpoint.phase(CheckpointExtracted); extracted != nil {
+		merged = extracted.Layers
+		im.mergeStats = *extracted.Stats
+		im.Logger.Infof("Continuing with layer %d of %d", merged+1, len(im.LayerPathsToSquash))
+	}
+
 	if PathExists(im.TmpLayerDir) {
 		os.RemoveAll(im.TmpLayerDir)
 	}
-	if PathExists(im.MergeDir) {
+	if PathExists(im.MergeDir) && merged == 0 {
 		os.RemoveAll(im.MergeDir)
 	}
 	os.MkdirAll(im.MergeDir, 0755)
 	os.MkdirAll(im.TmpLayerDir, 0755)
+	if im.rootless {
+		im.Logger.Infof("Squashing rootless, ownership and device nodes are kept as metadata")
+		im.mergeIndex = make(metadataIndex)
+		if merged > 0 {
+			if err := readJsonFile(im.mergeIndexPath(), &im.mergeIndex); err != nil {
+				return fmt.Errorf("failed to read the metadata of the merged files: %w", err)
+			}
+		}
+	}
 
+	layerTarFiles := make([]string, len(im.LayerPathsToSquash))
+	var bytesTotal, bytesRead int64
 	for i, layerID := range im.LayerPathsToSquash {
-		im.Logger.Infof("Squashing file '%s'...", layerID)
-		layerTarFile := filepath.Join(im.OldImageDir, layerID)
+		layerTarFiles[i] = filepath.Join(im.OldImageDir, layerID)
 		if !im.OCIFormat {
-			layerTarFile = filepath.Join(im.OldImageDir, layerID, "layer.tar")
+			layerTarFiles[i] = filepath.Join(im.OldImageDir, layerID, "layer.tar")
+		}
+		if info, err := os.Stat(layerTarFiles[i]); err == nil {
+			bytesTotal += info.Size()
+		}
+	}
+	progress := im.startPhase(PhaseSquash, bytesTotal)
+	layerCount := len(im.LayerPathsToSquash)
+
+	diffIDs := im.squashedLayerDiffIDs()
+	// The cached merge of all layers is the squashed layer, unless paths are excluded
+	if n, entry, cachedTar := im.cache.longestMerged(diffIDs); merged == 0 && n == layerCount && len(im.Excludes) == 0 {
+		im.Logger.Infof("Using the cached merge of the %d layers", n)
+		os.Remove(im.SquashedTar)
+		if err := linkTree(cachedTar, im.SquashedTar); err != nil {
+			return NewIOError("failed to copy the cached layer", err)
+		}
+		im.mergeStats = entry.Stats
+		im.squashedDiffID = strings.TrimPrefix(entry.DiffID, "sha256:")
+		progress.end(ProgressEvent{LayerCount: layerCount, BytesRead: bytesTotal, BytesWritten: entry.Size})
+		return nil
+	} else if merged == 0 && n > 0 {
+		im.Logger.Infof("Using the cached merge of the first %d of %d layers", n, layerCount)
+		if err := im.extractLayer(ctx, cachedTar, im.MergeDir, im.mergeIndex, "error extracting cached layer"); err != nil {
+			return err
+		}
+		merged = n
+		im.mergeStats = entry.Stats
+	}
+	cachedLayers := merged
+
+	for i, layerID := range im.LayerPathsToSquash {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		layerTarFile := layerTarFiles[i]
+		var layerSize int64
+		if info, err := os.Stat(layerTarFile); err == nil {
+			layerSize = info.Size()
 		}
+		if i < merged {
+			bytesRead += layerSize
+			continue
+		}
+		im.Logger.Infof("Squashing file '%s'...", layerID)
+		progress.update(ProgressEvent{Layer: layerID, LayerIndex: i + 1, LayerCount: layerCount, BytesRead: bytesRead}, true)
 		if i == 0 {
-			_, err := ExtractTar(layerTarFile, im.MergeDir)
-			if err != nil {
-				log.Fatalf("Error extracting tar file: %v", err)
+			if err := im.extractLayer(ctx, layerTarFile, im.MergeDir, im.mergeIndex, fmt.Sprintf("error extracting layer %s", layerID)); err != nil {
+				return err
+			}
+			im.releaseSquashedLayer(layerTarFile)
+			bytesRead += layerSize
+			progress.layer(ProgressEvent{Layer: layerID, LayerIndex: i + 1, LayerCount: layerCount, BytesRead: layerSize})
+			if err := im.recordMerged(i + 1); err != nil {
+				return err
 			}
 			continue
 		}
 		os.RemoveAll(im.TmpLayerDir)
 		os.MkdirAll(im.TmpLayerDir, 0755)
-		_, err := ExtractTar(layerTarFile, im.TmpLayerDir)
-		if err != nil {
-			log.Fatalf("Error extracting tar file: %v", err)
+		im.layerIndex = make(metadataIndex)
+		if err := im.extractLayer(ctx, layerTarFile, im.TmpLayerDir, im.layerIndex, fmt.Sprintf("error extracting layer %s", layerID)); err != nil {
+			return err
 		}
+		im.releaseSquashedLayer(layerTarFile)
 
 		// Traverse the im.TmpLayerDir directory, saving files into whfiles and refiles.
 		whfiles, refiles, err := GetWhiteoutAndRegularFiles(im.TmpLayerDir)
 		if err != nil {
-			log.Fatalf("Error getting whiteout and regular files: %v", err)
+			return fmt.Errorf("error getting whiteout and regular files: %w", err)
 		}
 
 		layerRecords := make(map[string]int)
@@ -217,8 +376,14 @@ func (im *V2Image) squashLayers() {
 
 			dirpath1 := NormalizePath(filepath.Dir(file.Path))
 			destdir := filepath.Join(im.MergeDir, dirpath1[len(im.TmpLayerDir):])
+			// Whiteouts remove files of older layers, never what a symlink points to
+			if err := im.prepareMergePath(filepath.Join(destdir, name)); err != nil {
+				return err
+			}
 			if name == ".wh..wh..opq" {
 				if flag, _ := HasFiles(destdir); flag {
+					im.excludePath(destdir)
+					im.forgetMetadata(destdir)
 					os.RemoveAll(destdir)
 				} else {
 					CreateWhiteoutFile(filepath.Join(destdir, name))
@@ -227,44 +392,91 @@ func (im *V2Image) squashLayers() {
 			} else if strings.HasPrefix(name, ".wh.") {
 				destpath := filepath.Join(destdir, name[len(".wh."):])
 				if PathExists(destpath) {
+					im.excludePath(destpath)
+					im.forgetMetadata(destpath)
 					os.RemoveAll(destpath)
 				} else {
 					CreateWhiteoutFile(filepath.Join(destdir, name))
 				}
 			}
 		}
-		var recordsMutex sync.Mutex
-		var wg sync.WaitGroup
-
+		// Files are copied one at a time, in the order of the walk: Copy records what it
+		// copied in layerRecords, and a directory is merged before the files below it
 		for k, file := range refiles {
-			fmt.Printf("==>layer:[%d] all regular files %d, current is %d， path is: %s \n", i, len(refiles), k, file.Path)
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			progress.update(ProgressEvent{
+				Layer:          layerID,
+				LayerIndex:     i + 1,
+				LayerCount:     layerCount,
+				BytesRead:      bytesRead,
+				FilesProcessed: k + 1,
+				FilesTotal:     len(refiles),
+			}, k == len(refiles)-1)
 			sourcePath := NormalizePath(file.Path)
 			destPath := filepath.Join(im.MergeDir, file.Path[len(im.TmpLayerDir):])
+			if info, err := os.Lstat(destPath); err == nil && info.Mode().IsRegular() {
+				// Overwritten by the newer layer
+				im.mergeStats.BytesExcluded += info.Size()
+			}
 
-			wg.Add(1)
-			go func(src, dest string) {
-				defer wg.Done()
-				recordsMutex.Lock()
-				_, err := im.Copy(src, dest, layerRecords)
-				recordsMutex.Unlock()
-				if err != nil {
-					log.Fatalf("Error Copying file: %s , %v", src, err)
-				}
-			}(sourcePath, destPath)
+			if _, err := im.Copy(sourcePath, destPath, layerRecords); err != nil {
+				return fmt.Errorf("error copying file %s: %w", sourcePath, err)
+			}
+			// The layer directory is removed anyway, free the space while merging
+			if info, err := os.Lstat(sourcePath); err == nil && info.Mode().IsRegular() {
+				os.Remove(sourcePath)
+			}
+		}
+		im.mergeDirectoryMetadata()
+		bytesRead += layerSize
+		im.mergeStats.FilesMerged += len(refiles)
+		progress.layer(ProgressEvent{Layer: layerID, LayerIndex: i + 1, LayerCount: layerCount, BytesRead: layerSize, FilesTotal: len(refiles)})
+		if err := im.recordMerged(i + 1); err != nil {
+			return err
+		}
+		// The layers below the top one change less often between builds
+		if im.cache != nil && diffIDs != nil && i+1 == layerCount-1 && i+1 > cachedLayers {
+			if err := im.cache.storeMergeDir(ctx, diffIDs[:i+1], im.MergeDir, im.tarCreator(false), im.mergeStats); err != nil {
+				im.Logger.Warnf("Failed to cache the merged layers: %v", err)
+			}
 		}
-		wg.Wait()
 	}
 
-	// Package the im.MergeDir directory into a tar file.
-	err := CreateTar(im.MergeDir, im.SquashedTar)
-	if err != nil {
-		log.Fatalf("Error creating tar file: %v", err)
+	if err := im.excludeMerged(); err != nil {
+		return err
+	}
+
+	// Package the im.MergeDir directory into a tar file. The merged files are removed
+	// as they are written, unless a resumed run may still need them.
+	packTar := im.tarCreator(im.checkpoint == nil)
+	if err := packTar(ctx, im.MergeDir, im.SquashedTar); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if noSpaceLeft(err) || filesystemFull(im.SquashedDir) {
+			return NewInsufficientSpaceError(fmt.Sprintf("error creating tar file: %v", err))
+		}
+		return NewIOError("error creating tar file", err)
 	}
 
 	os.RemoveAll(im.TmpLayerDir)
 	os.RemoveAll(im.MergeDir)
+	os.Remove(im.mergeIndexPath())
 
-	im.Logger.Info("Squash finished...")
+	if im.cache != nil && diffIDs != nil {
+		im.cacheSquashedLayers(ctx, diffIDs, layerTarFiles)
+	}
+
+	var bytesWritten int64
+	if info, err := os.Stat(im.SquashedTar); err == nil {
+		bytesWritten = info.Size()
+	}
+	progress.end(ProgressEvent{LayerCount: layerCount, BytesRead: bytesRead, BytesWritten: bytesWritten})
+
+	im.Logger.Infof("Squash finished...")
+	return nil
 }
 
 // Main Copy function
@@ -273,16 +485,89 @@ func (im *V2Image) Copy(src, dest string, records map[string]int) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	if _, ok := records[src]; ok {
+		return 1, nil
+	}
+	// The file of the newer layer replaces a symlink instead of being written through it
+	if err := im.prepareMergePath(dest); err != nil {
+		return 0, err
+	}
+	if err := removeSymlink(dest); err != nil {
+		return 0, NewIOError("couldn't remove symlink", err)
+	}
 
+	var count int
 	if info.Mode()&os.ModeSymlink != 0 {
-		return im.CopySymlink(src, dest, records)
+		count, err = im.CopySymlink(src, dest, records)
 	} else if info.IsDir() {
-		return im.CopyDir(src, dest, records)
+		count, err = im.CopyDir(src, dest, records)
+	} else if info.Mode()&(os.ModeDevice|os.ModeNamedPipe) != 0 {
+		count, err = CopyDevice(src, dest, info, records)
 	} else {
-		return CopyFile(src, dest, records)
+		count, err = CopyFile(src, dest, records)
+	}
+	if err == nil {
+		im.copyMetadata(src, dest)
+	}
+	return count, err
+}
+
+// squashedLayerDiffIDs returns the diff_ids of the layers to squash from the config of
+// the source image, nil when they are not known.
+func (im *V2Image) squashedLayerDiffIDs() []string {
+	diffIDs := im.OldImageConfig.Rootfs.DiffIds
+	if len(diffIDs) != len(im.LayerPathsToMove)+len(im.LayerPathsToSquash) {
+		return nil
+	}
+	return diffIDs[len(im.LayerPathsToMove):]
+}
+
+// cacheSquashedLayers adds the squashed layers and the result of merging them to the
+// layer cache. Failures only cost the next run time, so they are logged.
+func (im *V2Image) cacheSquashedLayers(ctx context.Context, diffIDs, layerTarFiles []string) {
+	for i, layerTar := range layerTarFiles {
+		if err := im.cache.storeLayer(diffIDs[i], layerTar); err != nil {
+			im.Logger.Warnf("Failed to cache layer %s: %v", diffIDs[i], err)
+		}
+	}
+	diffID, err := im.computeSha256(ctx, im.SquashedTar)
+	if err != nil {
+		im.Logger.Warnf("Failed to cache the squashed layer: %v", err)
+		return
+	}
+	im.squashedDiffID = diffID
+	// Without the excluded paths the layer is no merge of the layers
+	if len(im.Excludes) != 0 {
+		return
+	}
+	if err := im.cache.storeMerged(diffIDs, im.SquashedTar, "sha256:"+diffID, im.mergeStats); err != nil {
+		im.Logger.Warnf("Failed to cache the squashed layer: %v", err)
 	}
 }
 
+// recordMerged records the extracted checkpoint after a layer was merged.
+func (im *V2Image) recordMerged(layers int) error {
+	if im.checkpoint == nil {
+		return nil
+	}
+	stats := im.mergeStats
+	artifacts := []string{im.MergeDir}
+	if im.rootless {
+		if err := writeJsonFile(im.mergeIndexPath(), im.mergeIndex); err != nil {
+			return err
+		}
+		artifacts = append(artifacts, im.mergeIndexPath())
+	}
+	return im.recordCheckpoint(checkpointPhase{Phase: CheckpointExtracted, Layers: layers, Stats: &stats}, artifacts...)
+}
+
+// excludePath counts a file or directory of the merged layers that a whiteout removes.
+func (im *V2Image) excludePath(path string) {
+	size, _ := im.dirSize(path)
+	im.mergeStats.BytesExcluded += size
+	im.mergeStats.WhiteoutsResolved++
+}
+
 // Helper function to Copy a symlink from src to dest
 func (im *V2Image) CopySymlink(src, dest string, records map[string]int) (int, error) {
 
@@ -304,8 +589,10 @@ func (im *V2Image) CopySymlink(src, dest string, records map[string]int) (int, e
 		absLinkTarget = filepath.Join(absSrcDir, linkTarget)
 		desLinkTarget = filepath.Join(absDestDir, linkTarget)
 	} else {
-		absLinkTarget = filepath.Join(im.TmpLayerDir, linkTarget)
-		desLinkTarget = filepath.Join(im.MergeDir, linkTarget)
+		// Absolute targets are resolved in the image, never on the host
+		rooted := filepath.Clean(string(filepath.Separator) + linkTarget)
+		absLinkTarget = filepath.Join(im.TmpLayerDir, rooted)
+		desLinkTarget = filepath.Join(im.MergeDir, rooted)
 	}
 
 	if !PathExists(absLinkTarget) {
@@ -313,7 +600,7 @@ func (im *V2Image) CopySymlink(src, dest string, records map[string]int) (int, e
 		desLinkTarget = filepath.Join(absDestDir, linkTarget)
 	}
 
-	if !PathExists(absLinkTarget) {
+	if !im.followSymlink(absLinkTarget, desLinkTarget) {
 		CreateSymlink(linkTarget, dest)
 		return 0, nil
 	}
@@ -328,6 +615,18 @@ func (im *V2Image) CopySymlink(src, dest string, records map[string]int) (int, e
 
 }
 
+// followSymlink tells whether the target of a symlink is copied along with it. Only
+// targets inside the extracted layer that are not reached through another symlink are.
+func (im *V2Image) followSymlink(target, dest string) bool {
+	if !within(im.TmpLayerDir, target) || !within(im.MergeDir, dest) {
+		return false
+	}
+	if _, ok := symlinkInPath(im.TmpLayerDir, filepath.Dir(target)); ok {
+		return false
+	}
+	return PathExists(target)
+}
+
 // Function to recursively Copy a directory
 func (im *V2Image) CopyDir(src, dest string, records map[string]int) (count int, err error) {
 
@@ -392,13 +691,20 @@ func (im *V2Image) generateRepositoriesJson(repositoriesFile, repositoryImageId
 	if len(repositoryImageId) == 0 {
 		return fmt.Errorf("Provided image id cannot be null")
 	}
-	if len(im.ImageName) == 0 && len(im.ImageTag) == 0 {
+	if len(im.Tags) == 0 {
 		return fmt.Errorf("No name and tag provided for the image, skipping generating repositories file")
 
 	}
 	repos := make(map[string]map[string]string)
-	repos[im.ImageName] = make(map[string]string)
-	repos[im.ImageName][im.ImageTag] = repositoryImageId
+	if im.batch != nil {
+		repos = im.batch.repositories
+	}
+	for _, tag := range im.Tags {
+		if _, ok := repos[tag.Name]; !ok {
+			repos[tag.Name] = make(map[string]string)
+		}
+		repos[tag.Name][tag.Tag] = repositoryImageId
+	}
 
 	// Marshal the data to JSON with compact formatting
 	data, err := json.Marshal(repos)
@@ -427,13 +733,32 @@ func (im *V2Image) generateRepositoriesJson(repositoriesFile, repositoryImageId
 
 }
 
-func (im *V2Image) moveLayers() error {
+func (im *V2Image) moveLayers(ctx context.Context) error {
 	for _, layer := range im.LayerPathsToMove {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		layerID := strings.Replace(layer, "sha256:", "", -1)
 		im.Logger.Debugf("Moving unmodified layer '%s'...", layerID)
 		srcPath := filepath.Join(im.OldImageDir, layerID)
-		prefix := "blobs/sha256/"
-		destPath := filepath.Join(im.NewImageDir, layerID[len(prefix):])
+		// Keep the path the layer has in the manifest
+		destPath := filepath.Join(im.NewImageDir, layerID)
+		if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+			return fmt.Errorf("failed to create directory for layer '%s': %w", layerID, err)
+		}
+
+		if !PathExists(srcPath) && PathExists(destPath) {
+			im.Logger.Debugf("Layer '%s' was saved to the new image directory already", layerID)
+			continue
+		}
+
+		if im.batch != nil {
+			// Other images of the batch may still need the layer, link it instead
+			if err := linkTree(srcPath, destPath); err != nil {
+				return fmt.Errorf("failed to link layer '%s': %w", layerID, err)
+			}
+			continue
+		}
 
 		// Move the layer from src to dest
 		if err := os.Rename(srcPath, destPath); err != nil {
@@ -449,29 +774,35 @@ func (im *V2Image) writeManifestMetadata(manifest ImageManifest) error {
 	manifestFile := filepath.Join(im.NewImageDir, "manifest.json")
 
 	manifests := []ImageManifest{}
+	if im.batch != nil {
+		manifests = im.batch.manifests
+	}
 
 	manifests = append(manifests, manifest)
+	if im.batch != nil {
+		im.batch.manifests = manifests
+	}
 	file, err := os.Create(manifestFile)
 	if err != nil {
-		im.Logger.Errorf("Error creating file:", err)
+		im.Logger.Errorf("Error creating file: %v", err)
 		return err
 	}
 	defer file.Close()
 	encoder := json.NewEncoder(file)
 	if err := encoder.Encode(manifests); err != nil {
-		im.Logger.Errorf("Error encoding JSON:", err)
+		im.Logger.Errorf("Error encoding JSON: %v", err)
 		return err
 	}
 	return nil
 
 }
 
-func (im *V2Image) generateManifestMetadata(imageID string, layerPathID string) ImageManifest {
+func (im *V2Image) generateManifestMetadata(imageID string, squashedLayer string) ImageManifest {
 
 	manifest := ImageManifest{}
-	manifest.Config = fmt.Sprintf("%s.json", imageID)
-	if im.ImageName != "" && im.ImageTag != "" {
-		manifest.RepoTags = []string{fmt.Sprintf("%s:%s", im.ImageName, im.ImageTag)}
+	manifest.Config = im.configPath(imageID)
+	for _, tag := range im.Tags {
+		manifest.RepoTags = append(manifest.RepoTags, tag.String())
 	}
 
 	var layers []string
@@ -485,8 +816,8 @@ func (im *V2Image) generateManifestMetadata(imageID string, layerPathID string)
 	}
 	manifest.Layers = layers
 
-	if layerPathID != "" {
-		manifest.Layers = append(manifest.Layers, fmt.Sprintf("%s/layer.tar", layerPathID))
+	if squashedLayer != "" {
+		manifest.Layers = append(manifest.Layers, squashedLayer)
 	}
 
 	return manifest
@@ -582,12 +913,12 @@ func (im *V2Image) generateSquashedLayerPathId() (string, error) {
 	return sha, nil
 }
 
-func (im *V2Image) writeImageMetadata(metaData *ImageConfig) string {
+func (im *V2Image) writeImageMetadata(metaData *ImageConfig) (string, error) {
 
 	// jsonMetadata, imageId := im.dumpJson(metadata, true)
 	jsonData, err := json.Marshal(metaData)
 	if err != nil {
-		panic(err) // handle the error appropriately in production code
+		return "", fmt.Errorf("error marshaling JSON: %w", err)
 	}
 
 	// Convert byte slice to string and optionally add newline
@@ -598,13 +929,15 @@ func (im *V2Image) writeImageMetadata(metaData *ImageConfig) string {
 	hasher.Write([]byte(jsonString))
 	imageId := fmt.Sprintf("%x", hasher.Sum(nil))
 
-	imageMetadataFile := filepath.Join(im.NewImageDir, imageId+".json")
+	imageMetadataFile := filepath.Join(im.NewImageDir, im.configPath(imageId))
+	if err := os.MkdirAll(filepath.Dir(imageMetadataFile), 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory for the image config: %w", err)
+	}
 	if err := im.writeJsonMetadata(jsonString, imageMetadataFile); err != nil {
-		im.Logger.Fatal("write metadata json failed")
-		return ""
+		return "", fmt.Errorf("write metadata json failed: %w", err)
 	}
 
-	return imageId
+	return imageId, nil
 
 }
 
@@ -634,9 +967,12 @@ func (im *V2Image) generateImageMetadata() (*ImageConfig, error) {
 		Config:        im.OldImageConfig.Config,
 		DockerVersion: im.OldImageConfig.DockerVersion,
 		OS:            im.OldImageConfig.OS,
+		Variant:       im.OldImageConfig.Variant,
 		Rootfs:        im.OldImageConfig.Rootfs,
 	}
 
+	im.ConfigEdits.Apply(&metadata.Config)
+
 	// Update image creation date
 	metadata.Created = im.Date.Format(time.RFC3339)
 
@@ -703,49 +1039,80 @@ func (im *V2Image) generateChainId(chainIDs *[]string, diffIDs []string, parentC
 	return im.generateChainId(chainIDs, diffIDs[1:], digest)
 }
 
+// extractTarName returns the path of the layer tar, in the new image once the layer is
+// moved or spooled there.
 func (im *V2Image) extractTarName(path string) string {
-	if im.OCIFormat {
-		return filepath.Join(im.OldImageDir, path)
+	if !im.OCIFormat {
+		path = filepath.Join(path, "layer.tar")
 	}
-	return filepath.Join(im.OldImageDir, path, "layer.tar")
+	oldPath := filepath.Join(im.OldImageDir, path)
+	if newPath := filepath.Join(im.NewImageDir, path); !PathExists(oldPath) && PathExists(newPath) {
+		return newPath
+	}
+	return oldPath
 }
 
-func (im *V2Image) generateDiffIds() []string {
+func (im *V2Image) generateDiffIds(ctx context.Context) ([]string, error) {
 	var diffIDs []string
+	declared := im.OldImageConfig.Rootfs.DiffIds
 
-	for _, path := range im.LayerPathsToMove {
+	for i, path := range im.LayerPathsToMove {
+		if diffID, ok := im.batch.diffID(path); ok {
+			diffIDs = append(diffIDs, diffID)
+			continue
+		}
 		layerTar := im.extractTarName(path)
-		sha256, err := im.computeSha256(layerTar)
-		if err != nil {
-			panic(err) // Handle the error according to your application's requirements
+		// Moved layers saved from the daemon were hashed while they were written
+		sha256, ok := im.spooledDigest(path)
+		if !ok {
+			var err error
+			if sha256, err = im.computeSha256(ctx, layerTar); err != nil {
+				return nil, err
+			}
 		}
+		im.batch.setDiffID(path, sha256)
 		diffIDs = append(diffIDs, sha256)
+		if im.cache != nil && i < len(declared) && declared[i] == "sha256:"+sha256 {
+			if err := im.cache.storeLayer(declared[i], layerTar); err != nil {
+				im.Logger.Warnf("Failed to cache layer %s: %v", declared[i], err)
+			}
+		}
 	}
 
-	if len(im.LayerPathsToSquash) != 0 {
-		sha256, err := im.computeSha256(filepath.Join(im.SquashedDir, "layer.tar"))
+	if len(im.squashedDiffID) != 0 {
+		diffIDs = append(diffIDs, im.squashedDiffID)
+	} else if len(im.LayerPathsToSquash) != 0 {
+		sha256, err := im.computeSha256(ctx, filepath.Join(im.SquashedDir, "layer.tar"))
 		if err != nil {
-			panic(err) // Handle the error according to your application's requirements
+			return nil, err
 		}
 		diffIDs = append(diffIDs, sha256)
 	}
 
-	return diffIDs
+	return diffIDs, nil
 }
 
-func (im *V2Image) computeSha256(filePath string) (string, error) {
+func (im *V2Image) computeSha256(ctx context.Context, filePath string) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
 
+	// diff_ids are digests of the uncompressed layer, layers taken from OCI layouts and
+	// registries are usually compressed
+	reader, err := decompressedReader(contextReader{ctx: ctx, r: file})
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
 	hasher := sha256.New()
 
 	// Read the file in chunks to avoid high memory consumption
 	buffer := make([]byte, 10485760) // 10MB
 	for {
-		bytesRead, err := file.Read(buffer)
+		bytesRead, err := reader.Read(buffer)
 		if err != nil && err != io.EOF {
 			return "", err
 		}
@@ -785,9 +1152,11 @@ func (im *V2Image) initializeDirectories() error {
 	im.NewImageDir = filepath.Join(im.TmpDir, "new")
 	// Temporary location on the disk of the squashed *layer*
 	im.SquashedDir = filepath.Join(im.NewImageDir, "squashed")
+	// Location of the tar archive with squashed layers
+	im.SquashedTar = filepath.Join(im.SquashedDir, "layer.tar")
 
 	for _, dir := range []string{im.OldImageDir, im.NewImageDir} {
-		if err := os.Mkdir(dir, os.ModePerm); err != nil {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
 			return err
 		}
 	}
@@ -795,73 +1164,115 @@ func (im *V2Image) initializeDirectories() error {
 	return nil
 }
 
-func (im *V2Image) squashId(layer string) (string, error) {
+func (im *V2Image) squashId(ctx context.Context, layer string) (string, error) {
 	if layer == "<missing>" {
-		im.Logger.Info("You try to squash from layer that does not have it's own ID, we'll try to find it later")
+		im.Logger.Infof("You try to squash from layer that does not have it's own ID, we'll try to find it later")
 	}
 
-	imageInfo, _, err := im.DockerClient.ImageInspectWithRaw(context.Background(), layer)
+	imageID, err := im.Store.ImageID(ctx, layer)
 	if err != nil {
 		return "", err
 	}
-	im.Logger.Infof("Layer ID to squash from: %s", imageInfo.ID)
-	return imageInfo.ID, nil
+	im.Logger.Infof("Layer ID to squash from: %s", imageID)
+	return imageID, nil
 }
 
 func (oim *V2Image) validateNumberofLayers(number_of_layers int) error {
 	//Makes sure that the specified number of layers to squash is a valid number
 
 	if number_of_layers <= 0 {
-		return fmt.Errorf("Number of layers to squash cannot be less or equal 0, provided: {%s}", string(number_of_layers))
+		return NewInvalidLayerError(fmt.Sprintf("Number of layers to squash cannot be less or equal 0, provided: {%d}", number_of_layers))
 	}
 	if number_of_layers > len(oim.OldImageLayers) {
-		return fmt.Errorf("Cannot squash {%s} layers, the {%s} image contains only {%s} layers", number_of_layers, oim.ImageName, len(oim.OldImageLayers))
+		return NewInvalidLayerError(fmt.Sprintf("Cannot squash {%d} layers, the {%s} image contains only {%d} layers", number_of_layers, oim.Image, len(oim.OldImageLayers)))
 	}
 
 	return nil
 
 }
 
-func (im *V2Image) beforeSquashing() error {
+func (im *V2Image) beforeSquashing(ctx context.Context) error {
+
+	if err := im.selectLayers(ctx); err != nil {
+		return err
+	}
+
+	// A resumed run has done part of the work already
+	if !im.resume || !PathExists(im.TmpDir) {
+		if err := im.checkSpace(); err != nil {
+			return err
+		}
+	}
 
 	if err := im.initializeDirectories(); err != nil {
 		return err
 	}
 
-	// Location of the tar archive with squashed layers
-	im.SquashedTar = filepath.Join(im.SquashedDir, "layer.tar")
+	if im.resume {
+		if err := im.openCheckpoint(); err != nil {
+			return err
+		}
+		if im.resumed(CheckpointMetadata) {
+			return im.restoreState()
+		}
+	}
+
+	if !im.resumed(CheckpointSaved) {
+		if err := im.saveImage(ctx); err != nil {
+			return err
+		}
+	}
 
-	if len(im.Tag) != 0 {
-		im.parseImageName()
+	if err := im.readSavedImage(ctx); err != nil {
+		return err
 	}
+	if im.checkpoint == nil || im.resumed(CheckpointSaved) {
+		return nil
+	}
+	return im.recordCheckpoint(checkpointPhase{Phase: CheckpointSaved}, im.savedArtifacts()...)
+}
 
-	imageInfo, _, err := im.DockerClient.ImageInspectWithRaw(context.Background(), im.Image)
+// selectLayers inspects the image and decides which layers will be squashed and which
+// will be moved unchanged.
+func (im *V2Image) selectLayers(ctx context.Context) error {
+
+	imageID, err := im.Store.ImageID(ctx, im.Image)
 	if err != nil {
-		im.Logger.Errorf("Could not get the image ID to squash, please check provided 'image' argument:", im.Image)
+		im.Logger.Errorf("Could not get the image ID to squash, please check provided 'image' argument: %s", im.Image)
 		return err
 	}
-	im.OldImageId = imageInfo.ID
+	im.OldImageId = imageID
 
-	if err := im.readLayers(im.OldImageId); err != nil {
+	if err := im.readLayers(ctx, im.OldImageId); err != nil {
 		return err
 	}
 
 	ReverseList(im.OldImageLayers)
+	return im.splitLayers(ctx)
+}
+
+// splitLayers divides OldImageLayers, oldest first, into the layers to move and the
+// layers to squash according to FromLayer.
+func (im *V2Image) splitLayers(ctx context.Context) error {
 	im.Logger.Infof("Old image has %d layers", len(im.OldImageLayers))
 	im.Logger.Debugf("Old layers: %s", im.OldImageLayers)
 
 	numOfLayers, err := strconv.Atoi(im.FromLayer)
 
 	if err == nil {
-		im.Logger.Debug("We detected number of layers as the argument to squash")
+		im.Logger.Debugf("We detected number of layers as the argument to squash")
 	} else {
-		im.Logger.Debug("We detected layer as the argument to squash")
-		squashId, err := im.squashId(im.FromLayer)
-		if err != nil || len(squashId) == 0 {
-			im.Logger.Infof("The %s layer could not be found in the %s image", im.FromLayer, im.Image)
+		im.Logger.Debugf("We detected layer as the argument to squash")
+		squashId, err := im.squashId(ctx, im.FromLayer)
+		var unavailable *DaemonUnavailableError
+		if errors.As(err, &unavailable) {
 			return err
 		}
-		numOfLayers = len(im.OldImageLayers) - FindIndex(im.OldImageLayers, squashId) - 1
+		index := FindIndex(im.OldImageLayers, squashId)
+		if err != nil || index < 0 {
+			return NewInvalidLayerError(fmt.Sprintf("The %s layer could not be found in the %s image", im.FromLayer, im.Image))
+		}
+		numOfLayers = len(im.OldImageLayers) - index - 1
 
 	}
 
@@ -874,38 +1285,61 @@ func (im *V2Image) beforeSquashing() error {
 	im.LayersToSquash = im.OldImageLayers[maker:]
 	im.LayersToMove = im.OldImageLayers[:maker]
 
-	im.Logger.Info("Checking if squashing is necessary...")
+	im.Logger.Infof("Checking if squashing is necessary...")
 
 	if len(im.LayersToSquash) < 1 {
-		return fmt.Errorf("Invalid number of layers to squash:  %s", len(im.LayersToSquash))
+		return NewInvalidLayerError(fmt.Sprintf("Invalid number of layers to squash: %d", len(im.LayersToSquash)))
 	}
 	if len(im.LayersToSquash) == 1 {
-		return fmt.Errorf("Single layer marked to squash, no squashing is required")
+		return NewSquashUnnecessaryError("Single layer marked to squash, no squashing is required")
 	}
 	im.Logger.Infof("Attempting to squash last [ %d ] layers...", numOfLayers)
 
 	im.Logger.Debugf("Layers to squash: {%s}", im.LayersToSquash)
 	im.Logger.Debugf("Layers to move: {%s}", im.LayersToMove)
+	return nil
+}
 
-	if err := im.saveImage(); err != nil {
-		return err
-	}
-	im.SizeBefore, err = im.dirSize(im.OldImageDir)
-	if err != nil {
-		return err
+// readSavedImage reads the manifest and config of the saved image and maps the selected
+// layers to their paths in the archive.
+func (im *V2Image) readSavedImage(ctx context.Context) error {
+	var err error
+
+	// Images read from an OCI index already know their manifest and config
+	if len(im.OldManifest.Config) == 0 {
+		if err := im.getManifest(ctx); err != nil {
+			return err
+		}
+		im.Logger.Debugf("Retrieved manifest '%v' ", im.OldManifest)
+		if err := im.unspoolFiles(); err != nil {
+			return err
+		}
+
+		if err := im.getIamgeConfig(); err != nil {
+			return err
+		}
 	}
+
 	im.Logger.Infof("Squashing image '%s'...", im.Image)
 
-	if err := im.getManifest(); err != nil {
+	for _, layer := range im.OldManifest.Layers {
+		if _, err := im.savedArchiveFile(layer); err != nil {
+			return err
+		}
+	}
+	if err := im.readLayerPaths(); err != nil {
 		return err
 	}
-	im.Logger.Debugf("Retrieved manifest '%s' ", im.OldManifest)
-
-	if err := im.getIamgeConfig(); err != nil {
+	if err := im.unspoolSquashedLayers(); err != nil {
 		return err
 	}
 
-	if err := im.readLayerPaths(); err != nil {
+	if im.batch != nil {
+		im.SizeBefore, err = im.manifestSize(im.OldImageDir, im.OldManifest)
+	} else {
+		im.SizeBefore, err = im.savedSize()
+	}
+	if err != nil {
 		return err
 	}
 
@@ -949,47 +1383,41 @@ func (oim *V2Image) readLayerPaths() error {
 
 }
 
-// getManifest checks for the presence of "index.json" to determine if it's an OCI format.
-// tries to load "manifest.json".
-
-func (oim *V2Image) getManifest() error {
-	indexPath := filepath.Join(oim.OldImageDir, "index.json")
-	manifestPath := filepath.Join(oim.OldImageDir, "manifest.json")
-
-	if _, err := os.Stat(indexPath); !os.IsNotExist(err) {
-
-		oim.OCIFormat = true
-	}
-
-	data, err := ioutil.ReadFile(manifestPath)
+// getManifest selects the format of the saved image and reads its manifest. Images saved
+// in the v1 format have none, it is built from their layers.
+func (oim *V2Image) getManifest(ctx context.Context) error {
+	format, err := oim.detectFormat()
 	if err != nil {
-		return fmt.Errorf("failed to read file: %v", err)
+		return err
 	}
-
-	var manifest []ImageManifest
-	if err := json.Unmarshal(data, &manifest); err != nil {
-		return fmt.Errorf("failed to unmarshal JSON: %v", err)
+	oim.setFormat(format)
+	oim.Logger.Debugf("The saved image is in the %s format", format)
+	if format == FormatV1 {
+		return oim.readLegacyImage(ctx)
 	}
 
-	if len(manifest) == 0 {
-		return errors.New("manifest is empty")
+	manifest, err := readManifestFile(filepath.Join(oim.OldImageDir, "manifest.json"))
+	if err != nil {
+		return err
 	}
-	oim.OldManifest = manifest[0]
+	oim.OldManifest = selectManifest(manifest, oim.OldImageId)
 	return nil
-
 }
 
 func (oim *V2Image) getIamgeConfig() error {
 
-	configPath := filepath.Join(oim.OldImageDir, oim.OldManifest.Config)
+	configPath, err := checkArchiveFile(oim.OldImageDir, oim.OldManifest.Config)
+	if err != nil {
+		return err
+	}
 
 	data, err := ioutil.ReadFile(configPath)
 	if err != nil {
-		return fmt.Errorf("failed to read file: %v", err)
+		return NewCorruptArchiveError("failed to read image config", err)
 	}
 
 	if err := json.Unmarshal(data, &oim.OldImageConfig); err != nil {
-		return fmt.Errorf("failed to unmarshal JSON: %v", err)
+		return NewCorruptArchiveError("failed to unmarshal image config", err)
 	}
 	return nil
 }
@@ -1018,30 +1446,51 @@ func (oim *V2Image) dirSize(directory string) (int64, error) {
 	return size, nil
 }
 
-func (im *V2Image) saveImage() error {
+func (im *V2Image) saveImage(ctx context.Context) error {
 	//Saves the image as a tar archive under specified name
+	return im.saveImages(ctx, []string{im.OldImageId})
+}
+
+// saveImages saves all given images with a single Save of the image store, so layers
+// they share are stored only once.
+func (im *V2Image) saveImages(ctx context.Context, imageIDs []string) error {
 
+	var err error
+	progress := im.startPhase(PhaseSave, 0)
 	for i := 0; i < 3; i++ {
-		im.Logger.Infof("Saving image %s to %s directory...", im.OldImageId, im.OldImageDir)
+		im.Logger.Infof("Saving image %s to %s directory...", strings.Join(imageIDs, ", "), im.OldImageDir)
 		im.Logger.Infof("Try #%d...", (i + 1))
 
-		reader, err := im.DockerClient.ImageSave(context.Background(), []string{im.OldImageId})
+		var reader io.ReadCloser
+		reader, err = im.Store.Save(ctx, imageIDs)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
-			im.Logger.Errorf("An error occurred while fetching the %s image, retrying: %v", im.OldImageId, err)
+			im.Logger.Errorf("An error occurred while fetching the %s image, retrying: %v", imageIDs, err)
 			continue
 		}
-		defer reader.Close()
 
-		err = im.extractTar(reader, im.OldImageDir)
+		counter := &progressReader{r: contextReader{ctx: ctx, r: reader}, progress: progress}
+		if im.batch == nil {
+			err = im.spoolTar(counter)
+		} else {
+			err = im.extractTar(counter, im.OldImageDir)
+		}
+		reader.Close()
 		if err == nil {
-			im.Logger.Info("Image saved successfully!")
+			im.Logger.Infof("Image saved successfully!")
+			progress.end(ProgressEvent{BytesRead: counter.n})
 			return nil
 		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 
-		im.Logger.Infof("An error occurred while extracting the %s image, retrying: %v", im.OldImageId, err)
+		im.Logger.Infof("An error occurred while extracting the %s image, retrying: %v", imageIDs, err)
 
 	}
-	return nil
+	return fmt.Errorf("failed to save image %s: %w", strings.Join(imageIDs, ", "), err)
 
 }
 
@@ -1055,31 +1504,42 @@ func (oim *V2Image) extractTar(tarReader io.Reader, directory string) error {
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("error reading tar archive: %v", err)
+			return NewCorruptArchiveError("error reading tar archive", err)
 		}
 
-		path := fmt.Sprintf("%s/%s", directory, header.Name)
+		path, err := secureJoin(directory, header.Name)
+		if err != nil {
+			return err
+		}
+		// Never write through a symlink an earlier entry created
+		if err := removeSymlink(path); err != nil {
+			return NewIOError("couldn't remove symlink", err)
+		}
+		if oim.rootless && isDevice(header.Typeflag) {
+			oim.Logger.Warnf("Skipping %s, device nodes can only be created as root", header.Name)
+			continue
+		}
 		switch header.Typeflag {
 		case tar.TypeDir:
 			if err := os.MkdirAll(path, os.FileMode(header.Mode)); err != nil {
-				return fmt.Errorf("couldn't create directory: %v", err)
+				return NewIOError("couldn't create directory", err)
 			}
 		case tar.TypeReg, tar.TypeRegA:
-			file, err := os.Create(path)
-			if err != nil {
-				return fmt.Errorf("couldn't create file: %v", err)
-			}
-			defer file.Close()
-
-			if _, err := io.Copy(file, tarBallReader); err != nil {
-				return fmt.Errorf("couldn't copy file contents: %v", err)
+			if err := writeFile(path, tarBallReader, os.FileMode(header.Mode)); err != nil {
+				return err
 			}
-			file.Chmod(os.FileMode(header.Mode))
 		case tar.TypeLink:
-			if err := os.Link(header.Linkname, path); err != nil {
+			target, err := secureJoin(directory, header.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.Link(target, path); err != nil {
 				return fmt.Errorf("couldn't create hard link: %v", err)
 			}
 		case tar.TypeSymlink:
+			if err := checkSymlink(header.Name, header.Linkname); err != nil {
+				return err
+			}
 			if err := os.Symlink(header.Linkname, path); err != nil {
 				return fmt.Errorf("couldn't create symlink: %v", err)
 			}
@@ -1103,55 +1563,93 @@ func (oim *V2Image) extractTar(tarReader io.Reader, directory string) error {
 	return nil
 }
 
+// writeFile writes the content of a regular file entry.
+func writeFile(path string, r io.Reader, mode os.FileMode) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return NewIOError("couldn't create file", err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return NewIOError("couldn't copy file contents", err)
+	}
+	file.Chmod(mode)
+	if err := file.Close(); err != nil {
+		return NewIOError("couldn't write file", err)
+	}
+	return nil
+}
+
 func mkdev(major, minor int64) uint32 {
 	return uint32((major << 8) | (minor & 0xff) | ((minor & 0xfff00) << 12))
 }
 
-func (oim *V2Image) parseImageName() {
-	//Parses the provided image name and splits it in the name and tag part, if possible. If no tag is provided  'latest' is used.
-	colonIndex := strings.LastIndex(oim.Tag, ":")
-	if colonIndex > -1 && !strings.Contains(oim.Tag[colonIndex:], "/") {
-		oim.ImageName = oim.Tag[:colonIndex]
-		oim.ImageTag = oim.Tag[colonIndex+1:]
-	} else {
-		oim.ImageName = oim.Tag
-		oim.ImageTag = "latest"
+func (im *V2Image) repoTagList() string {
+	var tags []string
+	if im.batch != nil {
+		for _, manifest := range im.batch.manifests {
+			tags = append(tags, manifest.RepoTags...)
+		}
+		return strings.Join(tags, ", ")
 	}
-
+	for _, tag := range im.Tags {
+		tags = append(tags, tag.String())
+	}
+	return strings.Join(tags, ", ")
 }
 
 func (im *V2Image) prepareTmpDirectory() error {
 	// Creates temporary directory that is used to work on layers
 
-	if len(im.TmpDir) != 0 {
-		if _, err := os.Stat(im.TmpDir); !os.IsNotExist(err) {
-
-			return fmt.Errorf("the '%s' directory already exists, please remove it before you proceed", im.TmpDir)
-		}
-		if err := os.MkdirAll(im.TmpDir, os.ModePerm); err != nil {
-			return fmt.Errorf("failed to create temporary directory: %v", err)
-		}
-
-	} else {
-		tmpDir, err := os.MkdirTemp("", "docker-squash-")
-		if err != nil {
+	if im.resume && PathExists(im.TmpDir) {
+		if err := checkWorkDir(im.TmpDir); err != nil {
 			return err
 		}
-		im.TmpDir = tmpDir
+		im.Logger.Infof("Using %s as the work directory", im.TmpDir)
+		return nil
+	}
+
+	tmpDir, err := createTmpDirectory(im.TmpDir, im.tmpParent)
+	if err != nil {
+		return err
 	}
+	im.TmpDir = tmpDir
 	im.Logger.Infof("Using %s as the temporary directory", im.TmpDir)
 	return nil
 }
 
-func (im *V2Image) readLayers(imageID string) error {
+// createTmpDirectory creates the given directory, refusing to reuse an existing one, or a
+// new random directory in parent when none is given.
+func createTmpDirectory(dir, parent string) (string, error) {
+	if len(dir) != 0 {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+
+			return "", fmt.Errorf("the '%s' directory already exists, please remove it before you proceed", dir)
+		}
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return "", NewIOError("failed to create temporary directory", err)
+		}
+		return dir, nil
+	}
+	dir, err := os.MkdirTemp(parent, "docker-squash-")
+	if err != nil {
+		return "", NewIOError("failed to create temporary directory", err)
+	}
+	return dir, nil
+}
+
+func (im *V2Image) readLayers(ctx context.Context, imageID string) error {
 
-	history, err := im.DockerClient.ImageHistory(context.Background(), imageID)
+	history, err := im.Store.History(ctx, imageID)
 	if err != nil {
 		return err
 	}
 	count := 0
 	for _, layer := range history {
 		im.OldImageLayers = append(im.OldImageLayers, layer.ID)
+		// Oldest first, like OldImageLayers once it is reversed
+		im.layerSizes = append([]int64{layer.Size}, im.layerSizes...)
 		count++
 	}
 
@@ -1162,54 +1660,64 @@ func (im *V2Image) readLayers(imageID string) error {
 	return nil
 }
 
-func (im *V2Image) LoadSquashedImage() error {
+func (im *V2Image) LoadSquashedImage(ctx context.Context) error {
 
-	tarFile := filepath.Join(im.TmpDir, "image.tar")
+	bytesTotal, _ := im.dirSize(im.NewImageDir)
+	progress := im.startPhase(PhaseLoad, bytesTotal)
 
-	if err := im.tarImage(tarFile, im.NewImageDir); err != nil {
-		im.Logger.Errorf("Error creating tar: %v\n", err)
-		return err
-	}
-
-	file, err := os.Open(tarFile)
-	if err != nil {
-		im.Logger.Errorf("Error opening tar file: %v\n", err)
-		return err
-	}
-	defer file.Close()
-	defer os.Remove(tarFile)
+	// Stream the image straight into the image store instead of staging a tarball on disk
+	pr, pw := io.Pipe()
+	counter := &progressWriter{w: pw, progress: progress}
+	go func() {
+		pw.CloseWithError(im.writeTar(ctx, counter, im.NewImageDir, false))
+	}()
+	defer pr.Close()
 
-	fmt.Printf("Loading squashed image -->[ %s:%s ]...\n", im.ImageName, im.ImageTag)
-	response, err := im.DockerClient.ImageLoad(context.Background(), file, true)
-	if err != nil {
+	fmt.Fprintf(im.Out, "Loading squashed image -->[ %s ]...\n", im.repoTagList())
+	if err := im.Store.Load(ctx, pr); err != nil {
 		im.Logger.Errorf("Error loading image: %v\n", err)
 		return err
 	}
-	defer response.Body.Close()
 
-	// Print the API response
-	bodyBytes, _ := ioutil.ReadAll(response.Body)
-	im.Logger.Debugf("Docker API Response:%s", string(bodyBytes))
-
-	im.Logger.Info("Image loaded!")
+	im.Logger.Infof("Image loaded!")
+	progress.end(ProgressEvent{BytesWritten: counter.n})
 	return nil
 
 }
 
-func (im *V2Image) tarImage(targetTarFile, directory string) error {
+// tarImage writes the directory as a tar archive to targetTarFile, or to stdout when
+// targetTarFile is "-". It returns the size of the archive. With remove the files are
+// removed once they are written.
+func (im *V2Image) tarImage(ctx context.Context, targetTarFile, directory string, remove bool, progress *phaseProgress) (int64, error) {
+	if targetTarFile == StdoutPath {
+		counter := &progressWriter{w: im.Output, progress: progress}
+		err := im.writeTar(ctx, counter, directory, remove)
+		return counter.n, err
+	}
+
 	file, err := os.Create(targetTarFile)
 	if err != nil {
-		return fmt.Errorf("error creating tar file: %v", err)
+		return 0, NewIOError("error creating tar file", err)
 	}
 	defer file.Close()
 
-	tw := tar.NewWriter(file)
-	defer tw.Close()
+	counter := &progressWriter{w: file, progress: progress}
+	if err := im.writeTar(ctx, counter, directory, remove); err != nil {
+		return 0, err
+	}
+	return counter.n, file.Close()
+}
+
+func (im *V2Image) writeTar(ctx context.Context, w io.Writer, directory string, remove bool) error {
+	tw := tar.NewWriter(w)
 
-	return filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if path == directory {
 			return nil // skip the root directory
 		}
@@ -1236,21 +1744,68 @@ func (im *V2Image) tarImage(targetTarFile, directory string) error {
 			}
 			defer data.Close()
 
-			if _, err := io.Copy(tw, data); err != nil {
+			if _, err := io.Copy(tw, contextReader{ctx: ctx, r: data}); err != nil {
 				return err
 			}
+			if remove {
+				return os.Remove(path)
+			}
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
 }
 
-func (im *V2Image) ExportTarArchive(outputPath string) error {
+func (im *V2Image) ExportTarArchive(ctx context.Context, outputPath string) error {
+
+	artifact, _ := filepath.Abs(outputPath)
+	if exported := im.checkpoint.phase(CheckpointExported); exported != nil {
+		if _, ok := exported.Artifacts[artifact]; ok {
+			im.Logger.Infof("Image already exported to '%s'", outputPath)
+			return nil
+		}
+	}
+
+	progress := im.startPhase(PhaseExport, 0)
+
+	imageDir := im.NewImageDir
+	if im.Compression != CompressionNone || im.batch.multiPlatform() {
+		imageDir = filepath.Join(im.TmpDir, "export")
+		// Left behind when an earlier run was interrupted while exporting
+		os.RemoveAll(imageDir)
+		if err := os.Mkdir(imageDir, os.ModePerm); err != nil {
+			return err
+		}
+		defer os.RemoveAll(imageDir)
+
+		if err := im.writeBlobLayout(ctx, imageDir, progress); err != nil {
+			return err
+		}
+	}
 
-	if err := im.tarImage(outputPath, im.NewImageDir); err != nil {
+	bytesTotal, _ := im.dirSize(imageDir)
+	progress.setTotal(bytesTotal)
+	// The image is written once more, remove it on the way unless it is loaded next
+	remove := imageDir != im.NewImageDir || im.removeExported
+	bytesWritten, err := im.tarImage(ctx, outputPath, imageDir, remove, progress)
+	if err != nil {
 		return err
 	}
+	progress.end(ProgressEvent{BytesWritten: bytesWritten})
+	if outputPath != StdoutPath {
+		if err := im.recordCheckpoint(checkpointPhase{Phase: CheckpointExported}, artifact); err != nil {
+			return err
+		}
+	}
 
-	im.Logger.Infof("Image available at '%s'", outputPath)
+	if outputPath == StdoutPath {
+		im.Logger.Infof("Image written to stdout")
+	} else {
+		im.Logger.Infof("Image available at '%s'", outputPath)
+	}
 
 	return nil
 }
@@ -0,0 +1,282 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// BatchEntry describes one image of a batch run together with its own options. The
+// images of a batch are written as one archive, or loaded in one go, so the output,
+// compression and loading apply to the whole batch.
+type BatchEntry struct {
+	Image     string   `yaml:"image"`
+	FromLayer string   `yaml:"from-layer"`
+	Tags      []string `yaml:"tags"`
+	Message   string   `yaml:"message"`
+	// Exclude are removed from the squashed layer of the image, next to the paths
+	// excluded for the whole batch
+	Exclude []string `yaml:"exclude"`
+}
+
+// BatchFile is the format of the file given to --batch-file.
+type BatchFile struct {
+	Images []BatchEntry `yaml:"images"`
+}
+
+// LoadBatchFile reads the images to squash from a YAML batch file.
+func LoadBatchFile(path string) ([]BatchEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read batch file: %w", err)
+	}
+
+	var batchFile BatchFile
+	decoder := yaml.NewDecoder(strings.NewReader(string(data)))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&batchFile); err != nil {
+		return nil, fmt.Errorf("failed to parse batch file '%s': %w", path, err)
+	}
+
+	for i, entry := range batchFile.Images {
+		if len(entry.Image) == 0 {
+			return nil, fmt.Errorf("batch file '%s': entry %d has no image", path, i+1)
+		}
+		if err := ValidateExcludes(entry.Exclude); err != nil {
+			return nil, fmt.Errorf("batch file '%s': entry %d: %w", path, i+1, err)
+		}
+	}
+	return batchFile.Images, nil
+}
+
+// ParseBatchEntry parses an image given on the command line as
+// IMAGE[,from-layer=N][,tag=TAG...][,message=MSG][,exclude=PATH...].
+func ParseBatchEntry(spec string) (BatchEntry, error) {
+	parts := strings.Split(spec, ",")
+	entry := BatchEntry{Image: parts[0]}
+	if len(entry.Image) == 0 {
+		return BatchEntry{}, fmt.Errorf("invalid batch image '%s': image is required", spec)
+	}
+
+	for _, part := range parts[1:] {
+		key, value, found := strings.Cut(part, "=")
+		if !found {
+			return BatchEntry{}, fmt.Errorf("invalid batch image '%s': expected key=value, got '%s'", spec, part)
+		}
+		switch key {
+		case "from-layer":
+			entry.FromLayer = value
+		case "tag":
+			entry.Tags = append(entry.Tags, value)
+		case "message":
+			entry.Message = value
+		case "exclude":
+			entry.Exclude = append(entry.Exclude, value)
+		default:
+			return BatchEntry{}, fmt.Errorf("invalid batch image '%s': unknown option '%s'", spec, key)
+		}
+	}
+	if err := ValidateExcludes(entry.Exclude); err != nil {
+		return BatchEntry{}, fmt.Errorf("invalid batch image '%s': %w", spec, err)
+	}
+	return entry, nil
+}
+
+// batchState is shared by the images squashed in one batch run. They are saved with a
+// single save and written into one image directory, so layers they have in common
+// are stored and hashed only once.
+type batchState struct {
+	diffIDs      map[string]string
+	manifests    []ImageManifest
+	repositories map[string]map[string]string
+	// platforms is set when the images are the platforms of one multi-platform image,
+	// in the order of manifests
+	platforms []OCIPlatform
+}
+
+func newBatchState() *batchState {
+	return &batchState{
+		diffIDs:      make(map[string]string),
+		repositories: make(map[string]map[string]string),
+	}
+}
+
+func (b *batchState) diffID(layerPath string) (string, bool) {
+	if b == nil {
+		return "", false
+	}
+	diffID, ok := b.diffIDs[layerPath]
+	return diffID, ok
+}
+
+func (b *batchState) setDiffID(layerPath, diffID string) {
+	if b != nil {
+		b.diffIDs[layerPath] = diffID
+	}
+}
+
+func (b *batchState) multiPlatform() bool {
+	return b != nil && len(b.platforms) != 0
+}
+
+func (b *batchState) lastManifest() ImageManifest {
+	return b.manifests[len(b.manifests)-1]
+}
+
+// RunBatch squashes all given images. Entries without their own message use the one of
+// the Squash instance. It returns the new image IDs in the order of the entries.
+func (s *Squash) RunBatch(ctx context.Context, entries []BatchEntry) (newImageIDs []string, err error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no images provided for the batch")
+	}
+	if s.resume {
+		return nil, errResumeUnsupported
+	}
+	if s.verify {
+		return nil, errVerifyUnsupported
+	}
+	if err := s.checkStore(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.validateOutput(); err != nil {
+		return nil, err
+	}
+
+	tmpDir, err := createTmpDirectory(s.tmpDir, "")
+	if err != nil {
+		return nil, err
+	}
+	s.logs.Infof("Using %s as the temporary directory", tmpDir)
+	defer func() { s.abort(ctx, err, tmpDir) }()
+
+	state := newBatchState()
+	var images []*V2Image
+	var imageIDs []string
+	seen := make(map[string]bool)
+
+	for i, entry := range entries {
+		tags, err := ParseRepoTags(entry.Tags)
+		if err != nil {
+			return nil, err
+		}
+
+		img := NewV2Image(s)
+		img.batch = state
+		img.Image = entry.Image
+		img.FromLayer = entry.FromLayer
+		img.Tags = tags
+		if len(entry.Message) != 0 {
+			img.Comment = entry.Message
+		}
+		if len(entry.Exclude) != 0 {
+			img.Excludes = append(append([]string(nil), s.excludes...), entry.Exclude...)
+		}
+		img.TmpDir = tmpDir
+		img.OldImageDir = filepath.Join(tmpDir, "old")
+		img.NewImageDir = filepath.Join(tmpDir, "new")
+		img.SquashedDir = filepath.Join(img.NewImageDir, fmt.Sprintf("squashed-%d", i))
+		img.SquashedTar = filepath.Join(img.SquashedDir, "layer.tar")
+
+		s.logs.Infof("Preparing image %d of %d: %s", i+1, len(entries), entry.Image)
+		if err := img.selectLayers(ctx); err != nil {
+			return nil, fmt.Errorf("image '%s': %w", entry.Image, err)
+		}
+		if !seen[img.OldImageId] {
+			seen[img.OldImageId] = true
+			imageIDs = append(imageIDs, img.OldImageId)
+		}
+		images = append(images, img)
+	}
+
+	lead := images[0]
+	for _, dir := range []string{lead.OldImageDir, lead.NewImageDir} {
+		if err := os.Mkdir(dir, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	if err := lead.saveImages(ctx, imageIDs); err != nil {
+		return nil, err
+	}
+
+	for _, img := range images {
+		if err := img.readSavedImage(ctx); err != nil {
+			return nil, fmt.Errorf("image '%s': %w", img.Image, err)
+		}
+		newImageID, err := img.squash(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("image '%s': %w", img.Image, err)
+		}
+		if err := img.afterSquashing(); err != nil {
+			return nil, fmt.Errorf("image '%s': %w", img.Image, err)
+		}
+		newImageIDs = append(newImageIDs, newImageID)
+	}
+
+	s.logs.Infof("Cleaning up %s temporary directory...", lead.OldImageDir)
+	if err := os.RemoveAll(lead.OldImageDir); err != nil {
+		s.logs.Errorf("Cleaning up temporary directory failed: %v", err)
+	}
+
+	s.squashed = images
+	if err := s.finish(ctx, lead); err != nil {
+		return nil, err
+	}
+	return newImageIDs, nil
+}
+
+// manifestSize sums up the files a manifest references in dir.
+func (im *V2Image) manifestSize(dir string, manifest ImageManifest) (int64, error) {
+	var size int64
+	for _, file := range append([]string{manifest.Config}, manifest.Layers...) {
+		info, err := os.Stat(filepath.Join(dir, file))
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+// selectManifest picks the manifest of the given image from a saved archive holding
+// one or more images.
+func selectManifest(manifests []ImageManifest, imageID string) ImageManifest {
+	digest := strings.TrimPrefix(imageID, "sha256:")
+	for _, manifest := range manifests {
+		config := filepath.Base(manifest.Config)
+		if config == digest || config == digest+".json" {
+			return manifest
+		}
+	}
+	return manifests[0]
+}
+
+// linkTree hard links the file or directory src to dest, keeping an existing dest.
+func linkTree(src, dest string) error {
+	if PathExists(dest) {
+		return nil
+	}
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, relPath)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		if err := os.Link(path, target); err != nil {
+			// The source may be on another filesystem, like a user provided OCI layout
+			_, err = CopyFile(path, target, make(map[string]int))
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,171 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseBatchEntry(t *testing.T) {
+	tests := []struct {
+		spec  string
+		entry BatchEntry
+		error string
+	}{
+		{spec: "app:build", entry: BatchEntry{Image: "app:build"}},
+		{
+			spec: "app:build,from-layer=2,tag=app:1,tag=app:latest,message=squash app,exclude=/tmp/*,exclude=/root/.cache",
+			entry: BatchEntry{
+				Image:     "app:build",
+				FromLayer: "2",
+				Tags:      []string{"app:1", "app:latest"},
+				Message:   "squash app",
+				Exclude:   []string{"/tmp/*", "/root/.cache"},
+			},
+		},
+		{spec: ",tag=app:1", error: "image is required"},
+		{spec: "app:build,tag", error: "expected key=value"},
+		{spec: "app:build,compression=gzip", error: "unknown option 'compression'"},
+		{spec: "app:build,exclude=/", error: "it excludes everything"},
+	}
+	for _, test := range tests {
+		entry, err := ParseBatchEntry(test.spec)
+		if len(test.error) != 0 {
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("%s: got error %v, expected %q", test.spec, err, test.error)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.spec, err)
+		} else if !reflect.DeepEqual(entry, test.entry) {
+			t.Errorf("%s: got %+v, expected %+v", test.spec, entry, test.entry)
+		}
+	}
+}
+
+// TestRunBatch squashes two images with a base layer in common. They are saved with one
+// Save, the base layer is stored once in the archive, and each image keeps its own
+// excluded paths.
+func TestRunBatch(t *testing.T) {
+	base := map[string]string{"etc/os-release": "ID=test\n", "bin/sh": "shell"}
+	store := newFakeStore(t,
+		fakeImage{name: "app", layers: []map[string]string{
+			base,
+			{"app/server": "v1", "app/cache/build.log": "log"},
+			{"app/server": "v2"},
+		}},
+		fakeImage{name: "worker", layers: []map[string]string{
+			base,
+			{"worker/run": "v1", "app/cache/build.log": "log"},
+			{"worker/run": "v2"},
+		}},
+	)
+
+	output := filepath.Join(t.TempDir(), "images.tar")
+	squash, err := NewSquashWithStore(CLI{OutputPath: output, TmpDir: filepath.Join(t.TempDir(), "work")}, store, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	newImageIDs, err := squash.RunBatch(context.Background(), []BatchEntry{
+		{Image: "app", FromLayer: "2", Tags: []string{"app:squashed"}, Exclude: []string{"/app/cache"}},
+		{Image: "worker", FromLayer: "2", Tags: []string{"worker:squashed"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(newImageIDs) != 2 {
+		t.Fatalf("got %d new images, expected 2", len(newImageIDs))
+	}
+
+	appID, _ := store.ImageID(context.Background(), "app")
+	workerID, _ := store.ImageID(context.Background(), "worker")
+	if !reflect.DeepEqual(store.saves, [][]string{{appID, workerID}}) {
+		t.Errorf("saved %v, expected one save of both images", store.saves)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := readArchive(t, data)
+	var manifests []ImageManifest
+	if err := json.Unmarshal(files["manifest.json"], &manifests); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 2 {
+		t.Fatalf("the archive has %d manifests, expected 2", len(manifests))
+	}
+	for i, tag := range []string{"app:squashed", "worker:squashed"} {
+		if !reflect.DeepEqual(manifests[i].RepoTags, []string{tag}) {
+			t.Errorf("image %d is tagged %v, expected %s", i+1, manifests[i].RepoTags, tag)
+		}
+		if len(manifests[i].Layers) != 2 {
+			t.Fatalf("image %d has %d layers, expected the base and the squashed one", i+1, len(manifests[i].Layers))
+		}
+	}
+	if manifests[0].Layers[0] != manifests[1].Layers[0] {
+		t.Errorf("the images do not share the base layer: %s and %s", manifests[0].Layers[0], manifests[1].Layers[0])
+	}
+
+	squashedFiles := func(manifest ImageManifest) []string {
+		var names []string
+		for name := range readArchive(t, files[manifest.Layers[1]]) {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	if names := squashedFiles(manifests[0]); !reflect.DeepEqual(names, []string{"app/.wh.cache", "app/server"}) {
+		t.Errorf("the squashed layer of app has %v, expected the excluded paths to be whited out", names)
+	}
+	if names := squashedFiles(manifests[1]); !reflect.DeepEqual(names, []string{"app/cache/build.log", "worker/run"}) {
+		t.Errorf("the squashed layer of worker has %v, expected the paths excluded for app to be kept", names)
+	}
+}
+
+// TestBatchHashesSharedLayersOnce computes the diff_ids of two images of a batch that
+// move the same layer. The second image takes the diff_id of the first, even once the
+// layer can no longer be read.
+func TestBatchHashesSharedLayersOnce(t *testing.T) {
+	dir := t.TempDir()
+	layerTar := fakeLayerTar(t, map[string]string{"etc/os-release": "ID=test\n"})
+	if err := os.MkdirAll(filepath.Join(dir, "old", "base"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	layerPath := filepath.Join(dir, "old", "base", "layer.tar")
+	if err := os.WriteFile(layerPath, layerTar, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state := newBatchState()
+	var diffIDs [][]string
+	for i := 0; i < 2; i++ {
+		im := &V2Image{Logger: testLogger(), batch: state}
+		im.OldImageDir = filepath.Join(dir, "old")
+		im.NewImageDir = filepath.Join(dir, "new")
+		im.LayerPathsToMove = []string{"base"}
+		ids, err := im.generateDiffIds(context.Background())
+		if err != nil {
+			t.Fatalf("image %d: %v", i+1, err)
+		}
+		diffIDs = append(diffIDs, ids)
+		if i == 0 {
+			// Reading the layer again fails from here on
+			if err := os.Remove(layerPath); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !reflect.DeepEqual(diffIDs[0], diffIDs[1]) || len(diffIDs[0]) != 1 {
+		t.Errorf("got the diff_ids %v, expected the same single one twice", diffIDs)
+	}
+}
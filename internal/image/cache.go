@@ -0,0 +1,404 @@
+package image
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Kinds of layer cache entries.
+const (
+	// CacheLayer is a layer of a source image, keyed by its diff_id
+	CacheLayer = "layer"
+	// CacheMerged is the squashed layer of a sequence of layers, keyed by the chain ID
+	// of their diff_ids
+	CacheMerged = "merged"
+)
+
+var cacheDirs = map[string]string{CacheLayer: "layers", CacheMerged: "merged"}
+
+// LayerCache keeps layers and the results of merging them on disk, so squashes of
+// successive builds only process the layers that changed. Its layout is:
+//
+//	layers/<diff_id>/layer.tar    a layer tar as it was saved
+//	layers/<diff_id>/index.json   the files and whiteouts of the layer
+//	merged/<chain_id>/layer.tar   the squashed layer of a sequence of layers
+//	merged/<chain_id>/entry.json  its diff_id, the merged diff_ids and the statistics
+//
+// Entries are hard linked from the work directory when it is on the same filesystem.
+type LayerCache struct {
+	dir string
+}
+
+// CacheEntry describes an entry of the layer cache.
+type CacheEntry struct {
+	Kind string
+	// Key is the diff_id of a layer, or the chain ID of the merged layers
+	Key      string
+	Size     int64
+	LastUsed time.Time
+	// Files is the number of files of a layer, Layers the number of merged layers
+	Files  int
+	Layers int
+
+	path string
+}
+
+// layerIndex is the index.json of a cached layer.
+type layerIndex struct {
+	DiffID    string   `json:"diff_id"`
+	Size      int64    `json:"size"`
+	Files     []string `json:"files"`
+	Whiteouts []string `json:"whiteouts"`
+}
+
+// mergedEntry is the entry.json of a cached merge.
+type mergedEntry struct {
+	// Layers are the diff_ids of the merged layers, the oldest first
+	Layers []string   `json:"layers"`
+	DiffID string     `json:"diff_id"`
+	Size   int64      `json:"size"`
+	Stats  MergeStats `json:"stats"`
+}
+
+// PruneOptions selects the entries removed by LayerCache.Prune.
+type PruneOptions struct {
+	// All removes every entry
+	All bool
+	// OlderThan removes the entries not used for this long, when not zero
+	OlderThan time.Duration
+	// MaxSize removes the least recently used entries until the cache is not larger,
+	// when not zero
+	MaxSize int64
+}
+
+// DefaultCacheDir is the layer cache directory used unless --cache-dir is given.
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "squash-docker-image")
+}
+
+// OpenLayerCache opens the layer cache in dir, creating it when needed.
+func OpenLayerCache(dir string) (*LayerCache, error) {
+	for _, kindDir := range cacheDirs {
+		if err := os.MkdirAll(filepath.Join(dir, kindDir), os.ModePerm); err != nil {
+			return nil, NewIOError("failed to create layer cache", err)
+		}
+	}
+	return &LayerCache{dir: dir}, nil
+}
+
+func (c *LayerCache) entryDir(kind, key string) string {
+	return filepath.Join(c.dir, cacheDirs[kind], strings.TrimPrefix(key, "sha256:"))
+}
+
+// storeLayer adds the layer tar at path to the cache, after checking it against its
+// diff_id. A layer that is cached already is marked as used.
+func (c *LayerCache) storeLayer(diffID, path string) error {
+	if c == nil {
+		return nil
+	}
+	if dir := c.entryDir(CacheLayer, diffID); PathExists(dir) {
+		c.touch(dir)
+		return nil
+	}
+	index, err := readLayerIndex(path)
+	if err != nil {
+		return err
+	}
+	if index.DiffID != diffID {
+		return NewVerificationError(fmt.Sprintf("layer %s does not match its diff_id %s, got %s", path, diffID, index.DiffID))
+	}
+	return c.store(CacheLayer, diffID, path, "index.json", index)
+}
+
+// longestMerged finds the longest sequence of layers at the bottom of diffIDs whose
+// merge is cached. It returns the number of layers, 0 when none is cached, with the
+// entry and the path of its squashed layer.
+func (c *LayerCache) longestMerged(diffIDs []string) (int, *mergedEntry, string) {
+	if c == nil {
+		return 0, nil, ""
+	}
+	chain := chainIDs(diffIDs)
+	// A single layer needs no merging
+	for n := len(chain); n > 1; n-- {
+		dir := c.entryDir(CacheMerged, chain[n-1])
+		var entry mergedEntry
+		if err := readJsonFile(filepath.Join(dir, "entry.json"), &entry); err != nil {
+			continue
+		}
+		c.touch(dir)
+		return n, &entry, filepath.Join(dir, "layer.tar")
+	}
+	return 0, nil, ""
+}
+
+// storeMerged adds the squashed layer at path, the merge of the layers with diffIDs, to
+// the cache.
+func (c *LayerCache) storeMerged(diffIDs []string, path, diffID string, stats MergeStats) error {
+	if c == nil || len(diffIDs) < 2 {
+		return nil
+	}
+	chain := chainIDs(diffIDs)
+	if PathExists(c.entryDir(CacheMerged, chain[len(chain)-1])) {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	entry := mergedEntry{Layers: diffIDs, DiffID: diffID, Size: info.Size(), Stats: stats}
+	return c.store(CacheMerged, chain[len(chain)-1], path, "entry.json", entry)
+}
+
+// storeMergeDir adds the merge of the layers with diffIDs, still unpacked in mergeDir,
+// to the cache. createTar packs it like the squashed layer is packed.
+func (c *LayerCache) storeMergeDir(ctx context.Context, diffIDs []string, mergeDir string, createTar func(ctx context.Context, srcDir, tarFile string) error, stats MergeStats) error {
+	if c == nil || len(diffIDs) < 2 {
+		return nil
+	}
+	tmpDir, err := os.MkdirTemp(c.dir, "tmp-")
+	if err != nil {
+		return NewIOError("failed to write to layer cache", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tarPath := filepath.Join(tmpDir, "layer.tar")
+	if err := createTar(ctx, mergeDir, tarPath); err != nil {
+		return NewIOError("failed to write to layer cache", err)
+	}
+	diffID, err := fileDigest(tarPath)
+	if err != nil {
+		return err
+	}
+	return c.storeMerged(diffIDs, tarPath, diffID, stats)
+}
+
+// store moves a new entry into place, so concurrent runs never see it half written.
+func (c *LayerCache) store(kind, key, path, metadataFile string, metadata interface{}) error {
+	tmpDir, err := os.MkdirTemp(c.dir, "tmp-")
+	if err != nil {
+		return NewIOError("failed to write to layer cache", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := linkTree(path, filepath.Join(tmpDir, "layer.tar")); err != nil {
+		return NewIOError("failed to write to layer cache", err)
+	}
+	if err := writeJsonFile(filepath.Join(tmpDir, metadataFile), metadata); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpDir, c.entryDir(kind, key)); err != nil && !PathExists(c.entryDir(kind, key)) {
+		return NewIOError("failed to write to layer cache", err)
+	}
+	return nil
+}
+
+// touch marks an entry as used, Prune removes the least recently used ones first.
+func (c *LayerCache) touch(dir string) {
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+}
+
+// List returns the entries of the cache, the most recently used first.
+func (c *LayerCache) List() ([]CacheEntry, error) {
+	var entries []CacheEntry
+	for _, kind := range []string{CacheLayer, CacheMerged} {
+		kindDir := filepath.Join(c.dir, cacheDirs[kind])
+		dirs, err := os.ReadDir(kindDir)
+		if err != nil {
+			return nil, NewIOError("failed to read layer cache", err)
+		}
+		for _, dir := range dirs {
+			info, err := dir.Info()
+			if err != nil {
+				continue
+			}
+			entry := CacheEntry{
+				Kind:     kind,
+				Key:      "sha256:" + dir.Name(),
+				LastUsed: info.ModTime(),
+				path:     filepath.Join(kindDir, dir.Name()),
+			}
+			if kind == CacheLayer {
+				var index layerIndex
+				readJsonFile(filepath.Join(entry.path, "index.json"), &index)
+				entry.Size, entry.Files = index.Size, len(index.Files)
+			} else {
+				var merged mergedEntry
+				readJsonFile(filepath.Join(entry.path, "entry.json"), &merged)
+				entry.Size, entry.Layers = merged.Size, len(merged.Layers)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].LastUsed.After(entries[j].LastUsed)
+	})
+	return entries, nil
+}
+
+// Prune removes the entries selected by opts and returns them.
+func (c *LayerCache) Prune(opts PruneOptions) ([]CacheEntry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []CacheEntry
+	var size int64
+	now := time.Now()
+	for _, entry := range entries {
+		size += entry.Size
+		expired := opts.OlderThan > 0 && now.Sub(entry.LastUsed) > opts.OlderThan
+		tooLarge := opts.MaxSize > 0 && size > opts.MaxSize
+		if !opts.All && !expired && !tooLarge {
+			continue
+		}
+		if err := os.RemoveAll(entry.path); err != nil {
+			return removed, NewIOError("failed to remove cache entry", err)
+		}
+		size -= entry.Size
+		removed = append(removed, entry)
+	}
+
+	// Left behind by runs that were killed while storing an entry
+	tmpDirs, _ := filepath.Glob(filepath.Join(c.dir, "tmp-*"))
+	for _, tmpDir := range tmpDirs {
+		if info, err := os.Stat(tmpDir); err == nil && (opts.All || now.Sub(info.ModTime()) > 24*time.Hour) {
+			os.RemoveAll(tmpDir)
+		}
+	}
+	return removed, nil
+}
+
+// WriteCacheEntries prints the entries as a table.
+func WriteCacheEntries(w io.Writer, entries []CacheEntry) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "KIND\tKEY\tSIZE\tLAST USED\tCONTENT")
+	for _, entry := range entries {
+		content := fmt.Sprintf("%d files", entry.Files)
+		if entry.Kind == CacheMerged {
+			content = fmt.Sprintf("%d layers", entry.Layers)
+		}
+		key := strings.TrimPrefix(entry.Key, "sha256:")
+		if len(key) > 12 {
+			key = key[:12]
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", entry.Kind, key, formatBytes(entry.Size), entry.LastUsed.Format(time.RFC3339), content)
+	}
+	return table.Flush()
+}
+
+// ParseSize reads a size like 512M or 10GiB, units are powers of 1024.
+func ParseSize(value string) (int64, error) {
+	number := strings.TrimRight(value, "BbIiKkMmGgTt")
+	unit := strings.ToUpper(strings.TrimSuffix(strings.TrimSuffix(value[len(number):], "B"), "b"))
+	size, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", value)
+	}
+	multipliers := map[string]float64{"": 1, "K": 1 << 10, "KI": 1 << 10, "M": 1 << 20, "MI": 1 << 20, "G": 1 << 30, "GI": 1 << 30, "T": 1 << 40, "TI": 1 << 40}
+	multiplier, ok := multipliers[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size '%s', expected a unit of K, M, G or T", value)
+	}
+	return int64(size * multiplier), nil
+}
+
+// readLayerIndex lists the files of a layer tar, which may be compressed, and computes
+// its diff_id.
+func readLayerIndex(path string) (layerIndex, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return layerIndex{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return layerIndex{}, err
+	}
+
+	uncompressed, err := decompressedReader(file)
+	if err != nil {
+		return layerIndex{}, NewCorruptArchiveError(fmt.Sprintf("failed to read layer %s", path), err)
+	}
+	defer uncompressed.Close()
+
+	hasher := sha256.New()
+	reader := tar.NewReader(io.TeeReader(uncompressed, hasher))
+	index := layerIndex{Size: info.Size(), Files: []string{}, Whiteouts: []string{}}
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return layerIndex{}, NewCorruptArchiveError(fmt.Sprintf("failed to read layer %s", path), err)
+		}
+		name := strings.TrimPrefix(filepath.Clean("/"+header.Name), "/")
+		if header.Typeflag == tar.TypeDir || len(name) == 0 {
+			continue
+		}
+		if strings.HasPrefix(filepath.Base(name), ".wh.") {
+			index.Whiteouts = append(index.Whiteouts, name)
+		} else {
+			index.Files = append(index.Files, name)
+		}
+	}
+	// The padding after the last entry is part of the diff_id
+	if _, err := io.Copy(hasher, uncompressed); err != nil {
+		return layerIndex{}, err
+	}
+	index.DiffID = fmt.Sprintf("sha256:%x", hasher.Sum(nil))
+	return index, nil
+}
+
+// fileDigest is the sha256 digest of a file.
+func fileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", hasher.Sum(nil)), nil
+}
+
+// chainIDs computes the chain IDs of a sequence of diff_ids, as defined by the OCI
+// image spec.
+func chainIDs(diffIDs []string) []string {
+	chain := make([]string, len(diffIDs))
+	for i, diffID := range diffIDs {
+		if i == 0 {
+			chain[i] = diffID
+			continue
+		}
+		chain[i] = "sha256:" + sha256Hex([]byte(chain[i-1]+" "+diffID))
+	}
+	return chain
+}
+
+func readJsonFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -2,59 +2,94 @@ package image
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"net/http"
 	"os"
 	"strconv"
 	"time"
 
 	"github.com/docker/docker/client"
-	"github.com/sirupsen/logrus"
+	"github.com/docker/go-connections/tlsconfig"
 )
 
 const DefaultTimeoutSeconds = 600
 
-func NewDockerClient(logger *logrus.Logger) (*client.Client, error) {
+// Logger receives the log messages of a squash run. *logrus.Logger implements it.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// StdoutPath given as the output path streams the squashed image to stdout.
+const StdoutPath = "-"
+
+// NewDockerClient creates a client of the daemon the connection selects.
+func NewDockerClient(connection DockerConnection, logger Logger) (*client.Client, error) {
 	// Read and parse timeout from environment variable
-	timeoutSeconds := readEnvOrDefault("DOCKER_TIMEOUT", DefaultTimeoutSeconds)
+	timeoutSeconds, err := readEnvOrDefault("DOCKER_TIMEOUT", DefaultTimeoutSeconds)
+	if err != nil {
+		return nil, err
+	}
 	if timeoutSeconds <= 0 {
-		return nil, logError("Provided timeout value needs to be greater than zero.")
+		return nil, fmt.Errorf("Provided timeout value needs to be greater than zero.")
 	}
 
 	// Set Docker host from environment variable if deprecated DOCKER_CONNECTION is used
 	if dockerConnection := os.Getenv("DOCKER_CONNECTION"); dockerConnection != "" {
 		os.Setenv("DOCKER_HOST", dockerConnection)
-		logger.Println("DOCKER_CONNECTION is deprecated, please use DOCKER_HOST instead")
+		logger.Warnf("DOCKER_CONNECTION is deprecated, please use DOCKER_HOST instead")
 	}
 
-	// Create a new Docker client with auto-detected API version and timeout
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation(), client.WithTimeout(time.Duration(timeoutSeconds)*time.Second))
+	endpoint, err := connection.resolve()
 	if err != nil {
-		return nil, logError("Could not create Docker client: " + err.Error())
+		return nil, err
+	}
+	logger.Debugf("Using the Docker daemon at %s (%s)", endpoint.Host, endpoint.Source)
+	return newDockerClient(endpoint, time.Duration(timeoutSeconds)*time.Second)
+}
+
+// newDockerClient creates a client of the endpoint with auto-detected API version.
+func newDockerClient(endpoint dockerEndpoint, timeout time.Duration) (*client.Client, error) {
+	var opts []client.Opt
+	if endpoint.TLS != nil {
+		tlsConfig, err := tlsconfig.Client(*endpoint.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the TLS config of the Docker client: %w", err)
+		}
+		opts = append(opts, client.WithHTTPClient(&http.Client{
+			Transport:     &http.Transport{TLSClientConfig: tlsConfig},
+			CheckRedirect: client.CheckRedirect,
+		}))
+	}
+	opts = append(opts, client.WithHost(endpoint.Host), client.WithVersionFromEnv(),
+		client.WithAPIVersionNegotiation(), client.WithTimeout(timeout))
+
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, NewDaemonUnavailableError(fmt.Errorf("could not create Docker client: %w", err))
 	}
 
 	return cli, nil
 }
 
-func readEnvOrDefault(envKey string, defaultValue int) int {
+func readEnvOrDefault(envKey string, defaultValue int) (int, error) {
 	value, exists := os.LookupEnv(envKey)
 	if !exists {
-		return defaultValue
+		return defaultValue, nil
 	}
 	timeout, err := strconv.Atoi(value)
 	if err != nil {
-		log.Fatalf("Provided timeout value: %s cannot be parsed as integer, exiting.", value)
+		return 0, fmt.Errorf("Provided timeout value: %s cannot be parsed as integer", value)
 	}
-	return timeout
+	return timeout, nil
 }
 
-func validDockerConnection(cli *client.Client) bool {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// validDockerConnection pings the daemon.
+func validDockerConnection(ctx context.Context, cli client.APIClient) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 	_, err := cli.Ping(ctx)
-	return err == nil
-}
-
-func logError(msg string) error {
-	log.Println(msg)
-	return logError(msg)
+	return err
 }
@@ -0,0 +1,274 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects the algorithm used for layer blobs in the exported image.
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+	// CompressionEstargz writes gzip layers with a table of contents and per-file chunks,
+	// so that lazy-pulling snapshotters can start containers before the layer is fetched.
+	CompressionEstargz Compression = "estargz"
+)
+
+// ParseCompression validates the value given to --compression.
+func ParseCompression(value string) (Compression, error) {
+	switch Compression(value) {
+	case "", CompressionNone:
+		return CompressionNone, nil
+	case CompressionGzip, CompressionZstd, CompressionEstargz:
+		return Compression(value), nil
+	}
+	return "", fmt.Errorf("unsupported compression '%s', expected one of: gzip, zstd, estargz, none", value)
+}
+
+// ValidateLevel checks the compression level against the range supported by the algorithm.
+// Level 0 always means the default level of the algorithm.
+func (c Compression) ValidateLevel(level int) error {
+	switch c {
+	case CompressionGzip, CompressionEstargz:
+		if level < 0 || level > gzip.BestCompression {
+			return fmt.Errorf("gzip compression level must be between 1 and %d, provided: %d", gzip.BestCompression, level)
+		}
+	case CompressionZstd:
+		if level < 0 || level > 22 {
+			return fmt.Errorf("zstd compression level must be between 1 and 22, provided: %d", level)
+		}
+	default:
+		if level != 0 {
+			return fmt.Errorf("compression level cannot be set without a compression algorithm")
+		}
+	}
+	return nil
+}
+
+// MediaType returns the OCI media type of a layer compressed with this algorithm.
+func (c Compression) MediaType() string {
+	switch c {
+	case CompressionGzip, CompressionEstargz:
+		return MediaTypeImageLayerGzip
+	case CompressionZstd:
+		return MediaTypeImageLayerZstd
+	}
+	return MediaTypeImageLayer
+}
+
+// newWriter wraps w with a compressing writer for this algorithm.
+func (c Compression) newWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	switch c {
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZstd:
+		encoderLevel := zstd.SpeedDefault
+		if level != 0 {
+			encoderLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(encoderLevel))
+	}
+	return nopWriteCloser{w}, nil
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// decompressedReader returns the uncompressed content of a layer that may be stored
+// plain, gzip or zstd compressed.
+func decompressedReader(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, zstdMagic):
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return io.NopCloser(buffered), nil
+}
+
+// layerMediaType tells the media type of a layer blob from the magic of its
+// compression, layers are taken over from saved images as they are stored.
+func layerMediaType(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(zstdMagic))
+	n, err := io.ReadFull(file, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	switch {
+	case bytes.HasPrefix(magic[:n], gzipMagic):
+		return CompressionGzip.MediaType(), nil
+	case bytes.HasPrefix(magic[:n], zstdMagic):
+		return CompressionZstd.MediaType(), nil
+	}
+	return CompressionNone.MediaType(), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressedLayer describes a layer blob written by compressLayer.
+type compressedLayer struct {
+	LayerDetails
+	// DiffID is the digest of the uncompressed layer. It differs from the digest of the
+	// source tar only when the algorithm rewrites the tar stream, as eStargz does.
+	DiffID string
+}
+
+// compressLayer compresses the src layer tar into blobsDir, naming the blob after the
+// digest of the compressed stream.
+func compressLayer(ctx context.Context, src, blobsDir string, c Compression, level int) (compressedLayer, error) {
+	source, err := os.Open(src)
+	if err != nil {
+		return compressedLayer{}, fmt.Errorf("failed to open layer: %w", err)
+	}
+	defer source.Close()
+
+	tmpFile, err := os.CreateTemp(blobsDir, "layer-")
+	if err != nil {
+		return compressedLayer{}, NewIOError("failed to create layer blob", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	hasher := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(tmpFile, hasher)}
+
+	var layer compressedLayer
+	if c == CompressionEstargz {
+		layer, err = writeEstargz(source, counter, level)
+	} else {
+		layer, err = writeCompressed(contextReader{ctx: ctx, r: source}, counter, c, level)
+	}
+	if err != nil {
+		return compressedLayer{}, fmt.Errorf("failed to compress layer '%s': %w", src, err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return compressedLayer{}, err
+	}
+
+	digest := fmt.Sprintf("%x", hasher.Sum(nil))
+	if err := os.Rename(tmpFile.Name(), filepath.Join(blobsDir, digest)); err != nil {
+		return compressedLayer{}, err
+	}
+
+	layer.MediaType = c.MediaType()
+	layer.Size = counter.n
+	layer.Digest = "sha256:" + digest
+	return layer, nil
+}
+
+// writeCompressed streams source through the compressor into w, hashing the
+// uncompressed data on the way.
+func writeCompressed(source io.Reader, w io.Writer, c Compression, level int) (compressedLayer, error) {
+	writer, err := c.newWriter(w, level)
+	if err != nil {
+		return compressedLayer{}, err
+	}
+	// Layers taken over from a compressed source are recompressed with c
+	uncompressed, err := decompressedReader(source)
+	if err != nil {
+		return compressedLayer{}, err
+	}
+	defer uncompressed.Close()
+
+	diffID := sha256.New()
+	if _, err := io.Copy(writer, io.TeeReader(uncompressed, diffID)); err != nil {
+		writer.Close()
+		return compressedLayer{}, err
+	}
+	if err := writer.Close(); err != nil {
+		return compressedLayer{}, err
+	}
+	return compressedLayer{DiffID: fmt.Sprintf("sha256:%x", diffID.Sum(nil))}, nil
+}
+
+// compressLayers compresses all given layer tars into blobsDir in parallel. The returned
+// descriptors are in the same order as the layers. done is called, one at a time, with
+// every compressed layer and the size of its tar.
+func compressLayers(ctx context.Context, layers []string, blobsDir string, c Compression, level int, done func(i int, layer compressedLayer, size int64)) ([]compressedLayer, error) {
+	descriptors := make([]compressedLayer, len(layers))
+	errs := make([]error, len(layers))
+	var doneMutex sync.Mutex
+
+	sem := make(chan struct{}, runtime.NumCPU())
+	var wg sync.WaitGroup
+	for i, layer := range layers {
+		wg.Add(1)
+		go func(i int, layer string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if errs[i] = ctx.Err(); errs[i] != nil {
+				return
+			}
+			descriptors[i], errs[i] = compressLayer(ctx, layer, blobsDir, c, level)
+			if errs[i] == nil && done != nil {
+				var size int64
+				if info, err := os.Stat(layer); err == nil {
+					size = info.Size()
+				}
+				doneMutex.Lock()
+				done(i, descriptors[i], size)
+				doneMutex.Unlock()
+			}
+		}(i, layer)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return descriptors, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
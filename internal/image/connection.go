@@ -0,0 +1,222 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+)
+
+// DockerConnection selects the Docker daemon, or the Docker compatible API of podman, to
+// talk to. Empty fields fall back to the environment, the current docker context and the
+// sockets found on the host, in the order the docker CLI uses.
+type DockerConnection struct {
+	// Host is the address of the daemon, like unix:///var/run/docker.sock or tcp://host:2376
+	Host string
+	// Context is the name of a context created with docker context create
+	Context string
+
+	// TLS connects with TLS, TLSVerify verifies the certificate of the daemon as well. The
+	// certificates default to ca.pem, cert.pem and key.pem in DOCKER_CERT_PATH or ~/.docker.
+	TLS       bool
+	TLSVerify bool
+	TLSCACert string
+	TLSCert   string
+	TLSKey    string
+}
+
+// dockerEndpoint is the daemon a DockerConnection resolved to.
+type dockerEndpoint struct {
+	Host string
+	// Source tells how the host was chosen, like --host or the podman socket
+	Source string
+	// TLS is nil for connections without TLS
+	TLS *tlsconfig.Options
+}
+
+// dockerContextMeta is the part of the metadata of a docker context that describes its
+// daemon.
+type dockerContextMeta struct {
+	Name      string `json:"Name"`
+	Endpoints map[string]struct {
+		Host          string `json:"Host"`
+		SkipTLSVerify bool   `json:"SkipTLSVerify"`
+	} `json:"Endpoints"`
+}
+
+// resolve picks the daemon: --host, --context, DOCKER_HOST, DOCKER_CONTEXT, the current
+// context of the docker config, then the first socket of the host that exists.
+func (c DockerConnection) resolve() (dockerEndpoint, error) {
+	endpoint, err := c.selectHost()
+	if err != nil {
+		return dockerEndpoint{}, err
+	}
+	if strings.HasPrefix(endpoint.Host, "ssh://") {
+		return dockerEndpoint{}, fmt.Errorf("ssh hosts like %s are not supported, forward the socket with ssh -L and use its local address", endpoint.Host)
+	}
+	if endpoint.TLS == nil {
+		endpoint.TLS = c.tlsOptions()
+	}
+	return endpoint, nil
+}
+
+func (c DockerConnection) selectHost() (dockerEndpoint, error) {
+	if len(c.Host) != 0 {
+		return dockerEndpoint{Host: c.Host, Source: "--host"}, nil
+	}
+	if len(c.Context) != 0 && c.Context != "default" {
+		return c.contextEndpoint(c.Context)
+	}
+	if host := os.Getenv(client.EnvOverrideHost); len(host) != 0 {
+		return dockerEndpoint{Host: host, Source: client.EnvOverrideHost}, nil
+	}
+	// The default context is the environment and the default socket
+	if len(c.Context) == 0 {
+		name := os.Getenv("DOCKER_CONTEXT")
+		if len(name) == 0 {
+			name = currentDockerContext()
+		}
+		if len(name) != 0 && name != "default" {
+			return c.contextEndpoint(name)
+		}
+	}
+
+	for _, socket := range defaultSockets() {
+		if info, err := os.Stat(socket.path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			return dockerEndpoint{Host: "unix://" + socket.path, Source: socket.name}, nil
+		}
+	}
+	return dockerEndpoint{Host: client.DefaultDockerHost, Source: "default"}, nil
+}
+
+// contextEndpoint reads the daemon of a docker context and its TLS material from the
+// context store of the docker config directory.
+func (c DockerConnection) contextEndpoint(name string) (dockerEndpoint, error) {
+	id := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))
+	contexts := filepath.Join(dockerConfigDir(), "contexts")
+
+	var meta dockerContextMeta
+	data, err := ioutil.ReadFile(filepath.Join(contexts, "meta", id, "meta.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return dockerEndpoint{}, fmt.Errorf("docker context '%s' does not exist", name)
+		}
+		return dockerEndpoint{}, fmt.Errorf("failed to read docker context '%s': %w", name, err)
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return dockerEndpoint{}, fmt.Errorf("failed to parse docker context '%s': %w", name, err)
+	}
+	docker, ok := meta.Endpoints["docker"]
+	if !ok || len(docker.Host) == 0 {
+		return dockerEndpoint{}, fmt.Errorf("docker context '%s' has no docker endpoint", name)
+	}
+	endpoint := dockerEndpoint{Host: docker.Host, Source: fmt.Sprintf("context %s", name)}
+
+	// TLS flags take precedence over the certificates stored with the context
+	tlsDir := filepath.Join(contexts, "tls", id, "docker")
+	if !c.tlsFlags() && PathExists(tlsDir) {
+		endpoint.TLS = &tlsconfig.Options{
+			CAFile:             existingFile(filepath.Join(tlsDir, "ca.pem")),
+			CertFile:           existingFile(filepath.Join(tlsDir, "cert.pem")),
+			KeyFile:            existingFile(filepath.Join(tlsDir, "key.pem")),
+			InsecureSkipVerify: docker.SkipTLSVerify,
+			ExclusiveRootPools: true,
+		}
+	}
+	return endpoint, nil
+}
+
+// tlsFlags tells whether the flags turn TLS on, the certificate flags alone do not.
+func (c DockerConnection) tlsFlags() bool {
+	return c.TLS || c.TLSVerify
+}
+
+// tlsOptions returns the TLS settings of the flags, or of DOCKER_TLS_VERIFY, nil when TLS
+// is not used. Like for the docker CLI, only --tls, --tlsverify and DOCKER_TLS_VERIFY turn
+// TLS on, DOCKER_CERT_PATH only tells where the certificates are.
+func (c DockerConnection) tlsOptions() *tlsconfig.Options {
+	verify := c.TLSVerify || len(os.Getenv(client.EnvTLSVerify)) != 0
+	if !c.tlsFlags() && !verify {
+		return nil
+	}
+	certPath := os.Getenv(client.EnvOverrideCertPath)
+	if len(certPath) == 0 {
+		certPath = dockerConfigDir()
+	}
+	options := &tlsconfig.Options{
+		CAFile:             c.TLSCACert,
+		CertFile:           c.TLSCert,
+		KeyFile:            c.TLSKey,
+		InsecureSkipVerify: !verify,
+		ExclusiveRootPools: true,
+	}
+	if len(options.CAFile) == 0 {
+		options.CAFile = existingFile(filepath.Join(certPath, "ca.pem"))
+	}
+	if len(options.CertFile) == 0 && len(options.KeyFile) == 0 {
+		options.CertFile = existingFile(filepath.Join(certPath, "cert.pem"))
+		options.KeyFile = existingFile(filepath.Join(certPath, "key.pem"))
+	}
+	return options
+}
+
+// existingFile returns path when the file exists, otherwise an empty path.
+func existingFile(path string) string {
+	if PathExists(path) {
+		return path
+	}
+	return ""
+}
+
+// currentDockerContext returns the context docker context use selected, empty when it
+// cannot be read.
+func currentDockerContext() string {
+	data, err := ioutil.ReadFile(filepath.Join(dockerConfigDir(), "config.json"))
+	if err != nil {
+		return ""
+	}
+	var config struct {
+		CurrentContext string `json:"currentContext"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return ""
+	}
+	return config.CurrentContext
+}
+
+// defaultSocket is a socket a Docker compatible API is usually found at.
+type defaultSocket struct {
+	name string
+	path string
+}
+
+// defaultSockets lists the sockets tried when no host is configured: the Docker daemon,
+// rootless Docker, rootless podman and podman running as root.
+func defaultSockets() []defaultSocket {
+	sockets := []defaultSocket{{name: "Docker socket", path: "/var/run/docker.sock"}}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); len(runtimeDir) != 0 {
+		sockets = append(sockets,
+			defaultSocket{name: "rootless Docker socket", path: filepath.Join(runtimeDir, "docker.sock")},
+			defaultSocket{name: "rootless podman socket", path: filepath.Join(runtimeDir, "podman", "podman.sock")})
+	}
+	return append(sockets, defaultSocket{name: "podman socket", path: "/run/podman/podman.sock"})
+}
+
+// dockerConfigDir is the directory of the docker config file, DOCKER_CONFIG or
+// ~/.docker.
+func dockerConfigDir() string {
+	if configDir := os.Getenv("DOCKER_CONFIG"); len(configDir) != 0 {
+		return configDir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".docker"
+	}
+	return filepath.Join(home, ".docker")
+}
@@ -0,0 +1,352 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/archive"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/platforms"
+	"github.com/distribution/reference"
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Defaults of the containerd client, overridden by CONTAINERD_ADDRESS and
+// CONTAINERD_NAMESPACE like for ctr.
+const (
+	DefaultContainerdAddress   = "/run/containerd/containerd.sock"
+	DefaultContainerdNamespace = "default"
+)
+
+// containerdStore talks to containerd through its socket with the containerd client.
+// Images are looked up in the images service and their manifests and configs read from
+// the content store of the namespace, images are exported and imported as archives.
+type containerdStore struct {
+	address   string
+	namespace string
+	logger    Logger
+
+	mu     sync.Mutex
+	client *containerd.Client
+	// Images resolved by ImageID, by the digest of their config
+	images map[string]containerdImage
+}
+
+// containerdImage is an image of the containerd store, down to the manifest of the
+// platform that is squashed.
+type containerdImage struct {
+	name     string
+	manifest OCIManifest
+	config   ImageConfig
+}
+
+// NewContainerdStore returns the image store of containerd listening on address, in the
+// namespace. Empty values are taken from the environment or the containerd defaults.
+func NewContainerdStore(address, namespace string, logger Logger) ImageStore {
+	if len(address) == 0 {
+		address = os.Getenv("CONTAINERD_ADDRESS")
+	}
+	if len(address) == 0 {
+		address = DefaultContainerdAddress
+	}
+	if len(namespace) == 0 {
+		namespace = os.Getenv("CONTAINERD_NAMESPACE")
+	}
+	if len(namespace) == 0 {
+		namespace = DefaultContainerdNamespace
+	}
+	return &containerdStore{
+		address:   address,
+		namespace: namespace,
+		logger:    logger,
+		images:    make(map[string]containerdImage),
+	}
+}
+
+// connect returns the client of the store, connected on first use. The context is
+// scoped to the namespace of the store.
+func (s *containerdStore) connect(ctx context.Context) (*containerd.Client, context.Context, error) {
+	ctx = namespaces.WithNamespace(ctx, s.namespace)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		client, err := containerd.New(s.address, containerd.WithDefaultNamespace(s.namespace))
+		if err != nil {
+			return nil, ctx, newStoreUnavailableError(fmt.Sprintf("containerd at %s", s.address), err)
+		}
+		s.client = client
+	}
+	return s.client, ctx, nil
+}
+
+// Close closes the client, the store connects again when it is used afterwards.
+func (s *containerdStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	err := s.client.Close()
+	s.client = nil
+	return err
+}
+
+func (s *containerdStore) Version(ctx context.Context) (StoreVersion, error) {
+	client, ctx, err := s.connect(ctx)
+	if err != nil {
+		return StoreVersion{}, err
+	}
+	version, err := client.Version(ctx)
+	if err != nil {
+		return StoreVersion{}, s.clientError(ctx, err)
+	}
+	return StoreVersion{Name: "containerd", Version: version.Version}, nil
+}
+
+// ImageID resolves the image in the namespace down to the manifest of the platform of
+// this host and returns the digest of its config. The layers of the images looked up
+// have no image of their own, their digests and diff_ids resolve to the layer digest
+// History gives them, as --from-layer takes them.
+func (s *containerdStore) ImageID(ctx context.Context, ref string) (string, error) {
+	s.mu.Lock()
+	if _, ok := s.images[ref]; ok {
+		s.mu.Unlock()
+		return ref, nil
+	}
+	if layer, ok := s.layer(ref); ok {
+		s.mu.Unlock()
+		return layer, nil
+	}
+	s.mu.Unlock()
+
+	client, ctx, err := s.connect(ctx)
+	if err != nil {
+		return "", err
+	}
+	img, err := s.findImage(ctx, client.ImageService(), ref)
+	if err != nil {
+		return "", err
+	}
+	store := client.ContentStore()
+	manifest, err := s.platformManifest(ctx, store, img.Target)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the manifest of %s: %w", img.Name, err)
+	}
+	var config ImageConfig
+	if err := s.readBlob(ctx, store, manifest.Config, &config); err != nil {
+		return "", fmt.Errorf("failed to read the config of %s: %w", img.Name, err)
+	}
+
+	s.mu.Lock()
+	s.images[manifest.Config.Digest] = containerdImage{name: img.Name, manifest: manifest, config: config}
+	s.mu.Unlock()
+	return manifest.Config.Digest, nil
+}
+
+// findImage returns the image named ref in the images service, given as it is stored or
+// in the short form docker uses, like nginx for docker.io/library/nginx:latest.
+func (s *containerdStore) findImage(ctx context.Context, store images.Store, ref string) (images.Image, error) {
+	names := []string{ref}
+	if named, err := reference.ParseDockerRef(ref); err == nil && named.String() != ref {
+		names = append(names, named.String())
+	}
+
+	for _, name := range names {
+		img, err := store.Get(ctx, name)
+		if err == nil {
+			return img, nil
+		}
+		if !errdefs.IsNotFound(err) {
+			return images.Image{}, s.clientError(ctx, err)
+		}
+	}
+	return images.Image{}, fmt.Errorf("image '%s' not found in containerd namespace %s", ref, s.namespace)
+}
+
+// platformManifest reads the manifest of the descriptor, following image indexes to the
+// manifest of the platform of this host.
+func (s *containerdStore) platformManifest(ctx context.Context, store content.Provider, descriptor ocispec.Descriptor) (OCIManifest, error) {
+	host := []OCIPlatform{{OS: runtime.GOOS, Architecture: runtime.GOARCH}}
+	for {
+		var content struct {
+			OCIManifest
+			Manifests []OCIDescriptor `json:"manifests"`
+		}
+		if err := s.readBlob(ctx, store, ociDescriptor(descriptor), &content); err != nil {
+			return OCIManifest{}, err
+		}
+		if content.MediaType != MediaTypeImageIndex && content.MediaType != MediaTypeDockerManifestList && len(content.Manifests) == 0 {
+			return content.OCIManifest, nil
+		}
+
+		found := false
+		for _, manifest := range content.Manifests {
+			if manifest.Platform != nil && matchPlatform(*manifest.Platform, host) {
+				descriptor = ocispec.Descriptor{MediaType: manifest.MediaType, Digest: godigest.Digest(manifest.Digest), Size: manifest.Size}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return OCIManifest{}, fmt.Errorf("the image has no manifest for %s", host[0])
+		}
+	}
+}
+
+// ociDescriptor converts a descriptor of the containerd client.
+func ociDescriptor(descriptor ocispec.Descriptor) OCIDescriptor {
+	return OCIDescriptor{MediaType: descriptor.MediaType, Digest: descriptor.Digest.String(), Size: descriptor.Size}
+}
+
+// readBlob reads a JSON blob from the content store.
+func (s *containerdStore) readBlob(ctx context.Context, store content.Provider, descriptor OCIDescriptor, v interface{}) error {
+	if err := checkDigest(descriptor.Digest); err != nil {
+		return err
+	}
+	data, err := content.ReadBlob(ctx, store, ocispec.Descriptor{MediaType: descriptor.MediaType, Digest: godigest.Digest(descriptor.Digest), Size: descriptor.Size})
+	if err != nil {
+		return s.clientError(ctx, fmt.Errorf("failed to read blob %s: %w", descriptor.Digest, err))
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return NewCorruptArchiveError(fmt.Sprintf("failed to unmarshal blob %s", descriptor.Digest), err)
+	}
+	return nil
+}
+
+// History returns the history of the image config, like docker history. The items of
+// layers are identified by the layer digest, like the history of images read from an OCI
+// layout, the ones of empty layers are <missing>.
+func (s *containerdStore) History(ctx context.Context, imageID string) ([]HistoryEntry, error) {
+	img, err := s.image(imageID)
+	if err != nil {
+		return nil, err
+	}
+
+	history := img.config.History
+	nonEmpty := 0
+	for _, item := range history {
+		if !item.EmptyLayer {
+			nonEmpty++
+		}
+	}
+	// Images built without history get one history item per layer
+	if nonEmpty != len(img.manifest.Layers) {
+		history = make([]HistoryItem, len(img.manifest.Layers))
+	}
+
+	entries := make([]HistoryEntry, len(history))
+	layer := 0
+	for i, item := range history {
+		entry := HistoryEntry{ID: "<missing>"}
+		if !item.EmptyLayer {
+			entry.ID = img.manifest.Layers[layer].Digest
+			entry.Size = img.manifest.Layers[layer].Size
+			layer++
+		}
+		entries[len(history)-1-i] = entry
+	}
+	return entries, nil
+}
+
+// layer finds the layer with the digest or diff_id among the images looked up and
+// returns its digest. s.mu is held.
+func (s *containerdStore) layer(ref string) (string, bool) {
+	if !strings.HasPrefix(ref, "sha256:") {
+		ref = "sha256:" + ref
+	}
+	for _, img := range s.images {
+		for i, layer := range img.manifest.Layers {
+			if layer.Digest == ref || (i < len(img.config.Rootfs.DiffIds) && img.config.Rootfs.DiffIds[i] == ref) {
+				return layer.Digest, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (s *containerdStore) image(imageID string) (containerdImage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	img, ok := s.images[imageID]
+	if !ok {
+		return containerdImage{}, fmt.Errorf("image %s was not looked up in containerd", imageID)
+	}
+	return img, nil
+}
+
+// Save exports the images from the content store, as an OCI image layout with a
+// manifest.json. Only the platforms that are squashed are exported.
+func (s *containerdStore) Save(ctx context.Context, imageIDs []string) (io.ReadCloser, error) {
+	client, ctx, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []archive.ExportOpt
+	var specs []ocispec.Platform
+	for _, imageID := range imageIDs {
+		img, err := s.image(imageID)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, archive.WithImage(client.ImageService(), img.name))
+		specs = append(specs, ocispec.Platform{OS: img.config.OS, Architecture: img.config.Architecture, Variant: img.config.Variant})
+	}
+	opts = append(opts, archive.WithPlatform(platforms.Any(specs...)))
+
+	reader, writer := io.Pipe()
+	go func() {
+		err := archive.Export(ctx, client.ContentStore(), writer, opts...)
+		if err != nil {
+			err = s.clientError(ctx, fmt.Errorf("failed to export the images: %w", err))
+		}
+		writer.CloseWithError(err)
+	}()
+	return reader, nil
+}
+
+// Load imports the archive into the images service. The layers of the platform of this
+// host are unpacked for the snapshotter, like for pulled images.
+func (s *containerdStore) Load(ctx context.Context, archive io.Reader) error {
+	client, ctx, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	imported, err := client.Import(ctx, archive, containerd.WithAllPlatforms(true))
+	if err != nil {
+		return s.clientError(ctx, fmt.Errorf("failed to import the images: %w", err))
+	}
+	for _, img := range imported {
+		s.logger.Debugf("Imported %s", img.Name)
+		err := containerd.NewImageWithPlatform(client, img, platforms.Default()).Unpack(ctx, "")
+		if errdefs.IsNotFound(err) {
+			s.logger.Debugf("%s has no layers for this host to unpack", img.Name)
+		} else if err != nil {
+			return s.clientError(ctx, fmt.Errorf("failed to unpack %s: %w", img.Name, err))
+		}
+	}
+	return nil
+}
+
+// clientError describes a failed call of the containerd client, failures to reach
+// containerd are DaemonUnavailableErrors.
+func (s *containerdStore) clientError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if errdefs.IsUnavailable(err) {
+		return newStoreUnavailableError(fmt.Sprintf("containerd at %s", s.address), err)
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+package image
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestContainerdFromLayer squashes from a layer given by digest and by diff_id. The
+// history of containerd has no images below the top one, its items are the layers.
+func TestContainerdFromLayer(t *testing.T) {
+	digest := func(c string) string { return "sha256:" + strings.Repeat(c, 64) }
+	store := NewContainerdStore("/nonexistent/containerd.sock", "test", testLogger()).(*containerdStore)
+	imageID := digest("c")
+	store.images[imageID] = containerdImage{
+		name: "docker.io/library/app:build",
+		manifest: OCIManifest{Layers: []OCIDescriptor{
+			{Digest: digest("1"), Size: 100},
+			{Digest: digest("2"), Size: 200},
+			{Digest: digest("3"), Size: 300},
+		}},
+		config: ImageConfig{
+			Rootfs: Rootfs{Type: "layers", DiffIds: []string{digest("a"), digest("b"), digest("d")}},
+			History: []HistoryItem{
+				{CreatedBy: "ADD rootfs"},
+				{CreatedBy: "ENV PATH=/app", EmptyLayer: true},
+				{CreatedBy: "COPY app"},
+				{CreatedBy: "RUN build"},
+			},
+		},
+	}
+
+	history, err := store.History(context.Background(), imageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []HistoryEntry{
+		{ID: digest("3"), Size: 300},
+		{ID: digest("2"), Size: 200},
+		{ID: "<missing>"},
+		{ID: digest("1"), Size: 100},
+	}
+	if !reflect.DeepEqual(history, expected) {
+		t.Errorf("got the history %v, expected %v", history, expected)
+	}
+
+	for _, fromLayer := range []string{digest("1"), strings.Repeat("1", 64), digest("a")} {
+		im := &V2Image{Logger: testLogger()}
+		im.Store = store
+		im.Image = "app:build"
+		im.FromLayer = fromLayer
+		if err := im.readLayers(context.Background(), imageID); err != nil {
+			t.Fatal(err)
+		}
+		ReverseList(im.OldImageLayers)
+		if err := im.splitLayers(context.Background()); err != nil {
+			t.Fatalf("--from-layer %s: %v", fromLayer, err)
+		}
+		if !reflect.DeepEqual(im.LayersToMove, []string{digest("1")}) {
+			t.Errorf("--from-layer %s moves %v, expected the first layer", fromLayer, im.LayersToMove)
+		}
+	}
+}
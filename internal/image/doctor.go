@@ -0,0 +1,152 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// DoctorReport describes the daemon a squash talks to.
+type DoctorReport struct {
+	Host string
+	// Source tells how the host was chosen, like --host or the podman socket
+	Source string
+	TLS    bool
+	// Namespace is the containerd namespace of the images, empty for the Docker API
+	Namespace string
+
+	// Engine is the Docker, podman or containerd engine with its version, set once the
+	// daemon answered
+	Engine        string
+	APIVersion    string
+	OSArch        string
+	StorageDriver string
+	// Unsupported is set for daemons older than MinDockerAPIVersion
+	Unsupported bool
+}
+
+// DoctorStore checks the image store of cli.Backend like Doctor does for the Docker
+// daemon. For containerd the version is reported, it has no API version or storage
+// driver.
+func DoctorStore(ctx context.Context, cli CLI, logger Logger) (DoctorReport, error) {
+	switch cli.Backend {
+	case "", BackendDocker:
+		return Doctor(ctx, cli.Docker, logger)
+	case BackendContainerd:
+		return doctorContainerd(ctx, cli.ContainerdAddress, cli.ContainerdNamespace, logger)
+	}
+	return DoctorReport{}, fmt.Errorf("unknown backend '%s', expected %s or %s", cli.Backend, BackendDocker, BackendContainerd)
+}
+
+func doctorContainerd(ctx context.Context, address, namespace string, logger Logger) (DoctorReport, error) {
+	source := "--containerd-address"
+	switch {
+	case len(address) != 0:
+	case len(os.Getenv("CONTAINERD_ADDRESS")) != 0:
+		source = "CONTAINERD_ADDRESS"
+	default:
+		source = "default"
+	}
+	store := NewContainerdStore(address, namespace, logger).(*containerdStore)
+	defer store.Close()
+	report := DoctorReport{Host: "unix://" + store.address, Source: source, Namespace: store.namespace}
+
+	version, err := store.Version(ctx)
+	if err != nil {
+		return report, err
+	}
+	report.Engine = version.String()
+	logger.Debugf("containerd %s answered: %+v", store.address, report)
+	return report, nil
+}
+
+// Doctor pings the daemon the connection selects and reports its version and storage
+// driver. The report tells which daemon was tried when it cannot be reached.
+func Doctor(ctx context.Context, connection DockerConnection, logger Logger) (DoctorReport, error) {
+	timeoutSeconds, err := readEnvOrDefault("DOCKER_TIMEOUT", DefaultTimeoutSeconds)
+	if err != nil {
+		return DoctorReport{}, err
+	}
+	endpoint, err := connection.resolve()
+	if err != nil {
+		return DoctorReport{}, err
+	}
+	report := DoctorReport{Host: endpoint.Host, Source: endpoint.Source, TLS: endpoint.TLS != nil}
+
+	cli, err := newDockerClient(endpoint, time.Duration(timeoutSeconds)*time.Second)
+	if err != nil {
+		return report, err
+	}
+	defer cli.Close()
+	if err := validDockerConnection(ctx, cli); err != nil {
+		return report, NewDaemonUnavailableError(err)
+	}
+
+	version, err := negotiateServerVersion(ctx, cli, logger)
+	if err != nil {
+		return report, err
+	}
+	name, engineVersion := engineName(version)
+	report.Engine = fmt.Sprintf("%s %s", name, engineVersion)
+	report.APIVersion = version.APIVersion
+	report.OSArch = fmt.Sprintf("%s/%s", version.Os, version.Arch)
+	unsupported := checkDockerAPIVersion(StoreVersion{Name: name, Version: engineVersion, APIVersion: version.APIVersion})
+	report.Unsupported = unsupported != nil
+
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return report, daemonError(err)
+	}
+	report.StorageDriver = info.Driver
+	logger.Debugf("Docker daemon %s answered: %+v", endpoint.Host, report)
+	return report, unsupported
+}
+
+// engineName returns the name and version of the engine behind the Docker API, podman
+// serves it as well.
+func engineName(version types.Version) (string, string) {
+	for _, component := range version.Components {
+		if strings.Contains(component.Name, "Podman") {
+			return "Podman", component.Version
+		}
+	}
+	return "Docker", version.Version
+}
+
+// WriteDoctorReport writes the report as a table, leaving out what is not known.
+func WriteDoctorReport(w io.Writer, report DoctorReport) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "Host:\t%s (%s)\n", report.Host, report.Source)
+	if len(report.Namespace) != 0 {
+		fmt.Fprintf(table, "Namespace:\t%s\n", report.Namespace)
+	} else {
+		tls := "no"
+		if report.TLS {
+			tls = "yes"
+		}
+		fmt.Fprintf(table, "TLS:\t%s\n", tls)
+	}
+	if len(report.Engine) == 0 {
+		fmt.Fprintln(table, "Status:\tnot reachable")
+		return table.Flush()
+	}
+	if report.Unsupported {
+		fmt.Fprintln(table, "Status:\tunsupported, Docker API "+MinDockerAPIVersion+" or newer is required")
+	} else {
+		fmt.Fprintln(table, "Status:\tok")
+	}
+	fmt.Fprintf(table, "Engine:\t%s\n", report.Engine)
+	if len(report.Namespace) != 0 {
+		return table.Flush()
+	}
+	fmt.Fprintf(table, "API version:\t%s\n", report.APIVersion)
+	fmt.Fprintf(table, "OS/Arch:\t%s\n", report.OSArch)
+	fmt.Fprintf(table, "Storage driver:\t%s\n", report.StorageDriver)
+	return table.Flush()
+}
@@ -0,0 +1,44 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestWriteDoctorReport(t *testing.T) {
+	tests := []struct {
+		report DoctorReport
+		output string
+	}{
+		{
+			report: DoctorReport{Host: "unix:///var/run/docker.sock", Source: "default", Engine: "Docker 25.0.3", APIVersion: "1.44", OSArch: "linux/amd64", StorageDriver: "overlay2"},
+			output: "Host:            unix:///var/run/docker.sock (default)\nTLS:             no\nStatus:          ok\nEngine:          Docker 25.0.3\nAPI version:     1.44\nOS/Arch:         linux/amd64\nStorage driver:  overlay2\n",
+		},
+		{
+			report: DoctorReport{Host: "unix:///run/containerd/containerd.sock", Source: "default", Namespace: "k8s.io", Engine: "containerd v1.7.13"},
+			output: "Host:       unix:///run/containerd/containerd.sock (default)\nNamespace:  k8s.io\nStatus:     ok\nEngine:     containerd v1.7.13\n",
+		},
+		{
+			report: DoctorReport{Host: "unix:///run/containerd/containerd.sock", Source: "CONTAINERD_ADDRESS", Namespace: "default"},
+			output: "Host:       unix:///run/containerd/containerd.sock (CONTAINERD_ADDRESS)\nNamespace:  default\nStatus:     not reachable\n",
+		},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		if err := WriteDoctorReport(&out, test.report); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.output {
+			t.Errorf("got\n%s\nexpected\n%s", out.String(), test.output)
+		}
+	}
+}
+
+func TestDoctorStoreUnknownBackend(t *testing.T) {
+	_, err := DoctorStore(context.Background(), CLI{Backend: "podman"}, testLogger())
+	if err == nil || !strings.Contains(err.Error(), "unknown backend 'podman'") {
+		t.Errorf("got error %v, expected the backend to be unknown", err)
+	}
+}
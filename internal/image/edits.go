@@ -0,0 +1,216 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var errVerifyUnsupported = errors.New("--verify is only supported for a single image from the image store")
+
+// ConfigEdits change the runtime config of the squashed image. Fields left empty keep
+// the value of the source image, an empty Entrypoint or Cmd list clears it.
+type ConfigEdits struct {
+	// Env sets environment variables, UnsetEnv removes them
+	Env      map[string]string `yaml:"env" json:"env,omitempty"`
+	UnsetEnv []string          `yaml:"unset-env" json:"unset_env,omitempty"`
+	// Labels sets labels, RemoveLabels removes them
+	Labels       map[string]string `yaml:"labels" json:"labels,omitempty"`
+	RemoveLabels []string          `yaml:"remove-labels" json:"remove_labels,omitempty"`
+	Entrypoint   []string          `yaml:"entrypoint" json:"entrypoint,omitempty"`
+	Cmd          []string          `yaml:"cmd" json:"cmd,omitempty"`
+	WorkingDir   string            `yaml:"workdir" json:"workdir,omitempty"`
+	User         string            `yaml:"user" json:"user,omitempty"`
+	// Expose adds exposed ports as PORT[/PROTOCOL], tcp by default
+	Expose []string `yaml:"expose" json:"expose,omitempty"`
+}
+
+// Validate checks the edits before anything is squashed.
+func (e ConfigEdits) Validate() error {
+	for name := range e.Env {
+		if len(name) == 0 || strings.Contains(name, "=") {
+			return fmt.Errorf("invalid environment variable name '%s'", name)
+		}
+	}
+	for _, port := range e.Expose {
+		if _, err := exposedPort(port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply changes c. Maps and lists of c are copied, not modified.
+func (e ConfigEdits) Apply(c *ConfigDetails) {
+	if len(e.Env) != 0 || len(e.UnsetEnv) != 0 {
+		unset := make(map[string]bool)
+		for _, name := range e.UnsetEnv {
+			unset[name] = true
+		}
+		set := make(map[string]bool)
+		var env []string
+		for _, variable := range c.Env {
+			name, _, _ := strings.Cut(variable, "=")
+			if value, ok := e.Env[name]; ok {
+				env = append(env, name+"="+value)
+				set[name] = true
+			} else if !unset[name] {
+				env = append(env, variable)
+			}
+		}
+		// Variables the image did not have are added sorted, so the config is stable
+		var added []string
+		for name := range e.Env {
+			if !set[name] {
+				added = append(added, name)
+			}
+		}
+		sort.Strings(added)
+		for _, name := range added {
+			env = append(env, name+"="+e.Env[name])
+		}
+		c.Env = env
+	}
+
+	if len(e.Labels) != 0 || len(e.RemoveLabels) != 0 {
+		labels := make(map[string]string)
+		for key, value := range c.Labels {
+			labels[key] = value
+		}
+		for _, key := range e.RemoveLabels {
+			delete(labels, key)
+		}
+		for key, value := range e.Labels {
+			labels[key] = value
+		}
+		c.Labels = labels
+	}
+
+	if e.Entrypoint != nil {
+		c.Entrypoint = nil
+		if len(e.Entrypoint) != 0 {
+			c.Entrypoint = append([]string(nil), e.Entrypoint...)
+		}
+	}
+	if e.Cmd != nil {
+		c.Cmd = nil
+		if len(e.Cmd) != 0 {
+			c.Cmd = append([]string(nil), e.Cmd...)
+		}
+	}
+	if len(e.WorkingDir) != 0 {
+		c.WorkingDir = e.WorkingDir
+	}
+	if len(e.User) != 0 {
+		c.User = e.User
+	}
+
+	if len(e.Expose) != 0 {
+		ports := make(map[string]map[string]struct{})
+		for port, value := range c.ExposedPorts {
+			ports[port] = value
+		}
+		for _, value := range e.Expose {
+			port, _ := exposedPort(value)
+			ports[port] = map[string]struct{}{}
+		}
+		c.ExposedPorts = ports
+	}
+}
+
+// exposedPort normalizes PORT[/PROTOCOL] to the key of ExposedPorts.
+func exposedPort(value string) (string, error) {
+	port, protocol, found := strings.Cut(value, "/")
+	if !found {
+		protocol = "tcp"
+	}
+	var number int
+	if _, err := fmt.Sscanf(port, "%d", &number); err != nil || fmt.Sprint(number) != port || number < 1 || number > 65535 {
+		return "", fmt.Errorf("invalid port '%s', expected PORT[/PROTOCOL]", value)
+	}
+	switch protocol {
+	case "tcp", "udp", "sctp":
+		return port + "/" + protocol, nil
+	}
+	return "", fmt.Errorf("invalid protocol of port '%s', expected tcp, udp or sctp", value)
+}
+
+// ValidateExcludes checks the patterns of paths to exclude from the squashed layer.
+func ValidateExcludes(patterns []string) error {
+	for _, pattern := range patterns {
+		if len(excludePattern(pattern)) == 0 {
+			return fmt.Errorf("invalid exclude pattern '%s', it excludes everything", pattern)
+		}
+		if _, err := path.Match(excludePattern(pattern), ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern '%s': %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func excludePattern(pattern string) string {
+	return strings.Trim(path.Clean("/"+pattern), "/")
+}
+
+// matchExclude tells whether the path, relative to the root of the image, or one of its
+// parent directories matches one of the patterns. Patterns are matched like
+// path.Match does, * does not cross directories.
+func matchExclude(patterns []string, name string) bool {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	for _, pattern := range patterns {
+		pattern = excludePattern(pattern)
+		for dir := name; dir != "." && len(dir) != 0; dir = path.Dir(dir) {
+			if matched, _ := path.Match(pattern, dir); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// excludeMerged removes the paths matching Excludes from the merged layers. When layers
+// are kept below the squashed one, a whiteout hides the path in them as well.
+func (im *V2Image) excludeMerged() error {
+	if len(im.Excludes) == 0 {
+		return nil
+	}
+	var excluded int
+	err := filepath.WalkDir(im.MergeDir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(im.MergeDir, file)
+		if err != nil || name == "." || strings.HasPrefix(entry.Name(), ".wh.") {
+			return err
+		}
+		if !matchExclude(im.Excludes, filepath.ToSlash(name)) {
+			return nil
+		}
+		size, _ := im.dirSize(file)
+		im.mergeStats.BytesExcluded += size
+		im.forgetMetadata(file)
+		if err := os.RemoveAll(file); err != nil {
+			return err
+		}
+		if len(im.LayerPathsToMove) != 0 {
+			if err := CreateWhiteoutFile(filepath.Join(filepath.Dir(file), ".wh."+entry.Name())); err != nil {
+				return err
+			}
+		}
+		excluded++
+		if entry.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return NewIOError("failed to exclude paths from the squashed layer", err)
+	}
+	im.Logger.Infof("Excluded %d paths from the squashed layer", excluded)
+	return nil
+}
@@ -1,6 +1,30 @@
 package image
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/docker/docker/client"
+)
+
+// Exit codes of the command line tool. They are stable, so scripts can tell "nothing to
+// do" from a real failure.
+const (
+	ExitOK                = 0
+	ExitFailure           = 1
+	ExitSquashUnnecessary = 2
+	ExitInvalidLayer      = 3
+	ExitDaemonUnavailable = 4
+	ExitCorruptArchive    = 5
+	ExitIO                = 6
+	ExitVerification      = 7
+	ExitNoSpace           = 8
+	// ExitInterrupted is used when SIGINT or SIGTERM aborted the run, the usual
+	// 128 + SIGINT of shells.
+	ExitInterrupted = 130
+)
 
 // Error is a basic error type that implements the error interface.
 type BasicError struct {
@@ -16,14 +40,28 @@ func NewError(msg string) *BasicError {
 	return &BasicError{message: msg}
 }
 
-// SquashError represents an error that occurs during the squashing process.
+// SquashError represents an error that occurs during the squashing process. Its code is
+// the exit code of the command.
 type SquashError struct {
 	BasicError
 	code int
+	err  error
 }
 
 func (e *SquashError) Error() string {
-	return fmt.Sprintf("%s (code: %d)", e.message, e.code)
+	if e.err == nil {
+		return e.message
+	}
+	return fmt.Sprintf("%s: %v", e.message, e.err)
+}
+
+// Code is the exit code of the error.
+func (e *SquashError) Code() int {
+	return e.code
+}
+
+func (e *SquashError) Unwrap() error {
+	return e.err
 }
 
 // NewSquashError creates a new SquashError.
@@ -31,20 +69,115 @@ func NewSquashError(msg string, code int) *SquashError {
 	return &SquashError{BasicError: BasicError{message: msg}, code: code}
 }
 
+func newSquashError(msg string, code int, err error) SquashError {
+	return SquashError{BasicError: BasicError{message: msg}, code: code, err: err}
+}
+
 // SquashUnnecessaryError indicates an error where squashing was unnecessary.
 type SquashUnnecessaryError struct {
 	SquashError
 }
 
 func NewSquashUnnecessaryError(msg string) *SquashUnnecessaryError {
-	return &SquashUnnecessaryError{SquashError: *NewSquashError(msg, 2)}
+	return &SquashUnnecessaryError{SquashError: newSquashError(msg, ExitSquashUnnecessary, nil)}
+}
+
+// InvalidLayerError indicates that the layer given to squash from is not valid for the
+// image.
+type InvalidLayerError struct {
+	SquashError
+}
+
+func NewInvalidLayerError(msg string) *InvalidLayerError {
+	return &InvalidLayerError{SquashError: newSquashError(msg, ExitInvalidLayer, nil)}
+}
+
+// DaemonUnavailableError indicates that the Docker daemon, or the image store used instead
+// of it, could not be reached.
+type DaemonUnavailableError struct {
+	SquashError
+}
+
+func NewDaemonUnavailableError(err error) *DaemonUnavailableError {
+	return &DaemonUnavailableError{SquashError: newSquashError("Docker daemon is not available", ExitDaemonUnavailable, err)}
 }
 
-// func main() {
-// 	// Example of using these errors
-// 	err := NewSquashError("Squash failed", 1)
-// 	fmt.Println(err.Error())
+// newStoreUnavailableError is a DaemonUnavailableError for image stores other than the
+// Docker daemon.
+func newStoreUnavailableError(store string, err error) *DaemonUnavailableError {
+	return &DaemonUnavailableError{SquashError: newSquashError(store+" is not available", ExitDaemonUnavailable, err)}
+}
+
+// UnsupportedDaemonError indicates that the Docker daemon is too old to save images
+// with its API.
+type UnsupportedDaemonError struct {
+	SquashError
+}
+
+func NewUnsupportedDaemonError(msg string) *UnsupportedDaemonError {
+	return &UnsupportedDaemonError{SquashError: newSquashError(msg, ExitDaemonUnavailable, nil)}
+}
 
-// 	unnecessaryErr := NewSquashUnnecessaryError("Squashing was unnecessary")
-// 	fmt.Println(unnecessaryErr.Error())
-// }
+// CorruptArchiveError indicates that a saved image, layer or OCI layout could not be
+// read.
+type CorruptArchiveError struct {
+	SquashError
+}
+
+func NewCorruptArchiveError(msg string, err error) *CorruptArchiveError {
+	return &CorruptArchiveError{SquashError: newSquashError(msg, ExitCorruptArchive, err)}
+}
+
+// IOError indicates that reading or writing local files failed.
+type IOError struct {
+	SquashError
+}
+
+func NewIOError(msg string, err error) *IOError {
+	return &IOError{SquashError: newSquashError(msg, ExitIO, err)}
+}
+
+// VerificationError indicates that content did not match its digest.
+type VerificationError struct {
+	SquashError
+}
+
+func NewVerificationError(msg string) *VerificationError {
+	return &VerificationError{SquashError: newSquashError(msg, ExitVerification, nil)}
+}
+
+// InsufficientSpaceError indicates that a filesystem has not enough free space, or the
+// system not enough memory, for the squash.
+type InsufficientSpaceError struct {
+	SquashError
+}
+
+func NewInsufficientSpaceError(msg string) *InsufficientSpaceError {
+	return &InsufficientSpaceError{SquashError: newSquashError(msg, ExitNoSpace, nil)}
+}
+
+// ExitCode maps an error returned by a squash run to the exit code of the command.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	if errors.Is(err, context.Canceled) {
+		return ExitInterrupted
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return ExitNoSpace
+	}
+	var coded interface{ Code() int }
+	if errors.As(err, &coded) {
+		return coded.Code()
+	}
+	return ExitFailure
+}
+
+// daemonError marks errors of Docker API calls that failed to reach the daemon.
+func daemonError(err error) error {
+	if err != nil && client.IsErrConnectionFailed(err) {
+		return NewDaemonUnavailableError(err)
+	}
+	return err
+}
@@ -0,0 +1,141 @@
+package image
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/opencontainers/go-digest"
+)
+
+// writeEstargz converts the source layer tar into an eStargz blob written to w. The
+// blob carries the TOC digest and uncompressed size annotations that lazy-pulling
+// snapshotters look for on the layer descriptor.
+func writeEstargz(source *os.File, w io.Writer, level int) (compressedLayer, error) {
+	info, err := source.Stat()
+	if err != nil {
+		return compressedLayer{}, err
+	}
+
+	if level == 0 {
+		level = gzip.BestCompression
+	}
+	blob, err := estargz.Build(io.NewSectionReader(source, 0, info.Size()),
+		estargz.WithCompression(&estargzCompression{
+			GzipCompressor:   estargz.NewGzipCompressorWithLevel(level),
+			GzipDecompressor: &estargz.GzipDecompressor{},
+			level:            level,
+		}))
+	if err != nil {
+		return compressedLayer{}, err
+	}
+	defer blob.Close()
+
+	// eStargz rewrites the tar stream, so the uncompressed size is counted from the
+	// blob itself while it is written out.
+	pr, pw := io.Pipe()
+	sizeCh := make(chan int64, 1)
+	go func() {
+		sizeCh <- uncompressedSize(pr)
+	}()
+
+	_, err = io.Copy(w, io.TeeReader(blob, pw))
+	pw.CloseWithError(err)
+	uncompressed := <-sizeCh
+	if err != nil {
+		return compressedLayer{}, err
+	}
+	if err := blob.Close(); err != nil {
+		return compressedLayer{}, err
+	}
+
+	layer := compressedLayer{DiffID: blob.DiffID().String()}
+	layer.Annotations = map[string]string{
+		estargz.TOCJSONDigestAnnotation:         blob.TOCDigest().String(),
+		estargz.StoreUncompressedSizeAnnotation: fmt.Sprintf("%d", uncompressed),
+	}
+	return layer, nil
+}
+
+// uncompressedSize drains a gzip stream and returns the number of decompressed bytes.
+func uncompressedSize(r *io.PipeReader) int64 {
+	defer io.Copy(io.Discard, r)
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0
+	}
+	n, _ := io.Copy(io.Discard, zr)
+	return n
+}
+
+// estargzCompression is the gzip compression of the estargz package with a footer that
+// does not depend on how compress/gzip encodes an empty stream. The footer of the
+// package, up to v0.18.2, is an empty gzip member written with compress/gzip, which is
+// 48 bytes with current Go releases instead of the 51 the format requires, and the
+// package panics on it. TestWriteEstargz opens the blobs with the package.
+type estargzCompression struct {
+	*estargz.GzipCompressor
+	*estargz.GzipDecompressor
+	level int
+}
+
+func (c *estargzCompression) WriteTOCAndFooter(w io.Writer, off int64, toc *estargz.JTOC, diffHash hash.Hash) (digest.Digest, error) {
+	tocJSON, err := json.MarshalIndent(toc, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	gz, err := gzip.NewWriterLevel(w, c.level)
+	if err != nil {
+		return "", err
+	}
+	gw := io.Writer(gz)
+	if diffHash != nil {
+		gw = io.MultiWriter(gz, diffHash)
+	}
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     estargz.TOCTarName,
+		Size:     int64(len(tocJSON)),
+	}); err != nil {
+		return "", err
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return "", err
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	if _, err := w.Write(estargzFooter(off)); err != nil {
+		return "", err
+	}
+	return digest.FromBytes(tocJSON), nil
+}
+
+// estargzFooter encodes the TOC offset as an empty gzip member whose extra field holds
+// the offset, laid out byte by byte so its size is always estargz.FooterSize.
+func estargzFooter(tocOffset int64) []byte {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOffset)
+
+	footer := make([]byte, 0, estargz.FooterSize)
+	// gzip header with FEXTRA set, no mtime, unknown OS
+	footer = append(footer, 0x1f, 0x8b, 0x08, 0x04, 0, 0, 0, 0, 0, 0xff)
+	footer = binary.LittleEndian.AppendUint16(footer, uint16(4+len(subfield)))
+	footer = append(footer, 'S', 'G')
+	footer = binary.LittleEndian.AppendUint16(footer, uint16(len(subfield)))
+	footer = append(footer, subfield...)
+	// final stored deflate block without data, then CRC32 and ISIZE of nothing
+	footer = append(footer, 0x01, 0x00, 0x00, 0xff, 0xff)
+	footer = append(footer, 0, 0, 0, 0, 0, 0, 0, 0)
+	return footer
+}
@@ -0,0 +1,93 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/opencontainers/go-digest"
+)
+
+// TestWriteEstargz converts a layer and opens the blob like a lazy-pulling snapshotter
+// does: the footer leads to the TOC, whose digest is the one of the annotation, and the
+// files are read back through it.
+func TestWriteEstargz(t *testing.T) {
+	files := map[string]string{
+		"etc/hostname":   "squashed\n",
+		"app/server.txt": string(bytes.Repeat([]byte("layer data "), 4096)),
+	}
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	for _, dir := range []string{"etc/", "app/"} {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0755}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"etc/hostname", "app/server.txt"} {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(files[name]))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "layer.tar")
+	if err := os.WriteFile(path, layer.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	var blob bytes.Buffer
+	compressed, err := writeEstargz(source, &blob, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := estargz.Open(io.NewSectionReader(bytes.NewReader(blob.Bytes()), 0, int64(blob.Len())))
+	if err != nil {
+		t.Fatalf("the blob is no eStargz: %v", err)
+	}
+	annotation, err := digest.Parse(compressed.Annotations[estargz.TOCJSONDigestAnnotation])
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := reader.VerifyTOC(annotation)
+	if err != nil {
+		t.Fatalf("the TOC does not match the annotation: %v", err)
+	}
+	for name, content := range files {
+		entry, ok := reader.Lookup(name)
+		if !ok {
+			t.Fatalf("%s is not in the TOC", name)
+		}
+		chunkVerifier, err := verifier.Verifier(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sr, err := reader.OpenFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(io.TeeReader(io.NewSectionReader(sr, 0, entry.Size), chunkVerifier))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("%s reads back as %d bytes, expected %d", name, len(data), len(content))
+		}
+		if !chunkVerifier.Verified() {
+			t.Errorf("%s does not match the digest of its chunks", name)
+		}
+	}
+}
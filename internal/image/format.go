@@ -0,0 +1,150 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Formats of saved images. The squashed image is written in the format of its source,
+// images saved in the v1 format are written like Docker archives.
+const (
+	// FormatV1 is the layout of Docker before 1.10: a directory with a layer.tar, a json
+	// and a VERSION file per layer, chained by their parent IDs
+	FormatV1 = "v1"
+	// FormatDocker has a manifest.json pointing to the config and the layer directories
+	FormatDocker = "docker"
+	// FormatOCI is an OCI image layout with an index.json and blobs, with a manifest.json
+	// as well when saved by Docker 25 and newer
+	FormatOCI = "oci"
+)
+
+// legacyIDPattern matches the IDs of layers saved in the v1 format.
+var legacyIDPattern = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// legacyLayer is the part of the json of a v1 layer that describes how it was built.
+type legacyLayer struct {
+	ID              string        `json:"id"`
+	Parent          string        `json:"parent"`
+	Created         string        `json:"created"`
+	Author          string        `json:"author"`
+	Comment         string        `json:"comment"`
+	ContainerConfig ConfigDetails `json:"container_config"`
+}
+
+// setFormat selects how the saved image is read and the squashed image is written.
+func (im *V2Image) setFormat(format string) {
+	im.format = format
+	im.OCIFormat = format == FormatOCI
+}
+
+// detectFormat tells the format of the image saved in OldImageDir from the files it
+// contains.
+func (im *V2Image) detectFormat() (string, error) {
+	switch {
+	case PathExists(filepath.Join(im.OldImageDir, "index.json")):
+		return FormatOCI, nil
+	case PathExists(filepath.Join(im.OldImageDir, "manifest.json")):
+		return FormatDocker, nil
+	case PathExists(im.savedFile(filepath.Join(legacyID(im.OldImageId), "json"))):
+		return FormatV1, nil
+	}
+	return "", NewCorruptArchiveError("the saved image has no index.json, manifest.json or legacy layer directories", nil)
+}
+
+// savedFile returns the path of a file of the saved image, in NewImageDir when it was
+// spooled there.
+func (im *V2Image) savedFile(name string) string {
+	oldPath := filepath.Join(im.OldImageDir, name)
+	if newPath := filepath.Join(im.NewImageDir, name); !PathExists(oldPath) && PathExists(newPath) {
+		return newPath
+	}
+	return oldPath
+}
+
+// savedArchiveFile returns the path of a file of the saved image like savedFile, once
+// checkArchiveFile made sure it is a regular file inside the saved image.
+func (im *V2Image) savedArchiveFile(name string) (string, error) {
+	root := im.OldImageDir
+	if within(im.NewImageDir, im.savedFile(name)) {
+		root = im.NewImageDir
+	}
+	return checkArchiveFile(root, name)
+}
+
+func legacyID(imageID string) string {
+	return strings.TrimPrefix(imageID, "sha256:")
+}
+
+// readLegacyImage reads an image saved in the v1 format. Its layers are the chain of
+// parents of the top layer, a config like the ones of newer daemons is written next to
+// them so the image is squashed like a Docker archive.
+func (im *V2Image) readLegacyImage(ctx context.Context) error {
+	var layers []legacyLayer
+	seen := make(map[string]bool)
+	for id := legacyID(im.OldImageId); len(id) != 0; {
+		if !legacyIDPattern.MatchString(id) || seen[id] {
+			return NewCorruptArchiveError(fmt.Sprintf("invalid parent layer '%s' in the saved image", id), nil)
+		}
+		seen[id] = true
+
+		jsonPath, err := im.savedArchiveFile(filepath.Join(id, "json"))
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(jsonPath)
+		if err != nil {
+			return NewCorruptArchiveError(fmt.Sprintf("failed to read the json of layer %s", id), err)
+		}
+		var layer legacyLayer
+		if err := json.Unmarshal(data, &layer); err != nil {
+			return NewCorruptArchiveError(fmt.Sprintf("failed to unmarshal the json of layer %s", id), err)
+		}
+		if len(layers) == 0 {
+			// The top layer holds the config of the image
+			if err := json.Unmarshal(data, &im.OldImageConfig); err != nil {
+				return NewCorruptArchiveError(fmt.Sprintf("failed to unmarshal the json of layer %s", id), err)
+			}
+		}
+		layer.ID = id
+		layers = append(layers, layer)
+		id = layer.Parent
+	}
+
+	config := im.OldImageConfig
+	config.ID, config.Parent, config.LayerID = "", "", ""
+	config.History = nil
+	config.Rootfs = Rootfs{Type: "layers"}
+	manifest := ImageManifest{Config: legacyID(im.OldImageId) + ".json"}
+	for i := len(layers) - 1; i >= 0; i-- {
+		layer := layers[i]
+		manifest.Layers = append(manifest.Layers, filepath.Join(layer.ID, "layer.tar"))
+
+		layerTar, err := im.savedArchiveFile(filepath.Join(layer.ID, "layer.tar"))
+		if err != nil {
+			return err
+		}
+		diffID, ok := im.spooledDigest(layer.ID)
+		if !ok {
+			if diffID, err = im.computeSha256(ctx, layerTar); err != nil {
+				return NewCorruptArchiveError(fmt.Sprintf("failed to read layer %s", layer.ID), err)
+			}
+		}
+		im.batch.setDiffID(layer.ID, diffID)
+		config.Rootfs.DiffIds = append(config.Rootfs.DiffIds, "sha256:"+diffID)
+		config.History = append(config.History, HistoryItem{
+			Created:   layer.Created,
+			CreatedBy: strings.Join(layer.ContainerConfig.Cmd, " "),
+			Comment:   layer.Comment,
+			Author:    layer.Author,
+		})
+	}
+
+	im.Logger.Debugf("Read %d layers of the v1 image %s", len(layers), im.OldImageId)
+	im.OldManifest = manifest
+	return writeJsonFile(filepath.Join(im.OldImageDir, manifest.Config), config)
+}
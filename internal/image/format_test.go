@@ -0,0 +1,116 @@
+package image
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The archives in testdata/formats hold the same image of two layers, saved in each of
+// the formats.
+const (
+	formatsConfigID = "sha256:56405f3aa87d69fa9189f39c56d3825755b37b08c23dfedcc3a1ae1e053eb58f"
+	formatsTopLayer = "sha256:95cf1a2e1698fe3ca1fcc3f653119146b271d0b62e487ec264441e886a11bd06"
+)
+
+var formatsDiffIDs = []string{
+	"sha256:72159584d7e29b2c609715d6f77decd8ed8236b8dde26907db3318bbbfe0fbd0",
+	"sha256:331a85f44e9041f23096d6bacbee4df1a902f96f7413c47e6f43daa887fd1365",
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		archive string
+		imageID string
+		format  string
+	}{
+		// v1 images are named after their top layer
+		{archive: "v1.tar", imageID: formatsTopLayer, format: FormatV1},
+		{archive: "docker.tar", imageID: formatsConfigID, format: FormatDocker},
+		{archive: "oci.tar", imageID: formatsConfigID, format: FormatOCI},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			im := openSavedImage(t, filepath.Join("testdata", "formats", test.archive))
+			im.OldImageId = test.imageID
+
+			format, err := im.detectFormat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != test.format {
+				t.Fatalf("detected format %s, expected %s", format, test.format)
+			}
+
+			ctx := context.Background()
+			if err := im.getManifest(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if im.format != test.format {
+				t.Errorf("image read in the %s format, expected %s", im.format, test.format)
+			}
+			if err := im.getIamgeConfig(); err != nil {
+				t.Fatal(err)
+			}
+
+			var layers []string
+			for _, layer := range im.OldManifest.Layers {
+				digest, err := im.computeSha256(ctx, im.savedFile(layer))
+				if err != nil {
+					t.Fatal(err)
+				}
+				layers = append(layers, "sha256:"+digest)
+			}
+			if !reflect.DeepEqual(layers, formatsDiffIDs) {
+				t.Errorf("read layers %v, expected %v", layers, formatsDiffIDs)
+			}
+			if !reflect.DeepEqual(im.OldImageConfig.Rootfs.DiffIds, formatsDiffIDs) {
+				t.Errorf("config has the diff_ids %v, expected %v", im.OldImageConfig.Rootfs.DiffIds, formatsDiffIDs)
+			}
+			if len(im.OldImageConfig.History) != len(formatsDiffIDs) {
+				t.Errorf("config has %d history items, expected %d", len(im.OldImageConfig.History), len(formatsDiffIDs))
+			}
+		})
+	}
+}
+
+func TestDetectFormatUnknown(t *testing.T) {
+	im := openSavedImage(t, "")
+	im.OldImageId = formatsConfigID
+	if _, err := im.detectFormat(); err == nil {
+		t.Fatal("detected the format of an empty directory")
+	}
+}
+
+// openSavedImage extracts the archive like a saved image, an empty path gives an empty
+// saved image.
+func openSavedImage(t *testing.T, archive string) *V2Image {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	im := &V2Image{Logger: logger}
+	im.OldImageDir = filepath.Join(t.TempDir(), "old")
+	im.NewImageDir = filepath.Join(t.TempDir(), "new")
+	for _, dir := range []string{im.OldImageDir, im.NewImageDir} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(archive) == 0 {
+		return im
+	}
+
+	file, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := im.extractTar(file, im.OldImageDir); err != nil {
+		t.Fatal(err)
+	}
+	return im
+}
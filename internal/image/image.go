@@ -2,6 +2,7 @@
 package image
 
 import (
+	"context"
 	"os"
 	"time"
 )
@@ -9,10 +10,10 @@ import (
 // "github.com/docker/docker/client"
 
 type ImageInterface interface {
-	Squash() (string, error)
+	Squash(ctx context.Context) (string, error)
 	Format() string
-	LoadSquashedImage() error
-	ExportTarArchive(string) error
+	LoadSquashedImage(ctx context.Context) error
+	ExportTarArchive(ctx context.Context, outputPath string) error
 	Cleanup() error
 }
 
@@ -20,14 +21,16 @@ type ImageSpec struct {
 	ImageID            string
 	FromLayer          string
 	TmpDir             string
-	Tag                string
+	Tags               []RepoTag
 	Comment            string
 	Image              string
-	ImageName          string
-	ImageTag           string
 	LastCreatedBy      string
 	SquashID           string
 	OCIFormat          bool
+	Compression        Compression
+	CompressionLevel   int
+	Excludes           []string
+	ConfigEdits        ConfigEdits
 	Date               time.Time
 	OldImageId         string
 	OldImageDir        string
@@ -55,9 +58,10 @@ type ImageManifest struct {
 }
 
 type LayerDetails struct {
-	MediaType string `json:"mediaType"`
-	Size      int64  `json:"size"`
-	Digest    string `json:"digest"`
+	MediaType   string            `json:"mediaType"`
+	Size        int64             `json:"size"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
 type ImageConfig struct {
@@ -71,6 +75,7 @@ type ImageConfig struct {
 	DockerVersion   string        `json:"docker_version"`
 	History         []HistoryItem `json:"history"`
 	OS              string        `json:"os"`
+	Variant         string        `json:"variant,omitempty"`
 	Rootfs          Rootfs        `json:"rootfs"`
 	Parent          string        `json:"parent"`
 	ID              string        `json:"id"`
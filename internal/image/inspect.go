@@ -0,0 +1,644 @@
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// TransportDockerArchive reads an image from a tar archive written by docker save or
+// by a squash, only the inspect, diff and verify commands take it.
+const TransportDockerArchive = "docker-archive"
+
+// maxJSONFileSize limits the manifests and configs read from an archive into memory.
+const maxJSONFileSize = 16 << 20
+
+// Files eStargz layers carry next to the files of the image.
+var estargzFiles = map[string]bool{
+	"stargz.index.json":     true,
+	".prefetch.landmark":    true,
+	".no.prefetch.landmark": true,
+}
+
+// ImageContents is an image read with its config and the files of its layers.
+type ImageContents struct {
+	// Name is the image as it was given
+	Name   string `json:"name"`
+	Format string `json:"format"`
+	// ImageID is the digest of the config
+	ImageID  string      `json:"image_id"`
+	RepoTags []string    `json:"repo_tags,omitempty"`
+	Config   ImageConfig `json:"config"`
+	// Layers of the image, oldest first
+	Layers []ImageLayer `json:"layers"`
+}
+
+// ImageLayer is a layer of an ImageContents.
+type ImageLayer struct {
+	// DiffID is the digest of the uncompressed layer, Digest and Size describe the layer
+	// as it is stored, which may be compressed
+	DiffID    string `json:"diff_id"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	MediaType string `json:"media_type,omitempty"`
+	// CreatedBy is taken from the history of the config, the comment when it is empty
+	CreatedBy string `json:"created_by,omitempty"`
+	// Files of the layer in archive order, whiteouts included
+	Files     []LayerFile `json:"-"`
+	FileCount int         `json:"file_count"`
+}
+
+// LayerFile is an entry of a layer.
+type LayerFile struct {
+	Path string
+	FileEntry
+}
+
+// FileEntry describes a file as an image holds it. Hard links are described as the
+// file they link to.
+type FileEntry struct {
+	Type     byte   `json:"type"`
+	Mode     int64  `json:"mode"`
+	Uid      int    `json:"uid"`
+	Gid      int    `json:"gid"`
+	Size     int64  `json:"size"`
+	Linkname string `json:"linkname,omitempty"`
+	// Digest of the content of regular files
+	Digest string `json:"digest,omitempty"`
+}
+
+// scannedLayer is an entry of an archive that could be read as a layer.
+type scannedLayer struct {
+	digest string
+	diffID string
+	size   int64
+	files  []LayerFile
+}
+
+// ReadImageContents reads an image from the image store, or from an archive given as
+// docker-archive:PATH[:REF] or oci-archive:PATH[:REF]. The image store of cli is only
+// connected to for images it holds.
+func ReadImageContents(ctx context.Context, cli CLI, logger Logger, name string) (*ImageContents, error) {
+	var store ImageStore
+	contents, err := readImageContents(ctx, name, func() (ImageStore, error) {
+		var err error
+		store, err = NewImageStore(cli, logger)
+		return store, err
+	})
+	if store != nil {
+		CloseStore(store)
+	}
+	return contents, err
+}
+
+// readImageContents reads the image, openStore is called for images of the image store.
+func readImageContents(ctx context.Context, name string, openStore func() (ImageStore, error)) (*ImageContents, error) {
+	var archiveFile, refName string
+	if strings.HasPrefix(name, TransportDockerArchive+":") {
+		archiveFile, refName = splitLayoutReference(strings.TrimPrefix(name, TransportDockerArchive+":"))
+	} else {
+		switch source := ParseImageSource(name); source.Transport {
+		case TransportDaemon:
+			store, err := openStore()
+			if err != nil {
+				return nil, err
+			}
+			imageID, err := store.ImageID(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			archive, err := store.Save(ctx, []string{imageID})
+			if err != nil {
+				return nil, err
+			}
+			defer archive.Close()
+			contents, err := readImageArchive(ctx, archive, "")
+			if err != nil {
+				return nil, err
+			}
+			contents.Name = name
+			return contents, nil
+		case TransportOCIArchive:
+			archiveFile, refName = source.Path, source.RefName
+		default:
+			return nil, fmt.Errorf("'%s' cannot be read, give an image of the image store, docker-archive:PATH or oci-archive:PATH", name)
+		}
+	}
+
+	file, err := os.Open(archiveFile)
+	if err != nil {
+		return nil, NewIOError("failed to open archive", err)
+	}
+	defer file.Close()
+	contents, err := readImageArchive(ctx, file, refName)
+	if err != nil {
+		return nil, err
+	}
+	contents.Name = name
+	return contents, nil
+}
+
+// readImageArchive reads an image archive in one pass: the manifests and configs are
+// kept in memory, every other entry that reads as a tar is listed as a possible layer.
+// refName selects the image of archives holding several, by tag or reference name.
+func readImageArchive(ctx context.Context, r io.Reader, refName string) (*ImageContents, error) {
+	jsonFiles := make(map[string][]byte)
+	layers := make(map[string]*scannedLayer)
+	links := make(map[string]string)
+
+	archive := tar.NewReader(contextReader{ctx: ctx, r: r})
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, NewCorruptArchiveError("failed to read image archive", err)
+		}
+		name, err := archivePath(header.Name)
+		if err != nil {
+			return nil, err
+		}
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			// Older daemons link layers shared by several images
+			links[name] = path.Join(path.Dir(name), header.Linkname)
+			continue
+		case tar.TypeReg:
+		default:
+			continue
+		}
+
+		buffered := bufio.NewReader(archive)
+		if head, _ := buffered.Peek(1); len(head) == 1 && head[0] == '{' && header.Size <= maxJSONFileSize {
+			data, err := io.ReadAll(buffered)
+			if err != nil {
+				return nil, NewCorruptArchiveError(fmt.Sprintf("failed to read %s", name), err)
+			}
+			jsonFiles[name] = data
+			continue
+		}
+		if layer, err := scanLayer(buffered); err == nil {
+			layers[name] = layer
+		} else if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	resolve := func(name string) string {
+		for i := 0; i < 8; i++ {
+			target, ok := links[name]
+			if !ok {
+				break
+			}
+			name = target
+		}
+		return name
+	}
+
+	contents := &ImageContents{}
+	var configName string
+	var layerNames []string
+	var mediaTypes []string
+	switch {
+	case jsonFiles["manifest.json"] != nil:
+		var manifests []ImageManifest
+		if err := json.Unmarshal(jsonFiles["manifest.json"], &manifests); err != nil {
+			return nil, NewCorruptArchiveError("failed to unmarshal manifest.json", err)
+		}
+		manifest, err := selectTaggedManifest(manifests, refName)
+		if err != nil {
+			return nil, err
+		}
+		contents.Format = FormatDocker
+		if jsonFiles["index.json"] != nil {
+			contents.Format = FormatOCI
+		}
+		contents.RepoTags = manifest.RepoTags
+		configName = manifest.Config
+		layerNames = manifest.Layers
+	case jsonFiles["index.json"] != nil:
+		var index OCIIndex
+		if err := json.Unmarshal(jsonFiles["index.json"], &index); err != nil {
+			return nil, NewCorruptArchiveError("failed to unmarshal index.json", err)
+		}
+		descriptors, err := selectIndexEntries(index, refName)
+		if err != nil {
+			return nil, err
+		}
+		if len(descriptors) != 1 || descriptors[0].MediaType == MediaTypeImageIndex {
+			return nil, fmt.Errorf("the archive holds a multi-platform image, only single images can be read")
+		}
+		var manifest OCIManifest
+		if err := json.Unmarshal(jsonFiles[blobPath(descriptors[0].Digest)], &manifest); err != nil {
+			return nil, NewCorruptArchiveError(fmt.Sprintf("failed to read manifest %s", descriptors[0].Digest), err)
+		}
+		contents.Format = FormatOCI
+		if name := descriptors[0].Annotations[AnnotationImageName]; len(name) != 0 {
+			contents.RepoTags = []string{name}
+		}
+		configName = blobPath(manifest.Config.Digest)
+		for _, layer := range manifest.Layers {
+			layerNames = append(layerNames, blobPath(layer.Digest))
+			mediaTypes = append(mediaTypes, layer.MediaType)
+		}
+	default:
+		return nil, NewCorruptArchiveError("the archive has no manifest.json or index.json, images in the v1 format cannot be read", nil)
+	}
+
+	configData, ok := jsonFiles[resolve(configName)]
+	if !ok {
+		return nil, NewCorruptArchiveError(fmt.Sprintf("config %s is missing from the archive", configName), nil)
+	}
+	if err := json.Unmarshal(configData, &contents.Config); err != nil {
+		return nil, NewCorruptArchiveError(fmt.Sprintf("failed to unmarshal config %s", configName), err)
+	}
+	contents.ImageID = "sha256:" + sha256Hex(configData)
+
+	var history []string
+	for _, item := range contents.Config.History {
+		if item.EmptyLayer {
+			continue
+		}
+		// Squashed layers carry the commit message as comment
+		if len(item.CreatedBy) == 0 {
+			history = append(history, item.Comment)
+		} else {
+			history = append(history, item.CreatedBy)
+		}
+	}
+	for i, layerName := range layerNames {
+		scanned, ok := layers[resolve(layerName)]
+		if !ok {
+			return nil, NewCorruptArchiveError(fmt.Sprintf("layer %s is missing from the archive", layerName), nil)
+		}
+		layer := ImageLayer{
+			DiffID:    scanned.diffID,
+			Digest:    scanned.digest,
+			Size:      scanned.size,
+			Files:     scanned.files,
+			FileCount: len(scanned.files),
+		}
+		if i < len(mediaTypes) {
+			layer.MediaType = mediaTypes[i]
+		}
+		if i < len(history) {
+			layer.CreatedBy = history[i]
+		}
+		contents.Layers = append(contents.Layers, layer)
+	}
+	return contents, nil
+}
+
+// selectTaggedManifest picks the image of a manifest.json by one of its tags, or the
+// only one.
+func selectTaggedManifest(manifests []ImageManifest, refName string) (ImageManifest, error) {
+	if len(refName) == 0 {
+		if len(manifests) != 1 {
+			return ImageManifest{}, fmt.Errorf("the archive holds %d images, select one with PATH:TAG", len(manifests))
+		}
+		return manifests[0], nil
+	}
+	for _, manifest := range manifests {
+		for _, tag := range manifest.RepoTags {
+			if tag == refName || strings.HasSuffix(tag, ":"+refName) {
+				return manifest, nil
+			}
+		}
+	}
+	return ImageManifest{}, fmt.Errorf("the archive holds no image tagged '%s'", refName)
+}
+
+// scanLayer lists the files of a layer, which may be compressed, and computes its digest
+// and diff_id. It fails for entries that are no tar archive.
+func scanLayer(r io.Reader) (*scannedLayer, error) {
+	digest := sha256.New()
+	counter := &countingWriter{w: digest}
+	decompressed, err := decompressedReader(io.TeeReader(r, counter))
+	if err != nil {
+		return nil, err
+	}
+	defer decompressed.Close()
+	diffID := sha256.New()
+	layerTar := tar.NewReader(io.TeeReader(decompressed, diffID))
+
+	layer := &scannedLayer{}
+	files := make(map[string]FileEntry)
+	for {
+		header, err := layerTar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := strings.Trim(path.Clean("/"+header.Name), "/")
+		if len(name) == 0 || estargzFiles[name] {
+			continue
+		}
+
+		entry := FileEntry{
+			Type:     header.Typeflag,
+			Mode:     header.Mode & 07777,
+			Uid:      header.Uid,
+			Gid:      header.Gid,
+			Linkname: header.Linkname,
+		}
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			entry.Type = tar.TypeReg
+			content := sha256.New()
+			size, err := io.Copy(content, layerTar)
+			if err != nil {
+				return nil, err
+			}
+			entry.Size = size
+			entry.Digest = "sha256:" + hex.EncodeToString(content.Sum(nil))
+		case tar.TypeLink:
+			target, ok := files[strings.Trim(path.Clean("/"+header.Linkname), "/")]
+			if !ok {
+				return nil, fmt.Errorf("hard link %s to the missing file %s", name, header.Linkname)
+			}
+			entry = target
+		}
+		files[name] = entry
+		layer.files = append(layer.files, LayerFile{Path: name, FileEntry: entry})
+	}
+	// The padding after the end of the tar archive counts as well
+	if _, err := io.Copy(io.Discard, io.TeeReader(decompressed, diffID)); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, err
+	}
+
+	layer.digest = "sha256:" + hex.EncodeToString(digest.Sum(nil))
+	layer.diffID = "sha256:" + hex.EncodeToString(diffID.Sum(nil))
+	layer.size = counter.n
+	return layer, nil
+}
+
+// Filesystem is the tree the layers of the image leave, the way a container sees it.
+func (c *ImageContents) Filesystem() map[string]FileEntry {
+	tree := make(map[string]FileEntry)
+	removeTree := func(dir string, self bool) {
+		if self {
+			delete(tree, dir)
+		}
+		for name := range tree {
+			if strings.HasPrefix(name, dir+"/") {
+				delete(tree, name)
+			}
+		}
+	}
+	for _, layer := range c.Layers {
+		// Whiteouts only hide the files of lower layers
+		for _, file := range layer.Files {
+			dir, base := path.Split(file.Path)
+			dir = strings.TrimSuffix(dir, "/")
+			switch {
+			case base == ".wh..wh..opq":
+				removeTree(dir, false)
+			case strings.HasPrefix(base, ".wh."):
+				removeTree(path.Join(dir, strings.TrimPrefix(base, ".wh.")), true)
+			}
+		}
+		for _, file := range layer.Files {
+			if strings.HasPrefix(path.Base(file.Path), ".wh.") {
+				continue
+			}
+			if previous, ok := tree[file.Path]; ok && previous.Type == tar.TypeDir && file.Type != tar.TypeDir {
+				removeTree(file.Path, false)
+			}
+			tree[file.Path] = file.FileEntry
+		}
+	}
+	return tree
+}
+
+// Kinds of FileChange, like the ones of docker diff.
+const (
+	FileAdded   = "A"
+	FileDeleted = "D"
+	FileChanged = "C"
+)
+
+// FileChange is a difference between the filesystems of two images.
+type FileChange struct {
+	Kind string `json:"kind"`
+	Path string `json:"path"`
+	// Details tells what changed
+	Details string `json:"details,omitempty"`
+}
+
+// DiffFilesystems lists how the files of b differ from the ones of a, sorted by path.
+// Modification times are not compared.
+func DiffFilesystems(a, b map[string]FileEntry) []FileChange {
+	var changes []FileChange
+	for name, entryA := range a {
+		entryB, ok := b[name]
+		if !ok {
+			changes = append(changes, FileChange{Kind: FileDeleted, Path: "/" + name})
+			continue
+		}
+		if details := fileDifferences(entryA, entryB); len(details) != 0 {
+			changes = append(changes, FileChange{Kind: FileChanged, Path: "/" + name, Details: strings.Join(details, ", ")})
+		}
+	}
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			changes = append(changes, FileChange{Kind: FileAdded, Path: "/" + name})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+func fileDifferences(a, b FileEntry) []string {
+	var details []string
+	if a.Type != b.Type {
+		return []string{fmt.Sprintf("type %q != %q", a.Type, b.Type)}
+	}
+	if a.Mode != b.Mode {
+		details = append(details, fmt.Sprintf("mode %04o != %04o", a.Mode, b.Mode))
+	}
+	if a.Uid != b.Uid || a.Gid != b.Gid {
+		details = append(details, fmt.Sprintf("owner %d:%d != %d:%d", a.Uid, a.Gid, b.Uid, b.Gid))
+	}
+	if a.Linkname != b.Linkname {
+		details = append(details, fmt.Sprintf("link %s != %s", a.Linkname, b.Linkname))
+	}
+	if a.Size != b.Size {
+		details = append(details, fmt.Sprintf("size %d != %d", a.Size, b.Size))
+	} else if a.Digest != b.Digest {
+		details = append(details, "content")
+	}
+	return details
+}
+
+// ConfigChange is a difference between the runtime configs of two images.
+type ConfigChange struct {
+	Field string `json:"field"`
+	A     string `json:"a"`
+	B     string `json:"b"`
+}
+
+// DiffConfigs lists the fields of the configs that change how containers of the images
+// run. History, rootfs and creation details are left out, a squash changes them.
+func DiffConfigs(a, b ImageConfig) []ConfigChange {
+	fields := []struct {
+		name string
+		a, b interface{}
+	}{
+		{"architecture", a.Architecture, b.Architecture},
+		{"os", a.OS, b.OS},
+		{"variant", a.Variant, b.Variant},
+		{"User", a.Config.User, b.Config.User},
+		{"ExposedPorts", a.Config.ExposedPorts, b.Config.ExposedPorts},
+		{"Env", a.Config.Env, b.Config.Env},
+		{"Entrypoint", a.Config.Entrypoint, b.Config.Entrypoint},
+		{"Cmd", a.Config.Cmd, b.Config.Cmd},
+		{"Healthcheck", a.Config.Healthcheck, b.Config.Healthcheck},
+		{"Volumes", a.Config.Volumes, b.Config.Volumes},
+		{"WorkingDir", a.Config.WorkingDir, b.Config.WorkingDir},
+		{"OnBuild", a.Config.OnBuild, b.Config.OnBuild},
+		{"Labels", a.Config.Labels, b.Config.Labels},
+	}
+	var changes []ConfigChange
+	for _, field := range fields {
+		valueA, valueB := configValue(field.a), configValue(field.b)
+		if valueA != valueB {
+			changes = append(changes, ConfigChange{Field: field.name, A: valueA, B: valueB})
+		}
+	}
+	return changes
+}
+
+// configValue renders a config field, unset and empty values alike.
+func configValue(v interface{}) string {
+	data, _ := json.Marshal(v)
+	switch value := string(data); value {
+	case "null", `""`, "[]", "{}", `{"Test":null}`:
+		return ""
+	default:
+		return value
+	}
+}
+
+// VerifyImage checks that the layers of the image match the diff_ids of its config.
+func VerifyImage(c *ImageContents) error {
+	diffIDs := c.Config.Rootfs.DiffIds
+	if len(diffIDs) != len(c.Layers) {
+		return NewVerificationError(fmt.Sprintf("%s has %d layers but its config lists %d diff_ids", c.Name, len(c.Layers), len(diffIDs)))
+	}
+	for i, layer := range c.Layers {
+		if layer.DiffID != diffIDs[i] {
+			return NewVerificationError(fmt.Sprintf("layer %d of %s does not match its diff_id %s, got %s", i+1, c.Name, diffIDs[i], layer.DiffID))
+		}
+	}
+	return nil
+}
+
+// VerifySquashed checks that the squashed image runs like its source: both are intact,
+// and they have the same files and runtime config. Paths matching excludes may be
+// missing from the squashed image, and its config is compared to the one of the source
+// with the edits applied. The differences are returned with a VerificationError.
+func VerifySquashed(source, squashed *ImageContents, excludes []string, edits ConfigEdits) ([]FileChange, []ConfigChange, error) {
+	if err := VerifyImage(source); err != nil {
+		return nil, nil, err
+	}
+	if err := VerifyImage(squashed); err != nil {
+		return nil, nil, err
+	}
+	var files []FileChange
+	for _, change := range DiffFilesystems(source.Filesystem(), squashed.Filesystem()) {
+		if change.Kind != FileDeleted || !matchExclude(excludes, change.Path) {
+			files = append(files, change)
+		}
+	}
+	sourceConfig := source.Config
+	edits.Apply(&sourceConfig.Config)
+	configs := DiffConfigs(sourceConfig, squashed.Config)
+	if len(files) != 0 || len(configs) != 0 {
+		return files, configs, NewVerificationError(fmt.Sprintf("%s differs from %s in %d files and %d config fields", squashed.Name, source.Name, len(files), len(configs)))
+	}
+	return nil, nil, nil
+}
+
+// WriteImageContents prints the image and its layers.
+func WriteImageContents(w io.Writer, c *ImageContents) error {
+	var size int64
+	var files int
+	for _, layer := range c.Layers {
+		size += layer.Size
+		files += layer.FileCount
+	}
+
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "Image:\t%s\n", c.Name)
+	fmt.Fprintf(table, "ID:\t%s\n", c.ImageID)
+	if len(c.RepoTags) != 0 {
+		fmt.Fprintf(table, "Tags:\t%s\n", strings.Join(c.RepoTags, ", "))
+	}
+	fmt.Fprintf(table, "Format:\t%s\n", c.Format)
+	platform := OCIPlatform{OS: c.Config.OS, Architecture: c.Config.Architecture, Variant: c.Config.Variant}
+	fmt.Fprintf(table, "Platform:\t%s\n", platform.String())
+	if len(c.Config.Created) != 0 {
+		fmt.Fprintf(table, "Created:\t%s\n", c.Config.Created)
+	}
+	fmt.Fprintf(table, "Layers:\t%d, %s, %d files\n", len(c.Layers), formatBytes(size), files)
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	table = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "#\tDIFF ID\tSIZE\tFILES\tCREATED BY")
+	for i, layer := range c.Layers {
+		createdBy := layer.CreatedBy
+		if len(createdBy) > 60 {
+			createdBy = createdBy[:59] + "…"
+		}
+		fmt.Fprintf(table, "%d\t%s\t%s\t%d\t%s\n", i+1, shortDigest(layer.DiffID), formatBytes(layer.Size), layer.FileCount, createdBy)
+	}
+	return table.Flush()
+}
+
+// WriteChanges prints the differences of two images, config fields first.
+func WriteChanges(w io.Writer, files []FileChange, configs []ConfigChange) error {
+	for _, change := range configs {
+		if _, err := fmt.Fprintf(w, "config %s: %s -> %s\n", change.Field, change.A, change.B); err != nil {
+			return err
+		}
+	}
+	for _, change := range files {
+		line := fmt.Sprintf("%s %s", change.Kind, change.Path)
+		if len(change.Details) != 0 {
+			line += " (" + change.Details + ")"
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func shortDigest(digest string) string {
+	hexDigest := strings.TrimPrefix(digest, "sha256:")
+	if len(hexDigest) > 12 {
+		return hexDigest[:12]
+	}
+	return hexDigest
+}
@@ -0,0 +1,222 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// schemaKeywords are the keywords validateSchema supports, the ones the published schemas
+// use. Annotations that do not constrain documents are accepted as well.
+var schemaKeywords = map[string]bool{
+	"type": true, "enum": true, "properties": true, "additionalProperties": true, "required": true,
+	"items": true, "minLength": true, "minimum": true, "pattern": true,
+	"$schema": true, "$id": true, "title": true, "description": true,
+}
+
+// validateSchema checks a document decoded from JSON or YAML against a JSON schema. Only
+// the keywords in schemaKeywords are supported, a schema using others is rejected rather
+// than checked partially.
+func validateSchema(schemaJSON []byte, document interface{}) error {
+	var schema map[string]interface{}
+	if err := json.Unmarshal(schemaJSON, &schema); err != nil {
+		return fmt.Errorf("invalid schema: %w", err)
+	}
+	if err := checkSchemaKeywords(schema, "#"); err != nil {
+		return fmt.Errorf("invalid schema: %w", err)
+	}
+	return validateValue(schema, document, "")
+}
+
+// checkSchemaKeywords fails on the keywords of the schema and its subschemas that are not
+// supported.
+func checkSchemaKeywords(schema map[string]interface{}, location string) error {
+	keywords := make([]string, 0, len(schema))
+	for keyword := range schema {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+	for _, keyword := range keywords {
+		if !schemaKeywords[keyword] {
+			return fmt.Errorf("%s: unsupported keyword %s", location, keyword)
+		}
+	}
+
+	if properties, ok := schema["properties"].(map[string]interface{}); ok {
+		names := make([]string, 0, len(properties))
+		for name := range properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := properties[name].(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s/properties/%s: must be a schema", location, name)
+			}
+			if err := checkSchemaKeywords(property, location+"/properties/"+name); err != nil {
+				return err
+			}
+		}
+	}
+	for _, keyword := range []string{"items", "additionalProperties"} {
+		if subschema, ok := schema[keyword].(map[string]interface{}); ok {
+			if err := checkSchemaKeywords(subschema, location+"/"+keyword); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateValue(schema map[string]interface{}, value interface{}, location string) error {
+	at := location
+	if len(at) == 0 {
+		at = "/"
+	}
+
+	if types := schemaStrings(schema["type"]); len(types) != 0 {
+		matched := false
+		for _, name := range types {
+			if hasType(value, name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: must be %s", at, strings.Join(types, " or "))
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		matched := false
+		var allowed []string
+		for _, option := range enum {
+			allowed = append(allowed, fmt.Sprint(option))
+			if fmt.Sprint(option) == fmt.Sprint(value) {
+				matched = true
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: must be one of %s", at, strings.Join(allowed, ", "))
+		}
+	}
+
+	switch value := value.(type) {
+	case string:
+		if minLength, ok := schema["minLength"].(float64); ok && float64(utf8.RuneCountInString(value)) < minLength {
+			return fmt.Errorf("%s: must be at least %v characters long", at, minLength)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if matched, err := regexp.MatchString(pattern, value); err != nil || !matched {
+				return fmt.Errorf("%s: '%s' does not match %s", at, value, pattern)
+			}
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range value {
+				if err := validateValue(items, item, fmt.Sprintf("%s/%d", location, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := value[fmt.Sprint(name)]; !ok {
+					return fmt.Errorf("%s: %s is required", at, name)
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			keySchema, ok := properties[key].(map[string]interface{})
+			if !ok {
+				switch additional := schema["additionalProperties"].(type) {
+				case bool:
+					if !additional {
+						return fmt.Errorf("%s: unknown field %s", at, key)
+					}
+					continue
+				case map[string]interface{}:
+					keySchema = additional
+				default:
+					continue
+				}
+			}
+			if err := validateValue(keySchema, value[key], location+"/"+key); err != nil {
+				return err
+			}
+		}
+	default:
+		if number, ok := toFloat(value); ok {
+			if minimum, ok := schema["minimum"].(float64); ok && number < minimum {
+				return fmt.Errorf("%s: must be at least %v", at, minimum)
+			}
+		}
+	}
+	return nil
+}
+
+// schemaStrings reads a keyword that is a string or a list of strings.
+func schemaStrings(keyword interface{}) []string {
+	switch keyword := keyword.(type) {
+	case string:
+		return []string{keyword}
+	case []interface{}:
+		var values []string
+		for _, value := range keyword {
+			values = append(values, fmt.Sprint(value))
+		}
+		return values
+	}
+	return nil
+}
+
+func hasType(value interface{}, name string) bool {
+	switch name {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	case "number":
+		_, ok := toFloat(value)
+		return ok
+	case "integer":
+		number, ok := toFloat(value)
+		return ok && number == math.Trunc(number)
+	}
+	return false
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case int:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case float64:
+		return value, true
+	}
+	return 0, false
+}
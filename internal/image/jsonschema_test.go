@@ -0,0 +1,98 @@
+package image
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lyon-v/squash-docker-image/schema"
+	"gopkg.in/yaml.v3"
+)
+
+// TestSquashConfigExamples loads the config files of the README, which are the ones that
+// start with the yaml-language-server comment naming the schema.
+func TestSquashConfigExamples(t *testing.T) {
+	readme, err := os.Open(filepath.Join("..", "..", "README.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readme.Close()
+
+	var examples []string
+	var example []string
+	scanner := bufio.NewScanner(readme)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "    # yaml-language-server: $schema="):
+			example = []string{line}
+		case example != nil && strings.HasPrefix(line, "    "):
+			example = append(example, strings.TrimPrefix(line, "    "))
+		case example != nil:
+			examples = append(examples, strings.Join(example, "\n")+"\n")
+			example = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(examples) == 0 {
+		t.Fatal("no config file examples in the README")
+	}
+
+	for i, example := range examples {
+		path := filepath.Join(t.TempDir(), "squash.yaml")
+		if err := os.WriteFile(path, []byte(example), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadSquashFile(path); err != nil {
+			t.Errorf("example %d of the README: %v", i+1, err)
+		}
+	}
+}
+
+func TestSquashConfigSchemaRejects(t *testing.T) {
+	tests := []struct {
+		file  string
+		error string
+	}{
+		{file: "missing-source.yaml", error: "/: source is required"},
+		{file: "empty-image.yaml", error: "/source/image: must be at least 1 characters long"},
+		{file: "unknown-field.yaml", error: "/: unknown field squash-all"},
+		{file: "wrong-version.yaml", error: "/version: must be one of 1"},
+		{file: "zero-from-layer.yaml", error: "/from-layer: must be at least 1"},
+		{file: "bad-platform.yaml", error: "/source/platforms/0: 'linux-amd64' does not match"},
+		{file: "bad-expose.yaml", error: "/config/expose/0: '8080/http' does not match"},
+		{file: "bad-compression.yaml", error: "/compression/algorithm: must be one of none, gzip, zstd, estargz"},
+		{file: "env-not-string.yaml", error: "/config/env/DEBUG: must be string"},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "squashconfig", test.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var document interface{}
+			if err := yaml.Unmarshal(data, &document); err != nil {
+				t.Fatal(err)
+			}
+			err = validateSchema(schema.SquashConfig, document)
+			if err == nil {
+				t.Fatal("the file matches the schema")
+			}
+			if !strings.Contains(err.Error(), test.error) {
+				t.Errorf("got error %q, expected %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestValidateSchemaUnsupportedKeyword(t *testing.T) {
+	schemaJSON := []byte(`{"type": "object", "properties": {"name": {"type": "string", "maxLength": 3}}}`)
+	err := validateSchema(schemaJSON, map[string]interface{}{"name": "abcd"})
+	if err == nil || !strings.Contains(err.Error(), "#/properties/name: unsupported keyword maxLength") {
+		t.Fatalf("got error %v, expected the unsupported keyword", err)
+	}
+}
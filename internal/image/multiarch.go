@@ -0,0 +1,394 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// annotationReferenceType marks the attestation manifests buildkit adds to an index.
+const annotationReferenceType = "vnd.docker.reference.type"
+
+// ParsePlatforms parses the values of --platform, given as OS/ARCH[/VARIANT] and
+// optionally separated by commas.
+func ParsePlatforms(values []string) ([]OCIPlatform, error) {
+	var platforms []OCIPlatform
+	for _, value := range values {
+		for _, spec := range strings.Split(value, ",") {
+			parts := strings.Split(strings.TrimSpace(spec), "/")
+			if len(parts) < 2 || len(parts) > 3 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+				return nil, fmt.Errorf("invalid platform '%s', expected OS/ARCH[/VARIANT]", spec)
+			}
+			platform := OCIPlatform{OS: parts[0], Architecture: parts[1]}
+			if len(parts) == 3 {
+				platform.Variant = parts[2]
+			}
+			platforms = append(platforms, platform)
+		}
+	}
+	return platforms, nil
+}
+
+// matchPlatform reports whether platform is selected by the filter. An empty filter
+// selects every platform, a filter without variant selects all variants.
+func matchPlatform(platform OCIPlatform, filter []OCIPlatform) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, want := range filter {
+		if want.OS == platform.OS && want.Architecture == platform.Architecture &&
+			(len(want.Variant) == 0 || want.Variant == platform.Variant) {
+			return true
+		}
+	}
+	return false
+}
+
+// platformImage is one platform of an image read from an OCI layout.
+type platformImage struct {
+	Platform OCIPlatform
+	Manifest OCIManifest
+}
+
+// SquashedPlatform is the result of squashing one platform of an image.
+type SquashedPlatform struct {
+	Platform OCIPlatform
+	ImageID  string
+}
+
+// readPlatformImages resolves the image named refName in the OCI layout down to the
+// manifests of its platforms. OCI indexes and Docker manifest lists are followed,
+// attestation manifests are left out.
+func readPlatformImages(layoutDir, refName string, filter []OCIPlatform) ([]platformImage, error) {
+	var index OCIIndex
+	data, err := ioutil.ReadFile(filepath.Join(layoutDir, "index.json"))
+	if err != nil {
+		return nil, NewCorruptArchiveError("failed to read index.json", err)
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, NewCorruptArchiveError("failed to unmarshal index.json", err)
+	}
+
+	descriptors, err := selectIndexEntries(index, refName)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []platformImage
+	if err := collectPlatformImages(layoutDir, descriptors, filter, &images); err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("the image has no manifest for the selected platforms")
+	}
+	return images, nil
+}
+
+// selectIndexEntries picks the descriptors of index.json naming the image. Without a
+// reference name all entries are used, so a layout whose index.json lists the
+// platforms directly works as well.
+func selectIndexEntries(index OCIIndex, refName string) ([]OCIDescriptor, error) {
+	var descriptors []OCIDescriptor
+	seen := make(map[string]bool)
+	for _, descriptor := range index.Manifests {
+		if len(refName) != 0 {
+			ref := descriptor.Annotations[AnnotationRefName]
+			name := descriptor.Annotations[AnnotationImageName]
+			if ref != refName && name != refName && !strings.HasSuffix(name, ":"+refName) {
+				continue
+			}
+		}
+		// Every tag of an image has its own entry pointing at the same manifest
+		if seen[descriptor.Digest] {
+			continue
+		}
+		seen[descriptor.Digest] = true
+		descriptors = append(descriptors, descriptor)
+	}
+	if len(descriptors) == 0 {
+		return nil, fmt.Errorf("no image named '%s' in the OCI layout", refName)
+	}
+	return descriptors, nil
+}
+
+func collectPlatformImages(layoutDir string, descriptors []OCIDescriptor, filter []OCIPlatform, images *[]platformImage) error {
+	for _, descriptor := range descriptors {
+		if descriptor.Annotations[annotationReferenceType] == "attestation-manifest" {
+			continue
+		}
+		if descriptor.Platform != nil && !matchPlatform(*descriptor.Platform, filter) {
+			continue
+		}
+
+		if err := checkDigest(descriptor.Digest); err != nil {
+			return err
+		}
+		blob, err := checkArchiveFile(layoutDir, blobPath(descriptor.Digest))
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(blob)
+		if err != nil {
+			return NewCorruptArchiveError(fmt.Sprintf("failed to read blob %s", descriptor.Digest), err)
+		}
+		if digest := "sha256:" + sha256Hex(data); digest != descriptor.Digest {
+			return NewVerificationError(fmt.Sprintf("blob digest mismatch, expected %s, got %s", descriptor.Digest, digest))
+		}
+
+		mediaType := descriptor.MediaType
+		if len(mediaType) == 0 {
+			var content struct {
+				MediaType string `json:"mediaType"`
+			}
+			json.Unmarshal(data, &content)
+			mediaType = content.MediaType
+		}
+
+		switch mediaType {
+		case MediaTypeImageIndex, MediaTypeDockerManifestList:
+			var index OCIIndex
+			if err := json.Unmarshal(data, &index); err != nil {
+				return NewCorruptArchiveError(fmt.Sprintf("failed to unmarshal index %s", descriptor.Digest), err)
+			}
+			if err := collectPlatformImages(layoutDir, index.Manifests, filter, images); err != nil {
+				return err
+			}
+		case MediaTypeImageManifest, MediaTypeDockerManifest:
+			var manifest OCIManifest
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return NewCorruptArchiveError(fmt.Sprintf("failed to unmarshal manifest %s", descriptor.Digest), err)
+			}
+			for _, blob := range append([]OCIDescriptor{manifest.Config}, manifest.Layers...) {
+				if err := checkDigest(blob.Digest); err != nil {
+					return err
+				}
+			}
+			platform, err := manifestPlatform(layoutDir, descriptor, manifest)
+			if err != nil {
+				return err
+			}
+			if platform.OS == "unknown" || !matchPlatform(platform, filter) {
+				continue
+			}
+			*images = append(*images, platformImage{Platform: platform, Manifest: manifest})
+		default:
+			return fmt.Errorf("unsupported media type '%s' of %s", mediaType, descriptor.Digest)
+		}
+	}
+	return nil
+}
+
+// manifestPlatform returns the platform of the descriptor, or the one in the image
+// config when the descriptor does not name it.
+func manifestPlatform(layoutDir string, descriptor OCIDescriptor, manifest OCIManifest) (OCIPlatform, error) {
+	if descriptor.Platform != nil {
+		return *descriptor.Platform, nil
+	}
+	configPath, err := checkArchiveFile(layoutDir, blobPath(manifest.Config.Digest))
+	if err != nil {
+		return OCIPlatform{}, err
+	}
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return OCIPlatform{}, fmt.Errorf("failed to read image config: %w", err)
+	}
+	var config ImageConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return OCIPlatform{}, NewCorruptArchiveError("failed to unmarshal image config", err)
+	}
+	return OCIPlatform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}, nil
+}
+
+// RunIndex squashes every platform of an image read from an OCI layout, an OCI archive
+// or a registry. Several platforms are exported as a new image index.
+func (s *Squash) RunIndex(ctx context.Context, source ImageSource) (results []SquashedPlatform, err error) {
+	if s.resume {
+		return nil, errResumeUnsupported
+	}
+	if s.verify {
+		return nil, errVerifyUnsupported
+	}
+	if err := s.validateOutput(); err != nil {
+		return nil, err
+	}
+
+	tmpDir, err := createTmpDirectory(s.tmpDir, "")
+	if err != nil {
+		return nil, err
+	}
+	s.logs.Infof("Using %s as the temporary directory", tmpDir)
+	defer func() { s.abort(ctx, err, tmpDir) }()
+
+	lead := NewV2Image(s)
+	lead.TmpDir = tmpDir
+	sourceDir := filepath.Join(tmpDir, "source")
+	if err := os.Mkdir(sourceDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	layoutDir, err := lead.openLayout(ctx, source, sourceDir, s.platforms)
+	if err != nil {
+		return nil, err
+	}
+
+	platformImages, err := readPlatformImages(layoutDir, source.RefName, s.platforms)
+	if err != nil {
+		return nil, fmt.Errorf("image '%s': %w", s.image, err)
+	}
+	loadImage := s.loadImage
+	if len(platformImages) > 1 {
+		if len(s.outputPath) == 0 {
+			return nil, fmt.Errorf("the image has %d platforms, docker cannot load more than one of them; use --output-path or select one with --platform", len(platformImages))
+		}
+		if loadImage {
+			s.logs.Warnf("Not loading the squashed image, docker cannot load all %d platforms of it", len(platformImages))
+			loadImage = false
+		}
+	}
+
+	state := newBatchState()
+	newImageDir := filepath.Join(tmpDir, "new")
+	if err := os.Mkdir(newImageDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	s.squashed = nil
+	for i, platformImage := range platformImages {
+		img := lead
+		if i != 0 {
+			img = NewV2Image(s)
+			img.TmpDir = tmpDir
+		}
+		img.batch = state
+		img.setFormat(FormatOCI)
+		img.OldImageDir = layoutDir
+		img.NewImageDir = newImageDir
+		img.SquashedDir = filepath.Join(newImageDir, fmt.Sprintf("squashed-%d", i))
+		img.SquashedTar = filepath.Join(img.SquashedDir, "layer.tar")
+
+		platform := platformImage.Platform
+		img.platform = &platform
+
+		s.logs.Infof("Squashing platform %s (%d of %d)...", platformImage.Platform, i+1, len(platformImages))
+		newImageID, err := img.squashPlatform(ctx, platformImage)
+		if err != nil {
+			return nil, fmt.Errorf("platform %s: %w", platformImage.Platform, err)
+		}
+		s.squashed = append(s.squashed, img)
+		if len(platformImages) > 1 {
+			state.platforms = append(state.platforms, platform)
+		}
+		results = append(results, SquashedPlatform{Platform: platformImage.Platform, ImageID: newImageID})
+	}
+
+	if layoutDir == sourceDir {
+		s.logs.Infof("Cleaning up %s temporary directory...", sourceDir)
+		if err := os.RemoveAll(sourceDir); err != nil {
+			s.logs.Errorf("Cleaning up temporary directory failed: %v", err)
+		}
+	}
+
+	if len(s.outputPath) != 0 {
+		if err := lead.ExportTarArchive(ctx, s.outputPath); err != nil {
+			return nil, err
+		}
+	}
+	if loadImage {
+		if err := lead.LoadSquashedImage(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// squashPlatform squashes the image of one platform. The layers are taken straight from
+// the OCI layout, the history in its config decides which of them are squashed.
+func (im *V2Image) squashPlatform(ctx context.Context, platformImage platformImage) (string, error) {
+	manifest := platformImage.Manifest
+	im.OldImageId = manifest.Config.Digest
+	im.OldManifest = ImageManifest{Config: blobPath(manifest.Config.Digest)}
+	for _, layer := range manifest.Layers {
+		im.OldManifest.Layers = append(im.OldManifest.Layers, blobPath(layer.Digest))
+	}
+	if err := im.getIamgeConfig(); err != nil {
+		return "", err
+	}
+	im.readHistoryLayers(manifest)
+
+	if err := im.resolveFromLayer(manifest); err != nil {
+		return "", err
+	}
+	if err := im.splitLayers(ctx); err != nil {
+		return "", err
+	}
+	if err := im.readSavedImage(ctx); err != nil {
+		return "", err
+	}
+	newImageID, err := im.squash(ctx)
+	if err != nil {
+		return "", err
+	}
+	if err := im.afterSquashing(); err != nil {
+		return "", err
+	}
+	return newImageID, nil
+}
+
+// readHistoryLayers fills OldImageLayers with one entry per history item, like the
+// image history of the daemon: the layer digest, or <missing> for empty layers.
+func (im *V2Image) readHistoryLayers(manifest OCIManifest) {
+	nonEmpty := 0
+	for _, item := range im.OldImageConfig.History {
+		if !item.EmptyLayer {
+			nonEmpty++
+		}
+	}
+	// Images built without history get one history item per layer
+	if nonEmpty != len(manifest.Layers) {
+		im.Logger.Debugf("Image history does not match its %d layers, using one item per layer", len(manifest.Layers))
+		im.OldImageConfig.History = nil
+		for range manifest.Layers {
+			im.OldImageConfig.History = append(im.OldImageConfig.History, HistoryItem{Created: im.OldImageConfig.Created})
+		}
+	}
+
+	im.OldImageLayers = nil
+	layer := 0
+	for _, item := range im.OldImageConfig.History {
+		if item.EmptyLayer {
+			im.OldImageLayers = append(im.OldImageLayers, "<missing>")
+			continue
+		}
+		im.OldImageLayers = append(im.OldImageLayers, manifest.Layers[layer].Digest)
+		layer++
+	}
+}
+
+// resolveFromLayer turns a layer digest or diff_id given as --from-layer into the number
+// of history items to squash, there is no daemon to look up layer IDs in.
+func (im *V2Image) resolveFromLayer(manifest OCIManifest) error {
+	if len(im.FromLayer) == 0 {
+		im.FromLayer = fmt.Sprintf("%d", len(im.OldImageLayers))
+		return nil
+	}
+	if _, err := strconv.Atoi(im.FromLayer); err == nil {
+		return nil
+	}
+
+	wanted := im.FromLayer
+	if !strings.HasPrefix(wanted, "sha256:") {
+		wanted = "sha256:" + wanted
+	}
+	for i, layer := range manifest.Layers {
+		if layer.Digest == wanted || (i < len(im.OldImageConfig.Rootfs.DiffIds) && im.OldImageConfig.Rootfs.DiffIds[i] == wanted) {
+			index := FindIndex(im.OldImageLayers, layer.Digest)
+			im.FromLayer = fmt.Sprintf("%d", len(im.OldImageLayers)-index-1)
+			return nil
+		}
+	}
+	return NewInvalidLayerError(fmt.Sprintf("the %s layer could not be found in the %s image", im.FromLayer, im.Image))
+}
@@ -0,0 +1,493 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The platforms of the image in the layout of writePlatformLayout, in the order of its
+// index.
+var layoutPlatforms = []OCIPlatform{
+	{OS: "linux", Architecture: "amd64"},
+	{OS: "linux", Architecture: "arm64", Variant: "v8"},
+	{OS: "linux", Architecture: "arm", Variant: "v7"},
+}
+
+// platformLayout is an OCI image layout holding app:1.0 for layoutPlatforms, with the
+// digests of the blobs of each platform.
+type platformLayout struct {
+	dir   string
+	index string
+	// blobs of each platform: the manifest, config and layers
+	blobs map[string][]string
+}
+
+// writePlatformLayout writes an image of two layers per platform, both holding a file
+// naming the platform, and an index listing them like buildkit does, with an
+// attestation manifest.
+func writePlatformLayout(t *testing.T) platformLayout {
+	layout := platformLayout{dir: t.TempDir(), blobs: make(map[string][]string)}
+	blobs := filepath.Join(layout.dir, blobsDir)
+	if err := os.MkdirAll(blobs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeJSONBlob := func(mediaType string, value interface{}) OCIDescriptor {
+		data, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		descriptor, err := writeBlob(blobs, mediaType, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return descriptor
+	}
+
+	index := OCIIndex{SchemaVersion: 2, MediaType: MediaTypeImageIndex}
+	for _, platform := range layoutPlatforms {
+		var layers []OCIDescriptor
+		var diffIDs []string
+		for _, files := range []map[string]string{
+			{"etc/platform": platform.String()},
+			{"app/bin": fmt.Sprintf("app for %s", platform)},
+		} {
+			descriptor, err := writeBlob(blobs, MediaTypeImageLayer, fakeLayerTar(t, files))
+			if err != nil {
+				t.Fatal(err)
+			}
+			layers = append(layers, descriptor)
+			diffIDs = append(diffIDs, descriptor.Digest)
+		}
+		config := writeJSONBlob(MediaTypeImageConfig, ImageConfig{
+			Architecture: platform.Architecture,
+			OS:           platform.OS,
+			Variant:      platform.Variant,
+			Rootfs:       Rootfs{Type: "layers", DiffIds: diffIDs},
+			History:      []HistoryItem{{CreatedBy: "ADD rootfs"}, {CreatedBy: "COPY app"}},
+		})
+		manifest := writeJSONBlob(MediaTypeImageManifest, OCIManifest{SchemaVersion: 2, MediaType: MediaTypeImageManifest, Config: config, Layers: layers})
+		platform := platform
+		manifest.Platform = &platform
+		index.Manifests = append(index.Manifests, manifest)
+
+		key := platform.String()
+		layout.blobs[key] = append(layout.blobs[key], manifest.Digest, config.Digest)
+		for _, layer := range layers {
+			layout.blobs[key] = append(layout.blobs[key], layer.Digest)
+		}
+	}
+	// The attestation manifest is not in the layout, it must never be read
+	index.Manifests = append(index.Manifests, OCIDescriptor{
+		MediaType:   MediaTypeImageManifest,
+		Digest:      "sha256:" + strings.Repeat("a", 64),
+		Size:        100,
+		Annotations: map[string]string{annotationReferenceType: "attestation-manifest"},
+		Platform:    &OCIPlatform{OS: "unknown", Architecture: "unknown"},
+	})
+	indexDescriptor := writeJSONBlob(MediaTypeImageIndex, index)
+	layout.index = indexDescriptor.Digest
+	indexDescriptor.Annotations = map[string]string{AnnotationImageName: "app:1.0", AnnotationRefName: "1.0"}
+
+	if err := writeJsonFile(filepath.Join(layout.dir, "index.json"), OCIIndex{SchemaVersion: 2, MediaType: MediaTypeImageIndex, Manifests: []OCIDescriptor{indexDescriptor}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeJsonFile(filepath.Join(layout.dir, "oci-layout"), OCILayout{ImageLayoutVersion: ociLayoutVersion}); err != nil {
+		t.Fatal(err)
+	}
+	return layout
+}
+
+func TestParsePlatforms(t *testing.T) {
+	tests := []struct {
+		values    []string
+		platforms []OCIPlatform
+		err       bool
+	}{
+		{values: nil},
+		{values: []string{"linux/amd64"}, platforms: layoutPlatforms[:1]},
+		{values: []string{"linux/amd64", "linux/arm64/v8, linux/arm/v7"}, platforms: layoutPlatforms},
+		{values: []string{"linux"}, err: true},
+		{values: []string{"linux/"}, err: true},
+		{values: []string{"/amd64"}, err: true},
+		{values: []string{"linux/arm/v7/extra"}, err: true},
+		{values: []string{"linux/amd64,"}, err: true},
+	}
+	for _, test := range tests {
+		platforms, err := ParsePlatforms(test.values)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: parsed %v, expected an error", test.values, platforms)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.values, err)
+			continue
+		}
+		if !reflect.DeepEqual(platforms, test.platforms) {
+			t.Errorf("%q: parsed %v, expected %v", test.values, platforms, test.platforms)
+		}
+	}
+}
+
+func TestMatchPlatform(t *testing.T) {
+	armV7 := OCIPlatform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	tests := []struct {
+		filter []OCIPlatform
+		match  bool
+	}{
+		{filter: nil, match: true},
+		{filter: []OCIPlatform{{OS: "linux", Architecture: "arm"}}, match: true},
+		{filter: []OCIPlatform{{OS: "linux", Architecture: "arm", Variant: "v7"}}, match: true},
+		{filter: []OCIPlatform{{OS: "linux", Architecture: "arm", Variant: "v6"}}},
+		{filter: []OCIPlatform{{OS: "linux", Architecture: "arm64"}}},
+		{filter: []OCIPlatform{{OS: "windows", Architecture: "arm"}}},
+		{filter: []OCIPlatform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm"}}, match: true},
+	}
+	for _, test := range tests {
+		if match := matchPlatform(armV7, test.filter); match != test.match {
+			t.Errorf("filter %v matches %s: %v, expected %v", test.filter, armV7, match, test.match)
+		}
+	}
+}
+
+func TestReadPlatformImages(t *testing.T) {
+	layout := writePlatformLayout(t)
+	tests := []struct {
+		refName   string
+		filter    []string
+		platforms []OCIPlatform
+		err       string
+	}{
+		// The attestation manifest is left out, it is not even in the layout
+		{platforms: layoutPlatforms},
+		{refName: "1.0", platforms: layoutPlatforms},
+		{refName: "app:1.0", platforms: layoutPlatforms},
+		{refName: "2.0", err: "no image named '2.0' in the OCI layout"},
+		{filter: []string{"linux/arm64"}, platforms: layoutPlatforms[1:2]},
+		{filter: []string{"linux/arm/v7", "linux/amd64"}, platforms: []OCIPlatform{layoutPlatforms[0], layoutPlatforms[2]}},
+		{filter: []string{"linux/arm/v6"}, err: "the image has no manifest for the selected platforms"},
+		{filter: []string{"unknown/unknown"}, err: "the image has no manifest for the selected platforms"},
+	}
+	for _, test := range tests {
+		filter, err := ParsePlatforms(test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		images, err := readPlatformImages(layout.dir, test.refName, filter)
+		if len(test.err) != 0 {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("ref %q, platforms %v: got error %v, expected %q", test.refName, test.filter, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ref %q, platforms %v: %v", test.refName, test.filter, err)
+			continue
+		}
+		var platforms []OCIPlatform
+		for _, img := range images {
+			platforms = append(platforms, img.Platform)
+			if img.Manifest.Config.Digest != layout.blobs[img.Platform.String()][1] {
+				t.Errorf("%s has the config %s, expected the one of its platform", img.Platform, img.Manifest.Config.Digest)
+			}
+		}
+		if !reflect.DeepEqual(platforms, test.platforms) {
+			t.Errorf("ref %q, platforms %v: got %v, expected %v", test.refName, test.filter, platforms, test.platforms)
+		}
+	}
+}
+
+// TestReadPlatformImagesFromConfig takes the platform from the image config when the
+// index does not name it.
+func TestReadPlatformImagesFromConfig(t *testing.T) {
+	layout := writePlatformLayout(t)
+	data, err := os.ReadFile(filepath.Join(layout.dir, blobPath(layout.index)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index OCIIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatal(err)
+	}
+	for i := range index.Manifests {
+		index.Manifests[i].Platform = nil
+	}
+	if err := writeJsonFile(filepath.Join(layout.dir, "index.json"), index); err != nil {
+		t.Fatal(err)
+	}
+	// Without platform the attestation manifest is only left out by its annotation
+	images, err := readPlatformImages(layout.dir, "", []OCIPlatform{{OS: "linux", Architecture: "arm"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Platform != layoutPlatforms[2] {
+		t.Errorf("got the images %v, expected %s", images, layoutPlatforms[2])
+	}
+}
+
+func TestRunIndexPlatforms(t *testing.T) {
+	layout := writePlatformLayout(t)
+	tests := []struct {
+		platforms []string
+		squashed  []OCIPlatform
+	}{
+		{squashed: layoutPlatforms},
+		{platforms: []string{"linux/arm64", "linux/arm"}, squashed: layoutPlatforms[1:]},
+		{platforms: []string{"linux/arm/v7"}, squashed: layoutPlatforms[2:]},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.platforms, ","), func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "squashed.tar")
+			cli := CLI{
+				Image:      "oci:" + layout.dir + ":1.0",
+				Tags:       []string{"app:squashed"},
+				OutputPath: output,
+				TmpDir:     filepath.Join(t.TempDir(), "work"),
+				Platforms:  test.platforms,
+			}
+			squash, err := NewSquashWithStore(cli, newFakeStore(t), testLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			results, err := squash.RunIndex(context.Background(), ParseImageSource(cli.Image))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var platforms []OCIPlatform
+			for _, result := range results {
+				platforms = append(platforms, result.Platform)
+			}
+			if !reflect.DeepEqual(platforms, test.squashed) {
+				t.Fatalf("squashed %v, expected %v", platforms, test.squashed)
+			}
+
+			data, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files := readArchive(t, data)
+			readJSON := func(name string, value interface{}) {
+				content, ok := files[name]
+				if !ok {
+					t.Fatalf("the archive has no %s", name)
+				}
+				if err := json.Unmarshal(content, value); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var index OCIIndex
+			readJSON("index.json", &index)
+			if len(index.Manifests) != 1 || index.Manifests[0].Annotations[AnnotationImageName] != "docker.io/library/app:squashed" {
+				t.Fatalf("index.json lists %v, expected the squashed image", index.Manifests)
+			}
+			manifests := index.Manifests
+			_, hasManifest := files["manifest.json"]
+			if len(test.squashed) > 1 {
+				// Several platforms are listed by a new image index, docker cannot load them
+				if index.Manifests[0].MediaType != MediaTypeImageIndex {
+					t.Fatalf("index.json points at a %s, expected an image index", index.Manifests[0].MediaType)
+				}
+				if hasManifest {
+					t.Error("the archive of several platforms has a manifest.json")
+				}
+				if squash.Results()[0].IndexDigest != index.Manifests[0].Digest {
+					t.Errorf("the result has the index %s, expected %s", squash.Results()[0].IndexDigest, index.Manifests[0].Digest)
+				}
+				var platformIndex OCIIndex
+				readJSON(path.Join(blobsDir, strings.TrimPrefix(index.Manifests[0].Digest, "sha256:")), &platformIndex)
+				manifests = platformIndex.Manifests
+			} else if !hasManifest {
+				t.Error("the archive of a single platform has no manifest.json")
+			}
+			if len(manifests) != len(test.squashed) {
+				t.Fatalf("the index lists %d manifests, expected %d", len(manifests), len(test.squashed))
+			}
+
+			for i, descriptor := range manifests {
+				platform := test.squashed[i]
+				if len(test.squashed) > 1 && (descriptor.Platform == nil || *descriptor.Platform != platform) {
+					t.Errorf("manifest %d has the platform %v, expected %s", i, descriptor.Platform, platform)
+				}
+				var manifest OCIManifest
+				readJSON(path.Join(blobsDir, strings.TrimPrefix(descriptor.Digest, "sha256:")), &manifest)
+				var config ImageConfig
+				readJSON(path.Join(blobsDir, strings.TrimPrefix(manifest.Config.Digest, "sha256:")), &config)
+				if config.OS != platform.OS || config.Architecture != platform.Architecture || config.Variant != platform.Variant {
+					t.Errorf("manifest %d has the config of %s/%s/%s, expected %s", i, config.OS, config.Architecture, config.Variant, platform)
+				}
+				if len(manifest.Layers) != 1 {
+					t.Fatalf("manifest %d has %d layers, expected the squashed one", i, len(manifest.Layers))
+				}
+				layer := readArchive(t, files[path.Join(blobsDir, strings.TrimPrefix(manifest.Layers[0].Digest, "sha256:"))])
+				if string(layer["etc/platform"]) != platform.String() || string(layer["app/bin"]) != "app for "+platform.String() {
+					t.Errorf("the squashed layer of %s holds %v, expected the files of its platform", platform, layer)
+				}
+			}
+		})
+	}
+}
+
+func TestRunIndexLoadPlatforms(t *testing.T) {
+	layout := writePlatformLayout(t)
+	cli := CLI{Image: "oci:" + layout.dir, LoadImage: true, TmpDir: filepath.Join(t.TempDir(), "work")}
+	squash, err := NewSquashWithStore(cli, newFakeStore(t), testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = squash.RunIndex(context.Background(), ParseImageSource(cli.Image))
+	if err == nil || !strings.Contains(err.Error(), "the image has 3 platforms, docker cannot load more than one of them") {
+		t.Fatalf("got error %v, expected the platforms not to be loadable", err)
+	}
+
+	store := newFakeStore(t)
+	cli.Platforms = []string{"linux/amd64"}
+	cli.TmpDir = filepath.Join(t.TempDir(), "work")
+	squash, err = NewSquashWithStore(cli, store, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := squash.RunIndex(context.Background(), ParseImageSource(cli.Image)); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.loaded) != 1 {
+		t.Errorf("loaded %d images, expected the selected platform", len(store.loaded))
+	}
+}
+
+// registryServer serves the image of a platform layout as app:1.0 over the
+// distribution API and records the requested paths.
+type registryServer struct {
+	*httptest.Server
+	layout platformLayout
+
+	mu        sync.Mutex
+	requested []string
+}
+
+func newRegistryServer(t *testing.T, layout platformLayout) *registryServer {
+	rs := &registryServer{layout: layout}
+	rs.Server = httptest.NewServer(http.HandlerFunc(rs.serve))
+	t.Cleanup(rs.Close)
+	// No credentials of the user are sent to the registry
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	return rs
+}
+
+func (rs *registryServer) serve(w http.ResponseWriter, r *http.Request) {
+	kind, ref, found := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/app/"), "/")
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	rs.mu.Lock()
+	rs.requested = append(rs.requested, ref)
+	rs.mu.Unlock()
+
+	if kind == "manifests" && ref == "1.0" {
+		ref = rs.layout.index
+	}
+	if !strings.HasPrefix(ref, "sha256:") || (kind != "manifests" && kind != "blobs") {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := os.ReadFile(filepath.Join(rs.layout.dir, blobPath(ref)))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(data)
+}
+
+func (rs *registryServer) image() string {
+	return strings.TrimPrefix(rs.URL, "http://") + "/app:1.0"
+}
+
+func TestPullImagePlatforms(t *testing.T) {
+	layout := writePlatformLayout(t)
+	tests := []struct {
+		platforms []string
+		pulled    []OCIPlatform
+	}{
+		{pulled: layoutPlatforms},
+		{platforms: []string{"linux/arm/v7"}, pulled: layoutPlatforms[2:]},
+		{platforms: []string{"linux/amd64", "linux/arm64"}, pulled: layoutPlatforms[:2]},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.platforms, ","), func(t *testing.T) {
+			rs := newRegistryServer(t, layout)
+			filter, err := ParsePlatforms(test.platforms)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir := t.TempDir()
+			if err := pullImage(context.Background(), rs.image(), dir, filter, testLogger()); err != nil {
+				t.Fatal(err)
+			}
+
+			// Only the blobs of the selected platforms are pulled, never the attestation
+			expected := []string{"1.0"}
+			for _, platform := range test.pulled {
+				expected = append(expected, layout.blobs[platform.String()]...)
+			}
+			if !reflect.DeepEqual(rs.requested, expected) {
+				t.Errorf("requested %v, expected %v", rs.requested, expected)
+			}
+
+			var index OCIIndex
+			data, err := os.ReadFile(filepath.Join(dir, "index.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(data, &index); err != nil {
+				t.Fatal(err)
+			}
+			if len(index.Manifests) != 1 || index.Manifests[0].Digest != layout.index || index.Manifests[0].Annotations[AnnotationRefName] != "1.0" {
+				t.Errorf("index.json lists %v, expected the index of the image", index.Manifests)
+			}
+
+			images, err := readPlatformImages(dir, "1.0", filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var platforms []OCIPlatform
+			for _, img := range images {
+				platforms = append(platforms, img.Platform)
+			}
+			if !reflect.DeepEqual(platforms, test.pulled) {
+				t.Errorf("the pulled layout has %v, expected %v", platforms, test.pulled)
+			}
+		})
+	}
+}
+
+func TestRunIndexRegistry(t *testing.T) {
+	rs := newRegistryServer(t, writePlatformLayout(t))
+	output := filepath.Join(t.TempDir(), "squashed.tar")
+	cli := CLI{Image: "docker://" + rs.image(), OutputPath: output, TmpDir: filepath.Join(t.TempDir(), "work"), Platforms: []string{"linux/arm64"}}
+	squash, err := NewSquashWithStore(cli, newFakeStore(t), testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := squash.RunIndex(context.Background(), ParseImageSource(cli.Image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Platform != layoutPlatforms[1] {
+		t.Errorf("squashed %v, expected %s", results, layoutPlatforms[1])
+	}
+	if _, err := os.Stat(output); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,415 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	MediaTypeImageIndex     = "application/vnd.oci.image.index.v1+json"
+	MediaTypeImageManifest  = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeImageConfig    = "application/vnd.oci.image.config.v1+json"
+	MediaTypeImageLayer     = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeImageLayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	// Docker's own media types, used by registries and the Docker image store
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+
+	AnnotationImageName = "io.containerd.image.name"
+	AnnotationRefName   = "org.opencontainers.image.ref.name"
+
+	ociLayoutVersion = "1.0.0"
+	blobsDir         = "blobs/sha256"
+)
+
+type OCIDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *OCIPlatform      `json:"platform,omitempty"`
+}
+
+type OCIPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p OCIPlatform) String() string {
+	if len(p.Variant) != 0 {
+		return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+	}
+	return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+}
+
+type OCIManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        OCIDescriptor     `json:"config"`
+	Layers        []OCIDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type OCIIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Manifests     []OCIDescriptor   `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type OCILayout struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+// writeBlobLayout builds an archive layout in exportDir that docker can load and that
+// is a valid OCI image layout at the same time: layers and config are stored as blobs,
+// referenced both from manifest.json and from the OCI manifests in index.json. The
+// platforms of a multi-platform image are referenced from a new image index instead.
+func (im *V2Image) writeBlobLayout(ctx context.Context, exportDir string, progress *phaseProgress) error {
+	manifests, err := readManifestFile(filepath.Join(im.NewImageDir, "manifest.json"))
+	if err != nil {
+		return err
+	}
+
+	blobs := filepath.Join(exportDir, blobsDir)
+	if err := os.MkdirAll(blobs, 0755); err != nil {
+		return fmt.Errorf("failed to create blobs directory: %w", err)
+	}
+
+	// Layers shared by several images are compressed only once
+	var layerFiles []string
+	layerIndex := make(map[string]int)
+	for _, manifest := range manifests {
+		for _, layer := range manifest.Layers {
+			if _, ok := layerIndex[layer]; !ok {
+				layerIndex[layer] = len(layerFiles)
+				layerFiles = append(layerFiles, filepath.Join(im.NewImageDir, layer))
+			}
+		}
+	}
+	if im.Compression == CompressionNone {
+		im.Logger.Infof("Writing %d layers as blobs...", len(layerFiles))
+	} else {
+		im.Logger.Infof("Compressing %d layers with %s...", len(layerFiles), im.Compression)
+	}
+	finished := 0
+	compressed, err := compressLayers(ctx, layerFiles, blobs, im.Compression, im.CompressionLevel, func(i int, layer compressedLayer, size int64) {
+		finished++
+		progress.layer(ProgressEvent{
+			Layer:        layer.Digest,
+			LayerIndex:   finished,
+			LayerCount:   len(layerFiles),
+			BytesRead:    size,
+			BytesWritten: layer.Size,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	index := OCIIndex{SchemaVersion: 2, MediaType: MediaTypeImageIndex}
+	var dockerManifests []ImageManifest
+	for i, manifest := range manifests {
+		var layers []compressedLayer
+		for _, layer := range manifest.Layers {
+			layers = append(layers, compressed[layerIndex[layer]])
+		}
+
+		dockerManifest, descriptor, err := im.writeImageBlobs(blobs, manifest, layers)
+		if err != nil {
+			return err
+		}
+		im.exported = append(im.exported, exportedManifest{
+			Descriptor: descriptor,
+			Config:     "sha256:" + filepath.Base(dockerManifest.Config),
+			Layers:     layers,
+		})
+
+		if im.batch.multiPlatform() {
+			platform := im.batch.platforms[i]
+			descriptor.Platform = &platform
+			index.Manifests = append(index.Manifests, descriptor)
+			continue
+		}
+
+		dockerManifests = append(dockerManifests, dockerManifest)
+		descriptors, err := taggedDescriptors(descriptor, manifest.RepoTags)
+		if err != nil {
+			return err
+		}
+		index.Manifests = append(index.Manifests, descriptors...)
+	}
+
+	if im.batch.multiPlatform() {
+		// index.json points at the new multi-platform index, docker's manifest.json
+		// cannot describe more than one platform of an image
+		indexData, err := json.Marshal(index)
+		if err != nil {
+			return err
+		}
+		indexDescriptor, err := writeBlob(blobs, MediaTypeImageIndex, indexData)
+		if err != nil {
+			return err
+		}
+		im.Logger.Infof("Squashed image index: %s", indexDescriptor.Digest)
+		im.exportIndex = indexDescriptor.Digest
+
+		var tags []string
+		for _, tag := range im.Tags {
+			tags = append(tags, tag.String())
+		}
+		descriptors, err := taggedDescriptors(indexDescriptor, tags)
+		if err != nil {
+			return err
+		}
+		index = OCIIndex{SchemaVersion: 2, MediaType: MediaTypeImageIndex, Manifests: descriptors}
+	}
+
+	if err := writeJsonFile(filepath.Join(exportDir, "index.json"), index); err != nil {
+		return err
+	}
+	if err := writeJsonFile(filepath.Join(exportDir, "oci-layout"), OCILayout{ImageLayoutVersion: ociLayoutVersion}); err != nil {
+		return err
+	}
+	if len(dockerManifests) == 0 {
+		return nil
+	}
+	return writeJsonFile(filepath.Join(exportDir, "manifest.json"), dockerManifests)
+}
+
+// configPath is the path of the config of the new image. Images read from an OCI layout
+// store it as a blob, Docker archives next to the layer directories.
+func (im *V2Image) configPath(imageID string) string {
+	if im.OCIFormat {
+		return blobPath("sha256:" + imageID)
+	}
+	return imageID + ".json"
+}
+
+// moveSquashedBlob moves the squashed layer into the blobs of the new image and returns
+// its path. The layer is not compressed, so its digest is its diff_id.
+func (im *V2Image) moveSquashedBlob() (string, error) {
+	layerPath := blobPath("sha256:" + im.DiffIDs[len(im.DiffIDs)-1])
+	destPath := filepath.Join(im.NewImageDir, layerPath)
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create blobs directory: %w", err)
+	}
+	if err := os.Rename(im.SquashedTar, destPath); err != nil {
+		return "", NewIOError("failed to move the squashed layer", err)
+	}
+	if err := os.RemoveAll(im.SquashedDir); err != nil {
+		im.Logger.Debugf("Failed to remove %s: %v", im.SquashedDir, err)
+	}
+	return layerPath, nil
+}
+
+// writeImageIndex makes the new image directory an OCI image layout like the archives of
+// Docker 25 and newer: the images of manifest.json get an OCI manifest blob each, listed
+// in index.json under their tags. The classic image store of docker loads manifest.json,
+// the containerd image store index.json.
+func (im *V2Image) writeImageIndex() error {
+	manifests, err := readManifestFile(filepath.Join(im.NewImageDir, "manifest.json"))
+	if err != nil {
+		return err
+	}
+	blobs := filepath.Join(im.NewImageDir, blobsDir)
+
+	index := OCIIndex{SchemaVersion: 2, MediaType: MediaTypeImageIndex}
+	for _, manifest := range manifests {
+		ociManifest := OCIManifest{SchemaVersion: 2, MediaType: MediaTypeImageManifest}
+		if ociManifest.Config, err = im.blobDescriptor(manifest.Config, MediaTypeImageConfig); err != nil {
+			return err
+		}
+		for _, layer := range manifest.Layers {
+			mediaType, err := layerMediaType(filepath.Join(im.NewImageDir, layer))
+			if err != nil {
+				return NewIOError(fmt.Sprintf("failed to read layer %s", layer), err)
+			}
+			descriptor, err := im.blobDescriptor(layer, mediaType)
+			if err != nil {
+				return err
+			}
+			ociManifest.Layers = append(ociManifest.Layers, descriptor)
+		}
+
+		manifestData, err := json.Marshal(ociManifest)
+		if err != nil {
+			return err
+		}
+		descriptor, err := writeBlob(blobs, MediaTypeImageManifest, manifestData)
+		if err != nil {
+			return err
+		}
+		descriptors, err := taggedDescriptors(descriptor, manifest.RepoTags)
+		if err != nil {
+			return err
+		}
+		index.Manifests = append(index.Manifests, descriptors...)
+	}
+
+	if err := writeJsonFile(filepath.Join(im.NewImageDir, "index.json"), index); err != nil {
+		return err
+	}
+	return writeJsonFile(filepath.Join(im.NewImageDir, "oci-layout"), OCILayout{ImageLayoutVersion: ociLayoutVersion})
+}
+
+// blobDescriptor describes a blob of the new image given by its path.
+func (im *V2Image) blobDescriptor(path, mediaType string) (OCIDescriptor, error) {
+	if filepath.Dir(path) != blobsDir {
+		return OCIDescriptor{}, NewCorruptArchiveError(fmt.Sprintf("'%s' is not a blob of the OCI layout", path), nil)
+	}
+	info, err := os.Stat(filepath.Join(im.NewImageDir, path))
+	if err != nil {
+		return OCIDescriptor{}, NewIOError(fmt.Sprintf("failed to read blob %s", path), err)
+	}
+	return OCIDescriptor{MediaType: mediaType, Digest: "sha256:" + filepath.Base(path), Size: info.Size()}, nil
+}
+
+// writeImageBlobs writes the config and OCI manifest of one image as blobs. It returns
+// the docker manifest entry for the image and the descriptor of its OCI manifest.
+func (im *V2Image) writeImageBlobs(blobs string, manifest ImageManifest, layers []compressedLayer) (ImageManifest, OCIDescriptor, error) {
+	configData, err := ioutil.ReadFile(filepath.Join(im.NewImageDir, manifest.Config))
+	if err != nil {
+		return ImageManifest{}, OCIDescriptor{}, fmt.Errorf("failed to read image config: %w", err)
+	}
+	if configData, err = im.updateDiffIds(configData, layers); err != nil {
+		return ImageManifest{}, OCIDescriptor{}, err
+	}
+	config, err := writeBlob(blobs, MediaTypeImageConfig, configData)
+	if err != nil {
+		return ImageManifest{}, OCIDescriptor{}, err
+	}
+
+	ociManifest := OCIManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeImageManifest,
+		Config:        config,
+	}
+	dockerManifest := ImageManifest{
+		Config:   blobPath(config.Digest),
+		RepoTags: manifest.RepoTags,
+	}
+	for _, layer := range layers {
+		ociManifest.Layers = append(ociManifest.Layers, OCIDescriptor{
+			MediaType:   layer.MediaType,
+			Digest:      layer.Digest,
+			Size:        layer.Size,
+			Annotations: layer.Annotations,
+		})
+		dockerManifest.Layers = append(dockerManifest.Layers, blobPath(layer.Digest))
+	}
+
+	manifestData, err := json.Marshal(ociManifest)
+	if err != nil {
+		return ImageManifest{}, OCIDescriptor{}, err
+	}
+	manifestDescriptor, err := writeBlob(blobs, MediaTypeImageManifest, manifestData)
+	if err != nil {
+		return ImageManifest{}, OCIDescriptor{}, err
+	}
+	return dockerManifest, manifestDescriptor, nil
+}
+
+// taggedDescriptors returns one copy of the descriptor per repo tag, annotated with the
+// image and reference name, or the plain descriptor when there are no tags.
+func taggedDescriptors(descriptor OCIDescriptor, repoTags []string) ([]OCIDescriptor, error) {
+	tags, err := ParseRepoTags(repoTags)
+	if err != nil {
+		return nil, err
+	}
+	var descriptors []OCIDescriptor
+	for _, tag := range tags {
+		tagged := descriptor
+		tagged.Annotations = map[string]string{
+			AnnotationImageName: tag.Reference(),
+			AnnotationRefName:   tag.Tag,
+		}
+		descriptors = append(descriptors, tagged)
+	}
+	if len(descriptors) == 0 {
+		descriptors = append(descriptors, descriptor)
+	}
+	return descriptors, nil
+}
+
+// updateDiffIds replaces the diff_ids in the image config when compressing changed the
+// uncompressed content of a layer, as converting to eStargz does. A changed config
+// also means a new image ID for the exported image.
+func (im *V2Image) updateDiffIds(configData []byte, layers []compressedLayer) ([]byte, error) {
+	config := ImageConfig{}
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return nil, fmt.Errorf("error unmarshaling JSON: %w", err)
+	}
+	if len(config.Rootfs.DiffIds) != len(layers) {
+		return nil, NewCorruptArchiveError(fmt.Sprintf("image config lists %d layers, manifest has %d", len(config.Rootfs.DiffIds), len(layers)), nil)
+	}
+
+	changed := false
+	for i, layer := range layers {
+		if config.Rootfs.DiffIds[i] != layer.DiffID {
+			config.Rootfs.DiffIds[i] = layer.DiffID
+			changed = true
+		}
+	}
+	if !changed {
+		return configData, nil
+	}
+
+	jsonData, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	configData = append(jsonData, '\n')
+	im.Logger.Infof("Layer content changed by %s compression, exported image ID is %s", im.Compression, sha256Hex(configData))
+	return configData, nil
+}
+
+// writeBlob stores data as a content addressed blob and returns its descriptor.
+func writeBlob(blobs, mediaType string, data []byte) (OCIDescriptor, error) {
+	digest := fmt.Sprintf("sha256:%s", sha256Hex(data))
+	if err := ioutil.WriteFile(filepath.Join(blobs, digest[len("sha256:"):]), data, 0644); err != nil {
+		return OCIDescriptor{}, NewIOError("failed to write blob", err)
+	}
+	return OCIDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(data))}, nil
+}
+
+func blobPath(digest string) string {
+	return filepath.Join(blobsDir, digest[len("sha256:"):])
+}
+
+func readManifestFile(manifestPath string) ([]ImageManifest, error) {
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, NewCorruptArchiveError("failed to read manifest.json", err)
+	}
+
+	var manifest []ImageManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, NewCorruptArchiveError("failed to unmarshal manifest.json", err)
+	}
+	if len(manifest) == 0 {
+		return nil, NewCorruptArchiveError("manifest is empty", nil)
+	}
+	if err := checkManifestPaths(manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func writeJsonFile(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error marshaling JSON: %w", err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return NewIOError("error writing to file", err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// SquashPlan tells what a squash would do, read from the history of the image in the
+// image store without saving it.
+type SquashPlan struct {
+	Image   string `json:"image"`
+	ImageID string `json:"image_id"`
+	// Layers of the image, oldest first
+	Layers []PlannedLayer `json:"layers"`
+}
+
+// PlannedLayer is a layer of a SquashPlan.
+type PlannedLayer struct {
+	// ID is the image the layer belongs to, <missing> for layers without one
+	ID       string `json:"id"`
+	Size     int64  `json:"size"`
+	Squashed bool   `json:"squashed"`
+}
+
+// Plan selects the layers to squash like Run does, without saving the image. The plan
+// is returned along with a SquashUnnecessaryError when a single layer is selected.
+func (s *Squash) Plan(ctx context.Context) (SquashPlan, error) {
+	if len(s.image) == 0 {
+		return SquashPlan{}, errors.New("image is not provided")
+	}
+	if source := ParseImageSource(s.image); source.Transport != TransportDaemon {
+		return SquashPlan{}, fmt.Errorf("only images of the image store can be planned, '%s' is read from %s", s.image, source.Transport)
+	}
+	if err := s.checkStore(ctx); err != nil {
+		return SquashPlan{}, err
+	}
+
+	img := NewV2Image(s)
+	err := img.selectLayers(ctx)
+	var unnecessary *SquashUnnecessaryError
+	if err != nil && !errors.As(err, &unnecessary) {
+		return SquashPlan{}, err
+	}
+
+	plan := SquashPlan{Image: s.image, ImageID: img.OldImageId}
+	for i, id := range img.OldImageLayers {
+		layer := PlannedLayer{ID: id, Squashed: i >= len(img.LayersToMove)}
+		if i < len(img.layerSizes) {
+			layer.Size = img.layerSizes[i]
+		}
+		plan.Layers = append(plan.Layers, layer)
+	}
+	return plan, err
+}
+
+// WritePlan prints the plan with a line per layer.
+func WritePlan(w io.Writer, plan SquashPlan) error {
+	var squashed int
+	var size, squashedSize int64
+	for _, layer := range plan.Layers {
+		size += layer.Size
+		if layer.Squashed {
+			squashed++
+			squashedSize += layer.Size
+		}
+	}
+
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "Image:\t%s (%s)\n", plan.Image, shortDigest(plan.ImageID))
+	fmt.Fprintf(table, "Layers:\t%d, %d squashed into one\n", len(plan.Layers), squashed)
+	fmt.Fprintf(table, "Size:\t%s, %s in the squashed layers\n", formatBytes(size), formatBytes(squashedSize))
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	table = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "#\tIMAGE\tSIZE\tACTION")
+	for i, layer := range plan.Layers {
+		action := "keep"
+		if layer.Squashed {
+			action = "squash"
+		}
+		id := layer.ID
+		if strings.HasPrefix(id, "sha256:") {
+			id = shortDigest(id)
+		}
+		fmt.Fprintf(table, "%d\t%s\t%s\t%s\n", i+1, id, formatBytes(layer.Size), action)
+	}
+	return table.Flush()
+}
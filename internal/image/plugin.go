@@ -0,0 +1,116 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// The docker CLI runs plugins installed as docker-NAME in its cli-plugins directories,
+// after asking for their metadata with PluginMetadataCommand.
+const (
+	PluginCommand         = "squash"
+	PluginMetadataCommand = "docker-cli-plugin-metadata"
+)
+
+// PluginMetadata is the answer to the metadata handshake of the docker CLI.
+type PluginMetadata struct {
+	SchemaVersion    string `json:"SchemaVersion"`
+	Vendor           string `json:"Vendor"`
+	Version          string `json:"Version,omitempty"`
+	ShortDescription string `json:"ShortDescription,omitempty"`
+	URL              string `json:"URL,omitempty"`
+}
+
+// WritePluginMetadata writes the metadata of the squash plugin.
+func WritePluginMetadata(w io.Writer, version string) error {
+	data, err := json.MarshalIndent(PluginMetadata{
+		SchemaVersion:    "0.1.0",
+		Vendor:           "lyon-v",
+		Version:          version,
+		ShortDescription: "Squash the layers of an image",
+		URL:              "https://github.com/lyon-v/squash-docker-image",
+	}, "", "     ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// IsPlugin tells whether the binary runs as a docker CLI plugin: it is installed as
+// docker-squash, or the docker CLI started it.
+func IsPlugin(args []string) bool {
+	name := strings.TrimSuffix(filepath.Base(args[0]), ".exe")
+	return name == "docker-"+PluginCommand || len(os.Getenv("DOCKER_CLI_PLUGIN_ORIGINAL_CLI_COMMAND")) != 0
+}
+
+// ParsePluginArgs reads the global options the docker CLI passes its plugins in front
+// of the plugin command, like --context, -H and the TLS flags, into connection. It
+// returns the arguments after the squash command, and whether debug output was asked
+// for. --config is passed on as DOCKER_CONFIG, where the contexts are looked up.
+func ParsePluginArgs(args []string, connection *DockerConnection) ([]string, bool, error) {
+	var (
+		configDir string
+		hosts     []string
+		debug     bool
+		logLevel  string
+	)
+	flags := pflag.NewFlagSet("docker", pflag.ContinueOnError)
+	flags.SetInterspersed(false)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&configDir, "config", "", "")
+	flags.StringVarP(&connection.Context, "context", "c", connection.Context, "")
+	flags.BoolVarP(&debug, "debug", "D", false, "")
+	flags.StringArrayVarP(&hosts, "host", "H", nil, "")
+	flags.StringVarP(&logLevel, "log-level", "l", "", "")
+	flags.BoolVar(&connection.TLS, "tls", connection.TLS, "")
+	flags.StringVar(&connection.TLSCACert, "tlscacert", connection.TLSCACert, "")
+	flags.StringVar(&connection.TLSCert, "tlscert", connection.TLSCert, "")
+	flags.StringVar(&connection.TLSKey, "tlskey", connection.TLSKey, "")
+	flags.BoolVar(&connection.TLSVerify, "tlsverify", connection.TLSVerify, "")
+	if err := flags.Parse(args); err != nil {
+		return nil, false, fmt.Errorf("invalid docker options: %w", err)
+	}
+
+	switch len(hosts) {
+	case 0:
+	case 1:
+		connection.Host = hosts[0]
+	default:
+		return nil, false, fmt.Errorf("only one daemon can be given with -H, got %d", len(hosts))
+	}
+	if len(configDir) != 0 {
+		os.Setenv("DOCKER_CONFIG", configDir)
+	}
+
+	rest := flags.Args()
+	if len(rest) != 0 && rest[0] == PluginCommand {
+		rest = rest[1:]
+	}
+	return rest, debug || logLevel == "debug", nil
+}
+
+// WatchPluginSocket calls cancel when the docker CLI that started the plugin closes the
+// socket it passes in DOCKER_CLI_PLUGIN_SOCKET, which it does when it is interrupted.
+func WatchPluginSocket(cancel func()) {
+	address := os.Getenv("DOCKER_CLI_PLUGIN_SOCKET")
+	if len(address) == 0 {
+		return
+	}
+	conn, err := net.Dial("unix", address)
+	if err != nil {
+		return
+	}
+	go func() {
+		io.Copy(io.Discard, conn)
+		conn.Close()
+		cancel()
+	}()
+}
@@ -0,0 +1,130 @@
+package image
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIsPlugin(t *testing.T) {
+	tests := []struct {
+		args    []string
+		command string
+		plugin  bool
+	}{
+		{args: []string{"/usr/local/bin/squash-docker-image", "squash", "app"}},
+		{args: []string{"/usr/libexec/docker/cli-plugins/docker-squash", "squash", "app"}, plugin: true},
+		{args: []string{"cli-plugins/docker-squash.exe", "squash", "app"}, plugin: true},
+		{args: []string{"docker-squash"}, plugin: true},
+		{args: []string{"docker-squash-old"}},
+		// The docker CLI sets it for the plugins it starts, whatever their file name
+		{args: []string{"/tmp/squash", "squash", "app"}, command: "docker squash app", plugin: true},
+	}
+	for _, test := range tests {
+		t.Setenv("DOCKER_CLI_PLUGIN_ORIGINAL_CLI_COMMAND", test.command)
+		if plugin := IsPlugin(test.args); plugin != test.plugin {
+			t.Errorf("%v started by %q runs as plugin: %v, expected %v", test.args, test.command, plugin, test.plugin)
+		}
+	}
+}
+
+func TestParsePluginArgs(t *testing.T) {
+	tests := []struct {
+		args       []string
+		rest       []string
+		debug      bool
+		connection DockerConnection
+		config     string
+		err        string
+	}{
+		{args: []string{"squash", "app:build"}, rest: []string{"app:build"}},
+		{args: []string{"squash", "-f", "3", "-t", "app:squashed", "app:build"}, rest: []string{"-f", "3", "-t", "app:squashed", "app:build"}},
+		// The options of the squash command are not taken as docker options
+		{args: []string{"squash", "--context", "other", "app"}, rest: []string{"--context", "other", "app"}},
+		{args: []string{"squash"}, rest: []string{}},
+		{args: []string{}, rest: []string{}},
+		{args: []string{"-H", "tcp://build:2376", "squash", "app"}, rest: []string{"app"}, connection: DockerConnection{Host: "tcp://build:2376"}},
+		{args: []string{"--host=unix:///run/podman.sock", "squash", "app"}, rest: []string{"app"}, connection: DockerConnection{Host: "unix:///run/podman.sock"}},
+		{args: []string{"-c", "remote", "squash", "app"}, rest: []string{"app"}, connection: DockerConnection{Context: "remote"}},
+		{args: []string{"--context", "remote", "-D", "squash", "app"}, rest: []string{"app"}, debug: true, connection: DockerConnection{Context: "remote"}},
+		{args: []string{"-l", "debug", "squash", "app"}, rest: []string{"app"}, debug: true},
+		{args: []string{"--log-level", "warn", "squash", "app"}, rest: []string{"app"}},
+		{
+			args:       []string{"--tlsverify", "--tlscacert", "/certs/ca.pem", "--tlscert", "/certs/cert.pem", "--tlskey", "/certs/key.pem", "-H", "tcp://build:2376", "squash", "app"},
+			rest:       []string{"app"},
+			connection: DockerConnection{Host: "tcp://build:2376", TLSVerify: true, TLSCACert: "/certs/ca.pem", TLSCert: "/certs/cert.pem", TLSKey: "/certs/key.pem"},
+		},
+		{args: []string{"--tls", "squash", "app"}, rest: []string{"app"}, connection: DockerConnection{TLS: true}},
+		{args: []string{"--config", "/home/ci/.docker", "squash", "app"}, rest: []string{"app"}, config: "/home/ci/.docker"},
+		{args: []string{"-H", "tcp://a:2375", "-H", "tcp://b:2375", "squash", "app"}, err: "only one daemon can be given with -H, got 2"},
+		{args: []string{"--orchestrator", "swarm", "squash", "app"}, err: "invalid docker options"},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			t.Setenv("DOCKER_CONFIG", "")
+			var connection DockerConnection
+			rest, debug, err := ParsePluginArgs(test.args, &connection)
+			if len(test.err) != 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rest, test.rest) {
+				t.Errorf("got the arguments %q, expected %q", rest, test.rest)
+			}
+			if debug != test.debug {
+				t.Errorf("got debug %v, expected %v", debug, test.debug)
+			}
+			if connection != test.connection {
+				t.Errorf("got the connection %+v, expected %+v", connection, test.connection)
+			}
+			if config := os.Getenv("DOCKER_CONFIG"); config != test.config {
+				t.Errorf("got DOCKER_CONFIG %q, expected %q", config, test.config)
+			}
+		})
+	}
+}
+
+// TestParsePluginArgsDefaults keeps the connection given by the environment for the
+// options the docker CLI does not pass.
+func TestParsePluginArgsDefaults(t *testing.T) {
+	connection := DockerConnection{Context: "ci", TLSVerify: true}
+	if _, _, err := ParsePluginArgs([]string{"-H", "tcp://build:2376", "squash", "app"}, &connection); err != nil {
+		t.Fatal(err)
+	}
+	expected := DockerConnection{Context: "ci", Host: "tcp://build:2376", TLSVerify: true}
+	if connection != expected {
+		t.Errorf("got the connection %+v, expected %+v", connection, expected)
+	}
+}
+
+func TestWritePluginMetadata(t *testing.T) {
+	var out bytes.Buffer
+	if err := WritePluginMetadata(&out, "1.2.3"); err != nil {
+		t.Fatal(err)
+	}
+	var metadata map[string]string
+	if err := json.Unmarshal(out.Bytes(), &metadata); err != nil {
+		t.Fatalf("the metadata is no JSON object of strings: %v", err)
+	}
+	expected := map[string]string{
+		"SchemaVersion":    "0.1.0",
+		"Vendor":           "lyon-v",
+		"Version":          "1.2.3",
+		"ShortDescription": "Squash the layers of an image",
+		"URL":              "https://github.com/lyon-v/squash-docker-image",
+	}
+	if !reflect.DeepEqual(metadata, expected) {
+		t.Errorf("got the metadata %v, expected %v", metadata, expected)
+	}
+	if !strings.HasSuffix(out.String(), "}\n") {
+		t.Errorf("the metadata %q does not end with a newline", out.String())
+	}
+}
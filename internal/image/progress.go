@@ -0,0 +1,289 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Phases of a squash run, in the order they run.
+const (
+	// PhaseOpen reads an image from an OCI layout, OCI archive or registry
+	PhaseOpen = "open"
+	// PhaseSave saves the image from the Docker daemon
+	PhaseSave   = "save"
+	PhaseSquash = "squash"
+	PhaseExport = "export"
+	PhaseLoad   = "load"
+)
+
+// Types of progress events.
+const (
+	EventPhaseStart = "phase_start"
+	EventPhaseEnd   = "phase_end"
+	// EventProgress reports the progress inside a phase
+	EventProgress = "progress"
+	// EventLayer is sent when a phase finished a layer
+	EventLayer = "layer"
+)
+
+// ProgressEvent describes the progress of a squash run.
+type ProgressEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Phase    string    `json:"phase"`
+	Image    string    `json:"image,omitempty"`
+	Platform string    `json:"platform,omitempty"`
+	// Layer is the layer being worked on, LayerIndex counts from 1
+	Layer      string `json:"layer,omitempty"`
+	LayerIndex int    `json:"layer_index,omitempty"`
+	LayerCount int    `json:"layer_count,omitempty"`
+	// BytesRead and BytesWritten are the totals of the phase so far, of the layer for
+	// layer events. BytesTotal is the number of bytes the phase reads when known.
+	BytesRead    int64 `json:"bytes_read,omitempty"`
+	BytesWritten int64 `json:"bytes_written,omitempty"`
+	BytesTotal   int64 `json:"bytes_total,omitempty"`
+	// FilesProcessed of FilesTotal regular files of the current layer were merged
+	FilesProcessed int `json:"files_processed,omitempty"`
+	FilesTotal     int `json:"files_total,omitempty"`
+	// ElapsedSeconds since the phase started, ETASeconds is the estimated time until
+	// it ends
+	ElapsedSeconds float64 `json:"elapsed_seconds,omitempty"`
+	ETASeconds     float64 `json:"eta_seconds,omitempty"`
+}
+
+// ProgressFunc receives the progress events of a squash run. Events of parallel work
+// are delivered from several goroutines, but never concurrently.
+type ProgressFunc func(ProgressEvent)
+
+// progressInterval limits how often progress events are sent within a phase.
+const progressInterval = 100 * time.Millisecond
+
+// phaseProgress reports the progress of one phase.
+type phaseProgress struct {
+	mu         sync.Mutex
+	send       func(ProgressEvent)
+	phase      string
+	started    time.Time
+	lastUpdate time.Time
+	// bytesTotal bytes are processed from totalSince on, used to estimate the remaining
+	// time
+	bytesTotal int64
+	totalSince time.Time
+	// ended receives the duration of the phase
+	ended func(PhaseDuration)
+}
+
+// PhaseDuration is the time a phase of a squash run took.
+type PhaseDuration struct {
+	Phase    string
+	Duration time.Duration
+}
+
+// newPhaseProgress sends the start event of a phase. The returned phaseProgress sends
+// nothing when there is no ProgressFunc.
+func newPhaseProgress(fn ProgressFunc, image string, platform *OCIPlatform, phase string, bytesTotal int64) *phaseProgress {
+	now := time.Now()
+	p := &phaseProgress{phase: phase, started: now, bytesTotal: bytesTotal, totalSince: now}
+	p.send = func(event ProgressEvent) {
+		if fn == nil {
+			return
+		}
+		event.Time = time.Now()
+		event.Phase = phase
+		event.Image = image
+		if platform != nil {
+			event.Platform = platform.String()
+		}
+		event.BytesTotal = p.bytesTotal
+		event.ElapsedSeconds = event.Time.Sub(p.started).Seconds()
+		fn(event)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.send(ProgressEvent{Type: EventPhaseStart})
+	return p
+}
+
+// update sends a progress event, at most every progressInterval unless force is set.
+func (p *phaseProgress) update(event ProgressEvent, force bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if !force && now.Sub(p.lastUpdate) < progressInterval {
+		return
+	}
+	p.lastUpdate = now
+	event.Type = EventProgress
+	event.ETASeconds = p.eta(now, event.BytesRead+event.BytesWritten)
+	p.send(event)
+}
+
+// setTotal sets the number of bytes the rest of the phase processes, when it becomes
+// known only while the phase runs.
+func (p *phaseProgress) setTotal(bytesTotal int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bytesTotal = bytesTotal
+	p.totalSince = time.Now()
+}
+
+// layer sends the event of a finished layer.
+func (p *phaseProgress) layer(event ProgressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	event.Type = EventLayer
+	p.send(event)
+}
+
+// end sends the end event of the phase.
+func (p *phaseProgress) end(event ProgressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	event.Type = EventPhaseEnd
+	p.send(event)
+	if p.ended != nil {
+		p.ended(PhaseDuration{Phase: p.phase, Duration: time.Since(p.started)})
+	}
+}
+
+// eta extrapolates the time the phase needs from the share of bytesTotal already
+// processed.
+func (p *phaseProgress) eta(now time.Time, bytesDone int64) float64 {
+	if p.bytesTotal <= 0 || bytesDone <= 0 || bytesDone >= p.bytesTotal {
+		return 0
+	}
+	elapsed := now.Sub(p.totalSince).Seconds()
+	return elapsed * float64(p.bytesTotal-bytesDone) / float64(bytesDone)
+}
+
+// progressReader counts the bytes read through it and reports them to the phase.
+type progressReader struct {
+	r        io.Reader
+	progress *phaseProgress
+	n        int64
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.n += int64(n)
+	pr.progress.update(ProgressEvent{BytesRead: pr.n}, false)
+	return n, err
+}
+
+// progressWriter counts the bytes written through it and reports them to the phase.
+type progressWriter struct {
+	w        io.Writer
+	progress *phaseProgress
+	n        int64
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.n += int64(n)
+	pw.progress.update(ProgressEvent{BytesWritten: pw.n}, false)
+	return n, err
+}
+
+// NewJSONProgress writes every event as a line of JSON to w.
+func NewJSONProgress(w io.Writer) ProgressFunc {
+	var mu sync.Mutex
+	encoder := json.NewEncoder(w)
+	return func(event ProgressEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		encoder.Encode(event)
+	}
+}
+
+// progressBarWidth is the number of characters of the bar itself.
+const progressBarWidth = 30
+
+// NewProgressBars draws a progress bar per phase to w, which should be a terminal.
+func NewProgressBars(w io.Writer) ProgressFunc {
+	var mu sync.Mutex
+	return func(event ProgressEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		label := event.Phase
+		if len(event.Platform) != 0 {
+			label += " " + event.Platform
+		}
+		switch event.Type {
+		case EventPhaseStart:
+			fmt.Fprintf(w, "\r\033[K%-7s ...", label)
+		case EventPhaseEnd:
+			details := fmt.Sprintf("done in %s", time.Duration(event.ElapsedSeconds*float64(time.Second)).Round(time.Millisecond))
+			if event.BytesWritten > 0 {
+				details += fmt.Sprintf(", %s written", formatBytes(event.BytesWritten))
+			}
+			fmt.Fprintf(w, "\r\033[K%-7s %s\n", label, details)
+		default:
+			fmt.Fprintf(w, "\r\033[K%-7s %s", label, progressLine(event))
+		}
+	}
+}
+
+// progressLine renders the bar and the counters of an event.
+func progressLine(event ProgressEvent) string {
+	var fraction float64
+	switch {
+	case event.BytesTotal > 0:
+		fraction = float64(event.BytesRead+event.BytesWritten) / float64(event.BytesTotal)
+	case event.LayerCount > 0:
+		fraction = float64(event.LayerIndex) / float64(event.LayerCount)
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	filled := int(fraction * progressBarWidth)
+	parts := []string{fmt.Sprintf("[%s%s] %3d%%", strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), int(fraction*100))}
+
+	if event.LayerCount > 0 {
+		parts = append(parts, fmt.Sprintf("layer %d/%d", event.LayerIndex, event.LayerCount))
+	}
+	if event.FilesTotal > 0 {
+		parts = append(parts, fmt.Sprintf("files %d/%d", event.FilesProcessed, event.FilesTotal))
+	}
+	if event.BytesRead > 0 {
+		parts = append(parts, formatBytes(event.BytesRead)+" read")
+	}
+	if event.BytesWritten > 0 {
+		parts = append(parts, formatBytes(event.BytesWritten)+" written")
+	}
+	if event.ETASeconds > 0 {
+		parts = append(parts, "ETA "+time.Duration(event.ETASeconds*float64(time.Second)).Round(time.Second).String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// startPhase sends the start event of a phase of the image.
+func (im *V2Image) startPhase(phase string, bytesTotal int64) *phaseProgress {
+	platform := im.platform
+	if im.batch.multiPlatform() && (phase == PhaseExport || phase == PhaseLoad) {
+		// The lead image exports all platforms
+		platform = nil
+	}
+	progress := newPhaseProgress(im.Progress, im.Image, platform, phase, bytesTotal)
+	progress.ended = func(duration PhaseDuration) {
+		im.phases = append(im.phases, duration)
+	}
+	return progress
+}
@@ -0,0 +1,332 @@
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+const dockerHubRegistry = "registry-1.docker.io"
+
+var manifestMediaTypes = []string{
+	MediaTypeImageIndex,
+	MediaTypeDockerManifestList,
+	MediaTypeImageManifest,
+	MediaTypeDockerManifest,
+}
+
+// registryClient pulls from a registry speaking the distribution API. It supports
+// anonymous access, bearer tokens and basic credentials stored in the docker config
+// file; credential helpers are not supported.
+type registryClient struct {
+	ctx        context.Context
+	host       string
+	repository string
+	scheme     string
+	token      string
+	username   string
+	password   string
+	client     *http.Client
+}
+
+func newRegistryClient(ctx context.Context, named reference.Named) *registryClient {
+	host := reference.Domain(named)
+	rc := &registryClient{
+		ctx:        ctx,
+		host:       host,
+		repository: reference.Path(named),
+		scheme:     "https",
+		client:     http.DefaultClient,
+	}
+	if host == "docker.io" {
+		rc.host = dockerHubRegistry
+	}
+	if strings.HasPrefix(host, "localhost") || strings.HasPrefix(host, "127.0.0.1") {
+		rc.scheme = "http"
+	}
+	rc.username, rc.password = dockerConfigCredentials(host)
+	return rc
+}
+
+// pullImage downloads the image named by ref into dir as an OCI layout. Of a
+// multi-platform image only the manifests of the selected platforms are fetched.
+func pullImage(ctx context.Context, ref, dir string, platforms []OCIPlatform, logger Logger) error {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return fmt.Errorf("invalid image reference '%s': %w", ref, err)
+	}
+	named = reference.TagNameOnly(named)
+
+	var tagOrDigest string
+	if digested, ok := named.(reference.Digested); ok {
+		tagOrDigest = digested.Digest().String()
+	} else {
+		tagOrDigest = named.(reference.Tagged).Tag()
+	}
+
+	blobs := filepath.Join(dir, blobsDir)
+	if err := os.MkdirAll(blobs, 0755); err != nil {
+		return fmt.Errorf("failed to create blobs directory: %w", err)
+	}
+
+	rc := newRegistryClient(ctx, named)
+	logger.Infof("Pulling %s from %s...", reference.FamiliarString(named), rc.host)
+	descriptor, err := rc.pullManifest(tagOrDigest, blobs, platforms, logger)
+	if err != nil {
+		return fmt.Errorf("failed to pull '%s': %w", ref, err)
+	}
+
+	descriptor.Annotations = map[string]string{
+		AnnotationImageName: reference.FamiliarString(named),
+		AnnotationRefName:   tagOrDigest,
+	}
+	index := OCIIndex{SchemaVersion: 2, MediaType: MediaTypeImageIndex, Manifests: []OCIDescriptor{descriptor}}
+	if err := writeJsonFile(filepath.Join(dir, "index.json"), index); err != nil {
+		return err
+	}
+	return writeJsonFile(filepath.Join(dir, "oci-layout"), OCILayout{ImageLayoutVersion: ociLayoutVersion})
+}
+
+// pullManifest fetches the manifest or index and, recursively, everything it references
+// for the selected platforms.
+func (rc *registryClient) pullManifest(tagOrDigest, blobs string, platforms []OCIPlatform, logger Logger) (OCIDescriptor, error) {
+	resp, err := rc.get("manifests/"+tagOrDigest, strings.Join(manifestMediaTypes, ", "))
+	if err != nil {
+		return OCIDescriptor{}, err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return OCIDescriptor{}, err
+	}
+	if strings.HasPrefix(tagOrDigest, "sha256:") && tagOrDigest != "sha256:"+sha256Hex(data) {
+		return OCIDescriptor{}, NewVerificationError(fmt.Sprintf("manifest digest mismatch, expected %s", tagOrDigest))
+	}
+
+	mediaType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	var content struct {
+		MediaType string `json:"mediaType"`
+	}
+	if json.Unmarshal(data, &content) == nil && len(content.MediaType) != 0 {
+		mediaType = content.MediaType
+	}
+
+	switch mediaType {
+	case MediaTypeImageIndex, MediaTypeDockerManifestList:
+		var index OCIIndex
+		if err := json.Unmarshal(data, &index); err != nil {
+			return OCIDescriptor{}, fmt.Errorf("failed to unmarshal index: %w", err)
+		}
+		for _, manifest := range index.Manifests {
+			if manifest.Annotations[annotationReferenceType] == "attestation-manifest" {
+				continue
+			}
+			if manifest.Platform != nil && !matchPlatform(*manifest.Platform, platforms) {
+				continue
+			}
+			if _, err := rc.pullManifest(manifest.Digest, blobs, platforms, logger); err != nil {
+				return OCIDescriptor{}, err
+			}
+		}
+	case MediaTypeImageManifest, MediaTypeDockerManifest:
+		var manifest OCIManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return OCIDescriptor{}, fmt.Errorf("failed to unmarshal manifest: %w", err)
+		}
+		for _, blob := range append([]OCIDescriptor{manifest.Config}, manifest.Layers...) {
+			if err := rc.pullBlob(blob, blobs, logger); err != nil {
+				return OCIDescriptor{}, err
+			}
+		}
+	default:
+		return OCIDescriptor{}, fmt.Errorf("unsupported manifest media type '%s'", mediaType)
+	}
+
+	// Platforms that were not pulled stay referenced from the index, readPlatformImages
+	// applies the same filter and never reads them
+	return writeBlob(blobs, mediaType, data)
+}
+
+// pullBlob downloads a blob into the blobs directory, verifying its digest.
+func (rc *registryClient) pullBlob(descriptor OCIDescriptor, blobs string, logger Logger) error {
+	if err := checkDigest(descriptor.Digest); err != nil {
+		return err
+	}
+	target := filepath.Join(blobs, strings.TrimPrefix(descriptor.Digest, "sha256:"))
+	if PathExists(target) {
+		return nil
+	}
+	logger.Debugf("Pulling blob %s (%d bytes)...", descriptor.Digest, descriptor.Size)
+
+	resp, err := rc.get("blobs/"+descriptor.Digest, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	tmpFile, err := os.CreateTemp(blobs, "pull-")
+	if err != nil {
+		return NewIOError("failed to create blob", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmpFile, hasher), resp.Body); err != nil {
+		return fmt.Errorf("failed to download blob %s: %w", descriptor.Digest, err)
+	}
+	if digest := fmt.Sprintf("sha256:%x", hasher.Sum(nil)); digest != descriptor.Digest {
+		return NewVerificationError(fmt.Sprintf("blob digest mismatch, expected %s, got %s", descriptor.Digest, digest))
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), target)
+}
+
+// get requests a path below /v2/<repository>/, authenticating when the registry asks
+// for it.
+func (rc *registryClient) get(path, accept string) (*http.Response, error) {
+	endpoint := fmt.Sprintf("%s://%s/v2/%s/%s", rc.scheme, rc.host, rc.repository, path)
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := http.NewRequestWithContext(rc.ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(accept) != 0 {
+			req.Header.Set("Accept", accept)
+		}
+		if len(rc.token) != 0 {
+			req.Header.Set("Authorization", "Bearer "+rc.token)
+		} else if len(rc.username) != 0 {
+			req.SetBasicAuth(rc.username, rc.password)
+		}
+
+		resp, err := rc.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if err := rc.authenticate(challenge); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %s: %s", endpoint, resp.Status)
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("GET %s: unauthorized", endpoint)
+}
+
+// authenticate answers a WWW-Authenticate challenge. Basic challenges are retried with
+// the stored credentials, bearer challenges fetch a token from the realm.
+func (rc *registryClient) authenticate(challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if strings.EqualFold(scheme, "Basic") {
+		if len(rc.username) == 0 {
+			return fmt.Errorf("registry %s requires credentials, log in with docker login first", rc.host)
+		}
+		return nil
+	}
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("unsupported authentication scheme '%s' of registry %s", scheme, rc.host)
+	}
+
+	values := make(map[string]string)
+	for _, param := range strings.Split(params, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+		if found {
+			values[key] = strings.Trim(value, `"`)
+		}
+	}
+	query := url.Values{}
+	if service := values["service"]; len(service) != 0 {
+		query.Set("service", service)
+	}
+	scope := values["scope"]
+	if len(scope) == 0 {
+		scope = fmt.Sprintf("repository:%s:pull", rc.repository)
+	}
+	query.Set("scope", scope)
+
+	req, err := http.NewRequestWithContext(rc.ctx, http.MethodGet, values["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if len(rc.username) != 0 {
+		req.SetBasicAuth(rc.username, rc.password)
+	}
+	resp, err := rc.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get registry token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get registry token: %s", resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("failed to decode registry token: %w", err)
+	}
+	rc.token = token.Token
+	if len(rc.token) == 0 {
+		rc.token = token.AccessToken
+	}
+	return nil
+}
+
+// dockerConfigCredentials returns the credentials docker login stored for the registry
+// in the docker config file.
+func dockerConfigCredentials(host string) (string, string) {
+	data, err := ioutil.ReadFile(filepath.Join(dockerConfigDir(), "config.json"))
+	if err != nil {
+		return "", ""
+	}
+
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", ""
+	}
+	keys := []string{host, "https://" + host, "http://" + host}
+	if host == "docker.io" {
+		keys = append(keys, "https://index.docker.io/v1/")
+	}
+	for _, key := range keys {
+		auth, ok := config.Auths[key]
+		if !ok {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			continue
+		}
+		if username, password, found := strings.Cut(string(decoded), ":"); found {
+			return username, password
+		}
+	}
+	return "", ""
+}
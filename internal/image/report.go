@@ -0,0 +1,103 @@
+package image
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Report is written by --report after a successful run, so scripts do not need to
+// scrape the messages.
+type Report struct {
+	Images []ReportImage `json:"images"`
+}
+
+// ReportImage describes one squashed image of the report.
+type ReportImage struct {
+	Source         string   `json:"source"`
+	Platform       string   `json:"platform,omitempty"`
+	SourceImageID  string   `json:"source_image_id"`
+	SourceFormat   string   `json:"source_format,omitempty"`
+	ImageID        string   `json:"image_id"`
+	ManifestDigest string   `json:"manifest_digest,omitempty"`
+	IndexDigest    string   `json:"index_digest,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
+	SizeBefore     int64    `json:"size_before"`
+	SizeAfter      int64    `json:"size_after"`
+	// MovedLayers are taken over unchanged, SquashedLayers are the source layers merged
+	// into SquashedLayer
+	MovedLayers       []ReportLayer `json:"moved_layers"`
+	SquashedLayers    []ReportLayer `json:"squashed_layers"`
+	SquashedLayer     *ReportLayer  `json:"squashed_layer,omitempty"`
+	FilesMerged       int           `json:"files_merged"`
+	WhiteoutsResolved int           `json:"whiteouts_resolved"`
+	BytesExcluded     int64         `json:"bytes_excluded"`
+	Phases            []ReportPhase `json:"phases"`
+}
+
+// ReportLayer describes a layer of the report.
+type ReportLayer struct {
+	DiffID string `json:"diff_id"`
+	Digest string `json:"digest,omitempty"`
+	Size   int64  `json:"size"`
+}
+
+// ReportPhase is the time a phase took.
+type ReportPhase struct {
+	Phase   string  `json:"phase"`
+	Seconds float64 `json:"seconds"`
+}
+
+// NewReport describes the images of a run.
+func NewReport(squashed []SquashedImage) Report {
+	report := Report{Images: []ReportImage{}}
+	for _, img := range squashed {
+		reportImage := ReportImage{
+			Source:            img.Image,
+			SourceImageID:     img.SourceImageID,
+			SourceFormat:      img.SourceFormat,
+			ImageID:           "sha256:" + img.ImageID,
+			ManifestDigest:    img.ManifestDigest,
+			IndexDigest:       img.IndexDigest,
+			Tags:              img.Tags,
+			SizeBefore:        img.SizeBefore,
+			SizeAfter:         img.SizeAfter,
+			MovedLayers:       []ReportLayer{},
+			SquashedLayers:    []ReportLayer{},
+			FilesMerged:       img.FilesMerged,
+			WhiteoutsResolved: img.WhiteoutsResolved,
+			BytesExcluded:     img.BytesExcluded,
+			Phases:            []ReportPhase{},
+		}
+		if img.Platform != nil {
+			reportImage.Platform = img.Platform.String()
+		}
+		for _, layer := range img.Layers {
+			reportLayer := ReportLayer{DiffID: layer.DiffID, Digest: layer.Digest, Size: layer.Size}
+			if layer.Squashed {
+				reportImage.SquashedLayer = &reportLayer
+			} else {
+				reportImage.MovedLayers = append(reportImage.MovedLayers, reportLayer)
+			}
+		}
+		for _, layer := range img.SourceLayers {
+			reportImage.SquashedLayers = append(reportImage.SquashedLayers, ReportLayer{DiffID: layer.DiffID, Digest: layer.Digest, Size: layer.Size})
+		}
+		for _, phase := range img.Phases {
+			reportImage.Phases = append(reportImage.Phases, ReportPhase{Phase: phase.Phase, Seconds: phase.Duration.Seconds()})
+		}
+		report.Images = append(report.Images, reportImage)
+	}
+	return report
+}
+
+// WriteReport writes the report of a run as JSON to path.
+func WriteReport(path string, squashed []SquashedImage) error {
+	data, err := json.MarshalIndent(NewReport(squashed), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return NewIOError("failed to write report", err)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// SquashedImage describes an image written by a squash run.
+type SquashedImage struct {
+	// Image is the source image as it was given
+	Image    string
+	Platform *OCIPlatform
+	// SourceImageID is the digest of the config of the source image
+	SourceImageID string
+	// SourceFormat is the format the source image was saved in, FormatV1, FormatDocker
+	// or FormatOCI
+	SourceFormat string
+	// ImageID is the ID of the squashed image, the digest of its config
+	ImageID    string
+	Tags       []string
+	SizeBefore int64
+	SizeAfter  int64
+	Layers     []SquashedLayer
+	// SourceLayers are the layers of the source image that were squashed
+	SourceLayers []SquashedLayer
+	MergeStats
+	// Phases lists the time each phase took. Export and load of several images are
+	// done by the first one.
+	Phases []PhaseDuration
+	// ManifestDigest and IndexDigest are set when the image was exported as an OCI
+	// layout, IndexDigest only for multi-platform images
+	ManifestDigest string
+	IndexDigest    string
+}
+
+// SquashedLayer describes a layer of a squashed image, oldest first.
+type SquashedLayer struct {
+	DiffID string
+	// Digest of the layer blob when the image was exported as an OCI layout
+	Digest   string
+	Size     int64
+	Squashed bool
+}
+
+// MergeStats counts what merging the squashed layers did.
+type MergeStats struct {
+	// FilesMerged is the number of regular files copied onto the oldest squashed layer
+	FilesMerged int
+	// WhiteoutsResolved is the number of whiteouts that removed a file or directory
+	WhiteoutsResolved int
+	// BytesExcluded is the size of the files of older squashed layers that newer ones
+	// deleted or overwrote
+	BytesExcluded int64
+}
+
+// exportedManifest records what writeBlobLayout wrote for one image.
+type exportedManifest struct {
+	Descriptor OCIDescriptor
+	Config     string
+	Layers     []compressedLayer
+}
+
+// Results describes the images written by the last run.
+func (s *Squash) Results() []SquashedImage {
+	if len(s.squashed) == 0 {
+		return nil
+	}
+	// The first image exports all images of the run
+	lead := s.squashed[0]
+
+	var results []SquashedImage
+	for i, img := range s.squashed {
+		result := img.result()
+		if i < len(lead.exported) {
+			exported := lead.exported[i]
+			result.ImageID = exported.Config[len("sha256:"):]
+			result.ManifestDigest = exported.Descriptor.Digest
+			result.IndexDigest = lead.exportIndex
+			for j := range result.Layers {
+				if j < len(exported.Layers) {
+					result.Layers[j].DiffID = exported.Layers[j].DiffID
+					result.Layers[j].Digest = exported.Layers[j].Digest
+					result.Layers[j].Size = exported.Layers[j].Size
+				}
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (im *V2Image) result() SquashedImage {
+	result := SquashedImage{
+		Image:         im.Image,
+		Platform:      im.platform,
+		SourceImageID: im.OldImageId,
+		SourceFormat:  im.format,
+		ImageID:       im.newImageID,
+		Tags:          im.newManifest.RepoTags,
+		SizeBefore:    im.SizeBefore,
+		SizeAfter:     im.SizeAfter,
+		MergeStats:    im.mergeStats,
+	}
+	result.Layers = append(result.Layers, im.newLayers...)
+	result.SourceLayers = append(result.SourceLayers, im.sourceLayers...)
+	result.Phases = append(result.Phases, im.phases...)
+	return result
+}
+
+// readSourceLayers describes the layers of the source image that are squashed while
+// they are still in OldImageDir.
+func (im *V2Image) readSourceLayers() []SquashedLayer {
+	var layers []SquashedLayer
+	diffIDs := im.OldImageConfig.Rootfs.DiffIds
+	for i, layerPath := range im.LayerPathsToSquash {
+		layer := SquashedLayer{Squashed: true}
+		if index := len(im.LayerPathsToMove) + i; index < len(diffIDs) {
+			layer.DiffID = diffIDs[index]
+		}
+		path := filepath.Join(im.OldImageDir, layerPath)
+		if im.OCIFormat {
+			layer.Digest = "sha256:" + filepath.Base(layerPath)
+		} else {
+			path = filepath.Join(path, "layer.tar")
+		}
+		if info, err := os.Stat(path); err == nil {
+			layer.Size = info.Size()
+		}
+		layers = append(layers, layer)
+	}
+	return layers
+}
+
+// readNewLayers describes the layers of the squashed image while they are still in
+// NewImageDir.
+func (im *V2Image) readNewLayers() []SquashedLayer {
+	var layers []SquashedLayer
+	for i, layer := range im.newManifest.Layers {
+		squashedLayer := SquashedLayer{Squashed: i >= len(im.LayerPathsToMove)}
+		if i < len(im.DiffIDs) {
+			squashedLayer.DiffID = "sha256:" + im.DiffIDs[i]
+		}
+		if info, err := os.Stat(filepath.Join(im.NewImageDir, layer)); err == nil {
+			squashedLayer.Size = info.Size()
+		}
+		layers = append(layers, squashedLayer)
+	}
+	return layers
+}
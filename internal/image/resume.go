@@ -0,0 +1,355 @@
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Checkpoints recorded in the work directory by --resume, in the order they are reached.
+const (
+	// CheckpointSaved: the image is saved from the daemon into the old directory
+	CheckpointSaved = "saved"
+	// CheckpointExtracted: some of the layers to squash are merged in the merge
+	// directory, recorded after every layer
+	CheckpointExtracted = "extracted"
+	// CheckpointMerged: the squashed layer tar is written
+	CheckpointMerged = "merged"
+	// CheckpointMetadata: the new image is complete in the new directory
+	CheckpointMetadata = "metadata"
+	// CheckpointExported: the image is written to the output path
+	CheckpointExported = "exported"
+)
+
+var checkpointOrder = []string{CheckpointSaved, CheckpointExtracted, CheckpointMerged, CheckpointMetadata, CheckpointExported}
+
+const checkpointFile = "checkpoint.json"
+
+var errResumeUnsupported = errors.New("--resume is only supported for a single image from the Docker daemon")
+
+// checkpoint records the completed phases of a squash in its work directory.
+type checkpoint struct {
+	// Fingerprint of the source image and the options the new image depends on, the
+	// checkpoint is discarded when it changes
+	Fingerprint string            `json:"fingerprint"`
+	Phases      []checkpointPhase `json:"phases"`
+	// State restores the image once its metadata is written and the source is removed
+	State *resumeState `json:"state,omitempty"`
+}
+
+type checkpointPhase struct {
+	Phase string `json:"phase"`
+	// Layers is the number of layers merged by the extracted phase
+	Layers int         `json:"layers,omitempty"`
+	Stats  *MergeStats `json:"stats,omitempty"`
+	// Artifacts maps the files and directories the phase produced to their digests
+	Artifacts map[string]string `json:"artifacts"`
+}
+
+type resumeState struct {
+	Format           string          `json:"format,omitempty"`
+	NewImageID       string          `json:"new_image_id"`
+	DiffIDs          []string        `json:"diff_ids"`
+	LayerPathsToMove []string        `json:"layer_paths_to_move"`
+	SizeBefore       int64           `json:"size_before"`
+	SourceLayers     []SquashedLayer `json:"source_layers"`
+	MergeStats       MergeStats      `json:"merge_stats"`
+}
+
+func checkpointIndex(phase string) int {
+	for i, name := range checkpointOrder {
+		if name == phase {
+			return i
+		}
+	}
+	return -1
+}
+
+// last returns the last completed phase, nil when there is none.
+func (c *checkpoint) last() *checkpointPhase {
+	if c == nil || len(c.Phases) == 0 {
+		return nil
+	}
+	return &c.Phases[len(c.Phases)-1]
+}
+
+// reached tells whether the phase was completed.
+func (c *checkpoint) reached(phase string) bool {
+	last := c.last()
+	return last != nil && checkpointIndex(last.Phase) >= checkpointIndex(phase)
+}
+
+// phase returns the recorded phase, nil when it was not completed.
+func (c *checkpoint) phase(name string) *checkpointPhase {
+	if c == nil {
+		return nil
+	}
+	for i := range c.Phases {
+		if c.Phases[i].Phase == name {
+			return &c.Phases[i]
+		}
+	}
+	return nil
+}
+
+// fingerprint identifies the source image and the options that shape the new one.
+func (im *V2Image) fingerprint() string {
+	var tags []string
+	for _, tag := range im.Tags {
+		tags = append(tags, tag.String())
+	}
+	data, _ := json.Marshal([]interface{}{im.OldImageId, im.FromLayer, tags, im.Comment, string(im.Compression), im.CompressionLevel, im.Excludes, im.ConfigEdits})
+	return "sha256:" + sha256Hex(data)
+}
+
+// openCheckpoint reads the checkpoint of the work directory and decides where to
+// continue. The last phase whose artifacts are unchanged wins; without one the work
+// directory is cleared and the squash starts over.
+func (im *V2Image) openCheckpoint() error {
+	im.checkpoint = &checkpoint{Fingerprint: im.fingerprint()}
+
+	data, err := ioutil.ReadFile(filepath.Join(im.TmpDir, checkpointFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return NewIOError("failed to read checkpoint", err)
+	}
+	var recorded checkpoint
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		im.Logger.Warnf("Ignoring unreadable checkpoint in %s: %v", im.TmpDir, err)
+		return im.resetWorkDir()
+	}
+	if recorded.Fingerprint != im.checkpoint.Fingerprint {
+		im.Logger.Warnf("The image or the options changed since the checkpoint in %s was written, starting over", im.TmpDir)
+		return im.resetWorkDir()
+	}
+
+	for len(recorded.Phases) != 0 {
+		last := recorded.last()
+		err := recorded.validate(last.Phase)
+		if err == nil {
+			im.checkpoint = &recorded
+			im.Logger.Infof("Resuming after the %s checkpoint", last.Phase)
+			return nil
+		}
+		im.Logger.Warnf("Checkpoint %s is no longer valid: %v", last.Phase, err)
+		recorded.Phases = recorded.Phases[:len(recorded.Phases)-1]
+	}
+	im.Logger.Warnf("No valid checkpoint in %s, starting over", im.TmpDir)
+	return im.resetWorkDir()
+}
+
+// validate checks the artifacts needed to continue after the phase. Until the metadata
+// is written the saved image is needed as well, and the export needs the new image.
+func (c *checkpoint) validate(phase string) error {
+	phases := []string{phase}
+	switch {
+	case checkpointIndex(phase) < checkpointIndex(CheckpointMetadata):
+		phases = append(phases, CheckpointSaved)
+	case phase == CheckpointExported:
+		phases = append(phases, CheckpointMetadata)
+	}
+	if checkpointIndex(phase) >= checkpointIndex(CheckpointMetadata) && c.State == nil {
+		return fmt.Errorf("the checkpoint has no image state")
+	}
+
+	for _, name := range phases {
+		recorded := c.phase(name)
+		if recorded == nil {
+			return fmt.Errorf("the %s checkpoint is missing", name)
+		}
+		for path, digest := range recorded.Artifacts {
+			actual, err := artifactDigest(path)
+			if err != nil {
+				return err
+			}
+			if actual != digest {
+				return NewVerificationError(fmt.Sprintf("%s changed, expected %s, got %s", path, digest, actual))
+			}
+		}
+	}
+	return nil
+}
+
+// checkWorkDir makes sure an existing directory given for --resume was left by an
+// earlier run, so nothing else in it is removed.
+func checkWorkDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return NewIOError("failed to read the work directory", err)
+	}
+	for _, entry := range entries {
+		switch entry.Name() {
+		case "old", "new", "export", checkpointFile:
+		default:
+			return fmt.Errorf("the '%s' directory is not the work directory of an earlier squash, it contains '%s'", dir, entry.Name())
+		}
+	}
+	return nil
+}
+
+// resetWorkDir removes what a previous run left in the work directory.
+func (im *V2Image) resetWorkDir() error {
+	im.checkpoint = &checkpoint{Fingerprint: im.checkpoint.Fingerprint}
+	for _, dir := range []string{im.OldImageDir, im.NewImageDir} {
+		if err := os.RemoveAll(dir); err != nil {
+			return NewIOError("failed to clear the work directory", err)
+		}
+		if err := os.Mkdir(dir, os.ModePerm); err != nil {
+			return NewIOError("failed to clear the work directory", err)
+		}
+	}
+	if err := os.Remove(filepath.Join(im.TmpDir, checkpointFile)); err != nil && !os.IsNotExist(err) {
+		return NewIOError("failed to remove checkpoint", err)
+	}
+	return nil
+}
+
+// resumed tells whether the phase was completed by an earlier run.
+func (im *V2Image) resumed(phase string) bool {
+	return im.checkpoint.reached(phase)
+}
+
+// recordCheckpoint records a completed phase with the digests of its artifacts.
+// Phases after it are dropped, they are redone.
+func (im *V2Image) recordCheckpoint(phase checkpointPhase, artifacts ...string) error {
+	if im.checkpoint == nil {
+		return nil
+	}
+	phase.Artifacts = make(map[string]string)
+	for _, path := range artifacts {
+		digest, err := artifactDigest(path)
+		if err != nil {
+			return err
+		}
+		phase.Artifacts[path] = digest
+	}
+
+	var phases []checkpointPhase
+	for _, recorded := range im.checkpoint.Phases {
+		if checkpointIndex(recorded.Phase) < checkpointIndex(phase.Phase) {
+			phases = append(phases, recorded)
+		}
+	}
+	im.checkpoint.Phases = append(phases, phase)
+	return writeJsonFile(filepath.Join(im.TmpDir, checkpointFile), im.checkpoint)
+}
+
+// saveState records what is needed to continue once the source image is gone.
+func (im *V2Image) saveState() {
+	if im.checkpoint == nil {
+		return
+	}
+	im.checkpoint.State = &resumeState{
+		Format:           im.format,
+		NewImageID:       im.newImageID,
+		DiffIDs:          im.DiffIDs,
+		LayerPathsToMove: im.LayerPathsToMove,
+		SizeBefore:       im.SizeBefore,
+		SourceLayers:     im.sourceLayers,
+		MergeStats:       im.mergeStats,
+	}
+}
+
+// restoreState continues with the new image written by an earlier run.
+func (im *V2Image) restoreState() error {
+	state := im.checkpoint.State
+	manifests, err := readManifestFile(filepath.Join(im.NewImageDir, "manifest.json"))
+	if err != nil {
+		return err
+	}
+	im.newManifest = manifests[0]
+	// Checkpoints written before the format was recorded are of Docker archives
+	format := state.Format
+	if len(format) == 0 {
+		format = FormatDocker
+	}
+	im.setFormat(format)
+	im.newImageID = state.NewImageID
+	im.DiffIDs = state.DiffIDs
+	im.LayerPathsToMove = state.LayerPathsToMove
+	im.SizeBefore = state.SizeBefore
+	im.sourceLayers = state.SourceLayers
+	im.mergeStats = state.MergeStats
+	return nil
+}
+
+// savedArtifacts lists the files of the saved image the squash reads.
+func (im *V2Image) savedArtifacts() []string {
+	// Images saved in the v1 format have no manifest.json
+	artifacts := []string{filepath.Join(im.OldImageDir, im.OldManifest.Config)}
+	if im.format != FormatV1 {
+		artifacts = append(artifacts, filepath.Join(im.OldImageDir, "manifest.json"))
+	}
+	for _, layer := range append(append([]string{}, im.LayerPathsToMove...), im.LayerPathsToSquash...) {
+		artifacts = append(artifacts, im.extractTarName(layer))
+	}
+	return artifacts
+}
+
+// newImageArtifacts lists the files of the new image.
+func (im *V2Image) newImageArtifacts() ([]string, error) {
+	var artifacts []string
+	err := filepath.Walk(im.NewImageDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			artifacts = append(artifacts, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, NewIOError("failed to list the new image", err)
+	}
+	return artifacts, nil
+}
+
+// artifactDigest hashes the content of a file. Directories are hashed by the names,
+// modes, link targets and contents of their entries, so a file changed in place
+// without changing its size is noticed as well.
+func artifactDigest(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return treeDigest(path)
+	}
+	return fileDigest(path)
+}
+
+func treeDigest(dir string) (string, error) {
+	var entries []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		var target, content string
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, _ = os.Readlink(path)
+		case info.Mode().IsRegular():
+			if content, err = fileDigest(path); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, fmt.Sprintf("%s\x00%o\x00%s\x00%s", relPath, info.Mode(), content, target))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(entries)
+	return "tree:sha256:" + sha256Hex([]byte(strings.Join(entries, "\n"))), nil
+}
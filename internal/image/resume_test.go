@@ -0,0 +1,69 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestResumeChangedMergeDir changes one byte of a merged file after the extracted
+// checkpoint. The size stays the same, still the merge is redone from the saved image.
+func TestResumeChangedMergeDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	newImage := func() *V2Image {
+		im := &V2Image{Logger: testLogger()}
+		im.TmpDir = tmpDir
+		im.OldImageDir = filepath.Join(tmpDir, "old")
+		im.NewImageDir = filepath.Join(tmpDir, "new")
+		im.MergeDir = filepath.Join(tmpDir, "new", "squashed", "mergedir")
+		return im
+	}
+
+	im := newImage()
+	if err := im.openCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(im.MergeDir, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(im.OldImageDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	saved := filepath.Join(im.OldImageDir, "manifest.json")
+	if err := os.WriteFile(saved, []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	merged := filepath.Join(im.MergeDir, "app", "server")
+	if err := os.WriteFile(merged, []byte("version 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.recordCheckpoint(checkpointPhase{Phase: CheckpointSaved}, saved); err != nil {
+		t.Fatal(err)
+	}
+	stats := MergeStats{}
+	if err := im.recordCheckpoint(checkpointPhase{Phase: CheckpointExtracted, Layers: 1, Stats: &stats}, im.MergeDir); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed := newImage()
+	if err := resumed.openCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if !resumed.resumed(CheckpointExtracted) {
+		t.Fatal("the unchanged merge is not resumed")
+	}
+
+	if err := os.WriteFile(merged, []byte("version 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resumed = newImage()
+	if err := resumed.openCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if resumed.resumed(CheckpointExtracted) {
+		t.Error("the merge is resumed after a merged file changed")
+	}
+	if !resumed.resumed(CheckpointSaved) {
+		t.Error("the saved image is not resumed")
+	}
+}
@@ -0,0 +1,374 @@
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A rootless squash can neither change the owner of files nor create device nodes. The
+// squashed layers are extracted without them: the ownership, the special permissions,
+// the device nodes and the extended attributes of every file are kept in a metadata
+// index, carried over while merging and written back into the squashed layer.
+
+// fileMetadata is what the tar header of a file holds beyond what is kept on disk.
+type fileMetadata struct {
+	Typeflag byte              `json:"type"`
+	Mode     int64             `json:"mode"`
+	Uid      int               `json:"uid"`
+	Gid      int               `json:"gid"`
+	Uname    string            `json:"uname,omitempty"`
+	Gname    string            `json:"gname,omitempty"`
+	Devmajor int64             `json:"devmajor,omitempty"`
+	Devminor int64             `json:"devminor,omitempty"`
+	Xattrs   map[string]string `json:"xattrs,omitempty"`
+}
+
+// metadataIndex maps the paths of an extracted directory, relative to it, to the metadata
+// of their files.
+type metadataIndex map[string]fileMetadata
+
+const xattrPrefix = "SCHILY.xattr."
+
+func headerMetadata(header *tar.Header) fileMetadata {
+	meta := fileMetadata{
+		Typeflag: header.Typeflag,
+		Mode:     header.Mode & 07777,
+		Uid:      header.Uid,
+		Gid:      header.Gid,
+		Uname:    header.Uname,
+		Gname:    header.Gname,
+		Devmajor: header.Devmajor,
+		Devminor: header.Devminor,
+	}
+	if meta.Typeflag == tar.TypeRegA {
+		meta.Typeflag = tar.TypeReg
+	}
+	for key, value := range header.PAXRecords {
+		if strings.HasPrefix(key, xattrPrefix) {
+			if meta.Xattrs == nil {
+				meta.Xattrs = make(map[string]string)
+			}
+			meta.Xattrs[key] = value
+		}
+	}
+	return meta
+}
+
+// isDevice tells whether the entry is a device node or a fifo.
+func isDevice(typeflag byte) bool {
+	return typeflag == tar.TypeChar || typeflag == tar.TypeBlock || typeflag == tar.TypeFifo
+}
+
+// extractLayer extracts a layer tar to dir. Rootless squashes record the metadata of its
+// files in index.
+func (im *V2Image) extractLayer(ctx context.Context, layerTar, dir string, index metadataIndex, msg string) error {
+	if !im.rootless {
+		if output, err := ExtractTar(ctx, layerTar, dir); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return tarError(msg, err, output)
+		}
+		return nil
+	}
+	if err := im.extractRootless(ctx, layerTar, dir, index); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%s: %w", msg, err)
+	}
+	return nil
+}
+
+// extractRootless extracts a layer tar, which may be compressed, without root privileges.
+// Files stay readable and writable by the owner, device nodes are written as empty files.
+func (im *V2Image) extractRootless(ctx context.Context, layerTar, dir string, index metadataIndex) error {
+	file, err := os.Open(layerTar)
+	if err != nil {
+		return NewIOError("failed to open layer", err)
+	}
+	defer file.Close()
+
+	reader, err := decompressedReader(contextReader{ctx: ctx, r: file})
+	if err != nil {
+		return NewCorruptArchiveError("failed to decompress layer", err)
+	}
+	defer reader.Close()
+
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return NewCorruptArchiveError("error reading tar archive", err)
+		}
+
+		name, err := layerEntryPath(header.Name)
+		if err != nil {
+			return err
+		}
+		path, err := secureJoin(dir, name)
+		if err != nil {
+			return err
+		}
+		if err := removeSymlink(path); err != nil {
+			return NewIOError("couldn't remove symlink", err)
+		}
+		// Like tar, create the parent directories the layer does not list
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return NewIOError("couldn't create directory", err)
+		}
+
+		switch {
+		case header.Typeflag == tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return NewIOError("couldn't create directory", err)
+			}
+		case header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA:
+			if err := writeFile(path, tarReader, os.FileMode(header.Mode).Perm()|0600); err != nil {
+				return err
+			}
+			os.Chtimes(path, header.ModTime, header.ModTime)
+		case header.Typeflag == tar.TypeLink:
+			linkname, err := layerEntryPath(header.Linkname)
+			if err != nil {
+				return err
+			}
+			target, err := secureJoin(dir, linkname)
+			if err != nil {
+				return err
+			}
+			os.Remove(path)
+			if err := os.Link(target, path); err != nil {
+				return NewIOError("couldn't create hard link", err)
+			}
+			if meta, ok := index[linkname]; ok {
+				index[name] = meta
+			}
+			continue
+		case header.Typeflag == tar.TypeSymlink:
+			os.Remove(path)
+			if err := os.Symlink(header.Linkname, path); err != nil {
+				return NewIOError("couldn't create symlink", err)
+			}
+		case isDevice(header.Typeflag):
+			// The index keeps the device, an empty file keeps its place in the layer
+			if err := writeFile(path, bytes.NewReader(nil), 0644); err != nil {
+				return err
+			}
+		default:
+			im.Logger.Infof("Ignoring unknown file type %c in %s", header.Typeflag, header.Name)
+			continue
+		}
+		index[name] = headerMetadata(header)
+	}
+}
+
+// layerEntryPath cleans the name or hard link target of a layer entry, the key of its
+// metadata. Like tar, leading slashes are removed.
+func layerEntryPath(name string) (string, error) {
+	return archivePath(strings.TrimLeft(name, "/"))
+}
+
+// copyMetadata carries the metadata of a file of the extracted layer over to the merged
+// file that replaces it.
+func (im *V2Image) copyMetadata(src, dest string) {
+	if !im.rootless {
+		return
+	}
+	srcName, err := filepath.Rel(im.TmpLayerDir, src)
+	if err != nil {
+		return
+	}
+	destName, err := filepath.Rel(im.MergeDir, dest)
+	if err != nil {
+		return
+	}
+	if meta, ok := im.layerIndex[srcName]; ok {
+		im.mergeIndex[destName] = meta
+	} else {
+		delete(im.mergeIndex, destName)
+	}
+}
+
+// mergeDirectoryMetadata takes the metadata of the directories of the extracted layer
+// over. Merging only copies files, the directories are created on the way.
+func (im *V2Image) mergeDirectoryMetadata() {
+	if !im.rootless {
+		return
+	}
+	for name, meta := range im.layerIndex {
+		if meta.Typeflag != tar.TypeDir {
+			continue
+		}
+		if info, err := os.Lstat(filepath.Join(im.MergeDir, name)); err == nil && info.IsDir() {
+			im.mergeIndex[name] = meta
+		}
+	}
+}
+
+// forgetMetadata drops the metadata of a merged path a whiteout removes, and of
+// everything below it.
+func (im *V2Image) forgetMetadata(path string) {
+	if !im.rootless {
+		return
+	}
+	name, err := filepath.Rel(im.MergeDir, path)
+	if err != nil {
+		return
+	}
+	for key := range im.mergeIndex {
+		if key == name || name == "." || strings.HasPrefix(key, name+string(filepath.Separator)) {
+			delete(im.mergeIndex, key)
+		}
+	}
+}
+
+// mergeIndexPath is where the metadata of the merged files is kept for resumed runs.
+func (im *V2Image) mergeIndexPath() string {
+	return filepath.Join(filepath.Dir(im.SquashedTar), "mergedir.json")
+}
+
+// tarCreator returns how the merged files are packed, removing them once they are
+// archived when remove is set.
+func (im *V2Image) tarCreator(remove bool) func(ctx context.Context, srcDir, tarFile string) error {
+	if im.rootless {
+		return func(ctx context.Context, srcDir, tarFile string) error {
+			return writeRootlessTar(ctx, srcDir, tarFile, im.mergeIndex, remove)
+		}
+	}
+	if remove {
+		return MoveToTar
+	}
+	return CreateTar
+}
+
+// writeRootlessTar packs srcDir like CreateTar, taking the owners, permissions, device
+// nodes and extended attributes from index. Files without metadata belong to root.
+func writeRootlessTar(ctx context.Context, srcDir, tarFile string, index metadataIndex, remove bool) error {
+	out, err := os.Create(tarFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	buffered := bufio.NewWriter(out)
+	tarWriter := tar.NewWriter(buffered)
+
+	// Hard links of the first merged layer are kept, merging copies the others
+	links := make(map[uint64]string)
+	err = filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+
+		var linkTarget string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if linkTarget, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, linkTarget)
+		if err != nil {
+			return err
+		}
+		header.Name = "./" + filepath.ToSlash(name)
+		if name == "." {
+			header.Name = "./"
+		} else if info.IsDir() {
+			header.Name += "/"
+		}
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+		header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+		if meta, ok := index[name]; ok {
+			applyMetadata(header, meta)
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && header.Typeflag == tar.TypeReg && stat.Nlink > 1 {
+			if first, ok := links[stat.Ino]; ok {
+				header.Typeflag, header.Linkname, header.Size = tar.TypeLink, first, 0
+			} else {
+				links[stat.Ino] = header.Name
+			}
+		}
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeReg {
+			if err := copyFileTo(tarWriter, path); err != nil {
+				return err
+			}
+		}
+		if remove && !info.IsDir() {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// applyMetadata sets what the index keeps about a file on its header, unless a newer
+// layer replaced it by a file of another kind.
+func applyMetadata(header *tar.Header, meta fileMetadata) {
+	switch {
+	case meta.Typeflag == tar.TypeDir || meta.Typeflag == tar.TypeSymlink:
+		if header.Typeflag != meta.Typeflag {
+			return
+		}
+	case isDevice(meta.Typeflag):
+		if header.Typeflag != tar.TypeReg {
+			return
+		}
+		header.Typeflag, header.Size = meta.Typeflag, 0
+		header.Devmajor, header.Devminor = meta.Devmajor, meta.Devminor
+	default:
+		if header.Typeflag != tar.TypeReg {
+			return
+		}
+	}
+	header.Mode = meta.Mode
+	header.Uid, header.Gid, header.Uname, header.Gname = meta.Uid, meta.Gid, meta.Uname, meta.Gname
+	for key, value := range meta.Xattrs {
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string)
+		}
+		header.PAXRecords[key] = value
+	}
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
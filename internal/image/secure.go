@@ -0,0 +1,157 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Images are often pulled from third parties, their archives are not trusted. Entries
+// and manifest paths must stay inside the directory they are written to, and files are
+// never written through a symlink an archive or an older layer created.
+
+var digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// checkDigest fails when the digest is not a sha256 digest, the blob path is built from it.
+func checkDigest(digest string) error {
+	if !digestPattern.MatchString(digest) {
+		return NewCorruptArchiveError(fmt.Sprintf("invalid digest '%s'", digest), nil)
+	}
+	return nil
+}
+
+// archivePath cleans a path taken from an archive, it must be relative and stay inside
+// the directory the archive is extracted to. "." is the directory itself.
+func archivePath(name string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(cleaned) || !within(".", cleaned) {
+		return "", NewCorruptArchiveError(fmt.Sprintf("'%s' points outside of the archive", name), nil)
+	}
+	return cleaned, nil
+}
+
+// secureJoin joins a path taken from an archive onto root. It fails when the path escapes
+// root, or when one of its parent directories is a symlink.
+func secureJoin(root, name string) (string, error) {
+	cleaned, err := archivePath(name)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(root, cleaned)
+	if link, ok := symlinkInPath(root, filepath.Dir(path)); ok {
+		return "", NewCorruptArchiveError(fmt.Sprintf("'%s' is written through the symlink %s", name, link), nil)
+	}
+	return path, nil
+}
+
+// checkSymlink fails when the symlink entry name of an archive points outside of it, a
+// file of the host could be read through it.
+func checkSymlink(name, linkname string) error {
+	if path.IsAbs(linkname) || filepath.IsAbs(linkname) {
+		return NewCorruptArchiveError(fmt.Sprintf("symlink '%s' points to the absolute path '%s'", name, linkname), nil)
+	}
+	if _, err := archivePath(path.Join(path.Dir(name), linkname)); err != nil {
+		return NewCorruptArchiveError(fmt.Sprintf("symlink '%s' to '%s' points outside of the archive", name, linkname), nil)
+	}
+	return nil
+}
+
+// checkArchiveFile returns the path of a file a manifest refers to, below root. It fails
+// unless the file, its symlinks resolved, is a regular file inside root, so a symlink
+// cannot make a file of the host part of the squashed image.
+func checkArchiveFile(root, name string) (string, error) {
+	joined, err := secureJoin(root, name)
+	if err != nil {
+		return "", err
+	}
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", NewIOError("couldn't resolve the archive directory", err)
+	}
+	resolved, err := filepath.EvalSymlinks(joined)
+	if err != nil {
+		return "", NewCorruptArchiveError(fmt.Sprintf("failed to read '%s'", name), err)
+	}
+	if !within(resolvedRoot, resolved) {
+		return "", NewCorruptArchiveError(fmt.Sprintf("'%s' points outside of the archive", name), nil)
+	}
+	if info, err := os.Stat(resolved); err != nil || !info.Mode().IsRegular() {
+		return "", NewCorruptArchiveError(fmt.Sprintf("'%s' is not a regular file", name), err)
+	}
+	return joined, nil
+}
+
+// within tells whether path is root or below it, without resolving symlinks.
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// symlinkInPath returns the first directory from root down to dir, dir included, that is
+// a symlink. Directories that do not exist yet are created as real directories.
+func symlinkInPath(root, dir string) (string, bool) {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == "." {
+		return "", false
+	}
+	current := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if err != nil {
+			return "", false
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return current, true
+		}
+	}
+	return "", false
+}
+
+// removeSymlink removes path when it is a symlink, so it is not written through.
+func removeSymlink(path string) error {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return os.Remove(path)
+	}
+	return nil
+}
+
+// checkManifestPaths fails when the config or a layer of the manifest points outside of
+// the saved image.
+func checkManifestPaths(manifests []ImageManifest) error {
+	for _, manifest := range manifests {
+		for _, path := range append([]string{manifest.Config}, manifest.Layers...) {
+			if cleaned, err := archivePath(path); err != nil {
+				return err
+			} else if cleaned == "." {
+				return NewCorruptArchiveError(fmt.Sprintf("invalid path '%s' in manifest.json", path), nil)
+			}
+		}
+	}
+	return nil
+}
+
+// prepareMergePath makes sure a path in MergeDir is written inside it. A newer layer
+// replaces what older layers created, so a symlink among the parent directories is
+// replaced by a real directory instead of being followed.
+func (im *V2Image) prepareMergePath(path string) error {
+	if !within(im.MergeDir, path) {
+		return NewCorruptArchiveError(fmt.Sprintf("%s points outside of the merged layers", path), nil)
+	}
+	for {
+		link, ok := symlinkInPath(im.MergeDir, filepath.Dir(path))
+		if !ok {
+			return nil
+		}
+		im.Logger.Debugf("Replacing the symlink %s by a directory", link)
+		if err := os.Remove(link); err != nil {
+			return NewIOError("couldn't remove symlink", err)
+		}
+		if err := os.Mkdir(link, 0755); err != nil {
+			return NewIOError("couldn't create directory", err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package image
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FuzzExtractTar extracts untrusted archives like saved images are extracted, and
+// checks that nothing is written or linked outside of the directory they are extracted
+// to. The seeds in testdata/fuzz/FuzzExtractTar are malicious archives: entries with
+// ../ and absolute names, entries written through symlinked parent directories, hard
+// links escaping the directory, and manifests whose paths escape it.
+func FuzzExtractTar(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dir := t.TempDir()
+		t.Cleanup(func() { makeRemovable(dir) })
+		secret := filepath.Join(dir, "outside", "secret")
+		if err := os.MkdirAll(filepath.Dir(secret), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		logger := logrus.New()
+		logger.SetOutput(io.Discard)
+
+		root := filepath.Join(dir, "extracted")
+		im := &V2Image{Logger: logger, rootless: true}
+		if err := os.Mkdir(root, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if im.extractTar(bytes.NewReader(data), root) == nil {
+			checkManifestFiles(t, root)
+		}
+		checkConfined(t, root, secret)
+
+		spooled := &V2Image{Logger: logger, rootless: true}
+		spooled.OldImageDir = filepath.Join(dir, "old")
+		spooled.NewImageDir = filepath.Join(dir, "new")
+		for _, root := range []string{spooled.OldImageDir, spooled.NewImageDir} {
+			if err := os.Mkdir(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		spooled.spoolTar(bytes.NewReader(data))
+		checkConfined(t, spooled.OldImageDir, secret)
+		checkConfined(t, spooled.NewImageDir, secret)
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 4 {
+			t.Errorf("extracting created files next to the extracted directories: %v", entries)
+		}
+		if files, _ := os.ReadDir(filepath.Dir(secret)); len(files) != 1 {
+			t.Errorf("extracting created files outside of the extracted directories: %v", files)
+		}
+		if content, _ := os.ReadFile(secret); string(content) != "secret" {
+			t.Errorf("extracting overwrote a file outside of the extracted directories: %q", content)
+		}
+	})
+}
+
+// checkManifestFiles checks that the files the manifests of an extracted image refer to
+// are regular files inside root, whenever checkArchiveFile accepts them.
+func checkManifestFiles(t *testing.T, root string) {
+	var names []string
+	if manifests, err := readManifestFile(filepath.Join(root, "manifest.json")); err == nil {
+		for _, manifest := range manifests {
+			names = append(names, manifest.Config)
+			names = append(names, manifest.Layers...)
+		}
+	}
+	if images, err := readPlatformImages(root, "", nil); err == nil {
+		for _, image := range images {
+			names = append(names, blobPath(image.Manifest.Config.Digest))
+			for _, layer := range image.Manifest.Layers {
+				names = append(names, blobPath(layer.Digest))
+			}
+		}
+	}
+
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		path, err := checkArchiveFile(root, name)
+		if err != nil {
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			t.Fatalf("%s accepted but cannot be resolved: %v", name, err)
+		}
+		if !within(resolvedRoot, resolved) {
+			t.Errorf("%s accepted but points outside of the archive to %s", name, resolved)
+		}
+		if info, err := os.Stat(resolved); err != nil || !info.Mode().IsRegular() {
+			t.Errorf("%s accepted but is not a regular file", name)
+		}
+	}
+}
+
+// checkConfined fails when a symlink below root points outside of it, or a file below
+// root is a hard link of secret.
+func checkConfined(t *testing.T, root, secret string) {
+	secretInfo, err := os.Stat(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filepath.IsAbs(target) || !within(root, filepath.Join(filepath.Dir(path), target)) {
+				t.Errorf("symlink %s points outside of %s to %s", path, root, target)
+			}
+		case os.SameFile(info, secretInfo):
+			t.Errorf("%s is a hard link of %s", path, secret)
+		}
+		return nil
+	})
+}
+
+// makeRemovable gives the owner full permissions on the directories below dir, archives
+// may create directories that cannot be removed otherwise.
+func makeRemovable(dir string) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(path, 0755)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,716 @@
+package image
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// States of a job of the server.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+// Files in the directory of a job.
+const (
+	jobArchiveFile = "image.tar"
+	jobReportFile  = "report.json"
+	jobLogFile     = "squash.log"
+	jobTmpDir      = "tmp"
+)
+
+// maxJobRequestSize limits the body of a request submitting a job.
+const maxJobRequestSize = 1 << 20
+
+// serverHeaderTimeout limits the time clients take to send the headers of a request.
+const serverHeaderTimeout = 10 * time.Second
+
+// jobIDPattern matches the IDs of jobs, which name their directories.
+var jobIDPattern = regexp.MustCompile(`^[a-f0-9]{16}$`)
+
+// ServerOptions configures the HTTP API of the serve command.
+type ServerOptions struct {
+	// Listen is a TCP address like 127.0.0.1:8080, or a socket like unix:///run/squash.sock
+	Listen string
+	// WorkDir holds a directory per job with its temporary files, archive, report and log
+	WorkDir string
+	// Workers is the number of jobs run at the same time, QueueSize the number of jobs
+	// waiting for a worker before new ones are rejected
+	Workers   int
+	QueueSize int
+	// Token is required as a bearer token by every request when set. It can only be
+	// empty when the server listens on a unix socket, which only its user can connect to
+	Token string
+	// Jobs read images from the image store only. Transports lists the other transports
+	// they may read from, AllowedPaths the directories the OCI layouts and archives of
+	// jobs must be in. AllowedPaths alone allows the oci and oci-archive transports
+	Transports   []string
+	AllowedPaths []string
+	// Retention is how long finished jobs are kept, until they are deleted when 0
+	Retention time.Duration
+	// Defaults holds the options all jobs share: the image store, the cache and the
+	// rootless mode
+	Defaults CLI
+}
+
+// JobRequest is the body of a request submitting a job.
+type JobRequest struct {
+	Image            string   `json:"image"`
+	FromLayer        string   `json:"from_layer,omitempty"`
+	Tags             []string `json:"tags,omitempty"`
+	Message          string   `json:"message,omitempty"`
+	Platforms        []string `json:"platforms,omitempty"`
+	Compression      string   `json:"compression,omitempty"`
+	CompressionLevel int      `json:"compression_level,omitempty"`
+	// Load loads the squashed image into the image store, Archive keeps it as a tar
+	// archive to download from the job. At least one of them is required.
+	Load    bool `json:"load"`
+	Archive bool `json:"archive"`
+}
+
+// JobStatus describes a job of the server.
+type JobStatus struct {
+	ID       string     `json:"id"`
+	State    string     `json:"state"`
+	Request  JobRequest `json:"request"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Phase is the phase of the last progress event
+	Phase string `json:"phase,omitempty"`
+	// ImageIDs of the squashed images, one per platform for multi-platform images
+	ImageIDs []string `json:"image_ids,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	// ExitCode is the exit code the command would have ended with
+	ExitCode int `json:"exit_code,omitempty"`
+}
+
+// serverJob is a job with the state the server keeps next to its status.
+type serverJob struct {
+	JobStatus
+	dir    string
+	cancel context.CancelFunc
+	events []ProgressEvent
+	// changed is closed and replaced whenever an event is added or the job ends
+	changed chan struct{}
+}
+
+func (job *serverJob) done() bool {
+	return job.Finished != nil
+}
+
+// notify wakes up the requests following the events of the job.
+func (job *serverJob) notify() {
+	close(job.changed)
+	job.changed = make(chan struct{})
+}
+
+// Server runs squash jobs submitted over HTTP with a bounded number of workers.
+type Server struct {
+	opts   ServerOptions
+	logger *logrus.Logger
+
+	mu    sync.Mutex
+	jobs  map[string]*serverJob
+	queue chan *serverJob
+}
+
+// NewServer creates the work directory of the server and removes the job directories
+// an earlier server left behind, their jobs are gone with it.
+func NewServer(opts ServerOptions, logger *logrus.Logger) (*Server, error) {
+	if opts.Workers < 1 {
+		return nil, fmt.Errorf("at least one worker is required")
+	}
+	if opts.QueueSize < 0 {
+		return nil, fmt.Errorf("the queue size cannot be negative")
+	}
+	if len(opts.Token) == 0 && !strings.HasPrefix(opts.Listen, "unix://") {
+		return nil, fmt.Errorf("a token is required to listen on %s, set --token or listen on a unix socket", opts.Listen)
+	}
+	for _, transport := range opts.Transports {
+		switch transport {
+		case TransportDaemon, TransportOCILayout, TransportOCIArchive, TransportRegistry:
+		default:
+			return nil, fmt.Errorf("unsupported transport '%s', expected one of: %s, %s, %s", transport, TransportOCILayout, TransportOCIArchive, TransportRegistry)
+		}
+	}
+	if len(opts.AllowedPaths) != 0 && len(opts.Transports) == 0 {
+		opts.Transports = []string{TransportOCILayout, TransportOCIArchive}
+	}
+	var allowedPaths []string
+	for _, path := range opts.AllowedPaths {
+		resolved, err := resolveServerPath(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed path '%s': %w", path, err)
+		}
+		allowedPaths = append(allowedPaths, resolved)
+	}
+	opts.AllowedPaths = allowedPaths
+	if err := os.MkdirAll(opts.WorkDir, 0700); err != nil {
+		return nil, NewIOError("failed to create work directory", err)
+	}
+	entries, err := os.ReadDir(opts.WorkDir)
+	if err != nil {
+		return nil, NewIOError("failed to read work directory", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && jobIDPattern.MatchString(entry.Name()) {
+			logger.Infof("Removing the directory of job %s of an earlier run", entry.Name())
+			os.RemoveAll(filepath.Join(opts.WorkDir, entry.Name()))
+		}
+	}
+
+	return &Server{
+		opts:   opts,
+		logger: logger,
+		jobs:   make(map[string]*serverJob),
+		queue:  make(chan *serverJob, opts.QueueSize),
+	}, nil
+}
+
+// Serve answers requests until ctx is cancelled. Running jobs are cancelled with it and
+// queued ones never start.
+func (srv *Server) Serve(ctx context.Context) error {
+	listener, err := listenServer(srv.opts.Listen)
+	if err != nil {
+		return err
+	}
+
+	var workers sync.WaitGroup
+	for i := 0; i < srv.opts.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-srv.queue:
+					srv.run(ctx, job)
+				}
+			}
+		}()
+	}
+	if srv.opts.Retention > 0 {
+		go srv.expireJobs(ctx)
+	}
+
+	httpServer := &http.Server{Handler: srv, ReadHeaderTimeout: serverHeaderTimeout}
+	go func() {
+		<-ctx.Done()
+		srv.logger.Infof("Stopping, running jobs are cancelled")
+		srv.cancelQueued()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	srv.logger.Infof("Listening on %s with %d workers", srv.opts.Listen, srv.opts.Workers)
+	err = httpServer.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	workers.Wait()
+	return err
+}
+
+// listenServer listens on a TCP address, or on a unix socket given as unix://PATH that
+// only the user of the server can connect to.
+func listenServer(address string) (net.Listener, error) {
+	if path := strings.TrimPrefix(address, "unix://"); path != address {
+		// A socket left behind by an earlier server
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+	return net.Listen("tcp", address)
+}
+
+// ServeHTTP routes the requests of the API:
+//
+//	POST   /v1/jobs              submit a job
+//	GET    /v1/jobs              list the jobs
+//	GET    /v1/jobs/ID           status of a job
+//	DELETE /v1/jobs/ID           cancel a job, or remove a finished one
+//	GET    /v1/jobs/ID/events    progress events as JSON lines, until the job ends
+//	GET    /v1/jobs/ID/report    report of a succeeded job
+//	GET    /v1/jobs/ID/image     archive of a succeeded job
+//	GET    /v1/jobs/ID/log       log of a job
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !srv.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "v1" || parts[1] != "jobs" || len(parts) > 4 {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if len(parts) == 2 {
+		switch r.Method {
+		case http.MethodGet:
+			srv.listJobs(w)
+		case http.MethodPost:
+			srv.submitJob(w, r)
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+
+	srv.mu.Lock()
+	job, ok := srv.jobs[parts[2]]
+	srv.mu.Unlock()
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("job '%s' not found", parts[2]))
+		return
+	}
+	if len(parts) == 3 && r.Method == http.MethodDelete {
+		srv.deleteJob(w, job)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if len(parts) == 3 {
+		writeAPIJSON(w, http.StatusOK, srv.status(job))
+		return
+	}
+	switch parts[3] {
+	case "events":
+		srv.streamEvents(w, r, job)
+	case "report":
+		srv.serveJobFile(w, r, job, jobReportFile, "application/json")
+	case "image":
+		if !job.Request.Archive {
+			writeAPIError(w, http.StatusNotFound, "the job keeps no archive of the image")
+			return
+		}
+		srv.serveJobFile(w, r, job, jobArchiveFile, "application/x-tar")
+	case "log":
+		if _, err := os.Stat(filepath.Join(job.dir, jobLogFile)); err != nil {
+			writeAPIError(w, http.StatusNotFound, "the job has not started yet")
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeFile(w, r, filepath.Join(job.dir, jobLogFile))
+	default:
+		writeAPIError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (srv *Server) authorized(r *http.Request) bool {
+	if len(srv.opts.Token) == 0 {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(srv.opts.Token)) == 1
+}
+
+// submitJob validates a job request and queues the job.
+func (srv *Server) submitJob(w http.ResponseWriter, r *http.Request) {
+	var request JobRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJobRequestSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid job request: %v", err))
+		return
+	}
+	if err := srv.validateJobRequest(request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	job := &serverJob{
+		JobStatus: JobStatus{ID: id, State: JobQueued, Request: request, Created: time.Now()},
+		dir:       filepath.Join(srv.opts.WorkDir, id),
+		changed:   make(chan struct{}),
+	}
+	if err := os.Mkdir(job.dir, 0700); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, fmt.Sprintf("failed to create job directory: %v", err))
+		return
+	}
+
+	srv.mu.Lock()
+	select {
+	case srv.queue <- job:
+		srv.jobs[id] = job
+	default:
+		srv.mu.Unlock()
+		os.RemoveAll(job.dir)
+		writeAPIError(w, http.StatusServiceUnavailable, "too many jobs are queued, try again later")
+		return
+	}
+	status := job.JobStatus
+	srv.mu.Unlock()
+
+	srv.logger.Infof("Job %s queued: %s", id, request.Image)
+	w.Header().Set("Location", "/v1/jobs/"+id)
+	writeAPIJSON(w, http.StatusAccepted, status)
+}
+
+// validateJobRequest rejects the requests the squash would fail on before it starts,
+// and the ones reading images the server does not allow.
+func (srv *Server) validateJobRequest(request JobRequest) error {
+	if len(request.Image) == 0 {
+		return fmt.Errorf("image is required")
+	}
+	if err := srv.checkSource(ParseImageSource(request.Image)); err != nil {
+		return err
+	}
+	if !request.Load && !request.Archive {
+		return fmt.Errorf("one of load or archive is required, the squashed image would not be accessible otherwise")
+	}
+	if _, err := ParseRepoTags(request.Tags); err != nil {
+		return err
+	}
+	if _, err := ParsePlatforms(request.Platforms); err != nil {
+		return err
+	}
+	compression, err := ParseCompression(request.Compression)
+	if err != nil {
+		return err
+	}
+	return compression.ValidateLevel(request.CompressionLevel)
+}
+
+func newJobID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to create job ID: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// listJobs writes the status of all jobs, the oldest first.
+func (srv *Server) listJobs(w http.ResponseWriter) {
+	srv.mu.Lock()
+	jobs := make([]JobStatus, 0, len(srv.jobs))
+	for _, job := range srv.jobs {
+		jobs = append(jobs, job.JobStatus)
+	}
+	srv.mu.Unlock()
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Created.Before(jobs[j].Created)
+	})
+	writeAPIJSON(w, http.StatusOK, jobs)
+}
+
+func (srv *Server) status(job *serverJob) JobStatus {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return job.JobStatus
+}
+
+// deleteJob cancels a queued or running job, or removes a finished one with its files.
+func (srv *Server) deleteJob(w http.ResponseWriter, job *serverJob) {
+	srv.mu.Lock()
+	switch job.State {
+	case JobQueued:
+		srv.finish(job, nil, context.Canceled)
+	case JobRunning:
+		// The worker finishes the job once the squash stopped
+		job.cancel()
+	default:
+		delete(srv.jobs, job.ID)
+		srv.mu.Unlock()
+		os.RemoveAll(job.dir)
+		srv.logger.Infof("Job %s removed", job.ID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	status := job.JobStatus
+	srv.mu.Unlock()
+	srv.logger.Infof("Job %s cancelled", job.ID)
+	writeAPIJSON(w, http.StatusAccepted, status)
+}
+
+// streamEvents writes the progress events of a job as JSON lines, the earlier ones
+// first, and returns when the job ends.
+func (srv *Server) streamEvents(w http.ResponseWriter, r *http.Request, job *serverJob) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	for sent := 0; ; {
+		srv.mu.Lock()
+		events := job.events[sent:]
+		done := job.done()
+		changed := job.changed
+		srv.mu.Unlock()
+
+		for _, event := range events {
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+		}
+		sent += len(events)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if done {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveJobFile serves a file a succeeded job wrote to its directory.
+func (srv *Server) serveJobFile(w http.ResponseWriter, r *http.Request, job *serverJob, name, contentType string) {
+	status := srv.status(job)
+	if status.State != JobSucceeded {
+		writeAPIError(w, http.StatusConflict, fmt.Sprintf("the job is %s", status.State))
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeFile(w, r, filepath.Join(job.dir, name))
+}
+
+// run squashes the image of a job, unless it was cancelled while queued.
+func (srv *Server) run(ctx context.Context, job *serverJob) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	srv.mu.Lock()
+	if job.State != JobQueued {
+		srv.mu.Unlock()
+		return
+	}
+	started := time.Now()
+	job.State = JobRunning
+	job.Started = &started
+	job.cancel = cancel
+	srv.mu.Unlock()
+
+	srv.logger.Infof("Job %s started: %s", job.ID, job.Request.Image)
+	report, err := srv.squash(ctx, job)
+	if err != nil && ctx.Err() != nil {
+		// Child processes get cancelled as well, their errors count as cancelled too
+		err = ctx.Err()
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.finish(job, report, err)
+	if err != nil {
+		srv.logger.Warnf("Job %s %s: %v", job.ID, job.State, err)
+	} else {
+		srv.logger.Infof("Job %s succeeded", job.ID)
+	}
+}
+
+// squash runs the squash of a job in its directory, logging to the log of the job.
+func (srv *Server) squash(ctx context.Context, job *serverJob) (*Report, error) {
+	logFile, err := os.Create(filepath.Join(job.dir, jobLogFile))
+	if err != nil {
+		return nil, NewIOError("failed to create job log", err)
+	}
+	defer logFile.Close()
+	logger := logrus.New()
+	logger.SetOutput(logFile)
+	logger.SetLevel(srv.logger.GetLevel())
+	logger.SetFormatter(srv.logger.Formatter)
+	logger.SetReportCaller(srv.logger.ReportCaller)
+
+	request := job.Request
+	cli := srv.opts.Defaults
+	cli.Image = request.Image
+	cli.FromLayer = request.FromLayer
+	cli.Tags = request.Tags
+	cli.Message = request.Message
+	if len(cli.Message) == 0 {
+		cli.Message = "squash image"
+	}
+	cli.Platforms = request.Platforms
+	cli.Compression = request.Compression
+	cli.CompressionLevel = request.CompressionLevel
+	cli.LoadImage = request.Load
+	if request.Archive {
+		cli.OutputPath = filepath.Join(job.dir, jobArchiveFile)
+	}
+	cli.TmpDir = filepath.Join(job.dir, jobTmpDir)
+	defer os.RemoveAll(cli.TmpDir)
+	cli.Messages = logFile
+	cli.Progress = func(event ProgressEvent) {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		job.events = append(job.events, event)
+		job.Phase = event.Phase
+		job.notify()
+	}
+
+	squash, err := NewSquash(cli, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer squash.Close()
+	if source := ParseImageSource(cli.Image); source.Transport != TransportDaemon {
+		_, err = squash.RunIndex(ctx, source)
+	} else {
+		_, err = squash.Run(ctx)
+	}
+	if err != nil {
+		logger.Errorf("Squash process failed: %v", err)
+		return nil, err
+	}
+
+	report := NewReport(squash.Results())
+	if err := WriteReport(filepath.Join(job.dir, jobReportFile), squash.Results()); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// finish records the end of a job. srv.mu must be held.
+func (srv *Server) finish(job *serverJob, report *Report, err error) {
+	finished := time.Now()
+	job.Finished = &finished
+	job.ExitCode = ExitCode(err)
+	switch {
+	case err == nil:
+		job.State = JobSucceeded
+		for _, img := range report.Images {
+			job.ImageIDs = append(job.ImageIDs, img.ImageID)
+		}
+	case job.ExitCode == ExitInterrupted:
+		job.State = JobCanceled
+		job.Error = "the job was cancelled"
+	default:
+		job.State = JobFailed
+		job.Error = err.Error()
+	}
+	job.notify()
+}
+
+// cancelQueued cancels the jobs no worker started, when the server stops.
+func (srv *Server) cancelQueued() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, job := range srv.jobs {
+		if job.State == JobQueued {
+			srv.finish(job, nil, context.Canceled)
+		}
+	}
+}
+
+// expireJobs removes the jobs that finished more than Retention ago.
+func (srv *Server) expireJobs(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			srv.expire(now)
+		}
+	}
+}
+
+// expire removes the jobs that finished more than Retention before now.
+func (srv *Server) expire(now time.Time) {
+	srv.mu.Lock()
+	var expired []*serverJob
+	for id, job := range srv.jobs {
+		if job.done() && now.Sub(*job.Finished) > srv.opts.Retention {
+			expired = append(expired, job)
+			delete(srv.jobs, id)
+		}
+	}
+	srv.mu.Unlock()
+	for _, job := range expired {
+		os.RemoveAll(job.dir)
+		srv.logger.Debugf("Job %s expired", job.ID)
+	}
+}
+
+func writeAPIJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, code int, message string) {
+	writeAPIJSON(w, code, map[string]string{"error": message})
+}
+
+// checkSource fails unless the transport of the image is allowed, and its OCI layout or
+// archive is in one of the allowed paths.
+func (srv *Server) checkSource(source ImageSource) error {
+	if source.Transport == TransportDaemon {
+		return nil
+	}
+	allowed := false
+	for _, transport := range srv.opts.Transports {
+		allowed = allowed || transport == source.Transport
+	}
+	if !allowed {
+		return fmt.Errorf("images cannot be read from the %s transport, the server only allows: %s", source.Transport, strings.Join(append([]string{TransportDaemon}, srv.opts.Transports...), ", "))
+	}
+	if source.Transport == TransportRegistry || len(srv.opts.AllowedPaths) == 0 {
+		return nil
+	}
+	path, err := resolveServerPath(source.Path)
+	if err != nil {
+		return fmt.Errorf("invalid path '%s': %w", source.Path, err)
+	}
+	for _, dir := range srv.opts.AllowedPaths {
+		if within(dir, path) {
+			return nil
+		}
+	}
+	return fmt.Errorf("'%s' is not in a path the server allows", source.Path)
+}
+
+// resolveServerPath makes the path absolute with its symlinks resolved, so a symlink
+// cannot lead out of an allowed path.
+func resolveServerPath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(path)
+}
@@ -0,0 +1,322 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testToken = "secret"
+
+// newTestServer serves the API of a server squashing the images of store. No worker
+// runs, the tests take the jobs from the queue.
+func newTestServer(t *testing.T, store *fakeStore, opts ServerOptions) (*Server, *httptest.Server) {
+	opts.WorkDir = filepath.Join(t.TempDir(), "jobs")
+	opts.Workers = 1
+	if len(opts.Listen) == 0 {
+		opts.Listen = "127.0.0.1:0"
+		opts.Token = testToken
+	}
+	opts.Defaults.Store = store
+	srv, err := NewServer(opts, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	return srv, ts
+}
+
+// apiRequest sends a request with the token and decodes the JSON answer into v, when
+// given.
+func apiRequest(t *testing.T, ts *httptest.Server, method, path, token string, body interface{}, v interface{}) int {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func testStore(t *testing.T) *fakeStore {
+	return newFakeStore(t, fakeImage{name: "app", layers: []map[string]string{
+		{"etc/os-release": "ID=test\n"},
+		{"app/server": "v1"},
+		{"app/server": "v2"},
+	}})
+}
+
+func TestServerToken(t *testing.T) {
+	for _, listen := range []string{"127.0.0.1:8080", "localhost:8080", "[::1]:8080", "0.0.0.0:8080"} {
+		_, err := NewServer(ServerOptions{Listen: listen, WorkDir: t.TempDir(), Workers: 1}, testLogger())
+		if err == nil || !strings.Contains(err.Error(), "a token is required") {
+			t.Errorf("%s without a token: got error %v, expected a token to be required", listen, err)
+		}
+	}
+	if _, err := NewServer(ServerOptions{Listen: "unix:///run/squash.sock", WorkDir: t.TempDir(), Workers: 1}, testLogger()); err != nil {
+		t.Errorf("unix socket without a token: %v", err)
+	}
+
+	_, ts := newTestServer(t, testStore(t), ServerOptions{})
+	for _, token := range []string{"", "wrong", testToken + "x"} {
+		if code := apiRequest(t, ts, http.MethodGet, "/v1/jobs", token, nil, nil); code != http.StatusUnauthorized {
+			t.Errorf("token %q: got status %d, expected %d", token, code, http.StatusUnauthorized)
+		}
+	}
+	var jobs []JobStatus
+	if code := apiRequest(t, ts, http.MethodGet, "/v1/jobs", testToken, nil, &jobs); code != http.StatusOK || len(jobs) != 0 {
+		t.Errorf("got status %d with %d jobs, expected %d without jobs", code, len(jobs), http.StatusOK)
+	}
+}
+
+func TestServerSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "squash.sock")
+	listener, err := listenServer("unix://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("the socket has the mode %o, expected 600", mode)
+	}
+}
+
+func TestServerSources(t *testing.T) {
+	allowed := t.TempDir()
+	layout := filepath.Join(allowed, "app")
+	if err := os.Mkdir(layout, 0755); err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(allowed, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		opts  ServerOptions
+		image string
+		error string
+	}{
+		{name: "image store", image: "app"},
+		{name: "no transports", image: "oci:" + layout, error: "cannot be read from the oci transport"},
+		{name: "other transport", opts: ServerOptions{Transports: []string{TransportOCIArchive}}, image: "docker://registry.local/app", error: "cannot be read from the docker transport"},
+		{name: "allowed transport", opts: ServerOptions{Transports: []string{TransportRegistry}}, image: "docker://registry.local/app"},
+		{name: "allowed path", opts: ServerOptions{AllowedPaths: []string{allowed}}, image: "oci:" + layout},
+		{name: "outside the allowed paths", opts: ServerOptions{AllowedPaths: []string{allowed}}, image: "oci:" + outside, error: "is not in a path the server allows"},
+		{name: "symlink out of the allowed paths", opts: ServerOptions{AllowedPaths: []string{allowed}}, image: "oci:" + filepath.Join(allowed, "link"), error: "is not in a path the server allows"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.QueueSize = 1
+			_, ts := newTestServer(t, testStore(t), test.opts)
+			var answer map[string]interface{}
+			code := apiRequest(t, ts, http.MethodPost, "/v1/jobs", testToken, JobRequest{Image: test.image, Load: true}, &answer)
+			if len(test.error) == 0 {
+				if code != http.StatusAccepted {
+					t.Errorf("got status %d, expected %d: %v", code, http.StatusAccepted, answer["error"])
+				}
+				return
+			}
+			message, _ := answer["error"].(string)
+			if code != http.StatusBadRequest || !strings.Contains(message, test.error) {
+				t.Errorf("got status %d with %q, expected %d with %q", code, message, http.StatusBadRequest, test.error)
+			}
+		})
+	}
+}
+
+func TestServerQueueFull(t *testing.T) {
+	srv, ts := newTestServer(t, testStore(t), ServerOptions{QueueSize: 2})
+	for i := 0; i < 2; i++ {
+		if code := apiRequest(t, ts, http.MethodPost, "/v1/jobs", testToken, JobRequest{Image: "app", Load: true}, nil); code != http.StatusAccepted {
+			t.Fatalf("job %d: got status %d, expected %d", i+1, code, http.StatusAccepted)
+		}
+	}
+	var answer map[string]string
+	if code := apiRequest(t, ts, http.MethodPost, "/v1/jobs", testToken, JobRequest{Image: "app", Load: true}, &answer); code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, expected %d", code, http.StatusServiceUnavailable)
+	}
+	entries, err := os.ReadDir(srv.opts.WorkDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("the work directory has %d entries, expected the directories of the 2 queued jobs", len(entries))
+	}
+}
+
+// submitJob submits a job and returns it as the worker takes it from the queue.
+func submitJob(t *testing.T, srv *Server, ts *httptest.Server, request JobRequest) *serverJob {
+	var status JobStatus
+	if code := apiRequest(t, ts, http.MethodPost, "/v1/jobs", testToken, request, &status); code != http.StatusAccepted {
+		t.Fatalf("got status %d, expected %d", code, http.StatusAccepted)
+	}
+	job := <-srv.queue
+	if job.ID != status.ID || status.State != JobQueued {
+		t.Fatalf("got job %s %s, expected the queued job %s", job.ID, job.State, status.ID)
+	}
+	return job
+}
+
+func TestServerJob(t *testing.T) {
+	store := testStore(t)
+	srv, ts := newTestServer(t, store, ServerOptions{QueueSize: 1})
+	job := submitJob(t, srv, ts, JobRequest{Image: "app", FromLayer: "2", Tags: []string{"app:squashed"}, Load: true, Archive: true})
+	srv.run(context.Background(), job)
+
+	var status JobStatus
+	apiRequest(t, ts, http.MethodGet, "/v1/jobs/"+job.ID, testToken, nil, &status)
+	if status.State != JobSucceeded || len(status.ImageIDs) != 1 || status.Finished == nil {
+		t.Fatalf("got the status %+v, expected the job to succeed with one image", status)
+	}
+	if len(store.loaded) != 1 {
+		t.Errorf("the image was loaded %d times, expected once", len(store.loaded))
+	}
+
+	resp, err := ts.Client().Do(authorizedRequest(t, ts, "/v1/jobs/"+job.ID+"/image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifests []ImageManifest
+	if err := json.Unmarshal(readArchive(t, archive)["manifest.json"], &manifests); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 1 || len(manifests[0].Layers) != 2 {
+		t.Errorf("the archive has the manifests %+v, expected one image of two layers", manifests)
+	}
+
+	var report Report
+	if code := apiRequest(t, ts, http.MethodGet, "/v1/jobs/"+job.ID+"/report", testToken, nil, &report); code != http.StatusOK || len(report.Images) != 1 {
+		t.Errorf("got status %d with the report %+v, expected the report of one image", code, report)
+	}
+}
+
+func authorizedRequest(t *testing.T, ts *httptest.Server, path string) *http.Request {
+	req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	return req
+}
+
+func TestServerCancel(t *testing.T) {
+	store := testStore(t)
+	store.block = make(chan struct{})
+	srv, ts := newTestServer(t, store, ServerOptions{QueueSize: 2})
+
+	// A queued job never starts
+	queued := submitJob(t, srv, ts, JobRequest{Image: "app", Load: true})
+	var status JobStatus
+	if code := apiRequest(t, ts, http.MethodDelete, "/v1/jobs/"+queued.ID, testToken, nil, &status); code != http.StatusAccepted || status.State != JobCanceled {
+		t.Fatalf("got status %d with the job %s, expected %d with the job canceled", code, status.State, http.StatusAccepted)
+	}
+	srv.run(context.Background(), queued)
+	if len(store.saves) != 0 {
+		t.Errorf("the cancelled job saved %v", store.saves)
+	}
+
+	// A running job stops while its image is saved
+	running := submitJob(t, srv, ts, JobRequest{Image: "app", Load: true})
+	done := make(chan struct{})
+	go func() {
+		srv.run(context.Background(), running)
+		close(done)
+	}()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		store.mu.Lock()
+		saving := len(store.saves) != 0
+		store.mu.Unlock()
+		if saving {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the job did not start to save the image")
+		}
+	}
+	if code := apiRequest(t, ts, http.MethodDelete, "/v1/jobs/"+running.ID, testToken, nil, nil); code != http.StatusAccepted {
+		t.Fatalf("got status %d, expected %d", code, http.StatusAccepted)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the job did not stop")
+	}
+	apiRequest(t, ts, http.MethodGet, "/v1/jobs/"+running.ID, testToken, nil, &status)
+	if status.State != JobCanceled || status.ExitCode != ExitInterrupted {
+		t.Errorf("got the job %s with exit code %d, expected it canceled with %d", status.State, status.ExitCode, ExitInterrupted)
+	}
+
+	// A finished job is removed with its files
+	if code := apiRequest(t, ts, http.MethodDelete, "/v1/jobs/"+running.ID, testToken, nil, nil); code != http.StatusNoContent {
+		t.Errorf("got status %d, expected %d", code, http.StatusNoContent)
+	}
+	if _, err := os.Stat(running.dir); !os.IsNotExist(err) {
+		t.Errorf("the directory of the removed job is left: %v", err)
+	}
+	if code := apiRequest(t, ts, http.MethodGet, "/v1/jobs/"+running.ID, testToken, nil, nil); code != http.StatusNotFound {
+		t.Errorf("got status %d for the removed job, expected %d", code, http.StatusNotFound)
+	}
+}
+
+func TestServerRetention(t *testing.T) {
+	srv, ts := newTestServer(t, testStore(t), ServerOptions{QueueSize: 2, Retention: time.Hour})
+	job := submitJob(t, srv, ts, JobRequest{Image: "app", Load: true})
+	srv.run(context.Background(), job)
+	pending := submitJob(t, srv, ts, JobRequest{Image: "app", Load: true})
+
+	finished := srv.status(job).Finished
+	srv.expire(finished.Add(30 * time.Minute))
+	if code := apiRequest(t, ts, http.MethodGet, "/v1/jobs/"+job.ID, testToken, nil, nil); code != http.StatusOK {
+		t.Errorf("got status %d before the retention is over, expected %d", code, http.StatusOK)
+	}
+
+	srv.expire(finished.Add(2 * time.Hour))
+	if code := apiRequest(t, ts, http.MethodGet, "/v1/jobs/"+job.ID, testToken, nil, nil); code != http.StatusNotFound {
+		t.Errorf("got status %d after the retention, expected %d", code, http.StatusNotFound)
+	}
+	if _, err := os.Stat(job.dir); !os.IsNotExist(err) {
+		t.Errorf("the directory of the expired job is left: %v", err)
+	}
+	if code := apiRequest(t, ts, http.MethodGet, "/v1/jobs/"+pending.ID, testToken, nil, nil); code != http.StatusOK {
+		t.Errorf("got status %d for the queued job, expected it to be kept", code)
+	}
+}
@@ -0,0 +1,92 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Transports an image to squash can be read from, named like the transports of skopeo.
+const (
+	TransportDaemon     = "docker-daemon"
+	TransportOCILayout  = "oci"
+	TransportOCIArchive = "oci-archive"
+	TransportRegistry   = "docker"
+)
+
+// ImageSource is the --image argument split into its transport and location.
+type ImageSource struct {
+	Transport string
+	// Path of the OCI layout or archive, or the image reference for other transports
+	Path string
+	// RefName selects an image in an OCI layout or archive holding several of them
+	RefName string
+}
+
+// ParseImageSource recognizes images given as oci:PATH[:REF], oci-archive:PATH[:REF]
+// and docker://REFERENCE. Anything else is an image in the Docker daemon.
+func ParseImageSource(image string) ImageSource {
+	switch {
+	case strings.HasPrefix(image, "docker://"):
+		return ImageSource{Transport: TransportRegistry, Path: strings.TrimPrefix(image, "docker://")}
+	case strings.HasPrefix(image, TransportOCIArchive+":"):
+		path, ref := splitLayoutReference(strings.TrimPrefix(image, TransportOCIArchive+":"))
+		return ImageSource{Transport: TransportOCIArchive, Path: path, RefName: ref}
+	case strings.HasPrefix(image, TransportOCILayout+":"):
+		path, ref := splitLayoutReference(strings.TrimPrefix(image, TransportOCILayout+":"))
+		return ImageSource{Transport: TransportOCILayout, Path: path, RefName: ref}
+	}
+	return ImageSource{Transport: TransportDaemon, Path: image}
+}
+
+// splitLayoutReference splits PATH:REF, a colon inside the last path element starts
+// the reference name.
+func splitLayoutReference(value string) (string, string) {
+	colonIndex := strings.LastIndex(value, ":")
+	if colonIndex > -1 && !strings.Contains(value[colonIndex:], "/") {
+		return value[:colonIndex], value[colonIndex+1:]
+	}
+	return value, ""
+}
+
+// openLayout makes the source available as an OCI image layout directory. Layouts given
+// by the user are used in place and only read; archives and registry images are
+// written into dir.
+func (im *V2Image) openLayout(ctx context.Context, source ImageSource, dir string, platforms []OCIPlatform) (string, error) {
+	switch source.Transport {
+	case TransportOCILayout:
+		if _, err := os.Stat(filepath.Join(source.Path, "index.json")); err != nil {
+			return "", fmt.Errorf("'%s' is not an OCI image layout: %w", source.Path, err)
+		}
+		return source.Path, nil
+	case TransportOCIArchive:
+		file, err := os.Open(source.Path)
+		if err != nil {
+			return "", fmt.Errorf("failed to open OCI archive: %w", err)
+		}
+		defer file.Close()
+
+		var bytesTotal int64
+		if info, err := file.Stat(); err == nil {
+			bytesTotal = info.Size()
+		}
+		progress := im.startPhase(PhaseOpen, bytesTotal)
+		im.Logger.Infof("Extracting OCI archive %s to %s directory...", source.Path, dir)
+		counter := &progressReader{r: contextReader{ctx: ctx, r: file}, progress: progress}
+		if err := im.extractTar(counter, dir); err != nil {
+			return "", err
+		}
+		progress.end(ProgressEvent{BytesRead: counter.n})
+		return dir, nil
+	case TransportRegistry:
+		progress := im.startPhase(PhaseOpen, 0)
+		if err := pullImage(ctx, source.Path, dir, platforms, im.Logger); err != nil {
+			return "", err
+		}
+		progress.end(ProgressEvent{})
+		return dir, nil
+	}
+	return "", fmt.Errorf("images from the %s transport cannot be read as an OCI layout", source.Transport)
+}
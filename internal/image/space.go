@@ -0,0 +1,329 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// spaceEstimate is the disk space and memory a squash needs, estimated from the layer
+// sizes in the image history before anything is saved.
+type spaceEstimate struct {
+	// Image is the size of all layers, what the saved image takes up
+	Image int64
+	// Squashed is the size of the layers to squash, what their merged files take up
+	Squashed int64
+	// Largest is the size of the largest layer to squash
+	Largest int64
+	// Tmp is needed in the temporary directory, Output for the exported archive
+	Tmp    int64
+	Output int64
+	// Cache is written to the layer cache, it counts when the cache is on the filesystem
+	// of the temporary directory
+	Cache int64
+	// Memory is held by the buffers of the squash, the files it writes to a tmpfs come
+	// on top of it
+	Memory int64
+}
+
+// Memory held by the squash, measured compressing layers of random files. Layers are
+// streamed, only the compressors of the export and the buffer of the layer hashing
+// hold more than a few pages.
+const (
+	// hashMemory is the buffer of computeSha256 with a decompressor for zstd layers
+	hashMemory int64 = 32 << 20
+	// Memory of a compressor, per layer compressed at the same time
+	gzipMemory       int64 = 1 << 20
+	estargzMemory    int64 = 4 << 20
+	zstdMemory       int64 = 32 << 20
+	zstdBetterMemory int64 = 64 << 20
+)
+
+const (
+	tmpfsMagic = 0x01021994
+	// Limit and usage of the cgroup of the process, with cgroup v2
+	cgroupMemoryLimit = "/sys/fs/cgroup/memory.max"
+	cgroupMemoryUsage = "/sys/fs/cgroup/memory.current"
+)
+
+// estimateSpace estimates the peak of the space needed by the phases of the squash, for
+// a layer cache that has none of the layers yet. The saved image is spooled once, the
+// moved layers where the new image needs them. Each layer to squash is extracted next to
+// its tar, and the tar removed once it is merged, unless the layer cache or a resumable
+// run keeps it. The merged files are removed as they are packed, unless a resumable run
+// still needs them. Compressed images are written to the export directory once the saved
+// image is removed.
+func (im *V2Image) estimateSpace() spaceEstimate {
+	var estimate spaceEstimate
+	squashedFrom := len(im.layerSizes) - len(im.LayersToSquash)
+	for i, size := range im.layerSizes {
+		estimate.Image += size
+		if i >= squashedFrom {
+			estimate.Squashed += size
+			estimate.Largest = max(estimate.Largest, size)
+		}
+	}
+
+	merge := estimate.Image + estimate.Largest
+	pack := estimate.Image
+	if im.cache != nil || im.resume {
+		merge += estimate.Squashed
+		pack += estimate.Squashed
+	}
+	if im.resume {
+		pack += estimate.Squashed
+	}
+	estimate.Tmp = max(merge, pack)
+	if im.Compression != CompressionNone {
+		estimate.Tmp = max(estimate.Tmp, 2*estimate.Image)
+	}
+	if im.cache != nil {
+		// The merge of all but the top layer is packed into the cache, the layers and
+		// the squashed layer are hard linked to it on the same filesystem
+		estimate.Cache = estimate.Squashed
+	}
+	if len(im.outputPath) != 0 && im.outputPath != StdoutPath {
+		// Layers only get smaller by squashing, the metadata is negligible
+		estimate.Output = estimate.Image
+	}
+
+	estimate.Memory = hashMemory
+	if im.Compression != CompressionNone {
+		// compressLayers compresses the moved layers and the squashed one, one per CPU
+		layers := len(im.layerSizes) - len(im.LayersToSquash) + 1
+		estimate.Memory += int64(min(layers, runtime.NumCPU())) * compressorMemory(im.Compression, im.CompressionLevel)
+	}
+	return estimate
+}
+
+// compressorMemory is the memory of a compressing writer of newWriter or writeEstargz.
+func compressorMemory(c Compression, level int) int64 {
+	switch c {
+	case CompressionGzip:
+		return gzipMemory
+	case CompressionEstargz:
+		return estargzMemory
+	case CompressionZstd:
+		// The better levels use larger match tables
+		if level != 0 && zstd.EncoderLevelFromZstd(level) >= zstd.SpeedBetterCompression {
+			return zstdBetterMemory
+		}
+		return zstdMemory
+	}
+	return 0
+}
+
+// checkSpace makes sure the squash does not run out of disk space or memory halfway.
+// Without --tmp-dir the temporary directory is created in the first of the system
+// temporary directory and the --tmp-dir-candidates that has enough free space, and
+// enough memory for a tmpfs.
+func (im *V2Image) checkSpace() error {
+	estimate := im.estimateSpace()
+	im.Logger.Debugf("Estimated disk space: %s for the temporary directory, %s for the output, %s for the layer cache (image %s, layers to squash %s), %s of memory",
+		formatBytes(estimate.Tmp), formatBytes(estimate.Output), formatBytes(estimate.Cache), formatBytes(estimate.Image), formatBytes(estimate.Squashed), formatBytes(estimate.Memory))
+
+	memory := estimate.Memory
+	var outputDir string
+	if estimate.Output != 0 {
+		// The export fails later when the directory is missing
+		outputDir = existingParent(filepath.Dir(im.outputPath))
+		if err := checkFreeSpace(outputDir, estimate.Output, "the output"); err != nil {
+			return err
+		}
+		if onTmpfs(outputDir) {
+			memory += estimate.Output
+		}
+	}
+	availableMemory, err := availableMemory()
+	if err != nil {
+		im.Logger.Debugf("Not checking the available memory: %v", err)
+		availableMemory = -1
+	}
+	if err := checkMemory(memory, availableMemory); err != nil {
+		return err
+	}
+
+	candidates := im.tmpDirCandidates
+	if len(im.TmpDir) != 0 {
+		// The parent of the directory to create, or the directory of a resumed run
+		candidates = []string{existingParent(im.TmpDir)}
+	} else {
+		candidates = append([]string{os.TempDir()}, candidates...)
+	}
+
+	var problems []string
+	for _, dir := range candidates {
+		needed := estimate.Tmp
+		if sameFilesystem(dir, outputDir) && !im.removeExported {
+			// The new image stays while the archive is written next to it
+			needed += estimate.Output
+		}
+		if im.cache != nil && sameFilesystem(dir, existingParent(im.cache.dir)) {
+			// Failing to write to the cache is no error, but it takes the space the
+			// squash needs
+			needed += estimate.Cache
+		}
+		err := checkFreeSpace(dir, needed, "the temporary directory")
+		if err == nil && onTmpfs(dir) {
+			// The files of a tmpfs are kept in memory
+			err = checkMemory(memory+needed, availableMemory)
+		}
+		if err == nil {
+			if len(im.TmpDir) == 0 && dir != os.TempDir() {
+				im.Logger.Infof("Creating the temporary directory in %s, it has enough free space", dir)
+				im.tmpParent = dir
+			}
+			return nil
+		}
+		var insufficient *InsufficientSpaceError
+		if !errors.As(err, &insufficient) {
+			return err
+		}
+		problems = append(problems, err.Error())
+	}
+	if len(problems) == 1 {
+		return NewInsufficientSpaceError(problems[0])
+	}
+	return NewInsufficientSpaceError(fmt.Sprintf("no temporary directory has enough free space: %s", strings.Join(problems, "; ")))
+}
+
+// checkFreeSpace fails when the filesystem of dir has less than needed bytes available.
+func checkFreeSpace(dir string, needed int64, purpose string) error {
+	available, err := freeSpace(dir)
+	if err != nil {
+		return NewIOError(fmt.Sprintf("failed to check the free space in %s", dir), err)
+	}
+	if available < needed {
+		return NewInsufficientSpaceError(fmt.Sprintf("%s needs about %s in %s, only %s are available",
+			purpose, formatBytes(needed), dir, formatBytes(available)))
+	}
+	return nil
+}
+
+// checkMemory fails when less than needed bytes of memory are available. It passes when
+// the available memory is unknown, which is negative.
+func checkMemory(needed, available int64) error {
+	if available >= 0 && available < needed {
+		return NewInsufficientSpaceError(fmt.Sprintf("the squash needs about %s of memory, only %s are available",
+			formatBytes(needed), formatBytes(available)))
+	}
+	return nil
+}
+
+// availableMemory returns the memory that can be used without swapping, the
+// MemAvailable of the kernel, less when the memory of the cgroup is limited.
+func availableMemory() (int64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	available := int64(-1)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "MemAvailable:" && fields[2] == "kB" {
+			kB, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid MemAvailable in /proc/meminfo: %w", err)
+			}
+			available = kB << 10
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if available < 0 {
+		return 0, fmt.Errorf("/proc/meminfo has no MemAvailable")
+	}
+
+	// memory.max is "max" without a limit
+	limit, errLimit := readMemoryFile(cgroupMemoryLimit)
+	usage, errUsage := readMemoryFile(cgroupMemoryUsage)
+	if errLimit == nil && errUsage == nil {
+		available = min(available, max(limit-usage, 0))
+	}
+	return available, nil
+}
+
+// readMemoryFile reads a number of bytes from a cgroup file.
+func readMemoryFile(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// onTmpfs tells whether dir is on a tmpfs, whose files take up memory.
+func onTmpfs(dir string) bool {
+	var stat syscall.Statfs_t
+	return syscall.Statfs(dir, &stat) == nil && int64(stat.Type) == tmpfsMagic
+}
+
+// freeSpace returns the bytes available to unprivileged users on the filesystem of dir.
+func freeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// sameFilesystem tells whether both directories are on the same filesystem.
+func sameFilesystem(a, b string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	statA, okA := infoA.Sys().(*syscall.Stat_t)
+	statB, okB := infoB.Sys().(*syscall.Stat_t)
+	return okA && okB && statA.Dev == statB.Dev
+}
+
+// existingParent returns path, or its closest parent that exists.
+func existingParent(path string) string {
+	for !PathExists(path) {
+		parent := filepath.Dir(path)
+		if parent == path {
+			break
+		}
+		path = parent
+	}
+	return path
+}
+
+// tarError tells a full disk from a corrupt archive when tar failed to extract it.
+func tarError(msg string, err error, output []byte) error {
+	err = fmt.Errorf("%w: %s", err, bytes.TrimSpace(output))
+	if noSpaceLeft(err) {
+		return NewInsufficientSpaceError(fmt.Sprintf("%s: %v", msg, err))
+	}
+	return NewCorruptArchiveError(msg, err)
+}
+
+// noSpaceLeft tells whether the error, or the message of tar in it, is ENOSPC.
+func noSpaceLeft(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || strings.Contains(err.Error(), syscall.ENOSPC.Error())
+}
+
+// filesystemFull tells whether less than a megabyte is left on the filesystem of dir.
+// tar only reports a short write when the archive it creates does not fit.
+func filesystemFull(dir string) bool {
+	available, err := freeSpace(dir)
+	return err == nil && available < 1<<20
+}
@@ -0,0 +1,51 @@
+package image
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+)
+
+func TestEstimateMemory(t *testing.T) {
+	tests := []struct {
+		compression Compression
+		level       int
+		compressor  int64
+	}{
+		{compression: CompressionNone},
+		{compression: CompressionGzip, level: 9, compressor: gzipMemory},
+		{compression: CompressionEstargz, compressor: estargzMemory},
+		{compression: CompressionZstd, compressor: zstdMemory},
+		{compression: CompressionZstd, level: 3, compressor: zstdMemory},
+		{compression: CompressionZstd, level: 19, compressor: zstdBetterMemory},
+	}
+	for _, test := range tests {
+		im := &V2Image{}
+		im.layerSizes = []int64{100, 200, 300, 400}
+		im.LayersToSquash = []string{"c", "d"}
+		im.Compression = test.compression
+		im.CompressionLevel = test.level
+		// The two moved layers and the squashed one are compressed
+		expected := hashMemory + int64(min(3, runtime.NumCPU()))*test.compressor
+		if memory := im.estimateSpace().Memory; memory != expected {
+			t.Errorf("%s level %d: estimated %d bytes of memory, expected %d", test.compression, test.level, memory, expected)
+		}
+	}
+}
+
+func TestCheckMemory(t *testing.T) {
+	if err := checkMemory(2<<20, 3<<20); err != nil {
+		t.Errorf("enough memory: %v", err)
+	}
+	if err := checkMemory(2<<20, -1); err != nil {
+		t.Errorf("unknown memory: %v", err)
+	}
+	err := checkMemory(2<<20, 1<<20)
+	var insufficient *InsufficientSpaceError
+	if !errors.As(err, &insufficient) || ExitCode(err) != ExitNoSpace {
+		t.Fatalf("got error %v, expected the memory to be insufficient", err)
+	}
+	if expected := "the squash needs about 2.0 MiB of memory, only 1.0 MiB are available"; err.Error() != expected {
+		t.Errorf("got error %q, expected %q", err, expected)
+	}
+}
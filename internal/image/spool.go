@@ -0,0 +1,254 @@
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A single image saved from the daemon is written in one pass. The directories and the
+// files below them, the layers, are spooled to NewImageDir and hashed on the way, the image
+// config and manifests go to OldImageDir. Once the manifest is read everything but the
+// layers that are moved unchanged goes back to OldImageDir, so moved layers are written
+// once, where the new image needs them, and are never hashed again.
+
+// spoolTar extracts the ImageSave stream, spooling the directories and the files below
+// them to NewImageDir.
+func (im *V2Image) spoolTar(r io.Reader) error {
+	im.spooled = make(map[string]string)
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return NewCorruptArchiveError("error reading tar archive", err)
+		}
+
+		name, err := archivePath(header.Name)
+		if err != nil {
+			return err
+		}
+		dir := im.OldImageDir
+		if header.Typeflag == tar.TypeDir || strings.ContainsRune(name, filepath.Separator) {
+			dir = im.NewImageDir
+		}
+		target, err := secureJoin(dir, name)
+		if err != nil {
+			return err
+		}
+		if err := removeSymlink(target); err != nil {
+			return NewIOError("couldn't remove symlink", err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.ModePerm); err != nil {
+				return NewIOError("couldn't create directory", err)
+			}
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+			digest, err := writeHashed(target, tarReader, os.FileMode(header.Mode))
+			if err != nil {
+				return err
+			}
+			if dir == im.NewImageDir {
+				im.spooled[name] = digest
+			}
+		case tar.TypeSymlink:
+			// Docker 25 links the layer.tar of its legacy directories to the blobs
+			if err := checkSymlink(header.Name, header.Linkname); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+				return NewIOError("couldn't create directory", err)
+			}
+			// A retried save writes the link again
+			os.Remove(target)
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return NewIOError("couldn't create symlink", err)
+			}
+			if dir == im.NewImageDir {
+				im.spooled[name] = ""
+			}
+		default:
+			im.Logger.Infof("Ignoring unknown file type %c in %s", header.Typeflag, header.Name)
+		}
+	}
+	return nil
+}
+
+// writeHashed writes the file and returns the sha256 digest of its content, without
+// the sha256: prefix. The digest is empty for compressed files, whose diff_id is the
+// digest of the uncompressed content.
+func writeHashed(path string, r io.Reader, mode os.FileMode) (string, error) {
+	file, err := CreateFileWithDirs(path)
+	if err != nil {
+		return "", NewIOError("couldn't create file", err)
+	}
+	defer file.Close()
+
+	buffered := bufio.NewReader(r)
+	magic, _ := buffered.Peek(len(zstdMagic))
+	compressed := bytes.HasPrefix(magic, gzipMagic) || bytes.HasPrefix(magic, zstdMagic)
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hasher), buffered); err != nil {
+		return "", NewIOError("couldn't copy file contents", err)
+	}
+	if err := file.Chmod(mode); err != nil {
+		return "", NewIOError("couldn't set file mode", err)
+	}
+	if err := file.Close(); err != nil {
+		return "", NewIOError("couldn't write file", err)
+	}
+	if compressed {
+		return "", nil
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// unspoolFiles moves the spooled files that are not part of a layer of the saved image
+// back to OldImageDir.
+func (im *V2Image) unspoolFiles() error {
+	var layerPaths []string
+	for _, layer := range im.OldManifest.Layers {
+		if !im.OCIFormat {
+			// Legacy layers are directories with a layer.tar, a json and a VERSION file
+			layer = filepath.Dir(layer)
+		}
+		layerPaths = append(layerPaths, layer)
+	}
+	return im.unspool(func(name string) bool {
+		return !belongsToLayer(name, layerPaths)
+	})
+}
+
+// unspoolSquashedLayers moves the layers that are squashed back to OldImageDir, where
+// they are merged. The moved layers stay in NewImageDir.
+func (im *V2Image) unspoolSquashedLayers() error {
+	return im.unspool(func(name string) bool {
+		return belongsToLayer(name, im.LayerPathsToSquash)
+	})
+}
+
+// unspool moves the spooled files selected by move back to OldImageDir. A file that
+// also belongs to a moved layer is linked instead, the same blob may be used twice.
+func (im *V2Image) unspool(move func(name string) bool) error {
+	var names []string
+	for name := range im.spooled {
+		if move(name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		// Nothing was spooled when the saved image is resumed, keep the merge directory
+		return nil
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		src := filepath.Join(im.NewImageDir, name)
+		dest, err := secureJoin(im.OldImageDir, name)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+			return NewIOError("couldn't create directory", err)
+		}
+		if belongsToLayer(name, im.LayerPathsToMove) {
+			if err := linkTree(src, dest); err != nil {
+				return NewIOError("couldn't link saved file", err)
+			}
+			continue
+		}
+		if err := os.Rename(src, dest); err != nil {
+			return NewIOError("couldn't move saved file", err)
+		}
+		delete(im.spooled, name)
+	}
+	return removeEmptyDirs(im.NewImageDir)
+}
+
+// spooledDigest returns the digest computed while saving the tar of a moved layer,
+// without the sha256: prefix.
+func (im *V2Image) spooledDigest(layerPath string) (string, bool) {
+	if !im.OCIFormat {
+		layerPath = filepath.Join(layerPath, "layer.tar")
+	}
+	digest, ok := im.spooled[layerPath]
+	return digest, ok && len(digest) != 0
+}
+
+// belongsToLayer tells whether a saved file is one of the layers, or inside one of the
+// layer directories.
+func belongsToLayer(name string, layerPaths []string) bool {
+	for _, layer := range layerPaths {
+		if name == layer || strings.HasPrefix(name, layer+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeEmptyDirs removes the empty directories below root, deepest first.
+func removeEmptyDirs(root string) error {
+	var dirs []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return NewIOError("couldn't list saved files", err)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if hasFiles, _ := HasFiles(dirs[i]); !hasFiles {
+			os.Remove(dirs[i])
+		}
+	}
+	return nil
+}
+
+// savedSize is the size of the saved image, the moved layers spooled to NewImageDir
+// included.
+func (im *V2Image) savedSize() (int64, error) {
+	size, err := im.dirSize(im.OldImageDir)
+	if err != nil {
+		return 0, err
+	}
+	for _, layer := range im.LayerPathsToMove {
+		if PathExists(filepath.Join(im.OldImageDir, layer)) {
+			continue
+		}
+		layerSize, err := im.dirSize(filepath.Join(im.NewImageDir, layer))
+		if err != nil {
+			return 0, err
+		}
+		size += layerSize
+	}
+	return size, nil
+}
+
+// releaseSquashedLayer removes the tar of a squashed layer once it is extracted. Batch
+// runs share the saved layers, and resumed runs and the layer cache read them again.
+func (im *V2Image) releaseSquashedLayer(layerTar string) {
+	if im.batch != nil || im.checkpoint != nil || im.cache != nil {
+		return
+	}
+	if err := os.Remove(layerTar); err != nil {
+		im.Logger.Debugf("Failed to remove squashed layer %s: %v", layerTar, err)
+	}
+}
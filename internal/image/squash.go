@@ -1,16 +1,16 @@
 package image
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 
 	// "log"
 	"os"
 
 	"github.com/docker/docker/client"
-	"github.com/hashicorp/go-version"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/net/context"
 )
 
 type CLI struct {
@@ -18,127 +18,313 @@ type CLI struct {
 	Version    bool
 	Image      string
 	FromLayer  string
-	Tag        string
+	Tags       []string
 	Message    string
 	Cleanup    bool
 	TmpDir     string
 	OutputPath string
 	LoadImage  bool
+
+	Compression      string
+	CompressionLevel int
+
+	Platforms []string
+
+	// Excludes are patterns of paths removed from the squashed layer
+	Excludes []string
+	// ConfigEdits change the runtime config of the squashed image
+	ConfigEdits ConfigEdits
+	// Verify checks that the squashed image has the files and config of the source
+	// image, but for the excluded paths and the edits
+	Verify bool
+
+	// Output receives the image when OutputPath is StdoutPath, os.Stdout when nil
+	Output io.Writer
+	// Messages receives the human readable progress messages, os.Stdout when nil, or
+	// os.Stderr when the image is written to stdout
+	Messages io.Writer
+	// Progress receives progress events, none are sent when nil
+	Progress ProgressFunc
+	// Resume continues in the TmpDir of an earlier run of the same squash
+	Resume bool
+	// CacheDir is the directory of the layer cache, no cache is used when empty
+	CacheDir string
+	// TmpDirCandidates are tried in order for the temporary directory when the system
+	// temporary directory has not enough free space and TmpDir is not set
+	TmpDirCandidates []string
+	// Rootless keeps ownership, device nodes and special permissions of the squashed
+	// layers as metadata instead of on disk.
+	Rootless bool
+	// Backend is the image store images are read from and loaded into, BackendDocker
+	// when empty
+	Backend string
+	// Docker selects the daemon of the docker backend
+	Docker DockerConnection
+	// ContainerdAddress and ContainerdNamespace select the socket and namespace of the
+	// containerd backend, the containerd defaults are used when empty
+	ContainerdAddress   string
+	ContainerdNamespace string
+	// Store is the image store images are read from and loaded into, the one of Backend
+	// is connected when nil
+	Store ImageStore
 }
 
 // Squash represents the main structure to handle Docker image squashing.
 type Squash struct {
-	logs          *logrus.Logger
-	docker        *client.Client
+	logs  Logger
+	store ImageStore
+	// ownStore is set when NewSquash connected to the store, Close closes it
+	ownStore      bool
 	image         string
 	fromLayer     string
-	tag           string
+	tags          []RepoTag
 	comment       string
 	tmpDir        string
 	outputPath    string
 	loadImage     bool
 	cleanup       bool
 	development   bool
+	resume        bool
+	cache         *LayerCache
 	lastCreatedBy string
+
+	// Parents for the temporary directory when the system one is too small
+	tmpDirCandidates []string
+	// Squash without root privileges, see V2Image.extractRootless
+	rootless bool
+
+	compression      Compression
+	compressionLevel int
+
+	platforms []OCIPlatform
+
+	excludes    []string
+	configEdits ConfigEdits
+	verify      bool
+
+	output   io.Writer
+	out      io.Writer
+	progress ProgressFunc
+
+	// squashed holds the images written by the last run, in the order they were squashed
+	squashed []*V2Image
 }
 
-// NewSquash creates a new Squash instance.
-func NewSquash(cli CLI, loggers *logrus.Logger) (*Squash, error) {
+// NewSquash creates a new Squash instance talking to cli.Store, or to the image store of
+// cli.Backend, the Docker daemon configured in the environment by default.
+func NewSquash(cli CLI, loggers Logger) (*Squash, error) {
 
 	if loggers == nil {
-		loggers := logrus.New()
+		logger := logrus.New()
 
 		if os.Getenv("DEBUG") == "true" {
-			loggers.SetLevel(logrus.DebugLevel)
+			logger.SetLevel(logrus.DebugLevel)
 		} else {
-			loggers.SetLevel(logrus.InfoLevel)
+			logger.SetLevel(logrus.InfoLevel)
 		}
+		loggers = logger
 	}
 
-	var dockerClient *client.Client
-	var err error
-	if dockerClient, err = NewDockerClient(loggers); err != nil {
+	if cli.Store != nil {
+		return NewSquashWithStore(cli, cli.Store, loggers)
+	}
+	store, err := NewImageStore(cli, loggers)
+	if err != nil {
+		return nil, err
+	}
+	squash, err := NewSquashWithStore(cli, store, loggers)
+	if err != nil {
+		CloseStore(store)
 		return nil, err
 	}
+	squash.ownStore = true
+	return squash, nil
+}
+
+// Close closes the image store NewSquash connected to. A store given with cli.Store or
+// to NewSquashWithStore is left open for the caller.
+func (s *Squash) Close() error {
+	if !s.ownStore {
+		return nil
+	}
+	return CloseStore(s.store)
+}
+
+// NewSquashWithClient creates a new Squash instance using the given Docker client and
+// logger.
+func NewSquashWithClient(cli CLI, dockerClient client.APIClient, loggers Logger) (*Squash, error) {
+	return NewSquashWithStore(cli, NewDockerStore(dockerClient, loggers), loggers)
+}
+
+// NewSquashWithStore creates a new Squash instance using the given image store and
+// logger.
+func NewSquashWithStore(cli CLI, store ImageStore, loggers Logger) (*Squash, error) {
+	compression, err := ParseCompression(cli.Compression)
+	if err != nil {
+		return nil, err
+	}
+	if err := compression.ValidateLevel(cli.CompressionLevel); err != nil {
+		return nil, err
+	}
+
+	platforms, err := ParsePlatforms(cli.Platforms)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ValidateExcludes(cli.Excludes); err != nil {
+		return nil, err
+	}
+	if err := cli.ConfigEdits.Validate(); err != nil {
+		return nil, err
+	}
+
+	if cli.Resume && len(cli.TmpDir) == 0 {
+		return nil, fmt.Errorf("--resume needs the work directory given with --tmp-dir")
+	}
+	if !cli.Rootless && os.Geteuid() != 0 {
+		loggers.Infof("Not running as root, setting the owners and device nodes of the squashed layers may fail; --rootless keeps them as metadata instead")
+	}
+
+	var cache *LayerCache
+	if len(cli.CacheDir) != 0 {
+		if cache, err = OpenLayerCache(cli.CacheDir); err != nil {
+			return nil, err
+		}
+	}
+
 	development := false
 
 	if len(cli.TmpDir) != 0 {
 		development = true
 	}
-	if cli.Tag == cli.Image && cli.Cleanup {
-		cli.Cleanup = false
+	tags, err := ParseRepoTags(cli.Tags)
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range tags {
+		if (tag.String() == cli.Image || tag.Name == cli.Image) && cli.Cleanup {
+			cli.Cleanup = false
+		}
+	}
+
+	output := cli.Output
+	if output == nil {
+		output = os.Stdout
+	}
+	// Keep stdout clean when the image itself is streamed there
+	out := cli.Messages
+	if out == nil && cli.OutputPath == StdoutPath && output == os.Stdout {
+		out = os.Stderr
+	} else if out == nil {
+		out = os.Stdout
 	}
 
 	return &Squash{
 		logs:        loggers,
-		docker:      dockerClient,
+		store:       store,
 		image:       cli.Image,
 		fromLayer:   cli.FromLayer,
-		tag:         cli.Tag,
+		tags:        tags,
 		comment:     cli.Message,
 		tmpDir:      cli.TmpDir,
 		outputPath:  cli.OutputPath,
 		loadImage:   cli.LoadImage,
 		cleanup:     cli.Cleanup,
 		development: development,
+		resume:      cli.Resume,
+		cache:       cache,
+
+		tmpDirCandidates: cli.TmpDirCandidates,
+		rootless:         cli.Rootless,
+
+		compression:      compression,
+		compressionLevel: cli.CompressionLevel,
+
+		platforms: platforms,
+
+		excludes:    cli.Excludes,
+		configEdits: cli.ConfigEdits,
+		verify:      cli.Verify,
+
+		output:   output,
+		out:      out,
+		progress: cli.Progress,
 	}, nil
 }
 
-// Run executes the squashing process.
-func (s *Squash) Run() (string, error) {
+// Run executes the squashing process. Cancelling ctx aborts it and removes the temporary
+// directory, unless one was given.
+func (s *Squash) Run(ctx context.Context) (string, error) {
 
-	ctx := context.Background()
-	dockerVersion, err := s.docker.ServerVersion(ctx)
-	if err != nil {
-		s.logs.Error("Could not get the version of dockerserver %s: %v\n", s.docker, err)
+	if err := s.checkStore(ctx); err != nil {
 		return "", err
 	}
 
-	s.logs.Infof("docker-squash version %s, Docker %s, API %s...", squashVersion, dockerVersion.Version, dockerVersion.APIVersion)
-
 	if len(s.image) == 0 {
 		return "", errors.New("image is not provided")
 	}
 
-	if len(s.outputPath) == 0 && !s.loadImage {
-		// log.Println("No output path specified and loading into Docker is not selected either; squashed image would not be accessible, proceeding with squashing doesn't make sense")
-		return "", fmt.Errorf("No output path specified and loading into Docker is not selected either; squashed image would not be accessible, proceeding with squashing doesn't make sense")
-	}
-
-	// Check if the output path already exists
-	if _, err := os.Stat(s.outputPath); err == nil {
-		s.logs.Infof("Path '%s' specified as output path where the squashed image should be saved already exists, it'll be overridden", s.outputPath)
-	} else if !os.IsNotExist(err) {
-		s.logs.Fatalf("Failed to check if output path exists: %v", err)
+	if err := s.validateOutput(); err != nil {
+		return "", err
 	}
 
-	minVersion, _ := version.NewVersion("1.22")
-	dockerAPIVersion, _ := version.NewVersion(dockerVersion.APIVersion)
-
-	var img ImageInterface
-
-	if dockerAPIVersion.GreaterThanOrEqual(minVersion) {
-		img = NewV2Image(s)
-	}
-	s.logs.Println("Squashing image:", s.image)
+	// The format of the saved image is detected once it is saved, see detectFormat
+	v2Image := NewV2Image(s)
+	s.squashed = []*V2Image{v2Image}
+	s.logs.Infof("Squashing image: %s", s.image)
 	if s.outputPath != "" {
 		// Simulate exporting tar archive
 		s.logs.Infof("Exporting squashed image to %s\n", s.outputPath)
 	}
 
-	var newImageId string
-	if err, newImageId = s.squash(img); err != nil {
-		return "", nil
+	err, newImageId := s.squash(ctx, v2Image)
+	if err != nil {
+		s.abort(ctx, err, v2Image.TmpDir)
+		return "", err
 	}
 
-	s.logs.Println("Squashing complete")
+	s.logs.Infof("Squashing complete")
 
 	return newImageId, nil
 }
 
-func (s *Squash) squash(img ImageInterface) (error, string) {
+// checkStore logs the version of the image store. It fails when the store cannot be
+// reached or is a Docker daemon too old to be supported.
+func (s *Squash) checkStore(ctx context.Context) error {
+	storeVersion, err := s.store.Version(ctx)
+	if err != nil {
+		s.logs.Errorf("Could not get the version of the image store: %v", err)
+		return err
+	}
+	s.logs.Infof("docker-squash version %s, %s...", squashVersion, storeVersion)
+	return nil
+}
+
+// validateOutput makes sure the squashed image ends up somewhere.
+func (s *Squash) validateOutput() error {
+	if s.verify && s.outputPath == StdoutPath && !s.loadImage {
+		return fmt.Errorf("an image written to stdout cannot be verified, load it or write it to a file")
+	}
+	if len(s.outputPath) == 0 && !s.loadImage {
+		// log.Println("No output path specified and loading into Docker is not selected either; squashed image would not be accessible, proceeding with squashing doesn't make sense")
+		return fmt.Errorf("No output path specified and loading into Docker is not selected either; squashed image would not be accessible, proceeding with squashing doesn't make sense")
+	}
+
+	// Check if the output path already exists
+	if s.outputPath == StdoutPath {
+		s.logs.Infof("Squashed image will be written to stdout")
+	} else if _, err := os.Stat(s.outputPath); err == nil {
+		s.logs.Infof("Path '%s' specified as output path where the squashed image should be saved already exists, it'll be overridden", s.outputPath)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to check if output path exists: %w", err)
+	}
+	return nil
+}
+
+func (s *Squash) squash(ctx context.Context, img ImageInterface) (error, string) {
 
-	newImageId, err := img.Squash()
+	newImageId, err := img.Squash(ctx)
 
 	if err != nil {
 		s.logs.Errorf("error squashing the image %s", err.Error())
@@ -146,19 +332,87 @@ func (s *Squash) squash(img ImageInterface) (error, string) {
 		return err, ""
 	}
 
+	if err := s.finish(ctx, img); err != nil {
+		return err, ""
+	}
+
+	return nil, newImageId
+}
+
+// finish exports and loads the squashed image and cleans up afterwards.
+func (s *Squash) finish(ctx context.Context, img ImageInterface) error {
 	if len(s.outputPath) != 0 {
-		img.ExportTarArchive(s.outputPath)
+		if err := img.ExportTarArchive(ctx, s.outputPath); err != nil {
+			return err
+		}
 	}
 	if s.loadImage {
-		if err := img.LoadSquashedImage(); err != nil {
-			return err, ""
+		if err := img.LoadSquashedImage(ctx); err != nil {
+			return err
+		}
+	}
+
+	// The source image is compared before it is removed
+	if s.verify {
+		if err := s.verifySquashed(ctx); err != nil {
+			return err
 		}
 	}
 
 	if s.cleanup {
 		img.Cleanup()
-		s.logs.Info("Cleaning up source image")
+		s.logs.Infof("Cleaning up source image")
 	}
 
-	return nil, newImageId
+	return nil
+}
+
+// verifySquashed checks that the image of the last run has the files and config of its
+// source, read again from the exported archive or the image store.
+func (s *Squash) verifySquashed(ctx context.Context) error {
+	if len(s.squashed) != 1 || len(s.squashed[0].newImageID) == 0 {
+		return errVerifyUnsupported
+	}
+	img := s.squashed[0]
+	s.logs.Infof("Verifying the squashed image...")
+	openStore := func() (ImageStore, error) { return s.store, nil }
+
+	source, err := readImageContents(ctx, img.OldImageId, openStore)
+	if err != nil {
+		return fmt.Errorf("failed to read the source image: %w", err)
+	}
+	squashedName := "sha256:" + img.newImageID
+	if len(s.outputPath) != 0 && s.outputPath != StdoutPath {
+		squashedName = TransportDockerArchive + ":" + s.outputPath
+	}
+	squashed, err := readImageContents(ctx, squashedName, openStore)
+	if err != nil {
+		return fmt.Errorf("failed to read the squashed image: %w", err)
+	}
+
+	files, configs, err := VerifySquashed(source, squashed, s.excludes, s.configEdits)
+	if err != nil {
+		for _, change := range configs {
+			s.logs.Errorf("config %s: %s -> %s", change.Field, change.A, change.B)
+		}
+		for _, change := range files {
+			s.logs.Errorf("%s %s %s", change.Kind, change.Path, change.Details)
+		}
+		return err
+	}
+	s.logs.Infof("The squashed image has the files and config of %s", s.image)
+	return nil
+}
+
+// abort removes the temporary directory of a run that was interrupted, so a cancelled
+// squash does not leave the unpacked image behind. Directories given with --tmp-dir are
+// kept for debugging.
+func (s *Squash) abort(ctx context.Context, err error, tmpDir string) {
+	if err == nil || ctx.Err() == nil || s.development || len(tmpDir) == 0 {
+		return
+	}
+	s.logs.Infof("Interrupted, cleaning up %s temporary directory...", tmpDir)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		s.logs.Errorf("Cleaning up temporary directory failed: %v", err)
+	}
 }
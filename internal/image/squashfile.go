@@ -0,0 +1,107 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/lyon-v/squash-docker-image/schema"
+	"gopkg.in/yaml.v3"
+)
+
+// SquashFile is the format of the file given to --config, describing how an image is
+// squashed. Its schema is published as schema/squash-config.schema.json.
+type SquashFile struct {
+	Version     int               `yaml:"version"`
+	Source      SquashSource      `yaml:"source"`
+	FromLayer   string            `yaml:"from-layer"`
+	Exclude     []string          `yaml:"exclude"`
+	Config      ConfigEdits       `yaml:"config"`
+	Tags        []string          `yaml:"tags"`
+	Message     string            `yaml:"message"`
+	Output      SquashOutput      `yaml:"output"`
+	Compression SquashCompression `yaml:"compression"`
+	// Verify is nil when the file does not set it, like the other booleans
+	Verify *bool `yaml:"verify"`
+}
+
+// SquashSource is the image a SquashFile squashes.
+type SquashSource struct {
+	Image     string   `yaml:"image"`
+	Platforms []string `yaml:"platforms"`
+}
+
+// SquashOutput is where the image of a SquashFile goes.
+type SquashOutput struct {
+	Path    string `yaml:"path"`
+	Load    *bool  `yaml:"load"`
+	Cleanup *bool  `yaml:"cleanup"`
+	Report  string `yaml:"report"`
+}
+
+// SquashCompression is the compression of the layers of a SquashFile.
+type SquashCompression struct {
+	Algorithm string `yaml:"algorithm"`
+	Level     int    `yaml:"level"`
+}
+
+// LoadSquashFile reads a config file and validates it against its schema. Relative
+// paths of the file are taken relative to its directory.
+func LoadSquashFile(path string) (*SquashFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("failed to parse config file '%s': %w", path, err)
+	}
+	if err := validateSchema(schema.SquashConfig, document); err != nil {
+		return nil, fmt.Errorf("config file '%s' does not match its schema: %w", path, err)
+	}
+
+	var file SquashFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to parse config file '%s': %w", path, err)
+	}
+	if err := ValidateExcludes(file.Exclude); err != nil {
+		return nil, fmt.Errorf("config file '%s': %w", path, err)
+	}
+	if err := file.Config.Validate(); err != nil {
+		return nil, fmt.Errorf("config file '%s': %w", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	file.Source.Image = resolveSourcePath(dir, file.Source.Image)
+	if len(file.Output.Path) != 0 && file.Output.Path != StdoutPath {
+		file.Output.Path = resolvePath(dir, file.Output.Path)
+	}
+	if len(file.Output.Report) != 0 {
+		file.Output.Report = resolvePath(dir, file.Output.Report)
+	}
+	return &file, nil
+}
+
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// resolveSourcePath resolves the path of images read from an OCI layout or archive.
+func resolveSourcePath(dir, image string) string {
+	source := ParseImageSource(image)
+	if source.Transport != TransportOCILayout && source.Transport != TransportOCIArchive {
+		return image
+	}
+	image = source.Transport + ":" + resolvePath(dir, source.Path)
+	if len(source.RefName) != 0 {
+		image += ":" + source.RefName
+	}
+	return image
+}
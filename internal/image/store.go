@@ -0,0 +1,185 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/hashicorp/go-version"
+)
+
+// MinDockerAPIVersion is the oldest version of the Docker API images are squashed with,
+// the one of Docker 1.6.
+const MinDockerAPIVersion = "1.18"
+
+// serverAPIVersionPattern finds the API version in the error of daemons that do not
+// support the version the client asked for.
+var serverAPIVersionPattern = regexp.MustCompile(`server API version: ([0-9]+\.[0-9]+)`)
+
+// Backends images are read from and squashed images are loaded into.
+const (
+	BackendDocker     = "docker"
+	BackendContainerd = "containerd"
+)
+
+// ImageStore holds the images to squash and receives the squashed images: the Docker
+// daemon or containerd.
+type ImageStore interface {
+	// Version describes the store, it fails when the store cannot be reached
+	Version(ctx context.Context) (StoreVersion, error)
+	// ImageID returns the ID of the image given by name or ID, the digest of its config
+	ImageID(ctx context.Context, ref string) (string, error)
+	// History returns the history of an image, newest entry first
+	History(ctx context.Context, imageID string) ([]HistoryEntry, error)
+	// Save writes the images to a tar archive with a manifest.json, like docker save
+	Save(ctx context.Context, imageIDs []string) (io.ReadCloser, error)
+	// Load imports an archive written like the ones Save returns, the images are named
+	// after the RepoTags of its manifest.json
+	Load(ctx context.Context, archive io.Reader) error
+}
+
+// StoreVersion describes the image store a squash talks to.
+type StoreVersion struct {
+	Name    string
+	Version string
+	// APIVersion is the version of the Docker API, empty for other stores
+	APIVersion string
+}
+
+func (v StoreVersion) String() string {
+	if len(v.APIVersion) != 0 {
+		return fmt.Sprintf("%s %s, API %s", v.Name, v.Version, v.APIVersion)
+	}
+	return fmt.Sprintf("%s %s", v.Name, v.Version)
+}
+
+// HistoryEntry is an item of the history of an image. ID is <missing> for the items
+// that are no image of their own.
+type HistoryEntry struct {
+	ID   string
+	Size int64
+}
+
+// NewImageStore connects to the backend selected with cli.Backend.
+func NewImageStore(cli CLI, logger Logger) (ImageStore, error) {
+	switch cli.Backend {
+	case "", BackendDocker:
+		dockerClient, err := NewDockerClient(cli.Docker, logger)
+		if err != nil {
+			return nil, err
+		}
+		return NewDockerStore(dockerClient, logger), nil
+	case BackendContainerd:
+		return NewContainerdStore(cli.ContainerdAddress, cli.ContainerdNamespace, logger), nil
+	}
+	return nil, fmt.Errorf("unknown backend '%s', expected %s or %s", cli.Backend, BackendDocker, BackendContainerd)
+}
+
+// CloseStore closes the connection of an image store that holds one open, like the
+// client of the containerd store. Other stores are left as they are.
+func CloseStore(store ImageStore) error {
+	if closer, ok := store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// dockerStore is the Docker daemon, talked to through its API.
+type dockerStore struct {
+	client client.APIClient
+	logger Logger
+}
+
+// NewDockerStore returns the image store of the Docker daemon the client talks to.
+func NewDockerStore(dockerClient client.APIClient, logger Logger) ImageStore {
+	return &dockerStore{client: dockerClient, logger: logger}
+}
+
+func (s *dockerStore) Version(ctx context.Context) (StoreVersion, error) {
+	serverVersion, err := negotiateServerVersion(ctx, s.client, s.logger)
+	if err != nil {
+		return StoreVersion{}, err
+	}
+	name, engineVersion := engineName(serverVersion)
+	storeVersion := StoreVersion{Name: name, Version: engineVersion, APIVersion: serverVersion.APIVersion}
+	if err := checkDockerAPIVersion(storeVersion); err != nil {
+		return StoreVersion{}, err
+	}
+	return storeVersion, nil
+}
+
+// negotiateServerVersion returns the version of the daemon. Daemons before Docker 1.13
+// do not announce their API version, the client falls back to the one of the error they
+// answer with.
+func negotiateServerVersion(ctx context.Context, cli client.APIClient, logger Logger) (types.Version, error) {
+	serverVersion, err := cli.ServerVersion(ctx)
+	if err != nil {
+		if match := serverAPIVersionPattern.FindStringSubmatch(err.Error()); match != nil {
+			logger.Debugf("Falling back to version %s of the Docker API: %v", match[1], err)
+			cli.NegotiateAPIVersionPing(types.Ping{APIVersion: match[1]})
+			serverVersion, err = cli.ServerVersion(ctx)
+		}
+	}
+	if err != nil {
+		return types.Version{}, NewDaemonUnavailableError(err)
+	}
+	return serverVersion, nil
+}
+
+// checkDockerAPIVersion fails with an UnsupportedDaemonError for daemons older than
+// MinDockerAPIVersion.
+func checkDockerAPIVersion(storeVersion StoreVersion) error {
+	apiVersion, err := version.NewVersion(storeVersion.APIVersion)
+	if err != nil {
+		return NewUnsupportedDaemonError(fmt.Sprintf("%s %s reports the unknown API version '%s'", storeVersion.Name, storeVersion.Version, storeVersion.APIVersion))
+	}
+	if apiVersion.LessThan(version.Must(version.NewVersion(MinDockerAPIVersion))) {
+		return NewUnsupportedDaemonError(fmt.Sprintf("%s %s supports version %s of the Docker API, %s or newer is required", storeVersion.Name, storeVersion.Version, storeVersion.APIVersion, MinDockerAPIVersion))
+	}
+	return nil
+}
+
+func (s *dockerStore) ImageID(ctx context.Context, ref string) (string, error) {
+	imageInfo, _, err := s.client.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return "", daemonError(err)
+	}
+	return imageInfo.ID, nil
+}
+
+func (s *dockerStore) History(ctx context.Context, imageID string) ([]HistoryEntry, error) {
+	history, err := s.client.ImageHistory(ctx, imageID)
+	if err != nil {
+		return nil, daemonError(err)
+	}
+	var entries []HistoryEntry
+	for _, item := range history {
+		entries = append(entries, HistoryEntry{ID: item.ID, Size: item.Size})
+	}
+	return entries, nil
+}
+
+func (s *dockerStore) Save(ctx context.Context, imageIDs []string) (io.ReadCloser, error) {
+	reader, err := s.client.ImageSave(ctx, imageIDs)
+	if err != nil {
+		return nil, daemonError(err)
+	}
+	return reader, nil
+}
+
+func (s *dockerStore) Load(ctx context.Context, archive io.Reader) error {
+	response, err := s.client.ImageLoad(ctx, archive, true)
+	if err != nil {
+		return daemonError(err)
+	}
+	defer response.Body.Close()
+
+	// Print the API response
+	bodyBytes, _ := ioutil.ReadAll(response.Body)
+	s.logger.Debugf("Docker API Response:%s", string(bodyBytes))
+	return nil
+}
@@ -0,0 +1,252 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fakeImage is an image of a fakeStore. Its layers, the oldest first, hold files by path.
+type fakeImage struct {
+	name   string
+	layers []map[string]string
+}
+
+// fakeStore is an ImageStore holding images in memory. Save writes them like docker save
+// does for the classic image store, layers the images share are written once.
+type fakeStore struct {
+	t *testing.T
+
+	mu sync.Mutex
+	// images by name and by ID
+	images map[string]*fakeSaved
+	// saves are the image IDs given to each Save
+	saves [][]string
+	// loaded are the archives given to Load
+	loaded [][]byte
+	// block makes Save wait until it is closed or the context is done
+	block chan struct{}
+}
+
+// fakeSaved is an image of a fakeStore as it is saved.
+type fakeSaved struct {
+	id     string
+	name   string
+	config []byte
+	// layers are the paths of the layer tars in the archive, with their content
+	layers []string
+	tars   map[string][]byte
+	sizes  []int64
+}
+
+func newFakeStore(t *testing.T, images ...fakeImage) *fakeStore {
+	s := &fakeStore{t: t, images: make(map[string]*fakeSaved)}
+	for _, img := range images {
+		saved := &fakeSaved{name: img.name, tars: make(map[string][]byte)}
+		var diffIDs []string
+		var history []HistoryItem
+		for i, files := range img.layers {
+			layerTar := fakeLayerTar(t, files)
+			digest := fmt.Sprintf("%x", sha256.Sum256(layerTar))
+			layerPath := path.Join(digest, "layer.tar")
+			saved.layers = append(saved.layers, layerPath)
+			saved.tars[layerPath] = layerTar
+			saved.sizes = append(saved.sizes, int64(len(layerTar)))
+			diffIDs = append(diffIDs, "sha256:"+digest)
+			history = append(history, HistoryItem{CreatedBy: fmt.Sprintf("layer %d", i+1)})
+		}
+		config, err := json.Marshal(ImageConfig{
+			Architecture: "amd64",
+			OS:           "linux",
+			Rootfs:       Rootfs{Type: "layers", DiffIds: diffIDs},
+			History:      history,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved.config = config
+		saved.id = fmt.Sprintf("sha256:%x", sha256.Sum256(config))
+		s.images[img.name] = saved
+		s.images[saved.id] = saved
+	}
+	return s
+}
+
+// fakeLayerTar writes a layer tar of the files, with the directories above them.
+func fakeLayerTar(t *testing.T, files map[string]string) []byte {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	dirs := make(map[string]bool)
+	for _, name := range names {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if dirs[dir] {
+				break
+			}
+			dirs[dir] = true
+			if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir + "/", Mode: 0755}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(files[name]))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func (s *fakeStore) image(ref string) (*fakeSaved, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if img, ok := s.images[ref]; ok {
+		return img, nil
+	}
+	if img, ok := s.images["sha256:"+ref]; ok {
+		return img, nil
+	}
+	return nil, fmt.Errorf("No such image: %s", ref)
+}
+
+func (s *fakeStore) Version(ctx context.Context) (StoreVersion, error) {
+	return StoreVersion{Name: "fake", Version: "1.0"}, nil
+}
+
+func (s *fakeStore) ImageID(ctx context.Context, ref string) (string, error) {
+	img, err := s.image(ref)
+	if err != nil {
+		return "", err
+	}
+	return img.id, nil
+}
+
+func (s *fakeStore) History(ctx context.Context, imageID string) ([]HistoryEntry, error) {
+	img, err := s.image(imageID)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]HistoryEntry, len(img.layers))
+	for i := range img.layers {
+		entries[len(img.layers)-1-i] = HistoryEntry{ID: "<missing>", Size: img.sizes[i]}
+	}
+	entries[0].ID = img.id
+	return entries, nil
+}
+
+func (s *fakeStore) Save(ctx context.Context, imageIDs []string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	s.saves = append(s.saves, imageIDs)
+	block := s.block
+	s.mu.Unlock()
+	if block != nil {
+		select {
+		case <-block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	written := make(map[string]bool)
+	var manifests []ImageManifest
+	for _, imageID := range imageIDs {
+		img, err := s.image(imageID)
+		if err != nil {
+			return nil, err
+		}
+		configName := strings.TrimPrefix(img.id, "sha256:") + ".json"
+		s.writeFile(tw, configName, img.config)
+		for _, layer := range img.layers {
+			if written[layer] {
+				continue
+			}
+			written[layer] = true
+			if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: path.Dir(layer) + "/", Mode: 0755}); err != nil {
+				return nil, err
+			}
+			s.writeFile(tw, layer, img.tars[layer])
+		}
+		manifests = append(manifests, ImageManifest{Config: configName, RepoTags: []string{img.name + ":latest"}, Layers: img.layers})
+	}
+	manifest, err := json.Marshal(manifests)
+	if err != nil {
+		return nil, err
+	}
+	s.writeFile(tw, "manifest.json", manifest)
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(&buf), nil
+}
+
+func (s *fakeStore) writeFile(tw *tar.Writer, name string, data []byte) {
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+		s.t.Fatal(err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+func (s *fakeStore) Load(ctx context.Context, archive io.Reader) error {
+	data, err := io.ReadAll(archive)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loaded = append(s.loaded, data)
+	return nil
+}
+
+// testLogger is a logger that drops its messages.
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+// readArchive returns the regular files of a tar archive by name.
+func readArchive(t *testing.T, data []byte) map[string][]byte {
+	files := make(map[string][]byte)
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[path.Clean(header.Name)] = content
+	}
+}
@@ -0,0 +1,58 @@
+package image
+
+import (
+	"fmt"
+
+	"github.com/distribution/reference"
+)
+
+// RepoTag is a repository and tag the squashed image is published under.
+type RepoTag struct {
+	Name string
+	Tag  string
+}
+
+func (t RepoTag) String() string {
+	return fmt.Sprintf("%s:%s", t.Name, t.Tag)
+}
+
+// Reference is the fully qualified name of the tag, like docker.io/library/app:latest,
+// which is how the containerd image store names images.
+func (t RepoTag) Reference() string {
+	named, err := reference.ParseNormalizedNamed(t.String())
+	if err != nil {
+		return t.String()
+	}
+	return named.String()
+}
+
+// ParseRepoTags validates the tags given for the new image. Names may contain a registry
+// with a port, a missing tag defaults to 'latest', and digest references are rejected
+// since an image cannot be tagged with a digest.
+func ParseRepoTags(tags []string) ([]RepoTag, error) {
+	var repoTags []RepoTag
+	seen := make(map[string]bool)
+
+	for _, tag := range tags {
+		named, err := reference.ParseNormalizedNamed(tag)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag '%s': %w", tag, err)
+		}
+		if _, ok := named.(reference.Digested); ok {
+			return nil, fmt.Errorf("invalid tag '%s': digest references cannot be used as tags", tag)
+		}
+
+		tagged := reference.TagNameOnly(named).(reference.Tagged)
+		repoTag := RepoTag{
+			Name: reference.FamiliarName(named),
+			Tag:  tagged.Tag(),
+		}
+		if seen[repoTag.String()] {
+			continue
+		}
+		seen[repoTag.String()] = true
+		repoTags = append(repoTags, repoTag)
+	}
+
+	return repoTags, nil
+}
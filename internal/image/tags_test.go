@@ -0,0 +1,119 @@
+package image
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRepoTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		tags     []string
+		repoTags []RepoTag
+		error    string
+	}{
+		{
+			name:     "default tag",
+			tags:     []string{"app"},
+			repoTags: []RepoTag{{Name: "app", Tag: "latest"}},
+		},
+		{
+			name: "several tags",
+			tags: []string{"app:1.2.3", "app:1.2", "app:latest"},
+			repoTags: []RepoTag{
+				{Name: "app", Tag: "1.2.3"},
+				{Name: "app", Tag: "1.2"},
+				{Name: "app", Tag: "latest"},
+			},
+		},
+		{
+			name:     "registry port without tag",
+			tags:     []string{"host:5000/app"},
+			repoTags: []RepoTag{{Name: "host:5000/app", Tag: "latest"}},
+		},
+		{
+			name:     "registry port with tag",
+			tags:     []string{"host:5000/team/app:1.0"},
+			repoTags: []RepoTag{{Name: "host:5000/team/app", Tag: "1.0"}},
+		},
+		{
+			name:     "docker hub names are shortened",
+			tags:     []string{"docker.io/library/app:1.0"},
+			repoTags: []RepoTag{{Name: "app", Tag: "1.0"}},
+		},
+		{
+			name: "duplicates",
+			tags: []string{"app", "app:latest", "docker.io/library/app:latest", "app:1.0", "app:1.0"},
+			repoTags: []RepoTag{
+				{Name: "app", Tag: "latest"},
+				{Name: "app", Tag: "1.0"},
+			},
+		},
+		{
+			name:  "digest",
+			tags:  []string{"app@sha256:" + strings.Repeat("a", 64)},
+			error: "digest references cannot be used as tags",
+		},
+		{
+			name:  "tag and digest",
+			tags:  []string{"host:5000/app:1.0@sha256:" + strings.Repeat("a", 64)},
+			error: "digest references cannot be used as tags",
+		},
+		{
+			name:  "uppercase",
+			tags:  []string{"App:1.0"},
+			error: "invalid tag 'App:1.0'",
+		},
+		{
+			name:  "empty tag",
+			tags:  []string{"app:"},
+			error: "invalid tag 'app:'",
+		},
+		{
+			name:  "invalid tag characters",
+			tags:  []string{"app:1.0/beta"},
+			error: "invalid tag 'app:1.0/beta'",
+		},
+		{
+			name:  "empty",
+			tags:  []string{""},
+			error: "invalid tag ''",
+		},
+		{
+			name:  "one malformed tag fails all",
+			tags:  []string{"app:1.0", "app::1.1"},
+			error: "invalid tag 'app::1.1'",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repoTags, err := ParseRepoTags(test.tags)
+			if len(test.error) != 0 {
+				if err == nil || !strings.Contains(err.Error(), test.error) {
+					t.Fatalf("got error %v, expected %q", err, test.error)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(repoTags, test.repoTags) {
+				t.Errorf("got %v, expected %v", repoTags, test.repoTags)
+			}
+		})
+	}
+}
+
+func TestRepoTagReference(t *testing.T) {
+	tests := map[RepoTag]string{
+		{Name: "app", Tag: "latest"}:           "docker.io/library/app:latest",
+		{Name: "team/app", Tag: "1.0"}:         "docker.io/team/app:1.0",
+		{Name: "host:5000/app", Tag: "latest"}: "host:5000/app:latest",
+	}
+	for repoTag, expected := range tests {
+		if reference := repoTag.Reference(); reference != expected {
+			t.Errorf("%s has the reference %s, expected %s", repoTag, reference, expected)
+		}
+	}
+}
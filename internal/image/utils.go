@@ -2,6 +2,8 @@ package image
 
 import (
 	"bufio"
+	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,6 +11,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"syscall"
 )
 
 func ReverseList(list []string) {
@@ -88,6 +91,28 @@ func CopyFile(src, dest string, records map[string]int) (int, error) {
 	return 1, nil
 }
 
+// CopyDevice creates the device node or fifo src again at dest, reading it would not end.
+func CopyDevice(src, dest string, info os.FileInfo, records map[string]int) (int, error) {
+
+	if _, ok := records[src]; ok {
+		return 1, nil
+	}
+	records[src] += 1
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("failed to read device %s", src)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create directories: %w", err)
+	}
+	os.Remove(dest)
+	if err := syscall.Mknod(dest, uint32(stat.Mode), int(stat.Rdev)); err != nil {
+		return 0, fmt.Errorf("failed to create device: %w", err)
+	}
+	return 1, os.Chmod(dest, info.Mode().Perm())
+}
+
 // Helper function to create a file and its parent directories
 func CreateFileWithDirs(path string) (*os.File, error) {
 	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
@@ -180,14 +205,48 @@ func GetWhiteoutAndRegularFiles(root string) (whfiles, refiles []FileWithPath, e
 	return whfiles, refiles, err
 }
 
-func ExtractTar(src, dest string) ([]byte, error) {
-	cmd := exec.Command("tar", "--same-owner", "--xattrs", "--overwrite",
+func ExtractTar(ctx context.Context, src, dest string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "tar", "--same-owner", "--xattrs", "--overwrite",
 		"--preserve-permissions", "-xf", src, "-C", dest)
 	return cmd.CombinedOutput()
 }
 
 // CreateTar 打包目录为 tar 文件
-func CreateTar(srcDir, tarFile string) error {
-	cmd := exec.Command("tar", "-cf", tarFile, "-C", srcDir, ".")
-	return cmd.Run()
+func CreateTar(ctx context.Context, srcDir, tarFile string) error {
+	cmd := exec.CommandContext(ctx, "tar", "-cf", tarFile, "-C", srcDir, ".")
+	return runTar(cmd)
+}
+
+// MoveToTar is CreateTar removing every file once it is archived, so the directory and
+// the tar file never take up the space twice.
+func MoveToTar(ctx context.Context, srcDir, tarFile string) error {
+	cmd := exec.CommandContext(ctx, "tar", "--remove-files", "-cf", tarFile, "-C", srcDir, ".")
+	return runTar(cmd)
+}
+
+// runTar runs tar, adding its messages to the error.
+func runTar(cmd *exec.Cmd) error {
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// contextReader fails reads once the context is done, so long copies stop promptly.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+func sha256Hex(data []byte) string {
+	hasher := sha256.New()
+	hasher.Write(data)
+	return fmt.Sprintf("%x", hasher.Sum(nil))
 }
@@ -1,3 +1,8 @@
 package image
 
 const squashVersion = "1.0.0"
+
+// SquashVersion is the version of the squashing engine, logged by every run.
+func SquashVersion() string {
+	return squashVersion
+}
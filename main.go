@@ -1,115 +1,254 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"path"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/lyon-v/squash-docker-image/internal/image"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 // Version of the application, should be set during build
 var Version = "1.0.0"
 
+// GitCommit the application is built from, taken from the build information of Go
+// when it is not set during build
+var GitCommit = ""
+
 var (
 	verbose    bool
 	version    bool
+	logLevel   string
+	logger     *logrus.Logger
 	imageName  string
 	fromLayer  string
-	tag        string
+	tags       []string
 	message    string
 	cleanup    bool
 	tmpDir     string
 	outputPath string
 	loadImage  bool
+
+	compression      string
+	compressionLevel int
+
+	batchFile   string
+	batchImages []string
+
+	platforms []string
+
+	progressMode     string
+	reportPath       string
+	resume           bool
+	tmpDirCandidates []string
+	rootless         bool
+
+	backend             string
+	containerdAddress   string
+	containerdNamespace string
+	connection          image.DockerConnection
+
+	useCache  bool
+	cacheDir  string
+	pruneAll  bool
+	olderThan time.Duration
+	maxSize   string
+
+	serverOptions image.ServerOptions
+
+	outputFormat string
+
+	configFile  string
+	excludes    []string
+	verifyImage bool
 )
 
 func main() {
+	// The docker CLI checks its plugins with the metadata handshake
+	if len(os.Args) == 2 && os.Args[1] == image.PluginMetadataCommand {
+		if err := image.WritePluginMetadata(os.Stdout, Version); err != nil {
+			exitOnCommandError(err)
+		}
+		return
+	}
+
 	var rootCmd = &cobra.Command{
 		Use:   "squash-docker-image",
 		Short: "squash-docker-image is a CLI for squashing Docker images",
-		Run: func(cmd *cobra.Command, args []string) {
-			// Initialize logger
-			logger := logrus.New()
-			logger.SetReportCaller(true)
-			logger.SetFormatter(&logrus.TextFormatter{
-				DisableColors:   true,
-				TimestampFormat: "2006-01-02 15:03:04",
-				CallerPrettyfier: func(frame *runtime.Frame) (string, string) {
-					return fmt.Sprintf("%s", strings.Split(frame.Function, ".")[len(strings.Split(frame.Function, "."))-1]),
-						fmt.Sprintf("%s, line:%d", path.Base(frame.File), frame.Line)
-				},
-			})
-
-			// Handle version flag
-			if version {
-				fmt.Println("Version:", Version)
-				return
-			}
-
-			// Validate required flags
-			if imageName == "" {
-				logger.Error("Image is required")
-				cmd.Usage()
-				return
-			}
-
-			// Set log level
-			if verbose {
-				logger.SetLevel(logrus.DebugLevel)
-				logger.Debug("Verbose mode enabled")
-			} else {
-				logger.SetLevel(logrus.InfoLevel)
-			}
-
-			logger.Infof("Running version %s", Version)
-
-			// Create Squash instance
-			cli := image.CLI{
-				Verbose:    verbose,
-				Version:    version,
-				Image:      imageName,
-				FromLayer:  fromLayer,
-				Tag:        tag,
-				Message:    message,
-				Cleanup:    cleanup,
-				TmpDir:     tmpDir,
-				OutputPath: outputPath,
-				LoadImage:  loadImage,
-			}
-
-			squash, err := image.NewSquash(cli, logger)
-			if err != nil {
-				logger.Fatalf("Failed to create Squash instance: %v", err)
-			}
-
-			// Run squash process
-			newImageId, err := squash.Run()
-			if err != nil {
-				logger.Fatalf("Squash process failed: %v", err)
-			}
-
-			fmt.Printf("Squashed image ID: [%s]\n", newImageId)
-		},
+		// The flags of the squash command are taken here as well, as they were before
+		// there were subcommands
+		Args:              cobra.MaximumNArgs(1),
+		PersistentPreRunE: setupLogger,
+		Run:               runSquash,
 	}
 
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Verbose output")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "", "Log level: debug, info, warn or error (default \"info\", \"debug\" with --verbose)")
 	rootCmd.PersistentFlags().BoolVarP(&version, "version", "V", false, "Show version and exit")
-	rootCmd.Flags().StringVarP(&imageName, "image", "i", "", "Image to be squashed (required)")
-	rootCmd.Flags().StringVarP(&fromLayer, "from-layer", "f", "", "Number of layers to squash or ID of the layer to squash from")
-	rootCmd.Flags().StringVarP(&tag, "tag", "t", "", "Specify the tag to be used for the new image")
-	rootCmd.Flags().StringVarP(&message, "message", "m", "squash image", "Specify a commit message for the new image")
-	rootCmd.Flags().BoolVarP(&cleanup, "cleanup", "c", false, "Remove source image from Docker after squashing")
-	rootCmd.Flags().StringVarP(&tmpDir, "tmp-dir", "d", "", "Temporary directory to be created and used")
-	rootCmd.Flags().StringVarP(&outputPath, "output-path", "o", "", "Path where the image may be stored after squashing")
-	rootCmd.Flags().BoolVarP(&loadImage, "load-image", "l", true, "Whether to load the image into Docker daemon after squashing")
-
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	rootCmd.PersistentFlags().MarkDeprecated("version", "use the version command")
+	addConnectionFlags(rootCmd.PersistentFlags())
+
+	addSquashFlags(rootCmd.Flags())
+	rootCmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		flag.Hidden = true
+	})
+
+	rootCmd.AddCommand(
+		newSquashCommand(),
+		newPlanCommand(),
+		newInspectCommand(),
+		newDiffCommand(),
+		newVerifyCommand(),
+		newExportCommand(),
+		newVersionCommand(),
+		newCacheCommand(),
+		newDoctorCommand(),
+		newServeCommand(),
+	)
+
+	cmd := rootCmd
+	if image.IsPlugin(os.Args) {
+		cmd = newPluginCommand(rootCmd)
+	}
+	// Errors of the command line are reported like the other errors of the commands
+	cmd.SilenceErrors = true
+	if err := cmd.Execute(); err != nil {
+		exitOnCommandError(err)
+	}
+}
+
+// setupLogger creates the logger of the command from --verbose and --log-level. The
+// deprecated --version flag prints the version before anything else is done.
+func setupLogger(cmd *cobra.Command, args []string) error {
+	if version {
+		fmt.Println("Version:", Version)
+		os.Exit(image.ExitOK)
+	}
+
+	logger = newLogger()
+	switch {
+	case len(logLevel) != 0:
+		level, err := logrus.ParseLevel(logLevel)
+		if err != nil {
+			return fmt.Errorf("invalid --log-level: %w", err)
+		}
+		logger.SetLevel(level)
+	case verbose:
+		logger.SetLevel(logrus.DebugLevel)
+	}
+	return nil
+}
+
+// quietLogger keeps the informational messages of the squash steps from the output of
+// the commands that describe images, unless a log level is asked for.
+func quietLogger() {
+	if !verbose && len(logLevel) == 0 {
+		logger.SetLevel(logrus.WarnLevel)
+	}
+}
+
+// newPluginCommand runs rootCmd as docker squash, for the docker CLI that starts the
+// binary as its docker-squash plugin. The global options of the docker CLI in front of
+// the squash command select the daemon like --context and --host do.
+func newPluginCommand(rootCmd *cobra.Command) *cobra.Command {
+	args, debug, err := image.ParsePluginArgs(os.Args[1:], &connection)
+	if err != nil {
+		exitOnCommandError(err)
+	}
+	verbose = verbose || debug
+
+	dockerCmd := &cobra.Command{Use: "docker", SilenceUsage: true}
+	dockerCmd.CompletionOptions.DisableDefaultCmd = true
+	rootCmd.Use = image.PluginCommand + " [OPTIONS] IMAGE"
+	dockerCmd.AddCommand(rootCmd)
+	dockerCmd.SetArgs(append([]string{image.PluginCommand}, args...))
+	return dockerCmd
+}
+
+// newLogger creates the logger of the commands, logging the function and line of each
+// message.
+func newLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetReportCaller(true)
+	logger.SetFormatter(&logrus.TextFormatter{
+		DisableColors:   true,
+		TimestampFormat: "2006-01-02 15:03:04",
+		CallerPrettyfier: func(frame *runtime.Frame) (string, string) {
+			return fmt.Sprintf("%s", strings.Split(frame.Function, ".")[len(strings.Split(frame.Function, "."))-1]),
+				fmt.Sprintf("%s, line:%d", path.Base(frame.File), frame.Line)
+		},
+	})
+	return logger
+}
+
+// addConnectionFlags adds the flags selecting the image store: the backend and the
+// Docker daemon or containerd socket.
+func addConnectionFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&backend, "backend", image.BackendDocker, "Image store the image is read from and loaded into: docker or containerd")
+	flags.StringVar(&containerdAddress, "containerd-address", "", "Socket of containerd for --backend containerd, $CONTAINERD_ADDRESS or "+image.DefaultContainerdAddress+" by default")
+	flags.StringVar(&containerdNamespace, "containerd-namespace", "", "containerd namespace of the images for --backend containerd, $CONTAINERD_NAMESPACE or "+image.DefaultContainerdNamespace+" by default")
+	flags.StringVarP(&connection.Host, "host", "H", "", "Docker daemon or podman socket to connect to, like unix:///var/run/docker.sock or tcp://host:2376; $DOCKER_HOST, the docker context or the first socket found by default")
+	flags.StringVar(&connection.Context, "context", "", "Docker context to connect to, from the contexts of the docker config directory")
+	flags.BoolVar(&connection.TLS, "tls", false, "Use TLS to connect to the daemon")
+	flags.BoolVar(&connection.TLSVerify, "tlsverify", false, "Use TLS and verify the certificate of the daemon")
+	flags.StringVar(&connection.TLSCACert, "tlscacert", "", "CA certificate the daemon certificate is verified with, ca.pem in $DOCKER_CERT_PATH or ~/.docker by default")
+	flags.StringVar(&connection.TLSCert, "tlscert", "", "TLS client certificate, cert.pem in $DOCKER_CERT_PATH or ~/.docker by default")
+	flags.StringVar(&connection.TLSKey, "tlskey", "", "TLS client key, key.pem in $DOCKER_CERT_PATH or ~/.docker by default")
+}
+
+// storeCLI holds the options selecting the image store.
+func storeCLI() image.CLI {
+	return image.CLI{
+		Verbose:             verbose,
+		Backend:             backend,
+		Docker:              connection,
+		ContainerdAddress:   containerdAddress,
+		ContainerdNamespace: containerdNamespace,
+	}
+}
+
+// commandContext is cancelled by SIGINT and SIGTERM, and when the docker CLI running
+// the plugin is interrupted. A second signal kills the process.
+func commandContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	image.WatchPluginSocket(stop)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// exitOnCommandError reports the failure of a command and exits with the exit code of
+// the error.
+func exitOnCommandError(err error) {
+	var unnecessary *image.SquashUnnecessaryError
+	switch {
+	case image.ExitCode(err) == image.ExitInterrupted:
+		fmt.Fprintf(os.Stderr, "Interrupted: %v\n", err)
+	case errors.As(err, &unnecessary):
+		fmt.Fprintf(os.Stderr, "Nothing to squash: %v\n", err)
+	default:
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+	os.Exit(image.ExitCode(err))
+}
+
+// runError counts the failure of a run that was cancelled as interrupted, child
+// processes get the signal as well and fail with errors of their own.
+func runError(ctx context.Context, err error) error {
+	if ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+		return fmt.Errorf("%w: %v", ctx.Err(), err)
 	}
+	return err
 }
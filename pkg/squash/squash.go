@@ -0,0 +1,385 @@
+// Package squash squashes the layers of container images from Go programs. It is the
+// library behind the squash-docker-image command.
+//
+//	result, err := squash.Squash(ctx, squash.DaemonImage("app:build"),
+//		squash.Sink{Load: true}, squash.Options{FromLayer: "3", Tags: []string{"app:squashed"}})
+package squash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/lyon-v/squash-docker-image/internal/image"
+)
+
+// Logger receives the log messages of a squash run. *logrus.Logger implements it.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Options configures a squash run.
+type Options struct {
+	// FromLayer is the number of layers to squash, or the layer to squash from. All
+	// layers are squashed when it is empty.
+	FromLayer string
+	// Tags of the squashed image
+	Tags []string
+	// Message is the comment of the history entry of the squashed layer
+	Message string
+	// TmpDir is created and used as the working directory, a random directory in the
+	// system temporary directory is used when empty
+	TmpDir string
+	// TmpDirCandidates are tried in order for the temporary directory when TmpDir is empty
+	// and the system temporary directory has not enough free space
+	TmpDirCandidates []string
+	// Rootless keeps ownership, device nodes and special permissions of the squashed layers
+	// as metadata instead of on disk, so no root privileges are needed.
+	Rootless bool
+	// Resume continues an earlier run that used the same TmpDir from its last completed
+	// phase, only for images from the Docker daemon
+	Resume bool
+	// CacheDir is the directory of a layer cache shared by runs, so squashes of successive
+	// builds only process the layers that changed. No cache is used when empty.
+	CacheDir string
+	// Compression of the layers in the exported image: gzip, zstd, estargz or none
+	Compression      string
+	CompressionLevel int
+	// Platforms of a multi-platform image to squash as OS/ARCH[/VARIANT], all when empty
+	Platforms []string
+	// Excludes are patterns of paths removed from the squashed layer, * and ? match
+	// within a path element
+	Excludes []string
+	// Config edits the runtime config of the squashed image
+	Config ConfigEdits
+	// Verify reads the squashed image back and checks that it has the files and config of
+	// the source, but for the excluded paths and config edits. Only for a single image
+	// from the image store that is loaded or written to Path.
+	Verify bool
+
+	// Backend is the image store daemon images are read from and loaded into: docker, the
+	// default, or containerd
+	Backend string
+	// ContainerdAddress and ContainerdNamespace select the socket and namespace of the
+	// containerd backend, CONTAINERD_ADDRESS and CONTAINERD_NAMESPACE or the containerd
+	// defaults are used when empty
+	ContainerdAddress   string
+	ContainerdNamespace string
+
+	// ImageStore holds the daemon images and receives the loaded ones, instead of the
+	// store of Backend and Client
+	ImageStore ImageStore
+	// Client talks to the Docker daemon of the docker backend, one connected as Docker
+	// selects is created when nil
+	Client client.APIClient
+	// Docker selects the daemon when no Client is given: a host, a docker context and TLS
+	// settings. The environment, the current docker context and the Docker and podman
+	// sockets of the host are used for what is not set.
+	Docker DockerConnection
+	// Logger receives log messages, they are dropped when nil
+	Logger Logger
+	// Progress receives progress events, like the ones --progress json prints
+	Progress func(ProgressEvent)
+}
+
+// ImageStore holds the images to squash and receives the squashed images, like the
+// Docker daemon or containerd. Save writes a tar archive like docker save, Load imports
+// one.
+type ImageStore = image.ImageStore
+
+// StoreVersion and HistoryEntry are returned by the Version and History of an ImageStore.
+type (
+	StoreVersion = image.StoreVersion
+	HistoryEntry = image.HistoryEntry
+)
+
+// DockerConnection selects the Docker daemon, or the Docker compatible API of podman.
+type DockerConnection = image.DockerConnection
+
+// ConfigEdits change the runtime config of the squashed image: environment variables,
+// labels, entrypoint, command, working directory, user and exposed ports.
+type ConfigEdits = image.ConfigEdits
+
+// ProgressEvent describes the progress of a squash run: the start and end of a phase,
+// finished layers, and the bytes and files processed so far with an estimate of the
+// remaining time.
+type ProgressEvent = image.ProgressEvent
+
+// Phases and types of progress events.
+const (
+	PhaseOpen   = image.PhaseOpen
+	PhaseSave   = image.PhaseSave
+	PhaseSquash = image.PhaseSquash
+	PhaseExport = image.PhaseExport
+	PhaseLoad   = image.PhaseLoad
+
+	EventPhaseStart = image.EventPhaseStart
+	EventPhaseEnd   = image.EventPhaseEnd
+	EventProgress   = image.EventProgress
+	EventLayer      = image.EventLayer
+)
+
+// Source is the image to squash.
+type Source struct {
+	image string
+}
+
+// DaemonImage is an image in the Docker daemon, or in containerd with the containerd
+// backend, given by name or ID.
+func DaemonImage(name string) Source {
+	return Source{image: name}
+}
+
+// OCILayout is an image in an OCI image layout directory. ref selects the image by its
+// reference name when the layout holds several.
+func OCILayout(path, ref string) Source {
+	return Source{image: layoutSource(image.TransportOCILayout, path, ref)}
+}
+
+// OCIArchive is an image in a tar archive of an OCI image layout.
+func OCIArchive(path, ref string) Source {
+	return Source{image: layoutSource(image.TransportOCIArchive, path, ref)}
+}
+
+// Registry is an image pulled from a registry, like registry.local:5000/app:1.2.3.
+func Registry(ref string) Source {
+	return Source{image: "docker://" + ref}
+}
+
+// ParseSource parses an image given the way the command line takes it: a daemon image,
+// oci:PATH[:REF], oci-archive:PATH[:REF] or docker://REF.
+func ParseSource(value string) Source {
+	return Source{image: value}
+}
+
+func (s Source) String() string {
+	return s.image
+}
+
+func layoutSource(transport, path, ref string) string {
+	if len(ref) == 0 {
+		return fmt.Sprintf("%s:%s", transport, path)
+	}
+	return fmt.Sprintf("%s:%s:%s", transport, path, ref)
+}
+
+// Sink is where the squashed image goes. At least one of its fields must be set.
+type Sink struct {
+	// Path of a tar archive the image is written to
+	Path string
+	// Writer receives the image as a tar archive when Path is empty
+	Writer io.Writer
+	// Load loads the image into the Docker daemon, or into containerd with the containerd
+	// backend
+	Load bool
+}
+
+// Result describes the squashed images. Multi-platform sources have one image per
+// platform.
+type Result struct {
+	Images []Image
+}
+
+// ImageID is the ID of the first squashed image.
+func (r Result) ImageID() string {
+	if len(r.Images) == 0 {
+		return ""
+	}
+	return r.Images[0].ImageID
+}
+
+// Image describes one squashed image.
+type Image struct {
+	// Source is the image that was squashed
+	Source string
+	// Platform as OS/ARCH[/VARIANT], set for images read from an OCI layout or registry
+	Platform string
+	// SourceImageID is the digest of the config of the source image
+	SourceImageID string
+	// SourceFormat is the format the source image was saved in: v1, docker or oci
+	SourceFormat string
+	// ImageID of the squashed image, the hex digest of its config
+	ImageID string
+	// ConfigDigest is the ImageID as a digest
+	ConfigDigest string
+	// ManifestDigest is set when the image was written as an OCI layout, which happens
+	// with compression or for multi-platform images, IndexDigest only for the latter
+	ManifestDigest string
+	IndexDigest    string
+	Tags           []string
+	SizeBefore     int64
+	SizeAfter      int64
+	// Layers of the squashed image, oldest first
+	Layers []Layer
+	// SourceLayers are the layers of the source image that were squashed
+	SourceLayers []Layer
+
+	// FilesMerged is the number of regular files copied onto the oldest squashed layer,
+	// WhiteoutsResolved the number of whiteouts that removed something and
+	// BytesExcluded the size of the files that newer layers deleted or overwrote
+	FilesMerged       int
+	WhiteoutsResolved int
+	BytesExcluded     int64
+	// PhaseDurations is the time each phase took, by phase
+	PhaseDurations map[string]time.Duration
+}
+
+// Layer describes a layer of a squashed image.
+type Layer struct {
+	DiffID string
+	// Digest of the layer blob, set when the image was written as an OCI layout
+	Digest   string
+	Size     int64
+	Squashed bool
+}
+
+// Errors returned by Squash. Use errors.As to tell them apart; ExitCode maps them to the
+// exit codes of the command.
+type (
+	SquashUnnecessaryError = image.SquashUnnecessaryError
+	InvalidLayerError      = image.InvalidLayerError
+	DaemonUnavailableError = image.DaemonUnavailableError
+	UnsupportedDaemonError = image.UnsupportedDaemonError
+	CorruptArchiveError    = image.CorruptArchiveError
+	IOError                = image.IOError
+	VerificationError      = image.VerificationError
+	InsufficientSpaceError = image.InsufficientSpaceError
+)
+
+// ExitCode is the exit code the command uses for an error returned by Squash.
+func ExitCode(err error) int {
+	return image.ExitCode(err)
+}
+
+// Squash squashes the source image and writes the result to the sink. Cancelling ctx
+// aborts the run; the temporary directory is removed unless Options.TmpDir was set.
+func Squash(ctx context.Context, source Source, sink Sink, opts Options) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	if len(source.image) == 0 {
+		return Result{}, errors.New("image is not provided")
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = nopLogger{}
+	}
+
+	cli := image.CLI{
+		Image:     source.image,
+		FromLayer: opts.FromLayer,
+		Tags:      opts.Tags,
+		Message:   opts.Message,
+		TmpDir:    opts.TmpDir,
+		Resume:    opts.Resume,
+		CacheDir:  opts.CacheDir,
+		LoadImage: sink.Load,
+
+		Compression:      opts.Compression,
+		CompressionLevel: opts.CompressionLevel,
+
+		Platforms: opts.Platforms,
+
+		Excludes:    opts.Excludes,
+		ConfigEdits: opts.Config,
+		Verify:      opts.Verify,
+
+		Messages: io.Discard,
+		Progress: opts.Progress,
+
+		TmpDirCandidates: opts.TmpDirCandidates,
+		Rootless:         opts.Rootless,
+
+		Backend:             opts.Backend,
+		Docker:              opts.Docker,
+		ContainerdAddress:   opts.ContainerdAddress,
+		ContainerdNamespace: opts.ContainerdNamespace,
+	}
+	if len(sink.Path) != 0 {
+		cli.OutputPath = sink.Path
+	} else if sink.Writer != nil {
+		cli.OutputPath = image.StdoutPath
+		cli.Output = sink.Writer
+	}
+
+	cli.Store = opts.ImageStore
+	if cli.Store == nil && opts.Client != nil && (len(opts.Backend) == 0 || opts.Backend == image.BackendDocker) {
+		cli.Store = image.NewDockerStore(opts.Client, logger)
+	}
+
+	squash, err := image.NewSquash(cli, logger)
+	if err != nil {
+		return Result{}, err
+	}
+	defer squash.Close()
+
+	if parsed := image.ParseImageSource(source.image); parsed.Transport != image.TransportDaemon {
+		_, err = squash.RunIndex(ctx, parsed)
+	} else {
+		_, err = squash.Run(ctx)
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	return newResult(squash.Results()), nil
+}
+
+func newResult(squashed []image.SquashedImage) Result {
+	var result Result
+	for _, squashedImage := range squashed {
+		img := Image{
+			Source:         squashedImage.Image,
+			SourceImageID:  squashedImage.SourceImageID,
+			SourceFormat:   squashedImage.SourceFormat,
+			ImageID:        squashedImage.ImageID,
+			ConfigDigest:   "sha256:" + squashedImage.ImageID,
+			ManifestDigest: squashedImage.ManifestDigest,
+			IndexDigest:    squashedImage.IndexDigest,
+			Tags:           squashedImage.Tags,
+			SizeBefore:     squashedImage.SizeBefore,
+			SizeAfter:      squashedImage.SizeAfter,
+
+			FilesMerged:       squashedImage.FilesMerged,
+			WhiteoutsResolved: squashedImage.WhiteoutsResolved,
+			BytesExcluded:     squashedImage.BytesExcluded,
+			PhaseDurations:    make(map[string]time.Duration),
+		}
+		if squashedImage.Platform != nil {
+			img.Platform = squashedImage.Platform.String()
+		}
+		for _, layer := range squashedImage.Layers {
+			img.Layers = append(img.Layers, newLayer(layer))
+		}
+		for _, layer := range squashedImage.SourceLayers {
+			img.SourceLayers = append(img.SourceLayers, newLayer(layer))
+		}
+		for _, phase := range squashedImage.Phases {
+			img.PhaseDurations[phase.Phase] += phase.Duration
+		}
+		result.Images = append(result.Images, img)
+	}
+	return result
+}
+
+func newLayer(layer image.SquashedLayer) Layer {
+	return Layer{
+		DiffID:   layer.DiffID,
+		Digest:   layer.Digest,
+		Size:     layer.Size,
+		Squashed: layer.Squashed,
+	}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
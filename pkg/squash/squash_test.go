@@ -0,0 +1,235 @@
+package squash
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The archives in the testdata of internal/image hold the same image of two layers,
+// docker.tar as docker save writes it and oci.tar as an OCI image layout.
+var formats = filepath.Join("..", "..", "internal", "image", "testdata", "formats")
+
+const (
+	sourceImageID = "sha256:56405f3aa87d69fa9189f39c56d3825755b37b08c23dfedcc3a1ae1e053eb58f"
+	baseDiffID    = "sha256:72159584d7e29b2c609715d6f77decd8ed8236b8dde26907db3318bbbfe0fbd0"
+	topDiffID     = "sha256:331a85f44e9041f23096d6bacbee4df1a902f96f7413c47e6f43daa887fd1365"
+)
+
+// archiveStore is an ImageStore holding the image of docker.tar as test:latest.
+type archiveStore struct {
+	loaded [][]byte
+}
+
+func (s *archiveStore) Version(ctx context.Context) (StoreVersion, error) {
+	return StoreVersion{Name: "archive", Version: "1.0"}, nil
+}
+
+func (s *archiveStore) ImageID(ctx context.Context, ref string) (string, error) {
+	if ref != "test:latest" && ref != sourceImageID {
+		return "", fmt.Errorf("No such image: %s", ref)
+	}
+	return sourceImageID, nil
+}
+
+func (s *archiveStore) History(ctx context.Context, imageID string) ([]HistoryEntry, error) {
+	return []HistoryEntry{{ID: sourceImageID, Size: 10240}, {ID: "<missing>", Size: 10240}}, nil
+}
+
+func (s *archiveStore) Save(ctx context.Context, imageIDs []string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(formats, "docker.tar"))
+}
+
+func (s *archiveStore) Load(ctx context.Context, archive io.Reader) error {
+	data, err := io.ReadAll(archive)
+	if err != nil {
+		return err
+	}
+	s.loaded = append(s.loaded, data)
+	return nil
+}
+
+func TestSquashDaemonImage(t *testing.T) {
+	store := &archiveStore{}
+	var out bytes.Buffer
+	result, err := Squash(context.Background(), DaemonImage("test:latest"), Sink{Writer: &out, Load: true}, Options{
+		Tags:       []string{"test:squashed"},
+		TmpDir:     filepath.Join(t.TempDir(), "work"),
+		ImageStore: store,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Images) != 1 {
+		t.Fatalf("got %d images, expected one", len(result.Images))
+	}
+	img := result.Images[0]
+	if img.Source != "test:latest" || img.SourceImageID != sourceImageID || img.SourceFormat != "docker" {
+		t.Errorf("got the source %s %s in the %s format", img.Source, img.SourceImageID, img.SourceFormat)
+	}
+	if result.ImageID() != img.ImageID || img.ConfigDigest != "sha256:"+img.ImageID || img.ImageID == strings.TrimPrefix(sourceImageID, "sha256:") {
+		t.Errorf("got the image ID %s and config digest %s", result.ImageID(), img.ConfigDigest)
+	}
+	if len(img.Tags) != 1 || img.Tags[0] != "test:squashed" {
+		t.Errorf("got the tags %v", img.Tags)
+	}
+	if len(img.SourceLayers) != 2 || img.SourceLayers[0].DiffID != baseDiffID || img.SourceLayers[1].DiffID != topDiffID {
+		t.Errorf("got the source layers %v", img.SourceLayers)
+	}
+	if len(img.Layers) != 1 || !img.Layers[0].Squashed {
+		t.Errorf("got the layers %v, expected one squashed layer", img.Layers)
+	}
+	if len(img.PhaseDurations) == 0 {
+		t.Error("no phase durations")
+	}
+
+	if len(store.loaded) != 1 {
+		t.Fatalf("loaded %d archives, expected one", len(store.loaded))
+	}
+	if !bytes.Equal(store.loaded[0], out.Bytes()) {
+		t.Error("the loaded archive differs from the written one")
+	}
+	if _, ok := archiveFiles(t, out.Bytes())["manifest.json"]; !ok {
+		t.Error("the written archive has no manifest.json")
+	}
+}
+
+func TestSquashOCIArchive(t *testing.T) {
+	// Compressed layers are written as an OCI layout
+	output := filepath.Join(t.TempDir(), "squashed.tar")
+	result, err := Squash(context.Background(), OCIArchive(filepath.Join(formats, "oci.tar"), ""), Sink{Path: output}, Options{
+		TmpDir:      filepath.Join(t.TempDir(), "work"),
+		Compression: "gzip",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Images) != 1 {
+		t.Fatalf("got %d images, expected one", len(result.Images))
+	}
+	img := result.Images[0]
+	if img.Platform != "linux/amd64" {
+		t.Errorf("got the platform %q, expected linux/amd64", img.Platform)
+	}
+	if img.SourceImageID != sourceImageID {
+		t.Errorf("got the source image %s, expected %s", img.SourceImageID, sourceImageID)
+	}
+	// An index is only written for several platforms
+	if len(img.ManifestDigest) == 0 || len(img.IndexDigest) != 0 {
+		t.Errorf("got the manifest %q and index %q, expected a manifest only", img.ManifestDigest, img.IndexDigest)
+	}
+	if len(img.Layers) != 1 || len(img.Layers[0].Digest) == 0 {
+		t.Errorf("got the layers %v, expected one layer blob", img.Layers)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := archiveFiles(t, data)
+	if _, ok := files["index.json"]; !ok {
+		t.Error("the written archive has no index.json")
+	}
+	if _, ok := files["blobs/sha256/"+strings.TrimPrefix(img.ManifestDigest, "sha256:")]; !ok {
+		t.Errorf("the written archive has no blob of the manifest %s", img.ManifestDigest)
+	}
+}
+
+func TestSquashErrors(t *testing.T) {
+	// An OCI archive without index.json
+	corrupt := filepath.Join(t.TempDir(), "corrupt.tar")
+	if err := os.WriteFile(corrupt, archive(t, map[string]string{"oci-layout": `{"imageLayoutVersion": "1.0.0"}`}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		source    Source
+		fromLayer string
+		sink      Sink
+		target    interface{}
+		exitCode  int
+	}{
+		{name: "single layer", source: DaemonImage("test:latest"), fromLayer: "1", sink: Sink{Load: true}, target: new(*SquashUnnecessaryError), exitCode: 2},
+		{name: "too many layers", source: DaemonImage("test:latest"), fromLayer: "3", sink: Sink{Load: true}, target: new(*InvalidLayerError), exitCode: 3},
+		{name: "unknown layer", source: DaemonImage("test:latest"), fromLayer: "sha256:" + strings.Repeat("0", 64), sink: Sink{Load: true}, target: new(*InvalidLayerError), exitCode: 3},
+		{name: "corrupt archive", source: OCIArchive(corrupt, ""), sink: Sink{Writer: io.Discard}, target: new(*CorruptArchiveError), exitCode: 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Squash(context.Background(), test.source, test.sink, Options{
+				FromLayer:  test.fromLayer,
+				TmpDir:     filepath.Join(t.TempDir(), "work"),
+				ImageStore: &archiveStore{},
+			})
+			if err == nil {
+				t.Fatal("squashed, expected an error")
+			}
+			if !errors.As(err, test.target) {
+				t.Errorf("got the error %T %v, expected %T", err, err, test.target)
+			}
+			if code := ExitCode(err); code != test.exitCode {
+				t.Errorf("got the exit code %d, expected %d", code, test.exitCode)
+			}
+		})
+	}
+}
+
+func TestSquashCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := Squash(ctx, DaemonImage("test:latest"), Sink{Load: true}, Options{ImageStore: &archiveStore{}})
+	if !errors.Is(err, context.Canceled) || ExitCode(err) != 130 {
+		t.Errorf("got the error %v with exit code %d, expected the run to be cancelled", err, ExitCode(err))
+	}
+}
+
+// archive creates a tar archive of the files.
+func archive(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// archiveFiles returns the regular files of a tar archive by name.
+func archiveFiles(t *testing.T, data []byte) map[string][]byte {
+	files := make(map[string][]byte)
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[filepath.Clean(header.Name)] = content
+	}
+}
@@ -0,0 +1,10 @@
+// Package schema holds the published JSON schemas of the files squash-docker-image
+// reads.
+package schema
+
+import _ "embed"
+
+// SquashConfig is the schema of the file given to squash --config.
+//
+//go:embed squash-config.schema.json
+var SquashConfig []byte
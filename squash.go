@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/lyon-v/squash-docker-image/internal/image"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// newSquashCommand creates the squash command.
+func newSquashCommand() *cobra.Command {
+	squashCmd := &cobra.Command{
+		Use:   "squash [IMAGE]",
+		Short: "Squash the layers of an image",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   runSquash,
+	}
+	addSquashFlags(squashCmd.Flags())
+	return squashCmd
+}
+
+// addSquashFlags adds the flags of the squash command.
+func addSquashFlags(flags *pflag.FlagSet) {
+	addImageFlags(flags)
+	flags.StringArrayVarP(&tags, "tag", "t", nil, "Specify the tag to be used for the new image, can be repeated")
+	flags.StringVarP(&message, "message", "m", "squash image", "Specify a commit message for the new image")
+	flags.BoolVarP(&cleanup, "cleanup", "c", false, "Remove source image from Docker after squashing")
+	flags.StringVarP(&tmpDir, "tmp-dir", "d", "", "Temporary directory to be created and used")
+	flags.StringArrayVar(&tmpDirCandidates, "tmp-dir-candidates", nil, "Directory to create the temporary directory in when the system one has not enough free space, tried in order, can be repeated")
+	flags.StringVarP(&outputPath, "output-path", "o", "", "Path where the image may be stored after squashing, - writes it to stdout")
+	flags.BoolVarP(&loadImage, "load-image", "l", true, "Whether to load the image into Docker daemon after squashing")
+	flags.StringVar(&batchFile, "batch-file", "", "YAML file listing several images to squash in one run")
+	flags.StringArrayVar(&batchImages, "batch-image", nil, "Image to squash in a batch run as IMAGE[,from-layer=N][,tag=TAG][,message=MSG][,exclude=PATH], can be repeated")
+	flags.StringArrayVar(&platforms, "platform", nil, "Platform of a multi-platform image to squash as OS/ARCH[/VARIANT], can be repeated, all platforms by default")
+	flags.StringVar(&compression, "compression", "none", "Compression of the layers in the exported image: gzip, zstd, estargz or none")
+	flags.IntVar(&compressionLevel, "compression-level", 0, "Compression level, 0 uses the default level of the algorithm")
+	flags.StringVar(&reportPath, "report", "", "Write a JSON report of the squashed images to this file")
+	flags.BoolVar(&resume, "resume", false, "Continue an earlier run of the same squash in the directory given with --tmp-dir")
+	flags.StringVar(&progressMode, "progress", "auto", "Progress output: auto, tty, json or none; auto draws progress bars when stderr is a terminal")
+	flags.StringArrayVar(&excludes, "exclude", nil, "Path to remove from the squashed layer, * and ? match within a path element, can be repeated")
+	flags.BoolVar(&verifyImage, "verify", false, "Check that the squashed image has the files and config of the source image, but for the excluded paths and config edits")
+	addWorkFlags(flags)
+}
+
+// addImageFlags adds the flags selecting the image and the layers to squash, shared by
+// squash and plan.
+func addImageFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&imageName, "image", "i", "", "Image to be squashed (required), oci:PATH[:REF], oci-archive:PATH[:REF] and docker://REF read it from outside the daemon")
+	flags.StringVarP(&fromLayer, "from-layer", "f", "", "Number of layers to squash or ID of the layer to squash from")
+	addConfigFlag(flags)
+}
+
+// addConfigFlag adds the --config flag of the commands that read a config file.
+func addConfigFlag(flags *pflag.FlagSet) {
+	flags.StringVar(&configFile, "config", "", "YAML file describing the squash, validated against schema/squash-config.schema.json; flags given as well override its values")
+}
+
+// loadSquashFile reads the --config file, nil when none is given.
+func loadSquashFile() *image.SquashFile {
+	if len(configFile) == 0 {
+		return nil
+	}
+	file, err := image.LoadSquashFile(configFile)
+	if err != nil {
+		exitOnCommandError(err)
+	}
+	return file
+}
+
+// applySquashFile takes the values of the config file for the flags that are not given.
+func applySquashFile(flags *pflag.FlagSet, file *image.SquashFile) {
+	unset := func(name string) bool {
+		flag := flags.Lookup(name)
+		return flag != nil && !flag.Changed
+	}
+	if len(imageName) == 0 {
+		imageName = file.Source.Image
+	}
+	if unset("from-layer") {
+		fromLayer = file.FromLayer
+	}
+	if unset("platform") && len(file.Source.Platforms) != 0 {
+		platforms = file.Source.Platforms
+	}
+	if unset("exclude") && len(file.Exclude) != 0 {
+		excludes = file.Exclude
+	}
+	if unset("tag") && len(file.Tags) != 0 {
+		tags = file.Tags
+	}
+	if unset("message") && len(file.Message) != 0 {
+		message = file.Message
+	}
+	if unset("output-path") && len(file.Output.Path) != 0 {
+		outputPath = file.Output.Path
+	}
+	if unset("load-image") && file.Output.Load != nil {
+		loadImage = *file.Output.Load
+	}
+	if unset("cleanup") && file.Output.Cleanup != nil {
+		cleanup = *file.Output.Cleanup
+	}
+	if unset("report") && len(file.Output.Report) != 0 {
+		reportPath = file.Output.Report
+	}
+	if unset("compression") && len(file.Compression.Algorithm) != 0 {
+		compression = file.Compression.Algorithm
+	}
+	if unset("compression-level") && file.Compression.Level != 0 {
+		compressionLevel = file.Compression.Level
+	}
+	if unset("verify") && file.Verify != nil {
+		verifyImage = *file.Verify
+	}
+}
+
+// addWorkFlags adds the flags of how layers are squashed, shared by squash and serve.
+func addWorkFlags(flags *pflag.FlagSet) {
+	flags.BoolVar(&rootless, "rootless", false, "Keep ownership, device nodes and special permissions of the squashed layers as metadata instead of on disk, so no root privileges are needed")
+	flags.BoolVar(&useCache, "cache", false, "Keep layers and merge results in the layer cache, so later squashes only process the layers that changed")
+	flags.StringVar(&cacheDir, "cache-dir", image.DefaultCacheDir(), "Directory of the layer cache")
+}
+
+// imageArgument takes the image given as argument, like docker squash IMAGE, instead
+// of --image.
+func imageArgument(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	if len(imageName) != 0 && imageName != args[0] {
+		return fmt.Errorf("image given both as argument '%s' and with --image '%s'", args[0], imageName)
+	}
+	imageName = args[0]
+	return nil
+}
+
+// runSquash runs the squash command.
+func runSquash(cmd *cobra.Command, args []string) {
+	if err := imageArgument(args); err != nil {
+		exitOnCommandError(err)
+	}
+
+	squashFile := loadSquashFile()
+	if squashFile != nil {
+		applySquashFile(cmd.Flags(), squashFile)
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+
+	// Collect the images of a batch run
+	var batch []image.BatchEntry
+	if batchFile != "" {
+		entries, err := image.LoadBatchFile(batchFile)
+		if err != nil {
+			exitOnCommandError(fmt.Errorf("failed to read batch file: %w", err))
+		}
+		batch = append(batch, entries...)
+	}
+	for _, spec := range batchImages {
+		entry, err := image.ParseBatchEntry(spec)
+		if err != nil {
+			exitOnCommandError(fmt.Errorf("failed to parse batch image: %w", err))
+		}
+		batch = append(batch, entry)
+	}
+
+	// Validate required flags
+	if imageName == "" && len(batch) == 0 {
+		cmd.Usage()
+		exitOnCommandError(errors.New("image is required"))
+	}
+
+	logger.Debug("Verbose mode enabled")
+
+	// Human readable messages go to stdout, unless it carries the image or the
+	// progress events
+	out := os.Stdout
+	if outputPath == image.StdoutPath {
+		out = os.Stderr
+	}
+	progress, err := newProgress(progressMode, out)
+	if err != nil {
+		exitOnCommandError(err)
+	}
+	if progressMode == "json" {
+		out = os.Stderr
+	}
+	if progress != nil && progressMode != "json" && !verbose && len(logLevel) == 0 {
+		// The bars replace the informational log lines
+		logger.SetLevel(logrus.WarnLevel)
+	}
+
+	logger.Infof("Running version %s", Version)
+
+	// Create Squash instance
+	cli := storeCLI()
+	cli.Image = imageName
+	cli.FromLayer = fromLayer
+	cli.Tags = tags
+	cli.Message = message
+	cli.Cleanup = cleanup
+	cli.TmpDir = tmpDir
+	cli.OutputPath = outputPath
+	cli.LoadImage = loadImage
+
+	cli.Compression = compression
+	cli.CompressionLevel = compressionLevel
+
+	cli.Platforms = platforms
+
+	cli.Excludes = excludes
+	if squashFile != nil {
+		cli.ConfigEdits = squashFile.Config
+	}
+	cli.Verify = verifyImage
+
+	cli.Messages = out
+	cli.Progress = progress
+	cli.Resume = resume
+
+	cli.TmpDirCandidates = tmpDirCandidates
+	cli.Rootless = rootless
+	if useCache {
+		cli.CacheDir = cacheDir
+	}
+
+	squash, err := image.NewSquash(cli, logger)
+	if err != nil {
+		exitOnCommandError(fmt.Errorf("failed to create Squash instance: %w", err))
+	}
+	defer squash.Close()
+
+	if len(batch) != 0 {
+		newImageIds, err := squash.RunBatch(ctx, batch)
+		if err != nil {
+			exitOnCommandError(runError(ctx, err))
+		}
+		writeReport(ctx, logger, squash)
+		for i, newImageId := range newImageIds {
+			fmt.Fprintf(out, "Squashed image ID of %s: [%s]\n", batch[i].Image, newImageId)
+		}
+		return
+	}
+
+	// Images outside the daemon may have several platforms
+	if source := image.ParseImageSource(imageName); source.Transport != image.TransportDaemon {
+		squashed, err := squash.RunIndex(ctx, source)
+		if err != nil {
+			exitOnCommandError(runError(ctx, err))
+		}
+		writeReport(ctx, logger, squash)
+		for _, platform := range squashed {
+			fmt.Fprintf(out, "Squashed image ID of %s: [%s]\n", platform.Platform, platform.ImageID)
+		}
+		return
+	}
+
+	// Run squash process
+	newImageId, err := squash.Run(ctx)
+	if err != nil {
+		exitOnCommandError(runError(ctx, err))
+	}
+	writeReport(ctx, logger, squash)
+
+	fmt.Fprintf(out, "Squashed image ID: [%s]\n", newImageId)
+}
+
+// newProgress creates the renderer of the progress events. Bars are drawn to stderr,
+// JSON events written to out, as the squashed image never is.
+func newProgress(mode string, out io.Writer) (image.ProgressFunc, error) {
+	switch mode {
+	case "auto":
+		if info, err := os.Stderr.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			return image.NewProgressBars(os.Stderr), nil
+		}
+		return nil, nil
+	case "tty":
+		return image.NewProgressBars(os.Stderr), nil
+	case "json":
+		return image.NewJSONProgress(out), nil
+	case "none":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported progress '%s', expected one of: auto, tty, json, none", mode)
+}
+
+// writeReport writes the --report file of a successful run.
+func writeReport(ctx context.Context, logger *logrus.Logger, squash *image.Squash) {
+	if len(reportPath) == 0 {
+		return
+	}
+	if err := image.WriteReport(reportPath, squash.Results()); err != nil {
+		exitOnCommandError(runError(ctx, err))
+	}
+	logger.Infof("Report written to %s", reportPath)
+}